@@ -2,12 +2,14 @@ package v1
 
 import (
 	"encoding/json"
+	"fmt"
 	log "github.com/Sirupsen/logrus"
 	"github.com/go-martini/martini"
 	"github.com/martini-contrib/render"
 	"github.com/laincloud/backupd/crond"
 	"github.com/laincloud/backupd/tasks/backup"
 	"net/http"
+	"path"
 	"runtime"
 	"strings"
 	"sync/atomic"
@@ -17,6 +19,8 @@ import (
 const (
 	errUnvalidArg  = "Unvalid Argument"
 	errBackupError = "Error happend when doing backup action"
+
+	ChecksumHeader = "X-Checksum-Sha256" // sha256 of the downloaded file if known
 )
 
 var (
@@ -105,6 +109,24 @@ func CronOnce(params martini.Params, r render.Render, req *http.Request) {
 		r.JSON(400, newError(errUnvalidArg, err.Error()))
 		return
 	}
+	// the labels and note of the backup made by this run
+	if labels, note := req.PostForm["labels"], req.FormValue("note"); len(labels) > 0 || note != "" {
+		if job.Action != "backup" {
+			r.JSON(400, newError(errUnvalidArg, "labels and note are only for backup job"))
+			return
+		}
+		if _, err := backup.ParseLabels(labels); err != nil {
+			r.JSON(400, newError(errUnvalidArg, err.Error()))
+			return
+		}
+		tmp := *job
+		tmp.Args = make(crond.FuncArg)
+		for k, v := range job.Args {
+			tmp.Args[k] = v
+		}
+		tmp.Args["labels"], tmp.Args["note"] = labels, note
+		job = &tmp
+	}
 	r.JSON(202, map[string]string{
 		"rid": crond.Once(job),
 	})
@@ -143,6 +165,15 @@ func BackupJson(r render.Render, req *http.Request) {
 		r.JSON(503, newError(errBackupError, err.Error()))
 		return
 	}
+	if selectors := req.URL.Query()["label"]; len(selectors) > 0 { // key=value or key
+		var matched []backup.Entity
+		for _, ent := range ret {
+			if backup.MatchLabels(ent.Labels, selectors) {
+				matched = append(matched, ent)
+			}
+		}
+		ret = matched
+	}
 	r.JSON(200, ret)
 }
 
@@ -175,6 +206,66 @@ func BackupFileList(req *http.Request, params martini.Params, r render.Render) {
 	r.JSON(200, ret)
 }
 
+// ArchiveFileList lists the files in a directory of the full or dedup backup, the directory is given by query dir
+func ArchiveFileList(req *http.Request, params martini.Params, r render.Render) {
+	data, err := backup.ArchiveFileList(params["name"], req.URL.Query().Get("dir"))
+	if err != nil {
+		r.JSON(503, newError(errBackupError, err.Error()))
+		return
+	}
+	ret := make([]FInfo, len(data))
+	for i, item := range data {
+		ret[i] = FInfo{
+			Name:    path.Base(item.Path),
+			Size:    item.Size,
+			ModTime: item.ModTime,
+			Dir:     item.Mode.IsDir(),
+		}
+	}
+	r.JSON(200, ret)
+}
+
+// BackupDownload streams a backup file, the connection is closed before the end if the backup is corrupted
+func BackupDownload(w http.ResponseWriter, params martini.Params, r render.Render) {
+	file := params["_1"]
+	d, err := backup.OpenDownload(file)
+	if err != nil {
+		r.JSON(404, newError(errBackupError, err.Error()))
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", d.Name))
+	if d.Checksum != "" {
+		w.Header().Set(ChecksumHeader, d.Checksum)
+	}
+	w.WriteHeader(200)
+	if err := d.Copy(w); err != nil {
+		log.Errorf("Fail to download %s, %s", file, err.Error())
+		AbortResponse(w)
+	}
+}
+
+// AbortResponse closes the connection without finishing the response, so the client knows it's broken
+func AbortResponse(w http.ResponseWriter) {
+	if hj, ok := w.(http.Hijacker); ok {
+		if conn, _, err := hj.Hijack(); err == nil {
+			conn.Close()
+		}
+	}
+}
+
+// BackupUpload imports the archive in request body as a full backup of the directory in query path,
+// query filename is the archive's name, its codec is detected by the extension
+func BackupUpload(r render.Render, req *http.Request) {
+	query := req.URL.Query()
+	ent, err := backup.Import(req.Body, query.Get("path"), query.Get("filename"))
+	if err != nil {
+		r.JSON(503, newError(errBackupError, err.Error()))
+		return
+	}
+	r.JSON(201, ent)
+}
+
 func BackupDelete(r render.Render, req *http.Request) {
 	req.ParseForm()
 	for _, file := range req.PostForm["files"] {
@@ -186,6 +277,75 @@ func BackupDelete(r render.Render, req *http.Request) {
 	r.JSON(204, "DELETED")
 }
 
+// BackupHold pins the backup, form values are reason, owner and expires, expires is unix seconds or RFC3339, empty means never
+func BackupHold(r render.Render, req *http.Request, params martini.Params) {
+	var expires *time.Time
+	if v := req.FormValue("expires"); v != "" {
+		t, err := backup.ParseTimestamp(v)
+		if err != nil {
+			r.JSON(400, newError(errBackupError, "Unvalid expires "+v))
+			return
+		}
+		expires = &t
+	}
+	ent, err := backup.HoldBackup(params["name"], req.FormValue("reason"), req.FormValue("owner"), expires)
+	if err != nil {
+		r.JSON(400, newError(errBackupError, err.Error()))
+		return
+	}
+	r.JSON(200, ent)
+}
+
+// BackupUnhold removes the hold of the backup
+func BackupUnhold(r render.Render, params martini.Params) {
+	ent, err := backup.UnholdBackup(params["name"])
+	if err != nil {
+		r.JSON(400, newError(errBackupError, err.Error()))
+		return
+	}
+	r.JSON(200, ent)
+}
+
+// BackupLabel edits the labels and note of the backup, form values labels(key=value) are set, remove are the keys removed,
+// the note is changed if given
+func BackupLabel(r render.Render, req *http.Request, params martini.Params) {
+	labels, err := backup.ParseLabels(req.PostForm["labels"])
+	if err != nil {
+		r.JSON(400, newError(errUnvalidArg, err.Error()))
+		return
+	}
+	var note *string
+	if v, ok := req.PostForm["note"]; ok && len(v) > 0 {
+		note = &v[0]
+	}
+	ent, err := backup.LabelBackup(params["name"], labels, req.PostForm["remove"], note)
+	if err != nil {
+		r.JSON(400, newError(errBackupError, err.Error()))
+		return
+	}
+	r.JSON(200, ent)
+}
+
+// MetaReconcile compares the meta of namespace with the backups on storage, the diff is fixed if fix is true
+func MetaReconcile(r render.Render, req *http.Request) {
+	diff, err := backup.ReconcileNamespace(req.FormValue("namespace"), req.FormValue("fix") == "true")
+	if err != nil {
+		r.JSON(503, newError(errBackupError, err.Error()))
+		return
+	}
+	r.JSON(200, diff)
+}
+
+// MetaMigrate moves the backups in namespace into app layout, only the plan is returned if apply is not true
+func MetaMigrate(r render.Render, req *http.Request) {
+	result, err := backup.MigrateNamespace(req.FormValue("namespace"), req.FormValue("apply") == "true")
+	if err != nil {
+		r.JSON(503, newError(errBackupError, err.Error()))
+		return
+	}
+	r.JSON(200, result)
+}
+
 func BackupRecover(r render.Render, req *http.Request, params martini.Params) {
 	req.ParseForm()
 	rid, err := crond.RawOnce("backup_recover", map[string]interface{}{
@@ -193,6 +353,7 @@ func BackupRecover(r render.Render, req *http.Request, params martini.Params) {
 		"backup":    params["file"],
 		"files":     req.PostForm["files"],
 		"destDir":   req.FormValue("destDir"),
+		"at":        req.FormValue("at"),
 		"app":       req.FormValue("app"),
 		"proc":      req.FormValue("proc"),
 	})
@@ -225,14 +386,18 @@ func GetNotifyAddr(r render.Render) {
 func Debug(r render.Render) {
 	var memStats runtime.MemStats
 	runtime.ReadMemStats(&memStats)
-	r.JSON(200, map[string]interface{}{
+	data := map[string]interface{}{
 		"startTime":     startTime,
 		"updateTime":    cronUpdateTime,
 		"crond_status":  crond.Status(),
 		"goroutines":    runtime.NumGoroutine(),
 		"running_tasks": atomic.LoadInt32(&crond.RunningCount),
 		"mem_stats":     memStats,
-	})
+	}
+	if free, err := backup.FreeSpace(); err == nil {
+		data["backup_free_space"] = free
+	}
+	r.JSON(200, data)
 }
 
 func Router(r martini.Router) {
@@ -248,7 +413,15 @@ func Router(r martini.Router) {
 	r.Get("/backup/json", BackupJson)
 	r.Get("/backup/info/file/:name", BackupInfo)
 	r.Get("/backup/filelist/dir/**", BackupFileList)
+	r.Get("/backup/filelist/file/:name", ArchiveFileList)
+	r.Get("/backup/download/file/**", BackupDownload)
+	r.Post("/backup/upload", BackupUpload)
 	r.Post("/backup/delete", BackupDelete)
+	r.Post("/backup/hold/file/:name", BackupHold)
+	r.Post("/backup/unhold/file/:name", BackupUnhold)
+	r.Post("/backup/labels/file/:name", BackupLabel)
+	r.Post("/backup/meta/reconcile", MetaReconcile)
+	r.Post("/backup/meta/migrate", MetaMigrate)
 	r.Post("/backup/full/recover/file/:file", BackupRecover)
 	r.Post("/backup/increment/recover/dir/:file", BackupRecover)
 	r.Put("/notify", SetNotifyAddr)
@@ -7,12 +7,109 @@ import (
 	"path"
 )
 
+// the flags of the storage driver
+var driverFlags = []cli.Flag{
+	cli.StringFlag{
+		Name:  "backup-driver",
+		Value: "moosefs",
+		Usage: "Set backup driver",
+	},
+	cli.StringFlag{
+		Name:  "backup-keyfile",
+		Value: "",
+		Usage: "The file of keys used to encrypt backups, each line is `<key id> <base64 of 32 bytes key>`",
+	},
+	cli.StringFlag{
+		Name:  "backup-moosefs-dir",
+		Value: "/mfs/lain/backup",
+		Usage: "The direcotry path mount on moosefs, only used when backup-driver is moosefs",
+	},
+	cli.StringFlag{
+		Name:  "backup-local-dir",
+		Value: "/data/lain/backup",
+		Usage: "The directory backups stored in, it can be a plain disk or mounted NFS/CephFS, only used when backup-driver is local",
+	},
+	cli.StringFlag{
+		Name:  "backup-sftp-addr",
+		Value: "",
+		Usage: "The ssh address of the backup host, like 10.0.0.2:22, only used when backup-driver is sftp",
+	},
+	cli.StringFlag{
+		Name:  "backup-sftp-user",
+		Value: "backup",
+		Usage: "The user login to the backup host, only used when backup-driver is sftp",
+	},
+	cli.StringFlag{
+		Name:  "backup-sftp-key",
+		Value: "/root/.ssh/id_rsa",
+		Usage: "The private key file used to login the backup host, only used when backup-driver is sftp",
+	},
+	cli.StringFlag{
+		Name:  "backup-sftp-known-hosts",
+		Value: "/root/.ssh/known_hosts",
+		Usage: "The known_hosts file used to check the backup host's key, only used when backup-driver is sftp",
+	},
+	cli.StringFlag{
+		Name:  "backup-sftp-dir",
+		Value: "/lain/backup",
+		Usage: "The directory backups stored in on the backup host, only used when backup-driver is sftp",
+	},
+	cli.StringFlag{
+		Name:  "backup-s3-endpoint",
+		Value: "",
+		Usage: "The s3 compatible service's endpoint, like https://s3.amazonaws.com, only used when backup-driver is s3",
+	},
+	cli.StringFlag{
+		Name:  "backup-s3-region",
+		Value: "us-east-1",
+		Usage: "The region of the s3 bucket, only used when backup-driver is s3",
+	},
+	cli.StringFlag{
+		Name:  "backup-s3-bucket",
+		Value: "",
+		Usage: "The bucket backups stored in, only used when backup-driver is s3",
+	},
+	cli.StringFlag{
+		Name:  "backup-s3-prefix",
+		Value: "lain/backup",
+		Usage: "The key prefix of backups in the bucket, only used when backup-driver is s3",
+	},
+	cli.StringFlag{
+		Name:   "backup-s3-access-key",
+		Value:  "",
+		Usage:  "The access key of s3, only used when backup-driver is s3",
+		EnvVar: "BACKUPD_S3_ACCESS_KEY",
+	},
+	cli.StringFlag{
+		Name:   "backup-s3-secret-key",
+		Value:  "",
+		Usage:  "The secret key of s3, only used when backup-driver is s3",
+		EnvVar: "BACKUPD_S3_SECRET_KEY",
+	},
+	cli.StringFlag{
+		Name:  "backup-webdav-url",
+		Value: "",
+		Usage: "The webdav collection backups stored in, like https://cloud.example.com/remote.php/dav/files/lain/backup, only used when backup-driver is webdav",
+	},
+	cli.StringFlag{
+		Name:  "backup-webdav-user",
+		Value: "",
+		Usage: "The user of webdav server, only used when backup-driver is webdav",
+	},
+	cli.StringFlag{
+		Name:   "backup-webdav-password",
+		Value:  "",
+		Usage:  "The password of webdav server, only used when backup-driver is webdav",
+		EnvVar: "BACKUPD_WEBDAV_PASSWORD",
+	},
+}
+
 var commands = []cli.Command{
 	{
 		Name:   "daemon",
 		Usage:  "run backup daemon",
 		Action: daemonMain,
-		Flags: []cli.Flag{
+		Flags: append([]cli.Flag{
 			cli.StringFlag{
 				Name:  "addr",
 				Value: ":9002",
@@ -24,16 +121,48 @@ var commands = []cli.Command{
 				Usage: "The ip value daemon is running on",
 			},
 			cli.StringFlag{
-				Name:  "backup-driver",
-				Value: "moosefs",
-				Usage: "Set backup driver",
+				Name:  "backup-layout",
+				Value: "ip",
+				Usage: "Where the new backups are stored, ip or app, app stores them by app, proc, instance and volume",
+			},
+			cli.IntFlag{
+				Name:  "backup-part-size",
+				Value: 0,
+				Usage: "Upload the full backups in parts of MB and resume them if failed, 0 means in a single file",
+			},
+		}, driverFlags...),
+	},
+	{
+		Name:   "meta",
+		Usage:  "rebuild the meta of a daemon from the backups on storage, only print the diff without --fix",
+		Action: metaMain,
+		Flags: append([]cli.Flag{
+			cli.StringFlag{
+				Name:  "ip",
+				Value: "127.0.0.1",
+				Usage: "The ip of the daemon, the meta of its namespace is reconciled",
+			},
+			cli.BoolFlag{
+				Name:  "fix",
+				Usage: "Add the backups missing in meta and remove the ones not on storage, stop the daemon first or use its API",
 			},
+		}, driverFlags...),
+	},
+	{
+		Name:   "migrate",
+		Usage:  "move the backups in the namespace of a daemon into app layout, only print the plan without --apply",
+		Action: migrateMain,
+		Flags: append([]cli.Flag{
 			cli.StringFlag{
-				Name:  "backup-moosefs-dir",
-				Value: "/mfs/lain/backup",
-				Usage: "The direcotry path mount on moosefs, only used when backup-driver is moosefs",
+				Name:  "ip",
+				Value: "127.0.0.1",
+				Usage: "The ip of the daemon, the backups in its namespace are migrated",
 			},
-		},
+			cli.BoolFlag{
+				Name:  "apply",
+				Usage: "Move the backups, stop the daemon first or use its API",
+			},
+		}, driverFlags...),
 	},
 	{
 		Name:   "controller",
@@ -1,12 +1,18 @@
 package cli
 
 import (
+	"fmt"
 	log "github.com/Sirupsen/logrus"
 	"github.com/codegangsta/cli"
 	"github.com/laincloud/backupd/api"
 	"github.com/laincloud/backupd/crond"
 	"github.com/laincloud/backupd/tasks/backup"
+	"github.com/laincloud/backupd/tasks/backup/drivers/local"
+	"github.com/laincloud/backupd/tasks/backup/drivers/mirror"
 	"github.com/laincloud/backupd/tasks/backup/drivers/moosefs"
+	"github.com/laincloud/backupd/tasks/backup/drivers/s3"
+	"github.com/laincloud/backupd/tasks/backup/drivers/sftp"
+	"github.com/laincloud/backupd/tasks/backup/drivers/webdav"
 	_ "github.com/laincloud/backupd/tasks/test"
 	"os"
 	"os/signal"
@@ -15,6 +21,48 @@ import (
 	"time"
 )
 
+// initialize the backup driver by name, only the driver used is initialized
+func initDriver(c *cli.Context, name string) error {
+	if names, ok := mirror.ParseName(name); ok {
+		for _, name := range names {
+			if err := initDriver(c, name); err != nil {
+				return err
+			}
+		}
+		return mirror.Init(names)
+	}
+	switch name {
+	case "moosefs":
+		return moosefs.Init(c.String("backup-moosefs-dir"))
+	case "local":
+		return local.Init(c.String("backup-local-dir"))
+	case "s3":
+		return s3.Init(s3.Config{
+			Endpoint:  c.String("backup-s3-endpoint"),
+			Region:    c.String("backup-s3-region"),
+			Bucket:    c.String("backup-s3-bucket"),
+			Prefix:    c.String("backup-s3-prefix"),
+			AccessKey: c.String("backup-s3-access-key"),
+			SecretKey: c.String("backup-s3-secret-key"),
+		})
+	case "sftp":
+		return sftp.Init(sftp.Config{
+			Addr:       c.String("backup-sftp-addr"),
+			User:       c.String("backup-sftp-user"),
+			KeyFile:    c.String("backup-sftp-key"),
+			KnownHosts: c.String("backup-sftp-known-hosts"),
+			Dir:        c.String("backup-sftp-dir"),
+		})
+	case "webdav":
+		return webdav.Init(webdav.Config{
+			URL:      c.String("backup-webdav-url"),
+			User:     c.String("backup-webdav-user"),
+			Password: c.String("backup-webdav-password"),
+		})
+	}
+	return fmt.Errorf("Unknown backup driver %s", name)
+}
+
 func daemonMain(c *cli.Context) {
 
 	log.Infof("Initialize and Start crond service...")
@@ -22,9 +70,20 @@ func daemonMain(c *cli.Context) {
 	crond.Start()              // start default crond server
 
 	// all backup driver should init before backup package
-	// backup driver moosefs, initialization
-	log.Infof("Initialize moosefs-backup-driver...")
-	if err := moosefs.Init(c.String("backup-moosefs-dir")); err != nil {
+	log.Infof("Initialize %s-backup-driver...", c.String("backup-driver"))
+	if err := initDriver(c, c.String("backup-driver")); err != nil {
+		panic(err)
+	}
+	if keyfile := c.String("backup-keyfile"); keyfile != "" {
+		log.Infof("Load encryption keys from %s...", keyfile)
+		if err := backup.LoadKeys(keyfile); err != nil {
+			panic(err)
+		}
+	}
+	if err := backup.SetLayout(c.String("backup-layout")); err != nil {
+		panic(err)
+	}
+	if err := backup.SetPartSize(c.Int("backup-part-size")); err != nil {
 		panic(err)
 	}
 	log.Infof("Initialize backup-crond-task...")
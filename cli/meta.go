@@ -0,0 +1,45 @@
+package cli
+
+import (
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/codegangsta/cli"
+	"github.com/laincloud/backupd/tasks/backup"
+)
+
+// reconcile the meta of a namespace on the storage, it works without the daemon, so the lost meta can be rebuilt
+func metaMain(c *cli.Context) {
+	name := c.String("backup-driver")
+	if err := initDriver(c, name); err != nil {
+		log.Fatalf("Fail to initialize backup driver %s, %s", name, err.Error())
+	}
+	if keyfile := c.String("backup-keyfile"); keyfile != "" {
+		if err := backup.LoadKeys(keyfile); err != nil {
+			log.Fatalf("Fail to load encryption keys, %s", err.Error())
+		}
+	}
+	store, _ := backup.GetDriver(name)
+	mt := backup.NewSharedMeta(store, c.String("ip")) // the daemon of ip may be committing it
+	if err := mt.LoadFromBackend(); err != nil {
+		log.Warnf("Fail to load meta, it's rebuilt from the storage, %s", err.Error())
+	}
+	diff, err := backup.Reconcile(store, mt, c.Bool("fix"))
+	if err != nil {
+		log.Fatalf("Fail to reconcile meta of %s, %s", c.String("ip"), err.Error())
+	}
+
+	for _, ent := range diff.Missing {
+		fmt.Printf("+ %s\t%s\t%s\t%s\n", ent.Name, ent.Mode, ent.Source, ent.Created.Format("2006-01-02 15:04:05"))
+	}
+	for _, ent := range diff.Orphaned {
+		fmt.Printf("- %s\t%s\t%s\t%s\n", ent.Name, ent.Mode, ent.Source, ent.Created.Format("2006-01-02 15:04:05"))
+	}
+	for _, warning := range diff.Warnings {
+		fmt.Printf("! %s\n", warning)
+	}
+	if diff.Fixed {
+		fmt.Printf("%d backups added, %d orphans removed\n", len(diff.Missing), len(diff.Orphaned))
+	} else {
+		fmt.Printf("%d backups to be added, %d orphans to be removed\n", len(diff.Missing), len(diff.Orphaned))
+	}
+}
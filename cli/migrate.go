@@ -0,0 +1,46 @@
+package cli
+
+import (
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/codegangsta/cli"
+	"github.com/laincloud/backupd/tasks/backup"
+)
+
+// move the backups in the namespace of a daemon into app layout, it works without the daemon
+func migrateMain(c *cli.Context) {
+	name := c.String("backup-driver")
+	if err := initDriver(c, name); err != nil {
+		log.Fatalf("Fail to initialize backup driver %s, %s", name, err.Error())
+	}
+	if keyfile := c.String("backup-keyfile"); keyfile != "" { // the snapshots of encrypted dedup backups are read
+		if err := backup.LoadKeys(keyfile); err != nil {
+			log.Fatalf("Fail to load encryption keys, %s", err.Error())
+		}
+	}
+	store, _ := backup.GetDriver(name)
+	mt := backup.NewMeta(store, c.String("ip"))
+	if err := mt.LoadFromBackend(); err != nil {
+		log.Fatalf("Fail to load meta of %s, %s", c.String("ip"), err.Error())
+	}
+	index, err := backup.OpenIndex(store)
+	if err != nil {
+		log.Fatalf("Fail to load the index of app layout, %s", err.Error())
+	}
+	result, err := backup.Migrate(store, mt, index, c.Bool("apply"))
+	if err != nil {
+		log.Fatalf("Fail to migrate backups of %s, %s", c.String("ip"), err.Error())
+	}
+
+	for _, ent := range result.Migrated {
+		fmt.Printf("> %s\t%s\t%s\n", ent.Name, ent.Mode, ent.Namespace)
+	}
+	for _, warning := range result.Warnings {
+		fmt.Printf("! %s\n", warning)
+	}
+	if result.Applied {
+		fmt.Printf("%d backups migrated\n", len(result.Migrated))
+	} else {
+		fmt.Printf("%d backups to be migrated\n", len(result.Migrated))
+	}
+}
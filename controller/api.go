@@ -4,8 +4,10 @@ import (
 	"errors"
 	log "github.com/Sirupsen/logrus"
 	"github.com/go-martini/martini"
+	"github.com/laincloud/backupd/tasks/backup"
 	"github.com/martini-contrib/render"
 	"net/http"
+	"net/url"
 	"strconv"
 )
 
@@ -32,6 +34,15 @@ func GetBackup(r render.Render, params martini.Params, req *http.Request, let *L
 		r.JSON(500, err)
 		return
 	}
+	if selectors := req.URL.Query()["label"]; len(selectors) > 0 { // key=value or key
+		var matched []BackupEntity
+		for _, entity := range data {
+			if backup.MatchLabels(entity.Labels, selectors) {
+				matched = append(matched, entity)
+			}
+		}
+		data = matched
+	}
 	if data == nil {
 		r.JSON(200, []string{})
 	} else {
@@ -104,7 +115,19 @@ func GetCronRecord(r render.Render, params martini.Params, let *Lainlet) {
 	r.JSON(200, ret)
 }
 
-func CronOnce(r render.Render, params martini.Params, let *Lainlet) {
+// runArgs returns the labels and note of the backup made by running a job once
+func runArgs(req *http.Request) url.Values {
+	args := url.Values{}
+	if labels := req.PostForm["labels"]; len(labels) > 0 {
+		args["labels"] = labels
+	}
+	if note := req.FormValue("note"); note != "" {
+		args.Set("note", note)
+	}
+	return args
+}
+
+func CronOnce(r render.Render, params martini.Params, let *Lainlet, req *http.Request) {
 	app := params["app"]
 	if app == "" {
 		r.JSON(400, errors.New("app name can not be empty"))
@@ -116,7 +139,7 @@ func CronOnce(r render.Render, params martini.Params, let *Lainlet) {
 		return
 	}
 	ctl := NewController(app, let)
-	rid, err := ctl.CronOnce(id)
+	rid, err := ctl.CronOnce(id, runArgs(req))
 	if err != nil {
 		r.JSON(500, err)
 		return
@@ -149,7 +172,7 @@ func BackupRecover(r render.Render, req *http.Request, params martini.Params, le
 		return
 	}
 
-	id, err := ctl.BackupRecover(proc, "", file, entity.InstanceNo, entity.InstanceNo)
+	id, err := ctl.BackupRecover(proc, "", file, entity.InstanceNo, entity.InstanceNo, req.PostForm["files"])
 	if err != nil {
 		r.JSON(500, err)
 		return
@@ -186,7 +209,7 @@ func BackupRecoverIncrement(r render.Render, req *http.Request, params martini.P
 		return
 	}
 
-	id, err := ctl.IncrementBackupRecover(proc, "", entity.InstanceNo, entity.InstanceNo, dir, files)
+	id, err := ctl.IncrementBackupRecover(proc, "", entity.InstanceNo, entity.InstanceNo, dir, files, req.FormValue("at"))
 	if err != nil {
 		r.JSON(500, err)
 		return
@@ -228,7 +251,7 @@ func BackupMigrate(r render.Render, req *http.Request, params martini.Params, le
 		r.JSON(500, err)
 		return
 	}
-	id, err := ctl.BackupRecover(proc, volume, file, entity.InstanceNo, toi)
+	id, err := ctl.BackupRecover(proc, volume, file, entity.InstanceNo, toi, req.PostForm["files"])
 	if err != nil {
 		r.JSON(500, err)
 		return
@@ -274,7 +297,7 @@ func BackupMigrateIncrement(r render.Render, req *http.Request, params martini.P
 		r.JSON(500, err)
 		return
 	}
-	id, err := ctl.IncrementBackupRecover(proc, volume, entity.InstanceNo, toi, dir, files)
+	id, err := ctl.IncrementBackupRecover(proc, volume, entity.InstanceNo, toi, dir, files, req.FormValue("at"))
 	if err != nil {
 		r.JSON(500, err)
 		return
@@ -314,6 +337,32 @@ func GetIncrementBackupFileList(r render.Render, params martini.Params, let *Lai
 	r.JSON(200, data)
 }
 
+func GetArchiveFileList(r render.Render, params martini.Params, req *http.Request, let *Lainlet) {
+	app := params["app"]
+	if app == "" {
+		r.JSON(400, errors.New("app name can not be empty"))
+		return
+	}
+	proc := params["proc"]
+	if proc == "" {
+		r.JSON(400, errors.New("proc name can not be empty"))
+		return
+	}
+	file := params["file"]
+	if file == "" {
+		r.JSON(400, errors.New("file must be given"))
+		return
+	}
+
+	ctl := NewController(app, let)
+	data, err := ctl.ArchiveFileList(proc, file, req.URL.Query().Get("dir"))
+	if err != nil {
+		r.JSON(500, err)
+		return
+	}
+	r.JSON(200, data)
+}
+
 func NotFound(r render.Render) {
 	r.JSON(404, map[string]string{
 		"msg": "404 not found",
@@ -323,6 +372,7 @@ func NotFound(r render.Render) {
 func v1(r martini.Router) {
 	r.Get("/backup/json/app/:app/proc/:proc", GetBackup)
 	r.Get("/backup/filelist/app/:app/proc/:proc/dir/:dir", GetIncrementBackupFileList)
+	r.Get("/backup/filelist/app/:app/proc/:proc/file/:file", GetArchiveFileList)
 	r.Post("/backup/recover/app/:app/proc/:proc/file/:file", BackupRecover)
 	r.Post("/backup/migrate/app/:app/proc/:proc/file/:file", BackupMigrate)
 	r.Post("/backup/recover/increment/app/:app/proc/:proc/dir/:dir", BackupRecoverIncrement)
@@ -6,14 +6,20 @@ import (
 	log "github.com/Sirupsen/logrus"
 	"github.com/go-martini/martini"
 	"github.com/martini-contrib/render"
+	"io"
 	"io/ioutil"
+	api "github.com/laincloud/backupd/api/v1"
 	"github.com/laincloud/backupd/controller/records"
 	"github.com/laincloud/backupd/crond"
 	"net/http"
+	"regexp"
 	"strconv"
 	"strings"
 )
 
+// the full and dedup backups, the same with the names in routes
+var archiveName = regexp.MustCompile(`\.(?:tar(?:\.gz|\.zst|\.xz)?|snapshot)$`)
+
 func BackupFileInfoOrFileList(r render.Render, params martini.Params, let *Lainlet, req *http.Request) {
 	var (
 		data interface{}
@@ -21,7 +27,17 @@ func BackupFileInfoOrFileList(r render.Render, params martini.Params, let *Lainl
 	)
 	ctl := NewController(params["app"], let)
 	if req.URL.Query().Get("open") == "true" {
-		data, err = ctl.IncrementBackupFileList(params["proc"], params["file"])
+		// the files in an archive are listed by <archive>/<dir> or <archive>?dir=<dir>
+		parts := strings.SplitN(params["file"], "/", 2)
+		if archiveName.MatchString(parts[0]) {
+			dir := req.URL.Query().Get("dir")
+			if len(parts) > 1 {
+				dir = parts[1]
+			}
+			data, err = ctl.ArchiveFileList(params["proc"], parts[0], dir)
+		} else {
+			data, err = ctl.IncrementBackupFileList(params["proc"], params["file"])
+		}
 	} else {
 		data, err = ctl.BackupFileInfo(params["proc"], params["file"])
 	}
@@ -32,6 +48,138 @@ func BackupFileInfoOrFileList(r render.Render, params martini.Params, let *Lainl
 	r.JSON(200, data)
 }
 
+// BackupDownload proxies the backup file from backupd, the files in increment backup are downloaded by <dir>/<path>
+func BackupDownload(w http.ResponseWriter, r render.Render, params martini.Params, let *Lainlet) {
+	ctl := NewController(params["app"], let)
+	name := strings.Split(params["file"], "/")[0]
+	if code, err := procBackup(ctl, let, params["proc"], name); err != nil {
+		r.JSON(code, err.Error())
+		return
+	}
+	resp, err := ctl.DownloadBackup(params["proc"], params["file"])
+	if err != nil {
+		r.JSON(500, err.Error())
+		return
+	}
+	defer resp.Body.Close()
+	for _, key := range []string{"Content-Type", "Content-Disposition", api.ChecksumHeader} {
+		if v := resp.Header.Get(key); v != "" {
+			w.Header().Set(key, v)
+		}
+	}
+	w.WriteHeader(200)
+	if _, err := io.Copy(w, resp.Body); err != nil { // broken by backupd if the backup is corrupted
+		log.Errorf("Fail to download %s, %s", params["file"], err.Error())
+		api.AbortResponse(w)
+	}
+}
+
+// procBackup checks the backup named name is of the proc, it returns the http code if not
+func procBackup(ctl *Controller, let *Lainlet, proc, name string) (int, error) {
+	vs, err := let.Volumes(ctl.App, proc)
+	if err != nil {
+		return 500, err
+	}
+	backups, err := ctl.GetBackup(proc, vs...)
+	if err != nil {
+		return 500, err
+	}
+	for _, entity := range backups {
+		if entity.Name == name {
+			return 200, nil
+		}
+	}
+	return 404, fmt.Errorf("No backup named %s", name)
+}
+
+// BackupHold pins the backup so it can not be deleted by the delete API or backup_expire,
+// postdata is reason, owner and expires(unix seconds or RFC3339, empty means never)
+func BackupHold(r render.Render, params martini.Params, let *Lainlet, req *http.Request) {
+	ctl := NewController(params["app"], let)
+	if code, err := procBackup(ctl, let, params["proc"], params["file"]); err != nil {
+		r.JSON(code, err.Error())
+		return
+	}
+	entity, err := ctl.HoldBackup(params["proc"], params["file"], req.FormValue("reason"), req.FormValue("owner"), req.FormValue("expires"))
+	if err != nil {
+		r.JSON(500, err.Error())
+		return
+	}
+	r.JSON(200, entity)
+}
+
+// BackupLabel edits the labels and note of the backup,
+// postdata is labels(key=value) to set, remove(keys) to remove and note, the note is not changed if not given
+func BackupLabel(r render.Render, params martini.Params, let *Lainlet, req *http.Request) {
+	ctl := NewController(params["app"], let)
+	if code, err := procBackup(ctl, let, params["proc"], params["file"]); err != nil {
+		r.JSON(code, err.Error())
+		return
+	}
+	var note *string
+	if v, ok := req.PostForm["note"]; ok && len(v) > 0 {
+		note = &v[0]
+	}
+	entity, err := ctl.LabelBackup(params["proc"], params["file"], req.PostForm["labels"], req.PostForm["remove"], note)
+	if err != nil {
+		r.JSON(500, err.Error())
+		return
+	}
+	r.JSON(200, entity)
+}
+
+func BackupUnhold(r render.Render, params martini.Params, let *Lainlet) {
+	ctl := NewController(params["app"], let)
+	if code, err := procBackup(ctl, let, params["proc"], params["file"]); err != nil {
+		r.JSON(code, err.Error())
+		return
+	}
+	entity, err := ctl.UnholdBackup(params["proc"], params["file"])
+	if err != nil {
+		r.JSON(500, err.Error())
+		return
+	}
+	r.JSON(200, entity)
+}
+
+// BackupUpload imports the tar archive in request body as a full backup of the volume in the instance,
+// the codec of the archive is detected by the extension of filename
+func BackupUpload(r render.Render, params martini.Params, let *Lainlet, req *http.Request) {
+	volume, filename := req.FormValue("volume"), req.FormValue("filename")
+	if volume == "" || filename == "" {
+		r.JSON(400, "volume and filename must be given")
+		return
+	}
+	instance, err := strconv.Atoi(req.FormValue("instance"))
+	if err != nil {
+		r.JSON(400, "instance must be a integer")
+		return
+	}
+	vs, err := let.Volumes(params["app"], params["proc"])
+	if err != nil {
+		r.JSON(500, err.Error())
+		return
+	}
+	found := false
+	for _, v := range vs {
+		if v == volume {
+			found = true
+			break
+		}
+	}
+	if !found {
+		r.JSON(400, "No backup for volume "+volume)
+		return
+	}
+	ctl := NewController(params["app"], let)
+	entity, err := ctl.UploadBackup(params["proc"], volume, instance, filename, req.Body)
+	if err != nil {
+		r.JSON(500, err.Error())
+		return
+	}
+	r.JSON(201, entity)
+}
+
 func BackupDelete(r render.Render, params martini.Params, let *Lainlet, req *http.Request) {
 	files := req.PostForm["files"]
 	if len(files) > 0 {
@@ -61,7 +209,7 @@ func BackupDelete(r render.Render, params martini.Params, let *Lainlet, req *htt
 		}
 
 		if err := ctl.DeleteBackup(params["proc"], files); err != nil {
-			r.JSON(500, err)
+			r.JSON(500, err.Error()) // the held backups can not be deleted
 			return
 		}
 	}
@@ -78,9 +226,9 @@ func GetCronJob(r render.Render, params martini.Params, let *Lainlet) {
 	r.JSON(200, data)
 }
 
-func CronAction(r render.Render, params martini.Params, let *Lainlet) {
+func CronAction(r render.Render, params martini.Params, let *Lainlet, req *http.Request) {
 	ctl := NewController(params["app"], let)
-	data, err := ctl.CronAction(params["id"], params["action"])
+	data, err := ctl.CronAction(params["id"], params["action"], runArgs(req))
 	if err != nil {
 		r.JSON(400, err)
 		return
@@ -169,6 +317,52 @@ func GetCronRecordV2(r render.Render, params martini.Params) {
 	r.JSON(200, data)
 }
 
+// DrillReport returns the restore drills of the app in a month, and the success rate of each proc
+func DrillReport(r render.Render, params martini.Params, req *http.Request) {
+	month, year := 0, 0
+	if s := req.URL.Query().Get("month"); s != "" {
+		if i, err := strconv.Atoi(s); err == nil {
+			month = i
+		}
+	}
+	if s := req.URL.Query().Get("year"); s != "" {
+		if i, err := strconv.Atoi(s); err == nil {
+			year = i
+		}
+	}
+	data, err := records.GetByAction(params["app"], DrillFunc, year, month)
+	if err != nil {
+		r.JSON(500, err)
+		return
+	}
+	type procStat struct {
+		Total  int     `json:"total"`
+		Passed int     `json:"passed"`
+		Rate   float64 `json:"rate"`
+	}
+	procs := make(map[string]*procStat)
+	for _, record := range data {
+		if record.State == crond.StateRunning {
+			continue
+		}
+		proc, _ := record.Args["proc"].(string)
+		stat, ok := procs[proc]
+		if !ok {
+			stat = &procStat{}
+			procs[proc] = stat
+		}
+		stat.Total++
+		if record.State == crond.StateSuccess {
+			stat.Passed++
+		}
+		stat.Rate = float64(stat.Passed) / float64(stat.Total)
+	}
+	r.JSON(200, map[string]interface{}{
+		"procs":   procs,
+		"records": data,
+	})
+}
+
 func ServerDebug(r render.Render, params martini.Params) {
 	if !validIP(params["ip"]) {
 		r.JSON(400, "unvalid ip addr")
@@ -204,7 +398,7 @@ func Notify(r render.Render, req *http.Request) {
 	if a, ok := record.Job.Args["app"]; ok {
 		app, _ = a.(string)
 	}
-	if record.Job.Action == "backup_expire" {
+	if record.Job.Action == ExpireFunc || record.Job.Action == GCFunc {
 		app = "backupctl"
 	}
 	log.Debugf("Put records for app %s: %v", app, record)
@@ -229,19 +423,25 @@ func BackupDB(r render.Render, req *http.Request) {
 }
 
 func v2(r martini.Router) {
-	r.Get("/app/:app/proc/:proc/backups", GetBackup)                                              //
-	r.Get("/app/:app/proc/:proc/backups/(?P<file>.+)", BackupFileInfoOrFileList)                  //
-	r.Post("/app/:app/proc/:proc/backups/(?P<file>.+\\.tar\\.gz)/actions/recover", BackupRecover) //
-	r.Post("/app/:app/proc/:proc/backups/(?P<file>.+\\.tar\\.gz)/actions/migrate", BackupMigrate)
+	r.Get("/app/:app/proc/:proc/backups", GetBackup)                                                                             //
+	r.Get("/app/:app/proc/:proc/backups/(?P<file>.+)/download", BackupDownload)                                                  //
+	r.Get("/app/:app/proc/:proc/backups/(?P<file>.+)", BackupFileInfoOrFileList)                                                 //
+	r.Post("/app/:app/proc/:proc/backups/(?P<file>.+\\.(?:tar(?:\\.gz|\\.zst|\\.xz)?|snapshot))/actions/recover", BackupRecover) //
+	r.Post("/app/:app/proc/:proc/backups/(?P<file>.+\\.(?:tar(?:\\.gz|\\.zst|\\.xz)?|snapshot))/actions/migrate", BackupMigrate)
 	r.Post("/app/:app/proc/:proc/backups/:dir/actions/recover", BackupRecoverIncrement) //
 	r.Post("/app/:app/proc/:proc/backups/:dir/actions/migrate", BackupMigrateIncrement) //
 	r.Post("/app/:app/proc/:proc/backups/actions/delete", BackupDelete)                 //
+	r.Post("/app/:app/proc/:proc/backups/:file/actions/hold", BackupHold)               //
+	r.Post("/app/:app/proc/:proc/backups/:file/actions/unhold", BackupUnhold)           //
+	r.Post("/app/:app/proc/:proc/backups/:file/actions/label", BackupLabel)             //
+	r.Post("/app/:app/proc/:proc/backups/actions/upload", BackupUpload)                 //
 
 	r.Get("/app/:app/cron/jobs", GetCronJobs)                     //
 	r.Get("/app/:app/cron/jobs/:id", GetCronJob)                  //
 	r.Get("/app/:app/cron/records", GetCronRecordsV2)             //
 	r.Get("/app/:app/cron/records/:id", GetCronRecordV2)          //
 	r.Post("/app/:app/cron/jobs/:id/actions/:action", CronAction) //
+	r.Get("/app/:app/drills", DrillReport)                        //
 
 	r.Get("/server/:ip/cron/jobs", ServerCronJobs)             //
 	r.Put("/server/:ip/cron/actions/:action", ServerCronStats) //
@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"fmt"
 	log "github.com/Sirupsen/logrus"
+	"io"
 	"io/ioutil"
 	api "github.com/laincloud/backupd/api/v1"
 	"github.com/laincloud/backupd/crond"
@@ -21,6 +22,10 @@ type BackupEntity struct {
 	Size       uint64    `json:"size"`
 	Created    time.Time `json:"created"`
 	InstanceNo int       `json:"instanceNo"`
+
+	Hold   *backup.Hold      `json:"hold,omitempty"`
+	Labels map[string]string `json:"labels,omitempty"`
+	Note   string            `json:"note,omitempty"`
 }
 
 type Backend struct {
@@ -91,9 +96,10 @@ func (end *Backend) GetCronJob(id string) (crond.Job, error) {
 	return ret, err
 }
 
-func (end *Backend) CronAction(id, action string) (string, error) {
+// CronAction runs, sleeps or wakes up the job, args are the form values of run like labels and note
+func (end *Backend) CronAction(id, action string, args url.Values) (string, error) {
 	url := fmt.Sprintf("/cron/jobs/%s/actions/%s", id, action)
-	content, err := end.RawRequest("POST", url, nil)
+	content, err := end.RawRequest("POST", url, args)
 	if err != nil {
 		return "", err
 	}
@@ -203,11 +209,14 @@ func (end *Backend) BackupDelete(files []string) error {
 	return err
 }
 
-func (end *Backend) BackupRecover(namespace, file, destDir string, extra map[string]string) (string, error) {
+func (end *Backend) BackupRecover(namespace, file, destDir string, files []string, extra map[string]string) (string, error) {
 	uri := fmt.Sprintf("/backup/full/recover/file/%s", file)
 	args := url.Values{}
 	args.Add("namespace", namespace)
 	args.Add("destDir", destDir)
+	for _, f := range files {
+		args.Add("files", f)
+	}
 	for k, v := range extra {
 		args.Add(k, v)
 	}
@@ -254,8 +263,9 @@ func (end *Backend) BackupRecoverIncrement(namespace, dir, destDir string, files
 	return id, nil
 }
 
-func (end *Backend) CronOnce(id string) (string, error) {
-	content, err := end.RawRequest("POST", "/cron/once/"+id, nil)
+// CronOnce runs the job once, args are the form values like labels and note of the backup made by this run
+func (end *Backend) CronOnce(id string, args url.Values) (string, error) {
+	content, err := end.RawRequest("POST", "/cron/once/"+id, args)
 	if err != nil {
 		return "", err
 	}
@@ -298,6 +308,9 @@ func (end *Backend) BackupInfo(file string) (BackupEntity, error) {
 		Size:       entity.Size,
 		Created:    entity.Created,
 		InstanceNo: entity.InstanceNo,
+		Hold:       entity.Hold,
+		Labels:     entity.Labels,
+		Note:       entity.Note,
 	}, nil
 }
 
@@ -314,6 +327,19 @@ func (end *Backend) IncrementBackupFileList(dir string) ([]api.FInfo, error) {
 	return ret, nil
 }
 
+func (end *Backend) ArchiveFileList(file, dir string) ([]api.FInfo, error) {
+	var ret []api.FInfo
+	uri := fmt.Sprintf("/backup/filelist/file/%s?dir=%s", file, url.QueryEscape(dir))
+	content, err := end.RawRequest("GET", uri, nil)
+	if err != nil {
+		return ret, err
+	}
+	if err := json.Unmarshal(content, &ret); err != nil {
+		return ret, err
+	}
+	return ret, nil
+}
+
 func (end *Backend) SetNotify(addr string) error {
 	args := url.Values{}
 	args.Add("addr", addr)
@@ -346,6 +372,85 @@ func (end *Backend) RemoveNotify(addr string) error {
 	return nil
 }
 
+// Stream sends body to backupd without timeout, the response body must be closed by the caller
+func (end *Backend) Stream(method, uri string, body io.Reader) (*http.Response, error) {
+	url := fmt.Sprintf("%s%s%s", end.Addr, end.Prefix, uri)
+	log.Infof("Streaming request for [%s]%s", method, url)
+	req, err := http.NewRequest(method, url, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		content, _ := ioutil.ReadAll(resp.Body)
+		return nil, fmt.Errorf("%s", content)
+	}
+	return resp, nil
+}
+
+func (end *Backend) DownloadBackup(file string) (*http.Response, error) {
+	return end.Stream("GET", "/backup/download/file/"+file, nil)
+}
+
+func (end *Backend) UploadBackup(dir, filename string, body io.Reader) (backup.Entity, error) {
+	var entity backup.Entity
+	args := url.Values{}
+	args.Add("path", dir)
+	args.Add("filename", filename)
+	resp, err := end.Stream("POST", "/backup/upload?"+args.Encode(), body)
+	if err != nil {
+		return entity, err
+	}
+	defer resp.Body.Close()
+	err = json.NewDecoder(resp.Body).Decode(&entity)
+	return entity, err
+}
+
+// HoldBackup pins the backup, expires is unix seconds or RFC3339, empty means never
+func (end *Backend) HoldBackup(file, reason, owner, expires string) (backup.Entity, error) {
+	var entity backup.Entity
+	args := url.Values{}
+	args.Add("reason", reason)
+	args.Add("owner", owner)
+	args.Add("expires", expires)
+	content, err := end.RawRequest("POST", fmt.Sprintf("/backup/hold/file/%s", file), args)
+	if err != nil {
+		return entity, err
+	}
+	err = json.Unmarshal(content, &entity)
+	return entity, err
+}
+
+// LabelBackup sets the labels(key=value), removes the keys in remove, and changes the note if not nil
+func (end *Backend) LabelBackup(file string, labels, remove []string, note *string) (backup.Entity, error) {
+	var entity backup.Entity
+	args := url.Values{"labels": labels, "remove": remove}
+	if note != nil {
+		args.Set("note", *note)
+	}
+	content, err := end.RawRequest("POST", fmt.Sprintf("/backup/labels/file/%s", file), args)
+	if err != nil {
+		return entity, err
+	}
+	err = json.Unmarshal(content, &entity)
+	return entity, err
+}
+
+func (end *Backend) UnholdBackup(file string) (backup.Entity, error) {
+	var entity backup.Entity
+	content, err := end.RawRequest("POST", fmt.Sprintf("/backup/unhold/file/%s", file), nil)
+	if err != nil {
+		return entity, err
+	}
+	err = json.Unmarshal(content, &entity)
+	return entity, err
+}
+
 func (end *Backend) RawRequest(method, uri string, data url.Values) ([]byte, error) {
 	if uri[0] != '/' {
 		uri = "/" + uri
@@ -5,6 +5,11 @@ import (
 	"fmt"
 	api "github.com/laincloud/backupd/api/v1"
 	"github.com/laincloud/backupd/crond"
+	"github.com/laincloud/backupd/tasks/backup"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
 )
 
 type Controller struct {
@@ -31,12 +36,18 @@ func (c *Controller) GetBackup(proc string, volumes ...string) ([]BackupEntity,
 		return nil, err
 	}
 
+	seen := make(map[string]bool) // the backups in app layout are listed by every node
 	for _, node := range nodes {
 		tmp, err := NewBackend(fmt.Sprintf("%s:%d", node, DaemonPort), DaemonApiPrefix).GetBackup(absVolumes...)
 		if err != nil {
 			return nil, err
 		}
-		data = append(data, tmp...)
+		for _, item := range tmp {
+			if !seen[item.Name] {
+				seen[item.Name] = true
+				data = append(data, item)
+			}
+		}
 	}
 	return data, nil
 }
@@ -111,7 +122,8 @@ func (c *Controller) GetCronRecordById(id string) (crond.JobRecord, error) {
 	return ret, errors.New("record not found by id " + id)
 }
 
-func (c *Controller) IncrementBackupRecover(proc, volume string, from, to int, backupDir string, files []string) (string, error) {
+// IncrementBackupRecover recovers the files of increment backup, at selects the snapshot by time, empty means backupDir itself
+func (c *Controller) IncrementBackupRecover(proc, volume string, from, to int, backupDir string, files []string, at string) (string, error) {
 	node, err := c.let.GetNode(c.App, proc, to)
 	if err != nil {
 		return "", err
@@ -128,6 +140,7 @@ func (c *Controller) IncrementBackupRecover(proc, volume string, from, to int, b
 		"app":        c.App,
 		"instanceNo": fmt.Sprintf("%d", to),
 		"proc":       proc,
+		"at":         at,
 	}
 	backend := NewBackend(fmt.Sprintf("%s:%d", node, DaemonPort), DaemonApiPrefix)
 	id, err := backend.BackupRecoverIncrement(namespace, backupDir, volumeAbs, files, args)
@@ -137,7 +150,7 @@ func (c *Controller) IncrementBackupRecover(proc, volume string, from, to int, b
 	return id, nil
 }
 
-func (c *Controller) BackupRecover(proc, volume, file string, from int, to int) (string, error) {
+func (c *Controller) BackupRecover(proc, volume, file string, from int, to int, files []string) (string, error) {
 	node, err := c.let.GetNode(c.App, proc, to)
 	if err != nil {
 		return "", err
@@ -151,7 +164,7 @@ func (c *Controller) BackupRecover(proc, volume, file string, from int, to int)
 		volumeAbs = c.let.AbsDir(c.App, proc, to, volume)
 	}
 	backend := NewBackend(fmt.Sprintf("%s:%d", node, DaemonPort), DaemonApiPrefix)
-	id, err := backend.BackupRecover(namespace, file, volumeAbs, map[string]string{
+	id, err := backend.BackupRecover(namespace, file, volumeAbs, files, map[string]string{
 		"app":  c.App,
 		"proc": proc,
 	})
@@ -161,13 +174,13 @@ func (c *Controller) BackupRecover(proc, volume, file string, from int, to int)
 	return id, nil
 }
 
-func (c *Controller) CronOnce(id string) (string, error) {
+func (c *Controller) CronOnce(id string, args url.Values) (string, error) {
 	node, err := crond.ParseIPFromID(id)
 	if err != nil {
 		return "", err
 	}
 	backend := NewBackend(fmt.Sprintf("%s:%d", node, DaemonPort), DaemonApiPrefix)
-	rid, err := backend.CronOnce(id)
+	rid, err := backend.CronOnce(id, args)
 	if err != nil {
 		return "", err
 	}
@@ -193,6 +206,75 @@ func (c *Controller) IncrementBackupFileList(proc, dir string) ([]api.FInfo, err
 	return []api.FInfo{}, nil
 }
 
+// ArchiveFileList lists the files in dir of the full or dedup backup, from the node having the backup
+func (c *Controller) ArchiveFileList(proc, file, dir string) ([]api.FInfo, error) {
+	backend, err := c.backupBackend(proc, file)
+	if err != nil {
+		return nil, err
+	}
+	return backend.ArchiveFileList(file, dir)
+}
+
+// DownloadBackup streams the backup file from the node having it, file is a backup or <increment backup>/<path>
+func (c *Controller) DownloadBackup(proc, file string) (*http.Response, error) {
+	backend, err := c.backupBackend(proc, strings.SplitN(file, "/", 2)[0])
+	if err != nil {
+		return nil, err
+	}
+	return backend.DownloadBackup(file)
+}
+
+// UploadBackup imports the archive as a full backup of the volume in the instance
+func (c *Controller) UploadBackup(proc, volume string, instanceNo int, filename string, body io.Reader) (backup.Entity, error) {
+	node, err := c.let.GetNode(c.App, proc, instanceNo)
+	if err != nil {
+		return backup.Entity{}, err
+	}
+	backend := NewBackend(fmt.Sprintf("%s:%d", node, DaemonPort), DaemonApiPrefix)
+	return backend.UploadBackup(c.let.AbsDir(c.App, proc, instanceNo, volume), filename, body)
+}
+
+// HoldBackup pins the backup, it can not be deleted until unheld or the hold expires
+func (c *Controller) HoldBackup(proc, file, reason, owner, expires string) (backup.Entity, error) {
+	backend, err := c.backupBackend(proc, file)
+	if err != nil {
+		return backup.Entity{}, err
+	}
+	return backend.HoldBackup(file, reason, owner, expires)
+}
+
+// LabelBackup edits the labels and note of the backup
+func (c *Controller) LabelBackup(proc, file string, labels, remove []string, note *string) (backup.Entity, error) {
+	backend, err := c.backupBackend(proc, file)
+	if err != nil {
+		return backup.Entity{}, err
+	}
+	return backend.LabelBackup(file, labels, remove, note)
+}
+
+func (c *Controller) UnholdBackup(proc, file string) (backup.Entity, error) {
+	backend, err := c.backupBackend(proc, file)
+	if err != nil {
+		return backup.Entity{}, err
+	}
+	return backend.UnholdBackup(file)
+}
+
+// the backend of the node having the backup
+func (c *Controller) backupBackend(proc, file string) (*Backend, error) {
+	nodes, err := c.let.GetNodes(c.App, proc)
+	if err != nil {
+		return nil, err
+	}
+	for _, node := range nodes {
+		backend := NewBackend(fmt.Sprintf("%s:%d", node, DaemonPort), DaemonApiPrefix)
+		if _, err := backend.BackupInfo(file); err == nil {
+			return backend, nil
+		}
+	}
+	return nil, errors.New("Can not find backup file by name " + file)
+}
+
 func (c *Controller) BackupFileInfo(proc, file string) (BackupEntity, error) {
 	var (
 		ret   BackupEntity
@@ -227,11 +309,11 @@ func (c *Controller) GetCronJob(id string) (crond.Job, error) {
 	return job, nil
 }
 
-func (c *Controller) CronAction(id, action string) (string, error) {
+func (c *Controller) CronAction(id, action string, args url.Values) (string, error) {
 	node, err := crond.ParseIPFromID(id)
 	if err != nil {
 		return "", err
 	}
 	backend := NewBackend(fmt.Sprintf("%s:%d", node, DaemonPort), DaemonApiPrefix)
-	return backend.CronAction(id, action)
+	return backend.CronAction(id, action, args)
 }
@@ -156,6 +156,7 @@ func (ll *Lainlet) UpdateCronJobs() []string {
 	}
 	// update jobs from backup info
 	for nodeIp, backups := range backupDict {
+		dedup := false // the node has dedup backups, their chunks are collected by backup_gc
 		for _, item := range backups {
 			newOne := crond.Job{
 				Spec:   item.Schedule,
@@ -174,12 +175,63 @@ func (ll *Lainlet) UpdateCronJobs() []string {
 				},
 				Type: crond.TypeCron,
 			}
+			// the options are only given if set, so the ID of the jobs not using them are not changed
+			if item.Compression != "" {
+				newOne.Args["compression"] = item.Compression
+			}
+			if item.CompressionLevel != 0 {
+				newOne.Args["compressionLevel"] = item.CompressionLevel
+			}
+			if item.EncryptKey != "" {
+				newOne.Args["key"] = item.EncryptKey
+			}
+			if item.PartSize != 0 {
+				newOne.Args["partSize"] = item.PartSize
+			}
+			if len(item.Include) > 0 {
+				newOne.Args["include"] = item.Include
+			}
+			if len(item.Exclude) > 0 {
+				newOne.Args["exclude"] = item.Exclude
+			}
 			newOne.ID = newOne.GenerateID(nodeIp)
 			newJobs[nodeIp] = append(newJobs[nodeIp], newOne)
-			if item.Mode == backup.MODE_FULL {
-				expireAction[nodeIp] = append(expireAction[nodeIp], item.Dir(), item.Expire)
+			if item.Verify != "" {
+				verifyOne := crond.Job{
+					Spec:   item.Verify,
+					Action: VerifyFunc,
+					Args: map[string]interface{}{
+						"path":   item.Dir(),
+						"sample": item.VerifySample,
+					},
+					Type: crond.TypeCron,
+				}
+				verifyOne.ID = verifyOne.GenerateID(nodeIp)
+				newJobs[nodeIp] = append(newJobs[nodeIp], verifyOne)
+			}
+			if item.Drill != "" && item.DrillCheck != "" {
+				drillOne := crond.Job{
+					Spec:   item.Drill,
+					Action: DrillFunc,
+					Args: map[string]interface{}{
+						"path":       item.Dir(),
+						"app":        item.AppName,
+						"proc":       item.ProcName,
+						"volume":     item.Volume,
+						"containers": item.Containers,
+						"check":      item.DrillCheck,
+						"timeout":    item.DrillTimeout,
+					},
+					Type: crond.TypeCron,
+				}
+				drillOne.ID = drillOne.GenerateID(nodeIp)
+				newJobs[nodeIp] = append(newJobs[nodeIp], drillOne)
+			}
+			if item.Mode == backup.MODE_FULL || item.Mode == backup.MODE_DEDUP {
+				expireAction[nodeIp] = append(expireAction[nodeIp], item.Dir(), item.Retention())
+				dedup = dedup || item.Mode == backup.MODE_DEDUP
 			} else if item.Mode == backup.MODE_INCREMENT {
-				expireAction[nodeIp] = append(expireAction[nodeIp], item.Dir()+"@increment", item.Expire)
+				expireAction[nodeIp] = append(expireAction[nodeIp], item.Dir()+"@increment", item.Retention())
 			}
 		}
 		if len(expireAction[nodeIp]) > 0 {
@@ -190,6 +242,14 @@ func (ll *Lainlet) UpdateCronJobs() []string {
 				Type:   crond.TypeCron,
 			})
 		}
+		if dedup {
+			newJobs[nodeIp] = append(newJobs[nodeIp], crond.Job{
+				Spec:   GCSchedule,
+				Action: GCFunc,
+				Args:   map[string]interface{}{},
+				Type:   crond.TypeCron,
+			})
+		}
 
 		// check if changed
 		if len(ll.cronJobs[nodeIp]) != len(newJobs[nodeIp]) {
@@ -330,6 +390,18 @@ annotation in body shoule be like this:
       "volume": "/dev/registry",
       "preRun": "./backup.sh",
       "postRun": "end.sh",
+      "compression": "zstd",
+      "compressionLevel": 3,
+      "encryptKey": "2024",
+      "verify": "0 4 * * 0",
+      "verifySample": 2,
+      "drill": "0 5 * * 0",
+      "drillCheck": "mysqld --user=root --skip-networking & sleep 10 && mysqlcheck --all-databases",
+      "drillTimeout": "10m",
+      "keepDaily": 7,
+      "keepWeekly": 4,
+      "keepMonthly": 12,
+      "keepMin": 3
     }
   ]
 }
@@ -350,6 +422,28 @@ type BackupInfo struct {
 	PreRun     string   `json:"preRun"`
 	PostRun    string   `json:"postRun"`
 	Mode       string   `json:"mode"`
+
+	Compression      string `json:"compression"` // gzip(default), zstd, xz or none
+	CompressionLevel int    `json:"compressionLevel"`
+	EncryptKey       string `json:"encryptKey"` // id of the key in daemon's keyfile
+	PartSize         int    `json:"partSize"`   // upload the archive in parts of MB and resume it if failed, 0 means the default of daemon
+
+	Include []string `json:"include"` // glob patterns of the files backed up, empty means all
+	Exclude []string `json:"exclude"` // glob patterns of the files not backed up
+
+	Verify       string `json:"verify"`       // schedule of verifying the backups, empty means never
+	VerifySample int    `json:"verifySample"` // how many backups verified each time, 0 means all
+	Drill        string `json:"drill"`        // schedule of restore drill, empty means never
+	DrillCheck   string `json:"drillCheck"`   // command checks the restored data in a throwaway container
+	DrillTimeout string `json:"drillTimeout"` // timeout of the check, default 30m
+
+	// retention policy, the backups are kept if younger than expire or selected by any of the counts
+	KeepLast    int `json:"keepLast"`    // the newest n backups
+	KeepDaily   int `json:"keepDaily"`   // the newest backup of each of the last n days
+	KeepWeekly  int `json:"keepWeekly"`  // the newest backup of each of the last n weeks
+	KeepMonthly int `json:"keepMonthly"` // the newest backup of each of the last n months
+	KeepYearly  int `json:"keepYearly"`  // the newest backup of each of the last n years
+	KeepMin     int `json:"keepMin"`     // the newest n successful backups are never pruned, default 1
 }
 
 func (bi *BackupInfo) Dir() string {
@@ -361,9 +455,37 @@ func (bi *BackupInfo) ArchiveName() string {
 	return strings.Replace(v, "/", "-", -1)
 }
 
+// Retention returns the retention policy for backup_expire, see backup.ParseRetention
+func (bi *BackupInfo) Retention() string {
+	if bi.KeepLast+bi.KeepDaily+bi.KeepWeekly+bi.KeepMonthly+bi.KeepYearly+bi.KeepMin == 0 {
+		return bi.Expire
+	}
+	var fields []string
+	if bi.Expire != "" {
+		fields = append(fields, "expire="+bi.Expire)
+	}
+	for _, kv := range []struct {
+		key   string
+		count int
+	}{
+		{"last", bi.KeepLast}, {"daily", bi.KeepDaily}, {"weekly", bi.KeepWeekly},
+		{"monthly", bi.KeepMonthly}, {"yearly", bi.KeepYearly}, {"min", bi.KeepMin},
+	} {
+		if kv.count > 0 {
+			fields = append(fields, fmt.Sprintf("%s=%d", kv.key, kv.count))
+		}
+	}
+	return strings.Join(fields, ",")
+}
+
 func (bi *BackupInfo) Valid() bool {
+	if bi.Compression != "" {
+		if _, err := backup.GetCodec(bi.Compression); err != nil {
+			return false
+		}
+	}
 	return bi.ProcName != "" && bi.Volume != "" &&
-		bi.Expire != "" && bi.Schedule != ""
+		bi.Retention() != "" && bi.Schedule != ""
 }
 
 func distinct(arr []string) []string {
@@ -108,6 +108,33 @@ func Get(app string, limits ...int) ([]crond.JobRecord, error) {
 	return records, nil
 }
 
+// GetByAction returns all the records of the action in the month, the newest first
+func GetByAction(app, action string, year, month int) ([]crond.JobRecord, error) {
+	db, err := GetDB(year, month, false)
+	if err != nil {
+		if err == ErrDBNotExists {
+			return []crond.JobRecord{}, nil
+		}
+		return nil, err
+	}
+	records := make([]crond.JobRecord, 0)
+	err = db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(app))
+		if b == nil {
+			return nil
+		}
+		c := b.Cursor()
+		for k, v := c.Last(); k != nil; k, v = c.Prev() {
+			var tmp crond.JobRecord
+			if err := json.Unmarshal(v, &tmp); err == nil && tmp.Action == action {
+				records = append(records, tmp)
+			}
+		}
+		return nil
+	})
+	return records, err
+}
+
 func GetById(app, id string) (crond.JobRecord, error) {
 	var (
 		record = new(crond.JobRecord)
@@ -4,7 +4,11 @@ const (
 	VOLUME_ROOT    = "/data/lain/volumes"
 	BackupFunc     = "backup"
 	ExpireFunc     = "backup_expire"
+	VerifyFunc     = "backup_verify"
+	DrillFunc      = "backup_drill"
+	GCFunc         = "backup_gc"
 	ExpireSchedule = "* * * * *"
+	GCSchedule     = "30 3 * * *" // the unused chunks of dedup backups are collected once a day
 	NotifyURI      = "/api/v2/system/notify"
 )
 
@@ -262,10 +262,10 @@ func (cd *Crond) WrapFunc(job *Job, rid string) func() {
 		}(jr)
 
 		result, err := cd.functions[job.Action](job.Args)
+		jr.Result = result // the failed job may have result too, like the files failed
 		if err != nil {
 			panic(err)
 		}
-		jr.Result = result
 	}
 }
 
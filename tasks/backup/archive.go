@@ -0,0 +1,372 @@
+package backup
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// blocks all zero are skipped by seek when extracting, so sparse files keep sparse
+const sparseBlock = 4096
+
+// FileError is a file failed to be archived or extracted, the others go on
+type FileError struct {
+	Path  string `json:"path"`
+	Error string `json:"error"`
+}
+
+func fileError(errs []FileError, name string, err error) []FileError {
+	if perr, ok := err.(*os.PathError); ok { // do not repeat the path
+		err = fmt.Errorf("%s: %s", perr.Op, perr.Err.Error())
+	}
+	return append(errs, FileError{Path: name, Error: err.Error()})
+}
+
+type inode struct {
+	dev, ino uint64
+}
+
+// writeArchive writes dir/name into w in tar format, the files are named name/... in the archive, like `tar -C dir -cf - name`.
+// The files can not be read are skipped and returned as FileError, the ones not selected by filter are skipped silently.
+// onFile is called with every header before written if not nil, it may change the header.
+func writeArchive(w io.Writer, dir, name string, filter *Filter, onFile func(*tar.Header)) ([]FileError, error) {
+	var (
+		errs  []FileError
+		tw    = tar.NewWriter(w)
+		links = make(map[inode]string) // the first path of the hardlinked files
+	)
+	err := filepath.Walk(path.Join(dir, name), func(file string, info os.FileInfo, err error) error {
+		rel, _ := filepath.Rel(dir, file)
+		if err != nil {
+			errs = fileError(errs, rel, err)
+			if info != nil && info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if inner, _ := filepath.Rel(path.Join(dir, name), file); !filter.Match(filepath.ToSlash(inner), info.IsDir()) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if info.Mode()&os.ModeSocket != 0 { // sockets are ignored like tar
+			return nil
+		}
+
+		var link string
+		if info.Mode()&os.ModeSymlink != 0 {
+			if link, err = os.Readlink(file); err != nil {
+				errs = fileError(errs, rel, err)
+				return nil
+			}
+		}
+		hdr, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			errs = fileError(errs, rel, err)
+			return nil
+		}
+		hdr.Name = filepath.ToSlash(rel)
+		if info.IsDir() {
+			hdr.Name += "/"
+		}
+		hdr.Format = tar.FormatPAX // keep the long names and mtime in nanosecond
+
+		if stat, ok := info.Sys().(*syscall.Stat_t); ok && info.Mode().IsRegular() && stat.Nlink > 1 {
+			key := inode{uint64(stat.Dev), uint64(stat.Ino)}
+			if first, ok := links[key]; ok {
+				hdr.Typeflag, hdr.Linkname, hdr.Size = tar.TypeLink, first, 0
+				return writeHeader(tw, hdr, onFile)
+			}
+			links[key] = hdr.Name
+		}
+
+		if hdr.Typeflag != tar.TypeReg {
+			return writeHeader(tw, hdr, onFile)
+		}
+		in, err := os.Open(file)
+		if err != nil {
+			errs = fileError(errs, rel, err)
+			return nil
+		}
+		defer in.Close()
+		if err := writeHeader(tw, hdr, onFile); err != nil {
+			return err
+		}
+		// the size in header must be written, the file may be truncated or appended when reading
+		n, err := io.CopyN(tw, in, hdr.Size)
+		if err != nil && err != io.EOF {
+			if _, ok := err.(*os.PathError); !ok { // it's the writing failed
+				return err
+			}
+		}
+		if n < hdr.Size {
+			if err == nil || err == io.EOF {
+				err = fmt.Errorf("file shrank from %d to %d bytes when reading", hdr.Size, n)
+			}
+			errs = fileError(errs, rel, err)
+			if _, err := io.CopyN(tw, zeroReader{}, hdr.Size-n); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return errs, err
+	}
+	return errs, tw.Close()
+}
+
+func writeHeader(tw *tar.Writer, hdr *tar.Header, onFile func(*tar.Header)) error {
+	if onFile != nil {
+		onFile(hdr)
+	}
+	return tw.WriteHeader(hdr)
+}
+
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
+
+// extractArchive extracts the tar stream into dest, mode, ownership(only as root) and mtime are restored.
+// The files can not be created are skipped and returned as FileError.
+func extractArchive(r io.Reader, dest string) ([]FileError, error) {
+	return extractFiltered(r, dest, nil)
+}
+
+// cleanEntry returns the cleaned name of an entry or a hardlink in archive, it can not be absolute or outside of the archive
+func cleanEntry(name string) (string, error) {
+	name = path.Clean(name)
+	if path.IsAbs(name) || name == ".." || strings.HasPrefix(name, "../") {
+		return "", fmt.Errorf("unsafe path in archive")
+	}
+	return name, nil
+}
+
+// checkParents refuses the entry name in dest whose parent directories have a symlink, like GNU tar,
+// the symlinks created by the archive are never followed when extracting
+func checkParents(dest, name string) error {
+	dir := dest
+	for _, p := range strings.Split(path.Dir(name), "/") {
+		if p == "." {
+			break
+		}
+		dir = path.Join(dir, p)
+		info, err := os.Lstat(dir)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			return fmt.Errorf("%s is a symlink", strings.TrimPrefix(dir, dest+"/"))
+		}
+	}
+	return nil
+}
+
+// extractFiltered extracts the files in the tar stream that match returns true for, all files are extracted if match is nil.
+// The files are only written in dest, the entries outside of it or through a symlink are skipped as FileError.
+func extractFiltered(r io.Reader, dest string, match func(name string) bool) ([]FileError, error) {
+	var (
+		errs []FileError
+		tr   = tar.NewReader(r)
+		dirs []*tar.Header // the mtime of directories are set at last, creating files in it changes the mtime
+	)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return errs, err
+		}
+		name, err := cleanEntry(hdr.Name)
+		if err != nil {
+			errs = fileError(errs, hdr.Name, err)
+			continue
+		}
+		if match != nil && !match(name) {
+			continue
+		}
+		if err := checkParents(dest, name); err != nil {
+			errs = fileError(errs, name, err)
+			continue
+		}
+		target := path.Join(dest, name)
+		os.MkdirAll(path.Dir(target), 0755)
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if old, err := os.Lstat(target); err == nil && !old.IsDir() && name != "." {
+				os.Remove(target)
+			}
+			if err := os.MkdirAll(target, 0700); err != nil {
+				errs = fileError(errs, name, err)
+				continue
+			}
+			dirs = append(dirs, hdr)
+			continue
+		case tar.TypeReg:
+			err = extractFile(tr, target, hdr)
+		case tar.TypeSymlink:
+			os.RemoveAll(target)
+			err = os.Symlink(hdr.Linkname, target)
+		case tar.TypeLink:
+			var link string
+			if link, err = cleanEntry(hdr.Linkname); err != nil {
+				err = fmt.Errorf("unsafe link %s in archive", hdr.Linkname)
+			} else {
+				err = checkParents(dest, link)
+			}
+			if err == nil {
+				os.RemoveAll(target)
+				err = os.Link(path.Join(dest, link), target)
+			}
+		case tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+			os.RemoveAll(target)
+			err = syscall.Mknod(target, devMode(hdr), int(mkdev(hdr.Devmajor, hdr.Devminor)))
+		default:
+			err = fmt.Errorf("unsupported file type %c", hdr.Typeflag)
+		}
+		if err != nil {
+			errs = fileError(errs, name, err)
+			continue
+		}
+		if hdr.Typeflag == tar.TypeLink { // it's the same file
+			continue
+		}
+		if err := restoreAttrs(target, hdr); err != nil {
+			errs = fileError(errs, name, err)
+		}
+	}
+
+	sort.Slice(dirs, func(i, j int) bool { return dirs[i].Name > dirs[j].Name }) // children first
+	for _, hdr := range dirs {
+		name := path.Clean(hdr.Name)
+		// the directory may be replaced by a later entry
+		if info, err := os.Lstat(path.Join(dest, name)); err != nil || !info.IsDir() || checkParents(dest, name) != nil {
+			continue
+		}
+		if err := restoreAttrs(path.Join(dest, name), hdr); err != nil {
+			errs = fileError(errs, name, err)
+		}
+	}
+	return errs, nil
+}
+
+// extractFile writes the file into a temporary file besides target and renames it to target, so the old file
+// or what it links to is never written in place. The zero blocks are skipped, it keeps sparse on the filesystems support holes.
+func extractFile(r io.Reader, target string, hdr *tar.Header) error {
+	out, err := ioutil.TempFile(path.Dir(target), "."+path.Base(target)+".")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(out.Name()) // after renamed it's already gone
+	defer out.Close()
+	if err := writeSparse(r, out, hdr.Size); err != nil {
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	return os.Rename(out.Name(), target)
+}
+
+func writeSparse(r io.Reader, out *os.File, size int64) error {
+	buf := make([]byte, sparseBlock)
+	for {
+		n, err := io.ReadFull(r, buf)
+		if n > 0 {
+			if isZero(buf[:n]) {
+				if _, err := out.Seek(int64(n), io.SeekCurrent); err != nil {
+					return err
+				}
+			} else if _, err := out.Write(buf[:n]); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return out.Truncate(size) // the tailing hole
+}
+
+func isZero(b []byte) bool {
+	for _, c := range b {
+		if c != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func restoreAttrs(target string, hdr *tar.Header) error {
+	if os.Geteuid() == 0 {
+		if err := os.Lchown(target, hdr.Uid, hdr.Gid); err != nil {
+			return err
+		}
+	}
+	if hdr.Typeflag == tar.TypeSymlink { // the mode and mtime of symlink can not be changed
+		return nil
+	}
+	if err := os.Chmod(target, os.FileMode(hdr.Mode).Perm()|setBits(hdr.Mode)); err != nil {
+		return err
+	}
+	atime := hdr.AccessTime
+	if atime.IsZero() {
+		atime = time.Now()
+	}
+	return os.Chtimes(target, atime, hdr.ModTime)
+}
+
+// setuid, setgid and sticky bits in tar mode
+func setBits(mode int64) os.FileMode {
+	var ret os.FileMode
+	if mode&04000 != 0 {
+		ret |= os.ModeSetuid
+	}
+	if mode&02000 != 0 {
+		ret |= os.ModeSetgid
+	}
+	if mode&01000 != 0 {
+		ret |= os.ModeSticky
+	}
+	return ret
+}
+
+func devMode(hdr *tar.Header) uint32 {
+	mode := uint32(hdr.Mode & 07777)
+	switch hdr.Typeflag {
+	case tar.TypeChar:
+		mode |= syscall.S_IFCHR
+	case tar.TypeBlock:
+		mode |= syscall.S_IFBLK
+	case tar.TypeFifo:
+		mode |= syscall.S_IFIFO
+	}
+	return mode
+}
+
+// the device number in linux
+func mkdev(major, minor int64) uint64 {
+	return uint64(major&0xfff)<<8 | uint64(minor&0xff) | uint64(minor&^0xff)<<12 | uint64(major&^0xfff)<<32
+}
@@ -0,0 +1,179 @@
+package backup
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// create a directory with all kinds of files
+func makeTree(t *testing.T, root string) time.Time {
+	mtime := time.Now().Add(-time.Hour).Truncate(time.Second)
+	os.MkdirAll(path.Join(root, "sub"), 0750)
+	ioutil.WriteFile(path.Join(root, "sub", "file"), []byte("content"), 0640)
+	os.Link(path.Join(root, "sub", "file"), path.Join(root, "hardlink"))
+	os.Symlink("sub/file", path.Join(root, "symlink"))
+	syscall.Mkfifo(path.Join(root, "fifo"), 0600)
+
+	sparse, err := os.Create(path.Join(root, "sparse"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sparse.Seek(16<<20, io.SeekStart)
+	sparse.Write([]byte("end"))
+	sparse.Close()
+
+	for _, name := range []string{"sub/file", "sparse", "sub"} {
+		os.Chtimes(path.Join(root, name), mtime, mtime)
+	}
+	return mtime
+}
+
+func checkTree(t *testing.T, root string, mtime time.Time) {
+	if content, _ := ioutil.ReadFile(path.Join(root, "sub", "file")); string(content) != "content" {
+		t.Errorf("unexpected content %q", content)
+	}
+	info, err := os.Stat(path.Join(root, "sub", "file"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0640 || !info.ModTime().Equal(mtime) {
+		t.Errorf("mode and mtime should be kept, %v %v", info.Mode(), info.ModTime())
+	}
+	if dir, err := os.Stat(path.Join(root, "sub")); err != nil || dir.Mode().Perm() != 0750 || !dir.ModTime().Equal(mtime) {
+		t.Errorf("mode and mtime of directory should be kept, %v", err)
+	}
+	if link, err := os.Stat(path.Join(root, "hardlink")); err != nil || !os.SameFile(info, link) {
+		t.Errorf("hardlink should be kept, %v", err)
+	}
+	if link, err := os.Readlink(path.Join(root, "symlink")); err != nil || link != "sub/file" {
+		t.Errorf("symlink should be kept, %s %v", link, err)
+	}
+	if fifo, err := os.Lstat(path.Join(root, "fifo")); err != nil || fifo.Mode()&os.ModeNamedPipe == 0 {
+		t.Errorf("fifo should be kept, %v", err)
+	}
+	sparse, err := os.Stat(path.Join(root, "sparse"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sparse.Size() != 16<<20+3 {
+		t.Errorf("size of sparse file is %d", sparse.Size())
+	}
+	if blocks := sparse.Sys().(*syscall.Stat_t).Blocks; blocks*512 >= 16<<20 {
+		t.Errorf("sparse file should keep sparse, %d blocks used", blocks)
+	}
+}
+
+func TestArchive(t *testing.T) {
+	root, _ := ioutil.TempDir("", "backupd-archive")
+	defer os.RemoveAll(root)
+	mtime := makeTree(t, path.Join(root, "data"))
+
+	pr, pw := io.Pipe()
+	go func() {
+		errs, err := writeArchive(pw, root, "data", nil, nil)
+		if len(errs) > 0 {
+			t.Errorf("unexpected file errors %v", errs)
+		}
+		pw.CloseWithError(err)
+	}()
+	dest := path.Join(root, "recovering")
+	errs, err := extractArchive(pr, dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(errs) > 0 {
+		t.Errorf("unexpected file errors %v", errs)
+	}
+	checkTree(t, path.Join(dest, "data"), mtime)
+}
+
+func TestExtractUnsafePath(t *testing.T) {
+	root, _ := ioutil.TempDir("", "backupd-archive")
+	defer os.RemoveAll(root)
+
+	pr, pw := io.Pipe()
+	go func() {
+		_, err := writeArchive(pw, path.Join(root, "a", "b"), "../../escape", nil, nil)
+		pw.CloseWithError(err)
+	}()
+	os.MkdirAll(path.Join(root, "escape"), 0755)
+	errs, err := extractArchive(pr, path.Join(root, "dest"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(errs) != 1 || errs[0].Error != "unsafe path in archive" {
+		t.Errorf("path outside of dest should be refused, %v", errs)
+	}
+}
+
+func TestExtractThroughSymlink(t *testing.T) {
+	root, _ := ioutil.TempDir("", "backupd-archive")
+	defer os.RemoveAll(root)
+	outside, dest := path.Join(root, "outside"), path.Join(root, "dest")
+	os.MkdirAll(outside, 0755)
+	ioutil.WriteFile(path.Join(outside, "passwd"), []byte("root"), 0644)
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, hdr := range []*tar.Header{
+		{Name: "vol/", Typeflag: tar.TypeDir, Mode: 0755},
+		{Name: "vol/x", Typeflag: tar.TypeSymlink, Linkname: outside},
+		{Name: "vol/x/passwd", Typeflag: tar.TypeReg, Mode: 0644, Size: 4},
+		{Name: "vol/x/dir/", Typeflag: tar.TypeDir, Mode: 0777},
+		{Name: "vol/up", Typeflag: tar.TypeLink, Linkname: "../outside/passwd"},
+		{Name: "vol/via", Typeflag: tar.TypeLink, Linkname: "vol/x/passwd"},
+		{Name: "vol/y", Typeflag: tar.TypeSymlink, Linkname: path.Join(outside, "passwd")},
+		{Name: "vol/y", Typeflag: tar.TypeReg, Mode: 0644, Size: 4},
+	} {
+		tw.WriteHeader(hdr)
+		if hdr.Size > 0 {
+			tw.Write([]byte("evil"))
+		}
+	}
+	tw.Close()
+
+	errs, err := extractArchive(&buf, dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(errs) != 4 {
+		t.Errorf("the entries through symlink or outside of dest should be refused, %v", errs)
+	}
+	if data, _ := ioutil.ReadFile(path.Join(outside, "passwd")); string(data) != "root" {
+		t.Errorf("the file outside of dest should not be written, %q", data)
+	}
+	if _, err := os.Stat(path.Join(outside, "dir")); !os.IsNotExist(err) {
+		t.Errorf("no directory should be created outside of dest, %v", err)
+	}
+	if info, err := os.Lstat(path.Join(dest, "vol", "y")); err != nil || !info.Mode().IsRegular() {
+		t.Errorf("the symlink should be replaced by the file, %v", err)
+	}
+}
+
+func TestCloneDir(t *testing.T) {
+	root, _ := ioutil.TempDir("", "backupd-clone")
+	defer os.RemoveAll(root)
+	src, dest := path.Join(root, "src"), path.Join(root, "dest")
+	mtime := makeTree(t, src)
+	os.MkdirAll(path.Join(dest, "sub", "file"), 0755) // different type
+	ioutil.WriteFile(path.Join(dest, "extra"), []byte("extra"), 0644)
+
+	errs, err := cloneDir(src, dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(errs) > 0 {
+		t.Errorf("unexpected file errors %v", errs)
+	}
+	checkTree(t, dest, mtime)
+	if _, err := os.Stat(path.Join(dest, "extra")); !os.IsNotExist(err) {
+		t.Error("the file not in src should be deleted")
+	}
+}
@@ -1,15 +1,16 @@
 package backup
 
 import (
-	"bytes"
+	"archive/tar"
+	"crypto/sha256"
 	"fmt"
 	log "github.com/Sirupsen/logrus"
 	"io"
 	"io/ioutil"
 	"github.com/laincloud/backupd/crond"
 	"os"
-	"os/exec"
 	"path"
+	"sort"
 	"strings"
 	"sync"
 	"time"
@@ -22,6 +23,7 @@ const (
 
 	StateBackuping  = "backuping"
 	StateRecovering = "recovering"
+	StateDeleting   = "deleting"
 	StateFree       = "free"
 )
 
@@ -33,6 +35,7 @@ var (
 	meta          *Meta
 	namespace     string
 	bstats        *BackupStats
+	mstats        *BackupStats // the mirrors of increment backups, a snapshot is not deleted while its mirror is synced
 )
 
 func init() {
@@ -40,6 +43,9 @@ func init() {
 	bstats = &BackupStats{
 		stats: make(map[string]string),
 	}
+	mstats = &BackupStats{
+		stats: make(map[string]string),
+	}
 }
 
 type BackupStats struct {
@@ -77,7 +83,51 @@ type Storage interface {
 
 	FileInfo(name string) (os.FileInfo, error)
 
-	Rsync(src, dest string) error
+	// sync the files in the local directory src selected by filter into dest, nil filter selects all
+	Rsync(src, dest string, filter *Filter) error
+}
+
+// SpaceReporter is implemented by the storages which know how much space left
+type SpaceReporter interface {
+	// bytes available for backups
+	FreeSpace() (uint64, error)
+}
+
+// Renamer is implemented by the storages which can rename a file atomically, the meta file is replaced by renaming
+type Renamer interface {
+	// rename src to dest, dest is replaced if exists
+	Rename(src, dest string) error
+}
+
+// Creator is implemented by the storages which can create a file only if it does not exist,
+// the journal of the meta shared by the servers is written by it, so two servers never write the same version
+type Creator interface {
+	// upload reader into dest if dest does not exist, or fail with an error satisfying os.IsExist
+	Create(reader io.Reader, dest string) error
+}
+
+// Stager is implemented by the storages which commit a file uploaded into its staged name, see StagedName.
+// The staged file is seen as dest only after committed, or it's removed by aborting.
+type Stager interface {
+	// make the staged file seen as dest, dest is replaced if exists
+	Commit(staged, dest string) error
+	// remove the staged file
+	Abort(staged string) error
+}
+
+// SnapshotSyncer is implemented by the storages whose Rsync can save the files it replaces, see SnapshotSync.
+// The increment snapshots are taken by it, so the changed-files directory has exactly the versions overwritten by the sync.
+type SnapshotSyncer interface {
+	// sync like Rsync, a file in dest is copied into saveDir before it's replaced or deleted, unless saveDir already has it
+	SnapshotRsync(src, dest, saveDir string, filter *Filter) error
+}
+
+// ReplicaReporter is implemented by the storages which store a backup on several replicas
+type ReplicaReporter interface {
+	// start recording the results of the writes to the files with the prefix on each replica
+	WatchReplicas(prefix string)
+	// stop recording the prefix and return the results, "ok" if all the writes succeeded on the replica, or the first error message
+	ReplicaStatus(prefix string) map[string]string
 }
 
 // A Entity is a backup
@@ -87,11 +137,32 @@ type Entity struct {
 	Volume     string    `json:"volume"`
 	Name       string    `json:"name"`
 	Server     string    `json:"server"`
+	Namespace  string    `json:"namespace,omitempty"` // where the backup is stored in app layout, empty means the namespace of Server
 	Size       uint64    `json:"size"`
 	Created    time.Time `json:"created"`
 	workDir    string    `json:"-"`
 	Containers []string  `json:"containers"`
 	InstanceNo int       `json:"instanceNo"`
+
+	Compression      string `json:"compression,omitempty"` // codec of full backup, empty means gzip
+	CompressionLevel int    `json:"compressionLevel,omitempty"`
+	KeyID            string `json:"keyId,omitempty"`    // the key encrypted with, empty means not encrypted
+	Checksum         string `json:"checksum,omitempty"` // sha256 of the archive or snapshot, the files of increment backup are in its index
+	Parts            int    `json:"parts,omitempty"`    // the number of parts the archive is uploaded in, 0 means a single file
+	partSize         int64  // the archive is uploaded in parts of it if not 0
+
+	Include []string `json:"include,omitempty"` // patterns of the files backed up, the files not matched are not in the backup
+	Exclude []string `json:"exclude,omitempty"` // patterns of the files not backed up
+
+	Verified  *time.Time `json:"verified,omitempty"`  // the last time verified by backup_verify
+	Corrupted string     `json:"corrupted,omitempty"` // why the last verifying failed, empty if passed
+	Degraded  []string   `json:"degraded,omitempty"`  // the replicas failed to store the backup, see watchReplicas
+
+	Hold   *Hold             `json:"hold,omitempty"`   // the backup is pinned
+	Labels map[string]string `json:"labels,omitempty"` // set by users to find the backup
+	Note   string            `json:"note,omitempty"`
+
+	fileErrors []FileError // the files failed when archiving or recovering
 }
 
 func NewEntity(src, archive string, instanceNo int, containers []string, volume string, mode string) *Entity {
@@ -110,62 +181,112 @@ func NewEntity(src, archive string, instanceNo int, containers []string, volume
 		Containers: containers,
 		InstanceNo: instanceNo,
 	}
+	if layout == LayoutApp {
+		ret.Namespace = archiveNamespace(archive)
+	}
 	if mode == MODE_INCREMENT { // it is a directory, not a tar file
 		ret.Name = archive
+	} else if mode == MODE_DEDUP { // the chunks are always compressed by zstd
+		ret.Name = fmt.Sprintf("%s-%d%s", archive, now.Unix(), snapshotExt)
+	} else {
+		ret.Compression = CodecGzip
 	}
 	return ret
 }
 
-func (ent *Entity) IncrementRecover(files []string) error {
-	var (
-		fileList, tmp []string
-		err           error
-		pathBase      string = path.Join(namespace, ent.Name)
-	)
+// SetCompression sets the codec of full backup, the archive's extension is changed with it
+func (ent *Entity) SetCompression(compression string, level int) error {
+	if ent.Mode == MODE_INCREMENT || ent.Mode == MODE_DEDUP {
+		return nil
+	}
+	codec, err := GetCodec(compression)
+	if err != nil {
+		return err
+	}
+	old, _ := GetCodec(ent.Compression)
+	ent.Name = strings.TrimSuffix(ent.Name, old.Ext()) + codec.Ext()
+	ent.Compression, ent.CompressionLevel = compression, level
+	return nil
+}
+
+// the codec of the archive, it's detected by the extension if not recorded
+func (ent *Entity) codec() (Codec, error) {
+	if ent.Compression == "" {
+		return GetCodec(CodecByFile(ent.Name))
+	}
+	return GetCodec(ent.Compression)
+}
 
-	if len(files) == 1 && files[0] == "*" {
-		fileList, err = findAllFiles(pathBase, "*", driverRunning)
+// IncrementRecover recovers the files of the increment backup, "*" means all.
+// The files of a snapshot are found in the changed-files directories or the mirror, see incrementFiles.
+func (ent *Entity) IncrementRecover(files []string) error {
+	store, err := ent.storage(driverRunning)
+	if err != nil {
+		return err
+	}
+	index, locations, err := ent.incrementFiles(store, files)
+	if err != nil {
+		return err
+	}
+	// the files are downloaded and verified in a staging directory, the volume is not touched if any file is corrupted
+	stageDir := ent.Source + ".recovering"
+	if err := os.RemoveAll(stageDir); err != nil {
+		return err
+	}
+	defer os.RemoveAll(stageDir)
+	rels := make([]string, 0, len(locations))
+	for rel, file := range locations {
+		stagedFile := path.Join(stageDir, rel)
+		finfo, err := store.FileInfo(file)
 		if err != nil {
 			return err
 		}
-
-	} else {
-		for _, f := range files {
-			tmp, err = findAllFiles(pathBase, f, driverRunning)
-			if err != nil {
-				return err
-			}
-			fileList = append(fileList, tmp...)
+		mode, mtime := finfo.Mode(), finfo.ModTime()
+		entry, ok := index[rel]
+		if ok {
+			mode, mtime = entry.Mode, entry.ModTime
 		}
-	}
-	for _, file := range fileList {
-		destFile := path.Join(ent.Source, file[len(pathBase):])
-		finfo, err := driverRunning.FileInfo(file)
+		os.MkdirAll(path.Dir(stagedFile), 0755)
+		fhandle, err := os.Create(stagedFile)
 		if err != nil {
 			return err
 		}
-		os.MkdirAll(path.Dir(destFile), 0666) // create directory, ignore the errors
-		fhandle, err := os.Create(destFile)
+		h := sha256.New()
+		err = store.Download(io.MultiWriter(fhandle, h), file)
+		fhandle.Chmod(mode)
+		fhandle.Sync()
+		fhandle.Close()
 		if err != nil {
 			return err
 		}
-		if err := driverRunning.Download(fhandle, file); err != nil {
+		if ok && entry.Hash != "" && entry.Hash != hashString(h) {
+			return fmt.Errorf("Checksum of %s mismatch, the backup is corrupted", rel)
+		}
+		os.Chtimes(stagedFile, time.Now(), mtime)
+		rels = append(rels, rel)
+	}
+	for _, rel := range rels {
+		destFile := path.Join(ent.Source, rel)
+		os.MkdirAll(path.Dir(destFile), 0666) // create directory, ignore the errors
+		if err := moveFile(path.Join(stageDir, rel), destFile); err != nil {
 			return err
 		}
-		fhandle.Chmod(finfo.Mode())
-		os.Chtimes(destFile, time.Now(), finfo.ModTime())
-		fhandle.Sync()
-		fhandle.Close()
+	}
+	for rel, entry := range index { // symlinks are only in the index
+		if entry.Link != "" && selectedPath(rel, files) {
+			destFile := path.Join(ent.Source, rel)
+			os.MkdirAll(path.Dir(destFile), 0755)
+			os.Remove(destFile)
+			if err := os.Symlink(entry.Link, destFile); err != nil {
+				return err
+			}
+		}
 	}
 	return nil
 }
 
 func (ent *Entity) Recover(driver Storage, ns, file string) error {
 
-	var (
-		downloadError chan error = make(chan error)
-		output        bytes.Buffer
-	)
 	ent.workDir = path.Dir(ent.Source)
 
 	// create a recovering directory to extract the backup file
@@ -180,35 +301,21 @@ func (ent *Entity) Recover(driver Storage, ns, file string) error {
 	}
 	defer os.RemoveAll(recoverDir) // remove source.recovering/
 
-	cmd := exec.Command("tar", "-zxf", "-", "-C", recoverDir)
-	cmd.Stdout = &output
-	cmd.Stderr = &output
-	stdin, err := cmd.StdinPipe()
+	store, err := ent.storage(driver)
 	if err != nil {
-		log.Errorf("Fail to get the stdin pipe of extract command, %s", err.Error())
 		return err
 	}
-
+	pr, pw := io.Pipe() // the decompressed tar stream
 	go func() {
-		defer stdin.Close()
-		downloadError <- driver.Download(stdin, path.Join(ns, ent.Name))
+		pw.CloseWithError(ent.tarStream(store, ns, pw))
 	}()
-
-	log.Debugf("Running command %s", cmd.Args)
-	if err := cmd.Start(); err != nil {
-		log.Errorf("Fail to run recover command: %s, %s", cmd.Args, err.Error())
-		os.RemoveAll(recoverDir)
-		return err
+	ent.fileErrors, err = extractArchive(pr, recoverDir)
+	if err == nil { // the checksum is verified at the end of the stream, before the source is touched
+		_, err = io.Copy(ioutil.Discard, pr)
 	}
-
-	// same with Backup(), cmd.Wait() will close the stdin pipe, we must waiting for download action
-	if err := <-downloadError; err != nil {
-		log.Errorf("Fail to download backup file %s, %s", ent.Name, err.Error())
-		return err
-	}
-
-	if err := cmd.Wait(); err != nil {
-		log.Errorf("Command run failed, %s, \nOutput:%s", err.Error(), output.String())
+	pr.CloseWithError(err) // stop the downloading if extracting failed
+	if err != nil {
+		log.Errorf("Fail to extract backup file %s, %s", ent.Name, err.Error())
 		return err
 	}
 
@@ -219,33 +326,82 @@ func (ent *Entity) Recover(driver Storage, ns, file string) error {
 			return err
 		}
 	}
-	defer os.RemoveAll(backDir)                           // remove source.bak/
-	if err := cloneDir(ent.Source, backDir); err != nil { // copy source/* => source.bak/
+	defer os.RemoveAll(backDir) // remove source.bak/
+	// copy source/* => source.bak/, the source can not be restored if any file is not copied
+	if errs, err := cloneDir(ent.Source, backDir); err != nil || len(errs) > 0 {
+		if err == nil {
+			err = fmt.Errorf("Fail to copy %s to %s, %s: %s", ent.Source, backDir, errs[0].Path, errs[0].Error)
+		}
 		return err
 	}
-	if err := cloneDir(path.Join(recoverDir, path.Base(ent.Source)), ent.Source); err != nil {
+	// the recover fails if any file is not restored, the source is rolled back then
+	errs, err := cloneDir(path.Join(recoverDir, path.Base(ent.Source)), ent.Source)
+	ent.fileErrors = append(ent.fileErrors, errs...)
+	if err == nil && len(errs) > 0 {
+		err = fmt.Errorf("Fail to recover %d files into %s, %s: %s", len(errs), ent.Source, errs[0].Path, errs[0].Error)
+	}
+	if err != nil {
 		log.Debugf("Recover action failed, now recover %s from %s", ent.Source, backDir)
-		err = cloneDir(backDir, ent.Source) // copy source.bak/* => source/
-		if err != nil {
+		if _, rerr := cloneDir(backDir, ent.Source); rerr != nil { // copy source.bak/* => source/
 			// fail to rsync direcory, rename directly
 			// rename will cause volume disappeared in container, so container must restart
-			if err := os.Rename(backDir, ent.Source); err != nil {
+			if rerr := os.Rename(backDir, ent.Source); rerr != nil {
 				// if os.Rename failed again? God can't help you, too. check your filesystem
-				log.Errorf("Fail to rename %s to %s, %s, this is a fatal error, please check your server's filesystem", backDir, ent.Source, err.Error())
-				return err
+				log.Errorf("Fail to rename %s to %s, %s, this is a fatal error, please check your server's filesystem", backDir, ent.Source, rerr.Error())
+				return rerr
 			}
 		}
+		return err
 	}
 	return nil
 }
 
+// IncrementBackup syncs the source into the mirror and takes a snapshot named <archive>@<unix>,
+// the files of the last snapshot replaced or deleted by the sync are saved in its changed-files directory.
 func (ent *Entity) IncrementBackup() error {
-	if err := driverRunning.Rsync(ent.Source, path.Join(namespace, ent.Name)); err != nil {
+	store, err := ent.storage(driverRunning)
+	if err != nil {
+		return err
+	}
+	archive, mt := ent.mirrorName(), metaOf(ent)
+	mirror := path.Join(ent.ns(), archive)
+	// the snapshots are not deleted till synced, their changed-files directories are written by the sync
+	if err := mstats.Set(mirror, StateBackuping); err != nil {
+		return err
+	}
+	defer mstats.Free(mirror)
+	snapshots := mt.Snapshots(archive)
+	if len(snapshots) > 0 {
+		last := snapshots[len(snapshots)-1]
+		if err := SnapshotSync(store, ent.Source, mirror, path.Join(ent.ns(), last.Name), ent.filter()); err != nil {
+			log.Errorf("Fail to sync %s and save the changed files of snapshot %s, %s", ent.Source, last.Name, err.Error())
+			return err
+		}
+		if ent.Created.Unix() <= last.Created.Unix() { // the snapshots are named by seconds
+			ent.Created = time.Unix(last.Created.Unix()+1, 0)
+		}
+	} else if err := store.Rsync(ent.Source, mirror, ent.filter()); err != nil {
 		log.Errorf("Fail to rsync %s to backends, %s", ent.Source, err.Error())
 		return err
 	}
-	meta.Set(ent.Source+"@increment", []Entity{*ent})
-	if err := meta.Sync(); err != nil {
+	index, err := updateIndex(store, ent.Source, mirror, ent.filter())
+	if err != nil {
+		log.Errorf("Fail to record the checksums of %s, %s", ent.Source, err.Error())
+		return err
+	}
+	ent.Name = fmt.Sprintf("%s@%d", archive, ent.Created.Unix())
+	if err := saveIndex(store, path.Join(ent.ns(), ent.Name), index); err != nil {
+		log.Errorf("Fail to save the index of snapshot %s, %s", ent.Name, err.Error())
+		return err
+	}
+	err = mt.Commit(func(tx *MetaTx) error {
+		if legacy := tx.Get(archive); legacy != nil && legacy.Mode == MODE_INCREMENT { // the mirror before snapshots is replaced by this snapshot
+			tx.Delete(archive)
+		}
+		tx.Put(ent.Source+"@increment", *ent)
+		return nil
+	})
+	if err != nil {
 		log.Errorf("Fail to sync meta file to backends, %s", err.Error())
 		return err
 	}
@@ -254,101 +410,286 @@ func (ent *Entity) IncrementBackup() error {
 }
 
 func (ent *Entity) Backup(driver Storage) error {
+	manifest := make(map[string]IndexEntry)
+	onFile := func(hdr *tar.Header) {
+		if ent.partSize > 0 { // reading the files changes their atime, the archive must be the same to resume the parts
+			hdr.AccessTime, hdr.ChangeTime = time.Time{}, time.Time{}
+		}
+		addManifest(manifest, hdr)
+	}
+	err := ent.storeArchive(driver, manifest, func(w io.Writer) error {
+		var err error
+		ent.fileErrors, err = writeArchive(w, ent.workDir, path.Base(ent.Source), ent.filter(), onFile)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	for _, fe := range ent.fileErrors {
+		log.Warnf("File %s skipped when archiving %s, %s", fe.Path, ent.Source, fe.Error)
+	}
+	log.Debugf("Succeed the backup task for %s", ent.Source)
+	return nil
+}
+
+// storeArchive uploads the tar stream written by write as the full backup, compressed by its codec and encrypted by its key,
+// then the manifest is uploaded beside it and the backup is added into meta.
+// The archive is staged until the whole stream is uploaded, and deleted if the meta fails.
+// If the entity has a part size, the archive is uploaded in parts and continued by the next run if failed, see uploadParts.
+func (ent *Entity) storeArchive(driver Storage, manifest map[string]IndexEntry, write func(io.Writer) error) error {
 
+	var cp *checkpoint
+	if ent.partSize > 0 {
+		cp = ent.resume(driver)
+	}
 	var (
-		tarFile     string      = path.Join(ent.workDir, ent.Name)
-		uploadError chan error  = make(chan error, 1)
-		stderr      chan string = make(chan string, 1)
-		destFile    string      = path.Join(namespace, path.Base(tarFile))
+		uploadError  chan error = make(chan error, 1)
+		archiveError chan error = make(chan error, 1)
+		destFile     string     = path.Join(ent.ns(), ent.Name)
+		staged       string     = StagedName(destFile)
 	)
 
-	cmd := exec.Command("tar", "-Szcf", "-", path.Base(ent.Source))
-	cmd.Dir = ent.workDir
-	stdoutPipe, err := cmd.StdoutPipe() // stdout pipe
+	codec, err := ent.codec()
 	if err != nil {
 		return err
 	}
-	stderrPipe, err := cmd.StderrPipe() // stderr pipe
+	store, err := ent.storage(driver)
 	if err != nil {
 		return err
 	}
-
-	if err := cmd.Start(); err != nil {
-		log.Errorf("Fail to run archive command: %s, %s", cmd.Args, err.Error())
+	pr, pw := io.Pipe() // the compressed tar stream
+	compressor, err := codec.NewWriter(pw, ent.CompressionLevel)
+	if err != nil {
 		return err
 	}
 
 	go func() {
-		uploadError <- driver.Upload(stdoutPipe, destFile)
+		err := write(compressor)
+		if err == nil {
+			err = compressor.Close()
+		}
+		pw.CloseWithError(err)
+		archiveError <- err
 	}()
+	h := sha256.New()
 	go func() {
-		errOutput, err := ioutil.ReadAll(stderrPipe)
-		if err != nil {
-			log.Errorf("Fail to read stderr from command: %s, %s", cmd.Args, err.Error())
+		var err error
+		if cp != nil {
+			err = ent.uploadParts(driver, store, io.TeeReader(pr, h), cp)
+		} else {
+			err = store.Upload(io.TeeReader(pr, h), staged)
 		}
-		stderr <- string(errOutput)
+		pr.CloseWithError(err) // stop the archiving if upload failed
+		uploadError <- err
 	}()
 
-	// this must run before cmd.Wait(), Wait() will close stdoutPipe,
-	// so we must wait for upload finished,
-	// otherwise upload will get bad file descripter error because of stdoutPipe was closed by Wait()
+	abort := func() {
+		if cp == nil { // the committed parts are kept for the next run
+			abortStaged(driver, staged)
+		}
+	}
 	if err := <-uploadError; err != nil {
 		log.Errorf("Fail to upload tarball, %s", err.Error())
+		<-archiveError
+		abort()
 		return err
 	}
-
-	if err := cmd.Wait(); err != nil {
-		log.Errorf("Fail to run command %s. %s\n stderr: %s", cmd.Args, err.Error(), <-stderr)
+	if err := <-archiveError; err != nil {
+		log.Errorf("Fail to archive %s, %s", ent.Source, err.Error())
+		abort()
 		return err
 	}
-	if info, err := driver.FileInfo(destFile); err != nil {
-		ent.Size = 0
-	} else {
-		ent.Size = uint64(info.Size())
+	if cp == nil {
+		if err := CommitStaged(driver, staged, destFile); err != nil {
+			log.Errorf("Fail to commit tarball %s, %s", ent.Name, err.Error())
+			abort()
+			return err
+		}
+		if info, err := driver.FileInfo(destFile); err != nil {
+			ent.Size = 0
+		} else {
+			ent.Size = uint64(info.Size())
+		}
+	}
+	ent.Checksum = hashString(h)
+	if err := saveIndex(store, destFile, manifest); err != nil { // the archive is read through to list the files without it
+		log.Warnf("Fail to upload the manifest of %s, %s", ent.Name, err.Error())
 	}
 
 	// update meta data, and sync it onto backend storage
-	meta.Add(*ent)
-	if err := meta.Sync(); err != nil {
-		meta.Delete(ent.Name)
+	if err := metaOf(ent).Commit(func(tx *MetaTx) error { tx.Put(ent.Source, *ent); return nil }); err != nil {
+		log.Errorf("Fail to sync meta file to backends, %s", err.Error())
+		if cp != nil { // the parts are kept for the next run
+			return err
+		}
+		driver.Delete(destFile) // not a backup without meta
+		driver.Delete(indexFile(destFile))
+		return err
+	}
+	if cp != nil {
+		if err := driver.Delete(checkpointFile(ent.ns(), ent.Name)); err != nil {
+			log.Warnf("Fail to delete the checkpoint of %s, %s", ent.Name, err.Error())
+		}
 	}
-	log.Debugf("Succeed the backup task for %s", ent.Source)
 	return nil
 }
 
+// tarStream writes the tar stream of the full or dedup backup in namespace ns into w
+func (ent *Entity) tarStream(store Storage, ns string, w io.Writer) error {
+	if ent.Mode == MODE_DEDUP {
+		return ent.writeSnapshot(store, ns, w)
+	}
+	codec, err := ent.codec()
+	if err != nil {
+		return err
+	}
+	return downloadArchive(store, path.Join(ns, ent.Name), codec, ent.Checksum, w)
+}
+
+// download the archive and write the decompressed tar stream into writer,
+// an error is returned at the end if the archive does not match the checksum
+func downloadArchive(driver Storage, file string, codec Codec, checksum string, writer io.Writer) error {
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(driver.Download(pw, file))
+	}()
+	h := sha256.New()
+	raw := io.TeeReader(pr, h)
+	reader, err := codec.NewReader(raw)
+	if err != nil {
+		pr.CloseWithError(err)
+		return err
+	}
+	defer reader.Close()
+	if _, err = io.Copy(writer, reader); err == nil {
+		_, err = io.Copy(ioutil.Discard, raw) // the tailing bytes not read by codec
+	}
+	pr.CloseWithError(err) // stop the downloading if failed
+	if err == nil && checksum != "" && hashString(h) != checksum {
+		err = fmt.Errorf("Checksum of %s mismatch, the backup is corrupted", file)
+	}
+	return err
+}
+
 func Delete(name string) error {
+	var ent Entity
+	mt := meta
+	if tmp, found := findBackup(name); tmp != nil {
+		ent, mt = *tmp, found
+	}
+	if ent.Hold.active(time.Now()) {
+		return fmt.Errorf("Backup %s is %s", name, ent.Hold.String())
+	}
+	// the backup job of the source may be reading or writing the backups
+	if ent.Source != "" {
+		if err := bstats.Set(ent.Source, StateDeleting); err != nil {
+			return fmt.Errorf("Fail to delete backup %s, %s", name, err.Error())
+		}
+		defer bstats.Free(ent.Source)
+	}
+	only := false
+	if ent.isSnapshot() { // the files in its changed-files directory may be needed by the previous snapshot
+		mirror := path.Join(ent.ns(), ent.mirrorName())
+		if err := mstats.Set(mirror, StateDeleting); err != nil {
+			return fmt.Errorf("Fail to delete snapshot %s, %s", name, err.Error())
+		}
+		defer mstats.Free(mirror)
+		var err error
+		if only, err = mergeSnapshot(&ent); err != nil {
+			log.Errorf("Fail to merge snapshot %s, %s", name, err.Error())
+			return err
+		}
+	}
 	// update meta
-	meta.Delete(name)
-	if err := meta.Sync(); err != nil {
+	if err := mt.Commit(func(tx *MetaTx) error { tx.Delete(name); return nil }); err != nil {
 		return err
 	}
 	log.Infof("Deleting %s", name)
-	if err := driverRunning.Delete(path.Join(namespace, name)); err != nil {
+	if err := driverRunning.Delete(path.Join(ent.ns(), name)); err != nil && !(ent.isSnapshot() && os.IsNotExist(err)) {
 		log.Errorf("Fail to delete backup file in backend:%s", err.Error())
 		// not return error, this is a idempotent action
 		// we think it's not exist as long as it not exist in meta, no matter it's existence in backend
 	}
+	if ent.Mode != MODE_DEDUP {
+		driverRunning.Delete(indexFile(path.Join(ent.ns(), name))) // the manifest of full backup, or the index of increment backup
+	}
+	if only { // no snapshot uses the mirror any more
+		driverRunning.Delete(path.Join(ent.ns(), ent.mirrorName()))
+		driverRunning.Delete(indexFile(path.Join(ent.ns(), ent.mirrorName())))
+	}
 	return nil
 }
 
 func List(dir ...string) ([]Entity, error) {
 	log.Infof("Getting backup list for %v", dir)
-	return meta.Array(dir...), nil
+	return listBackups(dir...), nil
 }
 
 func Info(name string) (Entity, error) {
-	data := meta.Array()
-	for _, item := range data {
-		if item.Name == name {
-			return item, nil
+	mts := metas()
+	for _, mt := range mts {
+		if ent := mt.Get(name); ent != nil {
+			return *ent, nil
+		}
+	}
+	for _, mt := range mts {
+		if ent := mt.Snapshot(name, time.Now()); ent != nil { // the increment backup by archive name
+			return *ent, nil
 		}
 	}
 	return Entity{}, fmt.Errorf("backup named %s not found", name)
 }
 
+// updateEntity changes the backup named name by fn and syncs the meta
+func updateEntity(name string, fn func(*Entity) error) (Entity, error) {
+	var ret Entity
+	mt := meta
+	if _, found := findBackup(name); found != nil {
+		mt = found
+	}
+	err := mt.Commit(func(tx *MetaTx) error {
+		ent := tx.Get(name)
+		if ent == nil {
+			return fmt.Errorf("backup named %s not found", name)
+		}
+		if err := fn(ent); err != nil {
+			return err
+		}
+		tx.Update(*ent)
+		ret = *ent
+		return nil
+	})
+	return ret, err
+}
+
 func FileList(name string) ([]os.FileInfo, error) {
 	log.Infof("Getting file list of %s", name)
-	flist, err := driverRunning.List(path.Join(namespace, name))
+	parts := strings.SplitN(strings.Trim(path.Clean("/"+name), "/"), "/", 2)
+	ent, _ := findBackup(parts[0])
+	if ent != nil && ent.isSnapshot() { // the files of snapshot are listed by its index
+		index, err := LoadIndex(driverRunning, path.Join(ent.ns(), ent.Name))
+		if err != nil {
+			return nil, err
+		}
+		dir := ""
+		if len(parts) > 1 {
+			dir = parts[1]
+		}
+		entries, err := listIndexDir(index, ent.Name, dir)
+		if err != nil {
+			return nil, err
+		}
+		flist := make([]os.FileInfo, len(entries))
+		for i := range entries {
+			flist[i] = &indexInfo{entries[i]}
+		}
+		return flist, nil
+	}
+	ns := namespace
+	if ent != nil {
+		ns = ent.ns()
+	}
+	flist, err := driverRunning.List(path.Join(ns, name))
 	if err != nil {
 		// do not return the full name of path
 		if e, ok := err.(*os.PathError); ok {
@@ -360,9 +701,46 @@ func FileList(name string) ([]os.FileInfo, error) {
 	return flist, nil
 }
 
+// FreeSpace returns the free space of the running storage driver
+func FreeSpace() (uint64, error) {
+	reporter, ok := driverRunning.(SpaceReporter)
+	if !ok {
+		return 0, fmt.Errorf("backup driver %s can not report free space", driverRunning.Name())
+	}
+	return reporter.FreeSpace()
+}
+
+// watchReplicas records the results on each replica of the writes of the entity's backup, with its parts and manifest,
+// or the mirror and snapshots of the increment backup. The returned function stops it and returns the results,
+// nil if the running storage driver is not replicated.
+func watchReplicas(ent *Entity) func() map[string]string {
+	reporter, ok := driverRunning.(ReplicaReporter)
+	if !ok {
+		return func() map[string]string { return nil }
+	}
+	prefix := path.Join(ent.ns(), ent.Name)
+	if ent.Mode == MODE_INCREMENT {
+		prefix = path.Join(ent.ns(), ent.mirrorName())
+	}
+	reporter.WatchReplicas(prefix)
+	return func() map[string]string { return reporter.ReplicaStatus(prefix) }
+}
+
+// degradedReplicas returns the replicas failed in the results of watchReplicas
+func degradedReplicas(replicas map[string]string) []string {
+	var ret []string
+	for name, status := range replicas {
+		if status != "ok" {
+			ret = append(ret, name)
+		}
+	}
+	sort.Strings(ret)
+	return ret
+}
+
 // release the backup
 func Release() {
-	// meta.Sync() will use lock, so we must get the lock before stop
+	// meta.Commit() will use lock, so we must get the lock before stop
 	stopLock.Lock()
 	defer stopLock.Unlock()
 }
@@ -379,13 +757,22 @@ func Register(driver Storage) {
 	drivers[name] = driver
 }
 
+// GetDriver returns the registered storage driver by name
+func GetDriver(name string) (Storage, bool) {
+	driver, ok := drivers[name]
+	return driver, ok
+}
+
 // backup task initialize
 func Init(localip, driver string) {
 	ip = localip
 	namespace = ip
 	crond.Register("backup", backup)
 	crond.Register("backup_expire", expire)
+	crond.Register("backup_gc", collect)
 	crond.Register("backup_recover", backup_recover)
+	crond.Register("backup_verify", verify)
+	crond.Register("backup_drill", drill)
 
 	if driverRunning == nil {
 		ok, name := false, driver
@@ -399,4 +786,9 @@ func Init(localip, driver string) {
 	if err := meta.LoadFromBackend(); err != nil {
 		log.Warnf("Fail to load meta data: %s", err.Error())
 	}
+	var err error
+	if appIndex, err = OpenIndex(driverRunning); err != nil {
+		log.Warnf("Fail to load the index of app layout: %s", err.Error())
+	}
+	go sweep(driverRunning, meta, appIndex, time.Now())
 }
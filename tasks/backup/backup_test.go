@@ -1,14 +1,14 @@
 package backup
 
 import (
-	"errors"
 	"fmt"
+	"github.com/laincloud/backupd/crond"
 	"github.com/stretchr/testify/assert"
 	"io"
 	"io/ioutil"
 	"os"
-	"os/exec"
 	"path"
+	"strings"
 	"testing"
 )
 
@@ -84,13 +84,8 @@ func (driver *LocalDriver) FileInfo(name string) (os.FileInfo, error) {
 	return os.Stat(file)
 }
 
-func (driver *LocalDriver) Rsync(src, dest string) error {
-	src, dest = path.Join(src, "*"), path.Join(rootDir, dest)
-	cmd := exec.Command("/bin/bash", "-c", fmt.Sprintf("rsync -az --safe-links %s %s", src, dest))
-	if output, err := cmd.CombinedOutput(); err != nil {
-		return errors.New(err.Error() + ", Output:" + string(output))
-	}
-	return nil
+func (driver *LocalDriver) Rsync(src, dest string, filter *Filter) error {
+	return IncrementSync(driver, src, dest, filter)
 }
 
 func copyFile(src string, dest string) error {
@@ -126,7 +121,7 @@ func copyFile(src string, dest string) error {
 func init() {
 	os.Setenv("BACKUPD_BACKUP_DRIVER", "local")
 	os.Setenv("BACKUPD_IP", "192.168.77.10")
-	namespace = config.Get().IP
+	namespace = os.Getenv("BACKUPD_IP")
 	Register(&LocalDriver{})
 
 	if err := os.MkdirAll(rootDir, 0666); err != nil {
@@ -137,7 +132,7 @@ func init() {
 }
 
 func TestNewEntity(t *testing.T) {
-	Init()
+	Init(namespace, "local")
 	testEntity = NewEntity(testDir, "etc-bak", 0, []string{}, testDir, MODE_FULL)
 }
 
@@ -147,16 +142,16 @@ func ExampleDurationParser() {
 	}
 
 	for _, item := range testItems {
-		tm, err := durationParser(item)
+		tm, err := DurationParser(item)
 		if err != nil {
 			panic(err)
 		}
 		fmt.Println(tm)
 	}
-	if _, err := durationParser("234a"); err != nil {
+	if _, err := DurationParser("234a"); err != nil {
 		fmt.Println("error")
 	}
-	if _, err := durationParser("23aa"); err != nil {
+	if _, err := DurationParser("23aa"); err != nil {
 		fmt.Println("error")
 	}
 	// Output:
@@ -197,7 +192,7 @@ func TestRecover(t *testing.T) {
 	}
 	f := ""
 	for _, item := range his {
-		if item.Name() != ".meta" {
+		if meta.Get(item.Name()) != nil {
 			f = item.Name()
 			break
 		}
@@ -250,8 +245,13 @@ func TestIncrementBackupFilelist(t *testing.T) {
 
 func TestIncremenRecover(t *testing.T) {
 	testEntity.Source = "/data/etc-increment"
-	checkList := []string{"sudo.conf", "fstab", "filesystems", "ssh/ssh_config"}
-	if err := testEntity.IncrementRecover([]string{"sudo.conf", "fstab", "filesystems", "ssh"}); err != nil {
+	var checkList, files []string // only the ones of this system are recovered
+	for _, item := range []string{"sudo.conf", "fstab", "filesystems", "ssh/ssh_config"} {
+		if fileExist(testDir + "/" + item) {
+			checkList, files = append(checkList, item), append(files, strings.Split(item, "/")[0])
+		}
+	}
+	if err := testEntity.IncrementRecover(files); err != nil {
 		t.Error(err)
 	}
 	for _, item := range checkList {
@@ -266,3 +266,55 @@ func TestRelease(t *testing.T) {
 	os.RemoveAll(fullRecoverDir)
 	os.RemoveAll(incrementRecoverDir)
 }
+
+// replicaDriver reports a failed replica for the writes into the watched prefix
+type replicaDriver struct {
+	*dirDriver
+	watched []string
+	writes  map[string]int
+}
+
+func (d *replicaDriver) Upload(reader io.Reader, dest string) error {
+	for _, prefix := range d.watched {
+		if strings.HasPrefix(dest, prefix) {
+			d.writes[prefix]++
+		}
+	}
+	return d.dirDriver.Upload(reader, dest)
+}
+
+func (d *replicaDriver) WatchReplicas(prefix string) {
+	d.watched = append(d.watched, prefix)
+}
+
+func (d *replicaDriver) ReplicaStatus(prefix string) map[string]string {
+	if d.writes[prefix] == 0 {
+		return map[string]string{}
+	}
+	return map[string]string{"primary": "ok", "secondary": "storage broken"}
+}
+
+func TestReplicaStatus(t *testing.T) {
+	root, _ := ioutil.TempDir("", "backupd-replica")
+	defer os.RemoveAll(root)
+	src := path.Join(root, "etc")
+	os.MkdirAll(src, 0755)
+	ioutil.WriteFile(path.Join(src, "issue"), []byte("hello"), 0644)
+	replicated := &replicaDriver{dirDriver: &dirDriver{root: path.Join(root, "store")}, writes: make(map[string]int)}
+	saved, savedMeta := driverRunning, meta
+	driverRunning, meta = replicated, NewMeta(replicated, namespace)
+	defer func() { driverRunning, meta = saved, savedMeta }()
+
+	// the writes of the increment backup are into its mirror and snapshots
+	result, err := backup(crond.FuncArg{"path": src, "archive": "etc-inc", "mode": MODE_INCREMENT})
+	if err != nil {
+		t.Fatal(err)
+	}
+	name := result["file"].(string)
+	if replicas, _ := result["replicas"].(map[string]string); replicas["secondary"] == "" {
+		t.Errorf("the replica status of increment backup should be reported, %v", result)
+	}
+	if ent := meta.Get(name); ent == nil || len(ent.Degraded) != 1 || ent.Degraded[0] != "secondary" {
+		t.Errorf("the backup should be marked degraded, %+v", ent)
+	}
+}
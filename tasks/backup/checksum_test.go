@@ -0,0 +1,179 @@
+package backup
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"testing"
+	"time"
+)
+
+// rsyncDriver syncs the increment backups like the drivers with a native rsync, no index is written.
+// after runs when synced, like a file written again before the checksums are recorded.
+type rsyncDriver struct {
+	dirDriver
+	after func()
+}
+
+func (d *rsyncDriver) Rsync(src, dest string, filter *Filter) error {
+	_, err := cloneDir(src, path.Join(d.root, dest))
+	if d.after != nil {
+		d.after()
+	}
+	return err
+}
+
+// flip a byte in the middle of the stored file
+func corrupt(t *testing.T, file string) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[len(data)/2] ^= 0xff
+	ioutil.WriteFile(file, data, 0644)
+}
+
+func TestFullBackupChecksum(t *testing.T) {
+	root, _ := ioutil.TempDir("", "backupd-checksum")
+	defer os.RemoveAll(root)
+	driver := &dirDriver{root: path.Join(root, "store")}
+	meta = NewMeta(driver, namespace)
+	src := path.Join(root, "data")
+	os.MkdirAll(src, 0755)
+	ioutil.WriteFile(path.Join(src, "file"), bytes.Repeat([]byte("content "), 1024), 0644)
+
+	for _, mode := range []string{MODE_FULL, MODE_DEDUP} {
+		ent := NewEntity(src, "app-data-"+mode, 0, nil, "/data", mode)
+		ent.SetCompression(CodecNone, LevelDefault)
+		var err error
+		if mode == MODE_DEDUP {
+			err = ent.DedupBackup(driver)
+		} else {
+			err = ent.Backup(driver)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if saved := meta.Get(ent.Name); saved == nil || len(saved.Checksum) != 64 {
+			t.Fatalf("checksum should be recorded in meta, %+v", saved)
+		}
+		if err := ent.Recover(driver, namespace, ent.Name); err != nil {
+			t.Fatalf("%s backup should be recovered, %v", mode, err)
+		}
+
+		ioutil.WriteFile(path.Join(src, "live"), []byte("live"), 0644)
+		corrupt(t, path.Join(driver.root, namespace, ent.Name))
+		if err := ent.Recover(driver, namespace, ent.Name); err == nil {
+			t.Errorf("corrupted %s backup should not be recovered", mode)
+		}
+		if !fileExist(path.Join(src, "live")) {
+			t.Errorf("volume should not be touched if %s backup is corrupted", mode)
+		}
+		os.Remove(path.Join(src, "live"))
+	}
+}
+
+func TestIncrementChecksum(t *testing.T) {
+	root, _ := ioutil.TempDir("", "backupd-checksum")
+	defer os.RemoveAll(root)
+	src := path.Join(root, "data")
+	os.MkdirAll(path.Join(src, "sub"), 0755)
+	ioutil.WriteFile(path.Join(src, "sub", "file"), []byte("content"), 0644)
+	ioutil.WriteFile(path.Join(src, "other"), []byte("other"), 0644)
+
+	synced := &dirDriver{root: path.Join(root, "store")}
+	rsynced := &rsyncDriver{dirDriver: dirDriver{root: path.Join(root, "rsync")}}
+	for driver, store := range map[Storage]string{synced: synced.root, rsynced: rsynced.root} {
+		driverRunning = driver
+		meta = NewMeta(driver, namespace)
+		ent := NewEntity(src, "app-data", 0, nil, "/data", MODE_INCREMENT)
+		if err := ent.IncrementBackup(); err != nil {
+			t.Fatal(err)
+		}
+		index, _ := LoadIndex(driver, path.Join(namespace, ent.Name))
+		if entry := index["sub/file"]; entry.Hash == "" {
+			t.Errorf("checksum should be recorded by %T", driver)
+		}
+
+		ioutil.WriteFile(path.Join(src, "other"), []byte("changed"), 0644)
+		if err := ent.IncrementRecover([]string{"*"}); err != nil {
+			t.Fatal(err)
+		}
+		if content, _ := ioutil.ReadFile(path.Join(src, "other")); string(content) != "other" {
+			t.Errorf("file should be recovered, %q", content)
+		}
+
+		ioutil.WriteFile(path.Join(src, "other"), []byte("changed"), 0644)
+		corrupt(t, path.Join(store, namespace, ent.mirrorName(), "sub", "file"))
+		if err := ent.IncrementRecover([]string{"*"}); err == nil {
+			t.Errorf("corrupted file should fail the recover by %T", driver)
+		}
+		if content, _ := ioutil.ReadFile(path.Join(src, "other")); string(content) != "changed" {
+			t.Errorf("volume should not be touched if any file is corrupted, %q", content)
+		}
+		ioutil.WriteFile(path.Join(src, "other"), []byte("other"), 0644)
+	}
+}
+
+func TestIncrementChecksumWrittenAfterSync(t *testing.T) {
+	root, _ := ioutil.TempDir("", "backupd-checksum")
+	defer os.RemoveAll(root)
+	src := path.Join(root, "data")
+	os.MkdirAll(src, 0755)
+	ioutil.WriteFile(path.Join(src, "file"), []byte("synced"), 0644)
+
+	driver := &rsyncDriver{dirDriver: dirDriver{root: path.Join(root, "rsync")}}
+	driver.after = func() {
+		ioutil.WriteFile(path.Join(src, "file"), []byte("written"), 0644)
+		later := time.Now().Add(time.Hour)
+		os.Chtimes(path.Join(src, "file"), later, later)
+	}
+	driverRunning = driver
+	meta = NewMeta(driver, namespace)
+	ent := NewEntity(src, "app-data", 0, nil, "/data", MODE_INCREMENT)
+	if err := ent.IncrementBackup(); err != nil {
+		t.Fatal(err)
+	}
+	// the checksum is of the stored copy, the recover is not refused as corrupted
+	if err := ent.IncrementRecover([]string{"*"}); err != nil {
+		t.Fatal(err)
+	}
+	if content, _ := ioutil.ReadFile(path.Join(src, "file")); string(content) != "synced" {
+		t.Errorf("the stored copy should be recovered, %q", content)
+	}
+}
+
+func TestRecoverRollback(t *testing.T) {
+	root, _ := ioutil.TempDir("", "backupd-rollback")
+	defer os.RemoveAll(root)
+	driver := &dirDriver{root: path.Join(root, "store")}
+	meta = NewMeta(driver, namespace)
+	src := path.Join(root, "data")
+	os.MkdirAll(src, 0755)
+	ioutil.WriteFile(path.Join(src, "a"), []byte("old a"), 0644)
+	ioutil.WriteFile(path.Join(src, "b"), []byte("old b"), 0644)
+
+	ent := NewEntity(src, "app-data-rollback", 0, nil, "/data", MODE_FULL)
+	if err := ent.Backup(driver); err != nil {
+		t.Fatal(err)
+	}
+	ioutil.WriteFile(path.Join(src, "a"), []byte("new a"), 0644)
+	ioutil.WriteFile(path.Join(src, "b"), []byte("new b"), 0644)
+	// b can not be written even by root
+	if err := exec.Command("chattr", "+i", path.Join(src, "b")).Run(); err != nil {
+		t.Skip("chattr is not supported, ", err)
+	}
+	defer exec.Command("chattr", "-i", path.Join(src, "b")).Run()
+
+	if err := ent.Recover(driver, namespace, ent.Name); err == nil {
+		t.Fatal("recover should fail if a file can not be restored")
+	}
+	if len(ent.fileErrors) == 0 || path.Base(ent.fileErrors[0].Path) != "b" {
+		t.Errorf("the failed file should be reported, %+v", ent.fileErrors)
+	}
+	if data, _ := ioutil.ReadFile(path.Join(src, "a")); string(data) != "new a" {
+		t.Errorf("the restored files should be rolled back, got %q", data)
+	}
+}
@@ -0,0 +1,140 @@
+package backup
+
+import (
+	"compress/gzip"
+	"fmt"
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+	"io"
+	"io/ioutil"
+	"strings"
+)
+
+const (
+	CodecGzip = "gzip"
+	CodecZstd = "zstd"
+	CodecXz   = "xz"
+	CodecNone = "none"
+
+	// LevelDefault means the codec's default level
+	LevelDefault = 0
+)
+
+// A Codec compresses the tar stream of full backups
+type Codec interface {
+	// the file extension of archives, like .tar.gz
+	Ext() string
+
+	NewWriter(w io.Writer, level int) (io.WriteCloser, error)
+
+	NewReader(r io.Reader) (io.ReadCloser, error)
+}
+
+var codecs = map[string]Codec{
+	CodecGzip: gzipCodec{},
+	CodecZstd: zstdCodec{},
+	CodecXz:   xzCodec{},
+	CodecNone: noneCodec{},
+}
+
+// GetCodec returns the codec by name, the backups created before compression supported are gzip
+func GetCodec(name string) (Codec, error) {
+	if name == "" {
+		name = CodecGzip
+	}
+	codec, ok := codecs[name]
+	if !ok {
+		return nil, fmt.Errorf("Unknown compression %s", name)
+	}
+	return codec, nil
+}
+
+// CodecByFile detects the codec from the archive's extension
+func CodecByFile(file string) string {
+	for name, codec := range codecs {
+		if name != CodecNone && strings.HasSuffix(file, codec.Ext()) {
+			return name
+		}
+	}
+	return CodecNone
+}
+
+type gzipCodec struct{}
+
+func (gzipCodec) Ext() string { return ".tar.gz" }
+
+// level is 1-9
+func (gzipCodec) NewWriter(w io.Writer, level int) (io.WriteCloser, error) {
+	if level == LevelDefault {
+		level = gzip.DefaultCompression
+	}
+	return gzip.NewWriterLevel(w, level)
+}
+
+func (gzipCodec) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return gzip.NewReader(r)
+}
+
+type zstdCodec struct{}
+
+func (zstdCodec) Ext() string { return ".tar.zst" }
+
+// level is 1-22 like the zstd command, all cpus are used
+func (zstdCodec) NewWriter(w io.Writer, level int) (io.WriteCloser, error) {
+	if level == LevelDefault {
+		level = 3
+	}
+	return zstd.NewWriter(w, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(level)))
+}
+
+func (zstdCodec) NewReader(r io.Reader) (io.ReadCloser, error) {
+	decoder, err := zstd.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	return decoder.IOReadCloser(), nil
+}
+
+type xzCodec struct{}
+
+func (xzCodec) Ext() string { return ".tar.xz" }
+
+// dictionary size of the xz presets
+var xzDictCap = []int{256 << 10, 1 << 20, 2 << 20, 4 << 20, 4 << 20, 8 << 20, 8 << 20, 16 << 20, 32 << 20, 64 << 20}
+
+// level is 1-9 like the xz command, only the dictionary size is changed by level
+func (xzCodec) NewWriter(w io.Writer, level int) (io.WriteCloser, error) {
+	if level == LevelDefault {
+		level = 6
+	}
+	if level < 1 || level >= len(xzDictCap) {
+		return nil, fmt.Errorf("Unvalid xz compression level %d", level)
+	}
+	return xz.WriterConfig{DictCap: xzDictCap[level]}.NewWriter(w)
+}
+
+func (xzCodec) NewReader(r io.Reader) (io.ReadCloser, error) {
+	reader, err := xz.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.NopCloser(reader), nil
+}
+
+type noneCodec struct{}
+
+func (noneCodec) Ext() string { return ".tar" }
+
+func (noneCodec) NewWriter(w io.Writer, level int) (io.WriteCloser, error) {
+	return nopWriteCloser{w}, nil
+}
+
+func (noneCodec) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return ioutil.NopCloser(r), nil
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
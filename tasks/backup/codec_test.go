@@ -0,0 +1,92 @@
+package backup
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestCodecs(t *testing.T) {
+	data := []byte(strings.Repeat("lain backup ", 10000))
+	for name, codec := range codecs {
+		for _, level := range []int{LevelDefault, 1, 9} {
+			var buf bytes.Buffer
+			w, err := codec.NewWriter(&buf, level)
+			if err != nil {
+				t.Fatalf("%s level %d: %s", name, level, err)
+			}
+			w.Write(data)
+			if err := w.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if name != CodecNone && buf.Len() >= len(data) {
+				t.Errorf("%s does not compress the data", name)
+			}
+			r, err := codec.NewReader(&buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if out, err := ioutil.ReadAll(r); err != nil || !bytes.Equal(out, data) {
+				t.Errorf("%s level %d: decompressed data is different, %v", name, level, err)
+			}
+			r.Close()
+		}
+		if CodecByFile("app-web-1-data-1500000000"+codec.Ext()) != name {
+			t.Errorf("codec of %s not detected", codec.Ext())
+		}
+	}
+	if _, err := GetCodec("lz4"); err == nil {
+		t.Error("lz4 is not supported")
+	}
+	if _, err := (xzCodec{}).NewWriter(ioutil.Discard, 10); err == nil {
+		t.Error("xz level 10 should fail")
+	}
+}
+
+func TestCompressedBackup(t *testing.T) {
+	root, _ := ioutil.TempDir("", "backupd-codec")
+	defer os.RemoveAll(root)
+	driver := &dirDriver{root: path.Join(root, "store")}
+	src := path.Join(root, "data")
+	os.MkdirAll(src, 0755)
+	ioutil.WriteFile(path.Join(src, "file"), []byte("content"), 0644)
+	meta = NewMeta(driver, namespace)
+
+	ent := NewEntity(src, "app-data", 0, nil, "/data", MODE_FULL)
+	if !strings.HasSuffix(ent.Name, ".tar.gz") {
+		t.Errorf("gzip is the default codec, got %s", ent.Name)
+	}
+	if err := ent.SetCompression(CodecZstd, 19); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasSuffix(ent.Name, ".tar.zst") {
+		t.Errorf("archive of zstd should be .tar.zst, got %s", ent.Name)
+	}
+	if err := ent.Backup(driver); err != nil {
+		t.Fatal(err)
+	}
+	if saved := meta.Get(ent.Name); saved == nil || saved.Compression != CodecZstd || saved.CompressionLevel != 19 {
+		t.Errorf("compression should be recorded in meta, %+v", saved)
+	}
+
+	var out bytes.Buffer
+	cmd := exec.Command("tar", "-tf", "-")
+	cmd.Stdout = &out
+	stdin, _ := cmd.StdinPipe()
+	cmd.Start()
+	codec, _ := ent.codec()
+	if err := downloadArchive(driver, path.Join(namespace, ent.Name), codec, ent.Checksum, stdin); err != nil {
+		t.Fatal(err)
+	}
+	stdin.Close()
+	if err := cmd.Wait(); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "data/file") {
+		t.Errorf("unexpected archive content %q", out.String())
+	}
+}
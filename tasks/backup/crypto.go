@@ -0,0 +1,267 @@
+package backup
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+const (
+	cryptMagic     = "LAINBKE1" // version 1 of the encrypted stream
+	cryptSaltSize  = 32
+	cryptChunkSize = 64 << 10
+	cryptKeySize   = 32 // AES-256
+)
+
+var (
+	keys = make(map[string][]byte) // encryption keys by id
+
+	errCryptFormat = errors.New("not an encrypted backup stream")
+	errCryptAuth   = errors.New("encrypted backup stream is corrupted or truncated")
+)
+
+// LoadKeys loads the encryption keys from the keyfile, each line is `<key id> <base64 of 32 bytes key>`,
+// empty lines and the lines begin with # are ignored.
+func LoadKeys(file string) error {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	loaded := make(map[string][]byte)
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return fmt.Errorf("Unvalid key at line %d of %s", i+1, file)
+		}
+		key, err := base64.StdEncoding.DecodeString(fields[1])
+		if err != nil || len(key) != cryptKeySize {
+			return fmt.Errorf("Key %s in %s must be %d bytes in base64", fields[0], file, cryptKeySize)
+		}
+		if _, ok := loaded[fields[0]]; ok {
+			return fmt.Errorf("Duplicated key %s in %s", fields[0], file)
+		}
+		loaded[fields[0]] = key
+	}
+	keys = loaded
+	return nil
+}
+
+// a new stream key is derived from the master key and a random salt for every stream,
+// so the nonces of different streams never collide
+func streamAEAD(key, salt []byte) (cipher.AEAD, error) {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(salt)
+	block, err := aes.NewCipher(mac.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// nonce is the chunk counter, the last byte marks the final chunk to detect truncation
+func chunkNonce(counter uint64, final bool) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce[3:11], counter)
+	if final {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+// encrypter encrypts the stream in chunks with AES-256-GCM, the stream is
+//
+//	magic | salt | chunk 0 | chunk 1 | ... | final chunk
+//
+// every chunk is cryptChunkSize bytes plaintext with a 16 bytes tag, except the final one
+type encrypter struct {
+	w       io.Writer
+	aead    cipher.AEAD
+	buf     []byte
+	counter uint64
+}
+
+func newEncrypter(w io.Writer, key []byte) (io.WriteCloser, error) {
+	salt := make([]byte, cryptSaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	aead, err := streamAEAD(key, salt)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(append([]byte(cryptMagic), salt...)); err != nil {
+		return nil, err
+	}
+	return &encrypter{w: w, aead: aead, buf: make([]byte, 0, cryptChunkSize)}, nil
+}
+
+func (e *encrypter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		if len(e.buf) == cryptChunkSize { // the chunk is full and there are more data, it's not the final one
+			if err := e.flush(false); err != nil {
+				return written, err
+			}
+		}
+		n := copy(e.buf[len(e.buf):cryptChunkSize], p)
+		e.buf = e.buf[:len(e.buf)+n]
+		p = p[n:]
+		written += n
+	}
+	return written, nil
+}
+
+func (e *encrypter) flush(final bool) error {
+	sealed := e.aead.Seal(nil, chunkNonce(e.counter, final), e.buf, nil)
+	e.counter++
+	e.buf = e.buf[:0]
+	_, err := e.w.Write(sealed)
+	return err
+}
+
+// Close writes the final chunk, it does not close the underlying writer
+func (e *encrypter) Close() error {
+	return e.flush(true)
+}
+
+type decrypter struct {
+	r       *bufio.Reader
+	aead    cipher.AEAD
+	chunk   []byte
+	plain   []byte
+	counter uint64
+	done    bool
+}
+
+func newDecrypter(r io.Reader, key []byte) (io.Reader, error) {
+	header := make([]byte, len(cryptMagic)+cryptSaltSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil, errCryptFormat
+		}
+		return nil, err
+	}
+	if !bytes.Equal(header[:len(cryptMagic)], []byte(cryptMagic)) {
+		return nil, errCryptFormat
+	}
+	aead, err := streamAEAD(key, header[len(cryptMagic):])
+	if err != nil {
+		return nil, err
+	}
+	return &decrypter{
+		r:     bufio.NewReaderSize(r, cryptChunkSize),
+		aead:  aead,
+		chunk: make([]byte, cryptChunkSize+aead.Overhead()),
+	}, nil
+}
+
+func (d *decrypter) Read(p []byte) (int, error) {
+	for len(d.plain) == 0 {
+		if d.done {
+			return 0, io.EOF
+		}
+		if err := d.next(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, d.plain)
+	d.plain = d.plain[n:]
+	return n, nil
+}
+
+func (d *decrypter) next() error {
+	n, err := io.ReadFull(d.r, d.chunk)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return err
+	}
+	final := n < len(d.chunk)
+	if !final { // a full chunk is the final one only if nothing follows
+		if _, err := d.r.Peek(1); err == io.EOF {
+			final = true
+		} else if err != nil {
+			return err
+		}
+	}
+	plain, err := d.aead.Open(d.chunk[:0], chunkNonce(d.counter, final), d.chunk[:n], nil)
+	if err != nil {
+		return errCryptAuth
+	}
+	d.counter++
+	d.plain, d.done = plain, final
+	return nil
+}
+
+// cryptStorage encrypts the files uploaded and decrypts the files downloaded,
+// the files are incremental synced by IncrementSync, the native rsync can not encrypt.
+type cryptStorage struct {
+	Storage
+	key []byte
+}
+
+func (s *cryptStorage) Upload(reader io.Reader, dest string) error {
+	pr, pw := io.Pipe()
+	go func() {
+		enc, err := newEncrypter(pw, s.key)
+		if err == nil {
+			if _, err = io.Copy(enc, reader); err == nil {
+				err = enc.Close()
+			}
+		}
+		pw.CloseWithError(err)
+	}()
+	err := s.Storage.Upload(pr, dest)
+	pr.CloseWithError(err) // stop the encrypting if upload failed
+	return err
+}
+
+func (s *cryptStorage) Download(writer io.Writer, src string) error {
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(s.Storage.Download(pw, src))
+	}()
+	dec, err := newDecrypter(pr, s.key)
+	if err == nil {
+		_, err = io.Copy(writer, dec)
+	}
+	pr.CloseWithError(err) // stop the downloading if decrypting failed
+	if err == errCryptFormat || err == errCryptAuth {
+		return &os.PathError{Op: "decrypt", Path: src, Err: err}
+	}
+	return err
+}
+
+func (s *cryptStorage) Rsync(src, dest string, filter *Filter) error {
+	return IncrementSync(s, src, dest, filter)
+}
+
+// the storage used by the entity, files are encrypted if it has a key, and the archive is reassembled if it's in parts
+func (ent *Entity) storage(driver Storage) (Storage, error) {
+	store := driver
+	if ent.KeyID != "" {
+		key, ok := keys[ent.KeyID]
+		if !ok {
+			return nil, fmt.Errorf("Unknown encryption key %s, check the keyfile of daemon", ent.KeyID)
+		}
+		store = &cryptStorage{Storage: driver, key: key}
+	}
+	if ent.Parts > 0 {
+		store = &partStorage{Storage: store, name: ent.Name, parts: ent.Parts}
+	}
+	return store, nil
+}
@@ -0,0 +1,148 @@
+package backup
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func encrypt(t *testing.T, data, key []byte) []byte {
+	var buf bytes.Buffer
+	enc, err := newEncrypter(&buf, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	enc.Write(data)
+	if err := enc.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func decrypt(data, key []byte) ([]byte, error) {
+	dec, err := newDecrypter(bytes.NewReader(data), key)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(dec)
+}
+
+func TestEncryptStream(t *testing.T) {
+	key := make([]byte, cryptKeySize)
+	rand.Read(key)
+	for _, size := range []int{0, 1, cryptChunkSize - 1, cryptChunkSize, cryptChunkSize + 1, 3 * cryptChunkSize} {
+		data := make([]byte, size)
+		rand.Read(data)
+		sealed := encrypt(t, data, key)
+		if bytes.Contains(sealed, data) && size > 16 { // a few bytes may appear in the random output
+			t.Errorf("size %d: data is not encrypted", size)
+		}
+		plain, err := decrypt(sealed, key)
+		if err != nil {
+			t.Fatalf("size %d: %s", size, err)
+		}
+		if !bytes.Equal(plain, data) {
+			t.Errorf("size %d: decrypted data is different", size)
+		}
+	}
+
+	data := make([]byte, 2*cryptChunkSize+100)
+	sealed := encrypt(t, data, key)
+	other := make([]byte, cryptKeySize)
+	if _, err := decrypt(sealed, other); err != errCryptAuth {
+		t.Errorf("decrypt with wrong key should fail, %v", err)
+	}
+	tampered := append([]byte{}, sealed...)
+	tampered[len(tampered)/2] ^= 1
+	if _, err := decrypt(tampered, key); err != errCryptAuth {
+		t.Errorf("tampered stream should fail, %v", err)
+	}
+	// drop the final chunk
+	truncated := sealed[:len(cryptMagic)+cryptSaltSize+2*(cryptChunkSize+16)]
+	if _, err := decrypt(truncated, key); err != errCryptAuth {
+		t.Errorf("truncated stream should fail, %v", err)
+	}
+	if _, err := decrypt([]byte("plain tar stream, not encrypted at all........"), key); err != errCryptFormat {
+		t.Errorf("unencrypted stream should be detected, %v", err)
+	}
+}
+
+func TestLoadKeys(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "backupd-keys")
+	defer os.RemoveAll(dir)
+	file := path.Join(dir, "keyfile")
+
+	ioutil.WriteFile(file, []byte("# backup keys\n2023 MDEyMzQ1Njc4OTAxMjM0NTY3ODkwMTIzNDU2Nzg5MDE=\n\n"+
+		"2024 YWJjZGVmZ2hpamtsbW5vcHFyc3R1dnd4eXphYmNkZWY=\n"), 0600)
+	if err := LoadKeys(file); err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 2 || string(keys["2024"]) != "abcdefghijklmnopqrstuvwxyzabcdef" {
+		t.Errorf("unexpected keys %v", keys)
+	}
+
+	ioutil.WriteFile(file, []byte("short c2hvcnQ=\n"), 0600)
+	if err := LoadKeys(file); err == nil || !strings.Contains(err.Error(), "32 bytes") {
+		t.Errorf("short key should be refused, %v", err)
+	}
+	if len(keys) != 2 {
+		t.Error("keys should not be changed if keyfile is unvalid")
+	}
+}
+
+func TestEncryptedBackup(t *testing.T) {
+	root, _ := ioutil.TempDir("", "backupd-crypto")
+	defer os.RemoveAll(root)
+	driver := &dirDriver{root: path.Join(root, "store")}
+	keys = map[string][]byte{"2024": []byte("abcdefghijklmnopqrstuvwxyzabcdef")}
+	meta = NewMeta(driver, namespace)
+	src := path.Join(root, "data")
+	os.MkdirAll(src, 0755)
+	ioutil.WriteFile(path.Join(src, "secret"), []byte("top secret content"), 0644)
+
+	// full backup
+	ent := NewEntity(src, "app-data", 0, nil, "/data", MODE_FULL)
+	ent.SetCompression(CodecNone, LevelDefault)
+	ent.KeyID = "2024"
+	if err := ent.Backup(driver); err != nil {
+		t.Fatal(err)
+	}
+	stored, _ := ioutil.ReadFile(path.Join(driver.root, namespace, ent.Name))
+	if len(stored) == 0 || bytes.Contains(stored, []byte("top secret")) {
+		t.Error("archive should be encrypted")
+	}
+	store, _ := ent.storage(driver)
+	var buf bytes.Buffer
+	if err := store.Download(&buf, path.Join(namespace, ent.Name)); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(buf.Bytes(), []byte("top secret")) {
+		t.Error("archive should be decrypted with the key")
+	}
+
+	// increment backup
+	inc := NewEntity(src, "app-data-inc", 0, nil, "/data", MODE_INCREMENT)
+	inc.KeyID = "2024"
+	driverRunning = driver
+	if err := inc.IncrementBackup(); err != nil {
+		t.Fatal(err)
+	}
+	secret := path.Join(namespace, inc.mirrorName(), "secret")
+	if stored, _ := ioutil.ReadFile(path.Join(driver.root, secret)); len(stored) == 0 || bytes.Contains(stored, []byte("top secret")) {
+		t.Error("increment files should be encrypted")
+	}
+	store, _ = inc.storage(driver)
+	buf.Reset()
+	if err := store.Download(&buf, secret); err != nil || buf.String() != "top secret content" {
+		t.Errorf("increment file should be decrypted, %q %v", buf.String(), err)
+	}
+
+	ent.KeyID = "rotated"
+	if _, err := ent.storage(driver); err == nil {
+		t.Error("unknown key should fail")
+	}
+}
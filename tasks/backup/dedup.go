@@ -0,0 +1,509 @@
+package backup
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/klauspost/compress/zstd"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	MODE_DEDUP = "dedup"
+
+	snapshotExt = ".snapshot"
+	chunksDir   = ".chunks" // the chunks of all the dedup backups in the namespace
+
+	// the boundaries of chunks are decided by the content, so an insert only changes the chunks around it
+	chunkMin  = 256 << 10
+	chunkMax  = 8 << 20
+	chunkMask = uint64(1<<20-1) << 44 // 1MiB in average
+)
+
+var (
+	pins       = &chunkPins{refs: make(map[string]int)}
+	chunkGrace = 24 * time.Hour // the chunks newer than it are not collected, they may be used by the backups running on other servers
+	gear       [256]uint64
+
+	chunkEncoder, _ = zstd.NewWriter(nil)
+	chunkDecoder, _ = zstd.NewReader(nil)
+)
+
+func init() {
+	for i := range gear {
+		sum := sha256.Sum256([]byte{byte(i)})
+		gear[i] = binary.BigEndian.Uint64(sum[:8])
+	}
+}
+
+// chunkPins keeps the chunks used by the running dedup backups and migrations from being collected, see collectChunks.
+// A chunk is pinned before it's checked to be stored, and unpinned after its snapshot is in meta,
+// or at the end of the running collection, which may not see the snapshot.
+type chunkPins struct {
+	lock       sync.Mutex
+	refs       map[string]int // key is the chunk file
+	collecting bool
+	generation int      // increased by each collection, the chunks listed in an older generation may be deleted
+	released   []string // unpinned when the collection ends
+}
+
+func (p *chunkPins) pin(file string) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.refs[file]++
+}
+
+func (p *chunkPins) unpin(files []string) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.collecting {
+		p.released = append(p.released, files...)
+		return
+	}
+	p.release(files)
+}
+
+func (p *chunkPins) release(files []string) {
+	for _, file := range files {
+		if p.refs[file]--; p.refs[file] <= 0 {
+			delete(p.refs, file)
+		}
+	}
+}
+
+func (p *chunkPins) current() int {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.generation
+}
+
+// start begins a collection, false if another one is running
+func (p *chunkPins) start() bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.collecting {
+		return false
+	}
+	p.collecting = true
+	p.generation++
+	return true
+}
+
+func (p *chunkPins) end() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.collecting = false
+	p.release(p.released)
+	p.released = nil
+}
+
+// remove deletes the chunk file if it's not pinned, the pinning waits till it's deleted
+func (p *chunkPins) remove(driver Storage, file string) (bool, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.refs[file] > 0 {
+		return false, nil
+	}
+	if err := driver.Delete(file); err != nil && !os.IsNotExist(err) {
+		return false, err
+	}
+	return true, nil
+}
+
+// Snapshot is the manifest of a dedup backup, the files are in the archiving order
+type Snapshot struct {
+	Size  int64          `json:"size"` // bytes of the regular files
+	Files []SnapshotFile `json:"files"`
+}
+
+type SnapshotFile struct {
+	Header tar.Header `json:"header"`
+	Chunks []string   `json:"chunks,omitempty"` // sha256 of the chunks of regular file
+}
+
+// chunker splits the stream by a gear rolling hash
+type chunker struct {
+	r   *bufio.Reader
+	buf []byte
+}
+
+func newChunker() *chunker {
+	return &chunker{r: bufio.NewReaderSize(nil, 1<<20), buf: make([]byte, 0, chunkMax)}
+}
+
+// reset starts to split r, the buffers are reused
+func (c *chunker) reset(r io.Reader) {
+	c.r.Reset(r)
+}
+
+// next returns the next chunk, it's only valid until the next call
+func (c *chunker) next() ([]byte, error) {
+	var h uint64
+	c.buf = c.buf[:0]
+	for len(c.buf) < chunkMax {
+		b, err := c.r.ReadByte()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		c.buf = append(c.buf, b)
+		h = h<<1 + gear[b]
+		if len(c.buf) >= chunkMin && h&chunkMask == 0 {
+			break
+		}
+	}
+	if len(c.buf) == 0 {
+		return nil, io.EOF
+	}
+	return c.buf, nil
+}
+
+// the chunks are stored separately for each key, a chunk can only be shared by the snapshots encrypted with the same key.
+// ref of a chunk is like key-<key id>/ab/ab12..., or plain/ab/ab12... if not encrypted, it's the path in chunksDir.
+func (ent *Entity) chunkRef(hash string) string {
+	return path.Join(ent.chunkDir(), hash[:2], hash)
+}
+
+func (ent *Entity) chunkDir() string {
+	if ent.KeyID != "" {
+		return "key-" + ent.KeyID
+	}
+	return "plain"
+}
+
+func chunkFile(ns, ref string) string {
+	return path.Join(ns, chunksDir, ref)
+}
+
+// listChunks returns the chunks stored in namespace ns, key is the ref
+func listChunks(driver Storage, ns string) (map[string]os.FileInfo, error) {
+	ret := make(map[string]os.FileInfo)
+	dirs, err := driver.List(path.Join(ns, chunksDir))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return ret, nil
+		}
+		return nil, err
+	}
+	for _, keyDir := range dirs {
+		prefixes, err := driver.List(path.Join(ns, chunksDir, keyDir.Name()))
+		if err != nil {
+			return nil, err
+		}
+		for _, prefix := range prefixes {
+			files, err := driver.List(path.Join(ns, chunksDir, keyDir.Name(), prefix.Name()))
+			if err != nil {
+				return nil, err
+			}
+			for _, f := range files {
+				ret[path.Join(keyDir.Name(), prefix.Name(), f.Name())] = f
+			}
+		}
+	}
+	return ret, nil
+}
+
+// the chunks are compressed by zstd, and encrypted by the store if the backup has a key
+func uploadChunk(store Storage, ns, ref string, data []byte) (int, error) {
+	compressed := chunkEncoder.EncodeAll(data, nil)
+	return len(compressed), store.Upload(bytes.NewReader(compressed), chunkFile(ns, ref))
+}
+
+func downloadChunk(store Storage, ns, ref string, writer io.Writer) error {
+	var buf bytes.Buffer
+	if err := store.Download(&buf, chunkFile(ns, ref)); err != nil {
+		return err
+	}
+	data, err := chunkDecoder.DecodeAll(buf.Bytes(), nil)
+	if err != nil {
+		return err
+	}
+	if sum := sha256.Sum256(data); hex.EncodeToString(sum[:]) != path.Base(ref) {
+		return fmt.Errorf("Chunk %s is corrupted", ref)
+	}
+	_, err = writer.Write(data)
+	return err
+}
+
+// storeChunks reads the tar stream and uploads the chunks not stored, stored is the chunks listed in the generation of pins.
+// It returns the snapshot, the chunks it refers to, which are pinned, and the chunks uploaded with their stored size.
+func (ent *Entity) storeChunks(store Storage, r io.Reader, stored map[string]os.FileInfo, generation int) (*Snapshot, []string, []string, uint64, error) {
+	var (
+		snap     = &Snapshot{}
+		seen     = make(map[string]bool)
+		used     []string
+		added    []string
+		uploaded uint64
+		tr       = tar.NewReader(r)
+		c        = newChunker()
+	)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, used, added, uploaded, err
+		}
+		file := SnapshotFile{Header: *hdr}
+		file.Header.PAXRecords, file.Header.Format = nil, tar.FormatPAX
+		if hdr.Typeflag == tar.TypeReg {
+			snap.Size += hdr.Size
+			c.reset(tr)
+			for {
+				data, err := c.next()
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					return nil, used, added, uploaded, err
+				}
+				sum := sha256.Sum256(data)
+				hash := hex.EncodeToString(sum[:])
+				file.Chunks = append(file.Chunks, hash)
+				ref := ent.chunkRef(hash)
+				if seen[ref] {
+					continue
+				}
+				seen[ref] = true
+				pins.pin(chunkFile(ent.ns(), ref))
+				used = append(used, ref)
+				_, listed := stored[ref]
+				if ok, err := chunkStored(store, chunkFile(ent.ns(), ref), listed, generation); err != nil {
+					return nil, used, added, uploaded, err
+				} else if ok { // stored by other snapshots
+					continue
+				}
+				n, err := uploadChunk(store, ent.ns(), ref, data)
+				if err != nil {
+					return nil, used, added, uploaded, err
+				}
+				added = append(added, ref)
+				uploaded += uint64(n)
+			}
+		}
+		snap.Files = append(snap.Files, file)
+	}
+	return snap, used, added, uploaded, nil
+}
+
+// chunkStored checks whether the pinned chunk file is stored, the listing is trusted if no collection started since it's listed
+func chunkStored(store Storage, file string, listed bool, generation int) (bool, error) {
+	if generation == pins.current() {
+		return listed, nil
+	}
+	if _, err := store.FileInfo(file); err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// uploadSnapshot returns the size and sha256 of the stored snapshot
+func uploadSnapshot(store Storage, file string, snap *Snapshot) (int, string, error) {
+	data, err := json.Marshal(snap)
+	if err != nil {
+		return 0, "", err
+	}
+	compressed := chunkEncoder.EncodeAll(data, nil)
+	sum := sha256.Sum256(compressed)
+	return len(compressed), hex.EncodeToString(sum[:]), store.Upload(bytes.NewReader(compressed), file)
+}
+
+// loadSnapshot downloads the snapshot, it's verified if the checksum is not empty
+func loadSnapshot(store Storage, file, checksum string) (*Snapshot, error) {
+	var buf bytes.Buffer
+	if err := store.Download(&buf, file); err != nil {
+		return nil, err
+	}
+	if sum := sha256.Sum256(buf.Bytes()); checksum != "" && hex.EncodeToString(sum[:]) != checksum {
+		return nil, fmt.Errorf("Checksum of %s mismatch, the backup is corrupted", file)
+	}
+	data, err := chunkDecoder.DecodeAll(buf.Bytes(), nil)
+	if err != nil {
+		return nil, err
+	}
+	var snap Snapshot
+	if err := json.Unmarshal(data, &snap); err != nil {
+		return nil, err
+	}
+	return &snap, nil
+}
+
+// writeSnapshot reassembles the snapshot into a tar stream, the snapshot and chunks are in namespace ns
+func (ent *Entity) writeSnapshot(store Storage, ns string, w io.Writer) error {
+	snap, err := loadSnapshot(store, path.Join(ns, ent.Name), ent.Checksum)
+	if err != nil {
+		return err
+	}
+	tw := tar.NewWriter(w)
+	for i := range snap.Files {
+		if err := tw.WriteHeader(&snap.Files[i].Header); err != nil {
+			return err
+		}
+		for _, hash := range snap.Files[i].Chunks {
+			if err := downloadChunk(store, ns, ent.chunkRef(hash), tw); err != nil {
+				return err
+			}
+		}
+	}
+	return tw.Close()
+}
+
+// DedupBackup splits the files into chunks, only the chunks never stored in the namespace are uploaded.
+// The snapshot is named as the entity, the size of entity is the bytes newly stored.
+func (ent *Entity) DedupBackup(driver Storage) error {
+	var (
+		archiveError chan error = make(chan error, 1)
+		ns           string     = ent.ns()
+		destFile     string     = path.Join(ns, ent.Name)
+	)
+	store, err := ent.storage(driver)
+	if err != nil {
+		return err
+	}
+
+	// the chunks are pinned till the snapshot is in meta, the ones left by a failure are collected later
+	generation := pins.current()
+	stored, err := listChunks(driver, ns)
+	if err != nil {
+		log.Errorf("Fail to list the stored chunks, %s", err.Error())
+		return err
+	}
+	var used []string
+	defer func() {
+		files := make([]string, len(used))
+		for i, ref := range used {
+			files[i] = chunkFile(ns, ref)
+		}
+		pins.unpin(files)
+	}()
+
+	pr, pw := io.Pipe() // the tar stream
+	go func() {
+		var err error
+		ent.fileErrors, err = writeArchive(pw, ent.workDir, path.Base(ent.Source), ent.filter(), nil)
+		pw.CloseWithError(err)
+		archiveError <- err
+	}()
+	snap, used, added, uploaded, err := ent.storeChunks(store, pr, stored, generation)
+	pr.CloseWithError(err) // stop the archiving if failed
+	if archiveErr := <-archiveError; err == nil {
+		err = archiveErr
+	}
+	if err != nil {
+		log.Errorf("Fail to store the chunks of %s, %s", ent.Source, err.Error())
+		return err
+	}
+	for _, fe := range ent.fileErrors {
+		log.Warnf("File %s skipped when archiving %s, %s", fe.Path, ent.Source, fe.Error)
+	}
+
+	staged := StagedName(destFile)
+	n, checksum, err := uploadSnapshot(store, staged, snap)
+	if err == nil {
+		err = CommitStaged(driver, staged, destFile)
+	}
+	if err != nil {
+		log.Errorf("Fail to upload snapshot %s, %s", ent.Name, err.Error())
+		abortStaged(driver, staged)
+		return err
+	}
+	ent.Size, ent.Checksum = uploaded+uint64(n), checksum
+	log.Debugf("%d of %d chunks uploaded for %s", len(added), len(used), ent.Source)
+
+	if err := metaOf(ent).Commit(func(tx *MetaTx) error { tx.Put(ent.Source, *ent); return nil }); err != nil {
+		log.Errorf("Fail to sync meta file to backends, %s", err.Error())
+		driver.Delete(destFile) // not a backup without meta, its chunks are collected
+		return err
+	}
+	log.Debugf("Succeed the dedup backup task for %s", ent.Source)
+	return nil
+}
+
+// usedChunks returns the chunks in namespace ns referred by the dedup backups in meta,
+// and the key directories whose snapshots can not be read without the key, their chunks are all seen used
+func usedChunks(driver Storage, ns string) (map[string]bool, map[string]bool, error) {
+	used, unknown := make(map[string]bool), make(map[string]bool)
+	mts := []*Meta{meta}
+	if appIndex != nil {
+		if err := appIndex.Refresh(); err != nil { // the snapshots of the other servers must be seen
+			return nil, nil, err
+		}
+		mts = append(mts, appIndex)
+	}
+	for _, mt := range mts {
+		for _, ent := range mt.Array() {
+			if ent.Mode != MODE_DEDUP || ent.ns() != ns {
+				continue
+			}
+			store, err := ent.storage(driver)
+			if err != nil {
+				unknown[ent.chunkDir()] = true
+				continue
+			}
+			snap, err := loadSnapshot(store, path.Join(ns, ent.Name), "")
+			if err != nil {
+				if os.IsNotExist(err) {
+					continue
+				}
+				return nil, nil, fmt.Errorf("Fail to load snapshot %s, %s", ent.Name, err.Error())
+			}
+			for _, file := range snap.Files {
+				for _, hash := range file.Chunks {
+					used[ent.chunkRef(hash)] = true
+				}
+			}
+		}
+	}
+	return used, unknown, nil
+}
+
+// errCollecting is returned by collectChunks if another collection is running
+var errCollecting = errors.New("chunks are being collected")
+
+// collectChunks deletes the chunks in namespace ns not referred by any snapshot in meta, they are left by the deletes and failed backups.
+// The chunks pinned or newer than chunkGrace are kept. It fails with errCollecting if another collection is running.
+func collectChunks(ns string) (int, error) {
+	if !pins.start() {
+		return 0, errCollecting
+	}
+	defer pins.end()
+	stored, err := listChunks(driverRunning, ns)
+	if err != nil || len(stored) == 0 {
+		return 0, err
+	}
+	used, unknown, err := usedChunks(driverRunning, ns)
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for ref, info := range stored {
+		if used[ref] || unknown[strings.SplitN(ref, "/", 2)[0]] || time.Since(info.ModTime()) < chunkGrace {
+			continue
+		}
+		deleted, err := pins.remove(driverRunning, chunkFile(ns, ref))
+		if err != nil {
+			log.Warnf("Fail to delete chunk %s, %s", ref, err.Error())
+		} else if deleted {
+			n++
+		}
+	}
+	return n, nil
+}
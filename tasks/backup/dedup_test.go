@@ -0,0 +1,167 @@
+package backup
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func split(t *testing.T, data []byte) map[[sha256.Size]byte]bool {
+	ret := make(map[[sha256.Size]byte]bool)
+	c := newChunker()
+	c.reset(bytes.NewReader(data))
+	total := 0
+	for {
+		chunk, err := c.next()
+		if err != nil {
+			break
+		}
+		if len(chunk) > chunkMax {
+			t.Errorf("chunk of %d bytes is too large", len(chunk))
+		}
+		total += len(chunk)
+		ret[sha256.Sum256(chunk)] = true
+	}
+	if total != len(data) {
+		t.Errorf("%d bytes chunked, expect %d", total, len(data))
+	}
+	return ret
+}
+
+func TestChunker(t *testing.T) {
+	data := make([]byte, 16<<20)
+	rand.New(rand.NewSource(1)).Read(data)
+	before := split(t, data)
+	if len(before) < 4 {
+		t.Errorf("16MiB should be split into several chunks, got %d", len(before))
+	}
+
+	// insert some bytes in the middle, only the chunks around it change
+	changed := append(append(append([]byte{}, data[:8<<20]...), []byte("inserted")...), data[8<<20:]...)
+	after := split(t, changed)
+	shared := 0
+	for sum := range after {
+		if before[sum] {
+			shared++
+		}
+	}
+	if shared < len(before)-2 {
+		t.Errorf("only %d of %d chunks shared after inserting", shared, len(before))
+	}
+}
+
+func countChunks(t *testing.T, root string) int {
+	n := 0
+	prefixes, _ := ioutil.ReadDir(path.Join(root, namespace, chunksDir, "plain"))
+	for _, prefix := range prefixes {
+		files, _ := ioutil.ReadDir(path.Join(root, namespace, chunksDir, "plain", prefix.Name()))
+		n += len(files)
+	}
+	return n
+}
+
+func TestDedupBackup(t *testing.T) {
+	root, _ := ioutil.TempDir("", "backupd-dedup")
+	defer os.RemoveAll(root)
+	driver := &dirDriver{root: path.Join(root, "store")}
+	driverRunning = driver
+	meta = NewMeta(driver, namespace)
+	src := path.Join(root, "data")
+	mtime := makeTree(t, src)
+	big := make([]byte, 4<<20)
+	rand.New(rand.NewSource(2)).Read(big)
+	ioutil.WriteFile(path.Join(src, "big"), big, 0644)
+
+	first := NewEntity(src, "app-data", 0, nil, "/data", MODE_DEDUP)
+	if err := first.DedupBackup(driver); err != nil {
+		t.Fatal(err)
+	}
+	chunks := countChunks(t, driver.root)
+	if chunks == 0 {
+		t.Fatal("chunks should be stored")
+	}
+
+	// nothing changed, only the snapshot is uploaded
+	second := NewEntity(src, "app-data", 0, nil, "/data", MODE_DEDUP)
+	second.Name = "app-data-second" + snapshotExt
+	if err := second.DedupBackup(driver); err != nil {
+		t.Fatal(err)
+	}
+	if countChunks(t, driver.root) != chunks || second.Size >= 1<<20 {
+		t.Errorf("unchanged data should not be uploaded again, %d bytes stored", second.Size)
+	}
+	if len(pins.refs) != 0 {
+		t.Errorf("the chunks should be unpinned after backup, %v", pins.refs)
+	}
+
+	// restore the snapshot into another directory
+	restored := NewEntity(path.Join(root, "restore", "data"), "", 0, nil, "", MODE_DEDUP)
+	restored.Name = second.Name
+	os.MkdirAll(restored.Source, 0755)
+	if err := restored.Recover(driver, namespace, restored.Name); err != nil {
+		t.Fatal(err)
+	}
+	checkTree(t, restored.Source, mtime)
+	if content, _ := ioutil.ReadFile(path.Join(restored.Source, "big")); !bytes.Equal(content, big) {
+		t.Error("the big file is not restored")
+	}
+
+	// the chunks are collected after the last snapshot refers to them is deleted
+	defer func(grace time.Duration) { chunkGrace = grace }(chunkGrace)
+	chunkGrace = 0
+	if err := Delete(first.Name); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := collectChunks(namespace); err != nil || n != 0 || countChunks(t, driver.root) != chunks {
+		t.Errorf("chunks still referred should be kept, %d %v", n, err)
+	}
+	if err := Delete(second.Name); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := collectChunks(namespace); err != nil || n != chunks || countChunks(t, driver.root) != 0 {
+		t.Errorf("%d chunks left after all snapshots deleted, %v", countChunks(t, driver.root), err)
+	}
+}
+
+func TestCollectChunks(t *testing.T) {
+	root, _ := ioutil.TempDir("", "backupd-collect")
+	defer os.RemoveAll(root)
+	driver := &dirDriver{root: path.Join(root, "store")}
+	driverRunning = driver
+	meta = NewMeta(driver, namespace)
+	orphan := path.Join(driver.root, namespace, chunksDir, "plain", "ab", "ab12")
+	os.MkdirAll(path.Dir(orphan), 0755)
+	ioutil.WriteFile(orphan, []byte("orphan"), 0644)
+
+	// the new chunks may be used by the backups running on other servers
+	if n, err := collectChunks(namespace); err != nil || n != 0 || !fileExist(orphan) {
+		t.Errorf("new chunk should be kept, %d %v", n, err)
+	}
+	defer func(grace time.Duration) { chunkGrace = grace }(chunkGrace)
+	chunkGrace = 0
+
+	// the chunks pinned by running backups are kept
+	file := chunkFile(namespace, "plain/ab/ab12")
+	pins.pin(file)
+	if n, err := collectChunks(namespace); err != nil || n != 0 || !fileExist(orphan) {
+		t.Errorf("pinned chunk should be kept, %d %v", n, err)
+	}
+	// a chunk unpinned while collecting is kept till the collection ends
+	pins.start()
+	pins.unpin([]string{file})
+	if _, err := collectChunks(namespace); err != errCollecting {
+		t.Errorf("collection should be skipped while another one is running, %v", err)
+	}
+	if pins.refs[file] != 1 {
+		t.Error("chunk should be pinned till the collection ends")
+	}
+	pins.end()
+	if n, err := collectChunks(namespace); err != nil || n != 1 || fileExist(orphan) {
+		t.Errorf("orphan chunk should be collected, %d %v", n, err)
+	}
+}
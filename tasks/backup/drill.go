@@ -0,0 +1,94 @@
+package backup
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"time"
+)
+
+const drillOutputLimit = 64 << 10 // the tail of the check's output kept in the result
+
+// drillRunner runs the check command of restore drill, it's replaced in tests
+var drillRunner = dockerDrill
+
+// latestBackup returns the newest backup of src, the ones marked corrupted by backup_verify are skipped
+func latestBackup(src string) (*Entity, error) {
+	var ret *Entity
+	for _, item := range listBackups(src) {
+		if item.Corrupted != "" {
+			continue
+		}
+		if ret == nil || item.Created.After(ret.Created) {
+			tmp := item
+			ret = &tmp
+		}
+	}
+	if ret == nil {
+		return nil, fmt.Errorf("No backup of %s to restore", src)
+	}
+	return ret, nil
+}
+
+// restoreTo restores the backup into dir without touching the source, the files are in dir/<base of source>.
+// The backup is verified by its checksums.
+func (ent *Entity) restoreTo(driver Storage, dir string) ([]FileError, error) {
+	if ent.Mode == MODE_INCREMENT { // increment backup is always recovered from the running driver
+		tmp := *ent
+		tmp.Source = path.Join(dir, path.Base(ent.Source))
+		if err := os.MkdirAll(tmp.Source, 0755); err != nil {
+			return nil, err
+		}
+		return nil, tmp.IncrementRecover([]string{"*"})
+	}
+	store, err := ent.storage(driver)
+	if err != nil {
+		return nil, err
+	}
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(ent.tarStream(store, ent.ns(), pw))
+	}()
+	errs, err := extractArchive(pr, dir)
+	if err == nil {
+		_, err = io.Copy(ioutil.Discard, pr) // till the checksum is verified
+	}
+	pr.CloseWithError(err)
+	return errs, err
+}
+
+// dockerDrill runs the check by /bin/sh in a throwaway container of the container's image,
+// dir is mounted as the volume and the network is disabled, the container is killed after timeout.
+func dockerDrill(container, volume, dir, check string, timeout time.Duration) ([]byte, error) {
+	image, err := exec.Command("docker", "inspect", "--format", "{{.Config.Image}}", container).CombinedOutput()
+	if err != nil {
+		return image, fmt.Errorf("Fail to get the image of container %s, %s", container, err.Error())
+	}
+	if !path.IsAbs(volume) {
+		volume = path.Join(APP_ROOT, volume)
+	}
+	name := fmt.Sprintf("backupd-drill-%d", time.Now().UnixNano())
+	cmd := exec.Command("docker", "run", "--rm", "--name", name, "--network", "none",
+		"-v", dir+":"+volume, "-w", APP_ROOT, "--entrypoint", "/bin/sh",
+		strings.TrimSpace(string(image)), "-c", check)
+	timer := time.AfterFunc(timeout, func() {
+		exec.Command("docker", "rm", "-f", name).Run()
+	})
+	defer timer.Stop()
+	output, err := cmd.CombinedOutput()
+	if err != nil && !timer.Stop() {
+		err = fmt.Errorf("timeout after %s", timeout)
+	}
+	return output, err
+}
+
+func tailOutput(output []byte) string {
+	if len(output) > drillOutputLimit {
+		output = output[len(output)-drillOutputLimit:]
+	}
+	return string(output)
+}
@@ -0,0 +1,75 @@
+package backup
+
+import (
+	"errors"
+	"github.com/laincloud/backupd/crond"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestDrill(t *testing.T) {
+	root, _ := ioutil.TempDir("", "backupd-drill")
+	defer os.RemoveAll(root)
+	driver := &dirDriver{root: path.Join(root, "store")}
+	driverRunning = driver
+	meta = NewMeta(driver, namespace)
+	src := path.Join(root, "data")
+	os.MkdirAll(src, 0755)
+	ioutil.WriteFile(path.Join(src, "db"), []byte("old"), 0644)
+
+	args := crond.FuncArg{"path": src, "volume": "/var/lib/db", "containers": []string{"c1"}, "check": "check-db"}
+	if _, err := drill(args); err == nil {
+		t.Error("drill should fail without any backup")
+	}
+
+	old := NewEntity(src, "app-data-old", 0, nil, "/data", MODE_FULL)
+	if err := old.Backup(driver); err != nil {
+		t.Fatal(err)
+	}
+	ioutil.WriteFile(path.Join(src, "db"), []byte("new"), 0644)
+	latest := NewEntity(src, "app-data-new", 0, nil, "/data", MODE_DEDUP)
+	latest.Created = old.Created.Add(time.Second)
+	if err := latest.DedupBackup(driver); err != nil {
+		t.Fatal(err)
+	}
+	ioutil.WriteFile(path.Join(src, "db"), []byte("live"), 0644)
+
+	var checked string
+	drillRunner = func(container, volume, dir, check string, timeout time.Duration) ([]byte, error) {
+		if container != "c1" || volume != "/var/lib/db" || check != "check-db" || timeout != 30*time.Minute {
+			t.Errorf("unexpected check %s %s %s %s", container, volume, check, timeout)
+		}
+		content, _ := ioutil.ReadFile(path.Join(dir, "db"))
+		checked = string(content)
+		if checked != "new" {
+			return []byte("bad data"), errors.New("exit status 1")
+		}
+		return []byte("all tables ok"), nil
+	}
+	defer func() { drillRunner = dockerDrill }()
+
+	result, err := drill(args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if checked != "new" || result["backup"] != latest.Name || result["passed"] != true || result["output"] != "all tables ok" {
+		t.Errorf("the latest backup should be checked, %q %+v", checked, result)
+	}
+	if content, _ := ioutil.ReadFile(path.Join(src, "db")); string(content) != "live" {
+		t.Error("the volume should not be touched by drill")
+	}
+
+	// the corrupted backups are skipped
+	latest.Corrupted = "checksum mismatch"
+	meta.Commit(func(tx *MetaTx) error {
+		tx.Update(*latest)
+		return nil
+	})
+	result, err = drill(args)
+	if err == nil || checked != "old" || result["passed"] != false || result["output"] != "bad data" {
+		t.Errorf("the check should fail with the old backup, %q %+v %v", checked, result, err)
+	}
+}
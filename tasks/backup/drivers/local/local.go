@@ -0,0 +1,312 @@
+package local
+
+import (
+	"errors"
+	"fmt"
+	"github.com/laincloud/backupd/tasks/backup"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+var (
+	localDir string
+)
+
+// Init the local driver, dir can be any mounted filesystem, like a plain disk, NFS or CephFS
+func Init(dir string) error {
+	localDir = dir
+	if localDir == "" { // local directory not be configed
+		return errors.New("local backup directory is empty")
+	}
+	info, err := os.Stat(localDir)
+	if err != nil { // directory not exist, create it
+		if err := os.MkdirAll(localDir, 0755); err != nil {
+			return fmt.Errorf("Fail to create dir %s:%s", localDir, err.Error())
+		}
+	} else if !info.IsDir() { // is it not a direcotry?
+		return fmt.Errorf("%s already exist, but it's not a directory", localDir)
+	}
+	backup.Register(&LocalDriver{})
+	return nil
+}
+
+// do not expose the local directory in errors
+func errorFilter(err error) error {
+	if perr, ok := err.(*os.PathError); ok {
+		if rel, err := filepath.Rel(localDir, perr.Path); err == nil && !strings.HasPrefix(rel, "..") {
+			perr.Path = rel
+		}
+		return perr
+	}
+	return err
+}
+
+// sync the directory, make the rename or create in it durable
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// write the reader into file atomically, it writes a temporary file in the same directory,
+// fsync it and then rename it to file, so file is either the old one or the complete new one.
+func atomicWrite(reader io.Reader, file string, mode os.FileMode) error {
+	return writeTemp(reader, file, mode, os.Rename)
+}
+
+// write the reader into file if it does not exist, the temporary file is hard linked to file which fails if file exists
+func atomicCreate(reader io.Reader, file string, mode os.FileMode) error {
+	return writeTemp(reader, file, mode, func(tmp, file string) error {
+		defer os.Remove(tmp)
+		return os.Link(tmp, file)
+	})
+}
+
+// writeTemp writes the reader into a temporary file besides file, and publishes it as file
+func writeTemp(reader io.Reader, file string, mode os.FileMode, publish func(tmp, file string) error) error {
+	dir := path.Dir(file)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(dir, "."+path.Base(file)+".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(tmp, reader); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Chmod(mode); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := publish(tmp.Name(), file); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return syncDir(dir)
+}
+
+type LocalDriver struct{}
+
+func (driver *LocalDriver) Name() string {
+	return "local"
+}
+
+func (driver *LocalDriver) Upload(reader io.Reader, dest string) error {
+	if err := atomicWrite(reader, path.Join(localDir, dest), 0644); err != nil {
+		return errorFilter(err)
+	}
+	return nil
+}
+
+// Create writes the file only if it does not exist
+func (driver *LocalDriver) Create(reader io.Reader, dest string) error {
+	if err := atomicCreate(reader, path.Join(localDir, dest), 0644); err != nil {
+		if lerr, ok := err.(*os.LinkError); ok {
+			err = &os.PathError{Op: "create", Path: lerr.New, Err: lerr.Err}
+		}
+		return errorFilter(err)
+	}
+	return nil
+}
+
+func (driver *LocalDriver) Download(writer io.Writer, src string) error {
+	in, err := os.Open(path.Join(localDir, src))
+	if err != nil {
+		return errorFilter(err)
+	}
+	defer in.Close()
+
+	if _, err := io.Copy(writer, in); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (driver *LocalDriver) List(dir string) ([]os.FileInfo, error) {
+	ret, err := ioutil.ReadDir(path.Join(localDir, dir))
+	if err != nil {
+		return ret, errorFilter(err)
+	}
+	return ret, nil
+}
+
+func (driver *LocalDriver) Delete(file string) error {
+	if err := os.RemoveAll(path.Join(localDir, file)); err != nil {
+		return errorFilter(err)
+	}
+	return nil
+}
+
+func (driver *LocalDriver) FileInfo(name string) (os.FileInfo, error) {
+	info, err := os.Stat(path.Join(localDir, name))
+	if err != nil {
+		return info, errorFilter(err)
+	}
+	return info, nil
+}
+
+// Rename renames src to dest atomically, dest is replaced if exists
+func (driver *LocalDriver) Rename(src, dest string) error {
+	dest = path.Join(localDir, dest)
+	if err := os.Rename(path.Join(localDir, src), dest); err != nil {
+		if lerr, ok := err.(*os.LinkError); ok {
+			err = &os.PathError{Op: lerr.Op, Path: lerr.Old, Err: lerr.Err}
+		}
+		return errorFilter(err)
+	}
+	return syncDir(path.Dir(dest))
+}
+
+// Commit renames the staged file to dest
+func (driver *LocalDriver) Commit(staged, dest string) error {
+	if err := os.MkdirAll(path.Dir(path.Join(localDir, dest)), 0755); err != nil {
+		return errorFilter(err)
+	}
+	return driver.Rename(staged, dest)
+}
+
+// Abort removes the staged file
+func (driver *LocalDriver) Abort(staged string) error {
+	return driver.Delete(staged)
+}
+
+// Rsync copies the new or changed files in src selected by filter into dest, like `rsync -a --safe-links`.
+// A file is seen as changed if its size or mtime is different,
+// and it's replaced atomically, so dest is always usable even if the sync is interrupted.
+func (driver *LocalDriver) Rsync(src, dest string, filter *backup.Filter) error {
+	return rsync(src, dest, "", filter)
+}
+
+// SnapshotRsync is Rsync which hard links the regular files of dest into saveDir before they are replaced
+func (driver *LocalDriver) SnapshotRsync(src, dest, saveDir string, filter *backup.Filter) error {
+	return rsync(src, dest, saveDir, filter)
+}
+
+func rsync(src, dest, saveDir string, filter *backup.Filter) error {
+	src, dest = path.Clean(src), path.Join(localDir, dest)
+	// the replaced file keeps its inode, so it is saved by a hard link
+	save := func(rel, target string) error {
+		if saveDir == "" {
+			return nil
+		}
+		if old, err := os.Lstat(target); err != nil || !old.Mode().IsRegular() {
+			return nil
+		}
+		saved := path.Join(localDir, saveDir, rel)
+		if _, err := os.Lstat(saved); err == nil { // the older version is kept
+			return nil
+		}
+		if err := os.MkdirAll(path.Dir(saved), 0755); err != nil {
+			return errorFilter(err)
+		}
+		return errorFilter(os.Link(target, saved))
+	}
+	return filepath.Walk(src, func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, file)
+		if err != nil {
+			return err
+		}
+		if !filter.Match(filepath.ToSlash(rel), info.IsDir()) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		target := path.Join(dest, rel)
+
+		switch {
+		case info.IsDir():
+			if err := os.MkdirAll(target, info.Mode().Perm()); err != nil {
+				return errorFilter(err)
+			}
+			os.Chmod(target, info.Mode().Perm())
+		case info.Mode()&os.ModeSymlink != 0:
+			link, err := os.Readlink(file)
+			if err != nil {
+				return err
+			}
+			if !safeLink(src, file, link) { // ignore the symlinks point outside of src, like --safe-links
+				return nil
+			}
+			if old, err := os.Readlink(target); err == nil && old == link {
+				return nil
+			}
+			if err := save(rel, target); err != nil {
+				return err
+			}
+			os.RemoveAll(target)
+			if err := os.Symlink(link, target); err != nil {
+				return errorFilter(err)
+			}
+		case info.Mode().IsRegular():
+			if old, err := os.Lstat(target); err == nil && old.Mode().IsRegular() &&
+				old.Size() == info.Size() && old.ModTime().Equal(info.ModTime()) {
+				return nil // not changed
+			}
+			if err := save(rel, target); err != nil {
+				return err
+			}
+			in, err := os.Open(file)
+			if err != nil {
+				return err
+			}
+			err = atomicWrite(in, target, info.Mode().Perm())
+			in.Close()
+			if err != nil {
+				return errorFilter(err)
+			}
+		default: // devices, sockets and pipes are not backuped
+			return nil
+		}
+
+		if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+			os.Lchown(target, int(stat.Uid), int(stat.Gid)) // only works as root, ignore the error
+		}
+		if !info.IsDir() && info.Mode()&os.ModeSymlink == 0 {
+			os.Chtimes(target, info.ModTime(), info.ModTime())
+		}
+		return nil
+	})
+}
+
+// a symlink is safe if it's relative and do not point outside of root
+func safeLink(root, file, link string) bool {
+	if path.IsAbs(link) {
+		return false
+	}
+	target := path.Join(path.Dir(file), link)
+	return target == root || strings.HasPrefix(target, root+"/")
+}
+
+// FreeSpace returns the bytes available on the filesystem of the local directory
+func (driver *LocalDriver) FreeSpace() (uint64, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(localDir, &stat); err != nil {
+		return 0, err
+	}
+	return stat.Bavail * uint64(stat.Bsize), nil
+}
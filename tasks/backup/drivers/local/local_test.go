@@ -0,0 +1,238 @@
+package local
+
+import (
+	"bytes"
+	"github.com/laincloud/backupd/tasks/backup"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+func setup(t *testing.T) (*LocalDriver, func()) {
+	dir, err := ioutil.TempDir("", "backupd-local")
+	if err != nil {
+		t.Fatal(err)
+	}
+	localDir = dir
+	return &LocalDriver{}, func() { os.RemoveAll(dir) }
+}
+
+func TestUploadAndDownload(t *testing.T) {
+	driver, clean := setup(t)
+	defer clean()
+
+	if err := driver.Upload(strings.NewReader("hello"), "10.0.0.1/a.tar.gz"); err != nil {
+		t.Fatal(err)
+	}
+	if err := driver.Upload(strings.NewReader("world"), "10.0.0.1/a.tar.gz"); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := driver.Download(&buf, "10.0.0.1/a.tar.gz"); err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != "world" {
+		t.Errorf("downloaded content is %q, expect %q", buf.String(), "world")
+	}
+
+	// no temporary file left
+	list, err := driver.List("10.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 {
+		t.Errorf("expect only one file, got %d", len(list))
+	}
+
+	err = driver.Download(&buf, "10.0.0.1/notexist")
+	if perr, ok := err.(*os.PathError); !ok || perr.Path != "10.0.0.1/notexist" {
+		t.Errorf("the local directory should be hidden in error, %v", err)
+	}
+}
+
+func TestDeleteAndFileInfo(t *testing.T) {
+	driver, clean := setup(t)
+	defer clean()
+
+	driver.Upload(strings.NewReader("data"), "ns/dir/file")
+	info, err := driver.FileInfo("ns/dir/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() != 4 {
+		t.Errorf("size should be 4, got %d", info.Size())
+	}
+	if err := driver.Delete("ns/dir"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := driver.FileInfo("ns/dir/file"); !os.IsNotExist(err) {
+		t.Errorf("ns/dir should be deleted, %v", err)
+	}
+}
+
+func TestRsync(t *testing.T) {
+	driver, clean := setup(t)
+	defer clean()
+
+	src, err := ioutil.TempDir("", "backupd-local-src")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(src)
+	mtime := time.Now().Add(-time.Hour).Truncate(time.Second)
+	os.MkdirAll(path.Join(src, "sub"), 0755)
+	ioutil.WriteFile(path.Join(src, "sub", "a"), []byte("file a"), 0600)
+	os.Chtimes(path.Join(src, "sub", "a"), mtime, mtime)
+	os.Symlink("sub/a", path.Join(src, "link"))
+	os.Symlink("/etc/passwd", path.Join(src, "unsafe"))
+
+	if err := driver.Rsync(src, "ns/inc", nil); err != nil {
+		t.Fatal(err)
+	}
+	dest := path.Join(localDir, "ns/inc")
+	info, err := os.Stat(path.Join(dest, "sub", "a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 || !info.ModTime().Equal(mtime) {
+		t.Errorf("mode and mtime should be kept, got %v %v", info.Mode(), info.ModTime())
+	}
+	if link, err := os.Readlink(path.Join(dest, "link")); err != nil || link != "sub/a" {
+		t.Errorf("safe symlink should be copied, %s %v", link, err)
+	}
+	if _, err := os.Lstat(path.Join(dest, "unsafe")); !os.IsNotExist(err) {
+		t.Errorf("unsafe symlink should be ignored")
+	}
+
+	// changed file is synced again
+	ioutil.WriteFile(path.Join(src, "sub", "a"), []byte("file a changed"), 0600)
+	if err := driver.Rsync(src, "ns/inc", nil); err != nil {
+		t.Fatal(err)
+	}
+	if content, _ := ioutil.ReadFile(path.Join(dest, "sub", "a")); string(content) != "file a changed" {
+		t.Errorf("changed file not synced, %q", content)
+	}
+
+	// the files not selected by filter are skipped
+	ioutil.WriteFile(path.Join(src, "sub", "b.log"), []byte("log"), 0600)
+	os.MkdirAll(path.Join(src, "cache"), 0755)
+	ioutil.WriteFile(path.Join(src, "cache", "c"), []byte("cached"), 0600)
+	filter, _ := backup.NewFilter(nil, []string{"*.log", "cache"})
+	if err := driver.Rsync(src, "ns/filtered", filter); err != nil {
+		t.Fatal(err)
+	}
+	dest = path.Join(localDir, "ns/filtered")
+	if _, err := os.Stat(path.Join(dest, "sub", "a")); err != nil {
+		t.Errorf("selected file should be synced, %v", err)
+	}
+	for _, file := range []string{"sub/b.log", "cache"} {
+		if _, err := os.Lstat(path.Join(dest, file)); !os.IsNotExist(err) {
+			t.Errorf("%s should be skipped, %v", file, err)
+		}
+	}
+}
+
+func TestSnapshotRsync(t *testing.T) {
+	driver, clean := setup(t)
+	defer clean()
+
+	src, err := ioutil.TempDir("", "backupd-local-src")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(src)
+	for file, content := range map[string]string{"a": "a1", "b": "b1", "c": "c1"} {
+		ioutil.WriteFile(path.Join(src, file), []byte(content), 0600)
+	}
+	if err := driver.Rsync(src, "ns/inc", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	driver.Upload(strings.NewReader("c0"), "ns/inc@1/c")
+	ioutil.WriteFile(path.Join(src, "a"), []byte("a2"), 0600)
+	ioutil.WriteFile(path.Join(src, "c"), []byte("c2"), 0600)
+	os.Remove(path.Join(src, "b"))
+	os.Symlink("a", path.Join(src, "b"))
+	if err := driver.SnapshotRsync(src, "ns/inc", "ns/inc@1", nil); err != nil {
+		t.Fatal(err)
+	}
+	for file, content := range map[string]string{"ns/inc/a": "a2", "ns/inc/c": "c2", "ns/inc@1/a": "a1", "ns/inc@1/b": "b1", "ns/inc@1/c": "c0"} {
+		if data, err := ioutil.ReadFile(path.Join(localDir, file)); err != nil || string(data) != content {
+			t.Errorf("%s should be %q, got %q %v", file, content, data, err)
+		}
+	}
+}
+
+func TestFreeSpace(t *testing.T) {
+	driver, clean := setup(t)
+	defer clean()
+
+	free, err := driver.FreeSpace()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if free == 0 {
+		t.Error("free space should not be zero")
+	}
+}
+
+func TestRename(t *testing.T) {
+	driver, clean := setup(t)
+	defer clean()
+
+	driver.Upload(strings.NewReader("new"), "ns/.meta.tmp")
+	driver.Upload(strings.NewReader("old"), "ns/.meta")
+	if err := driver.Rename("ns/.meta.tmp", "ns/.meta"); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := driver.Download(&buf, "ns/.meta"); err != nil || buf.String() != "new" {
+		t.Errorf("dest should be replaced, %q %v", buf.String(), err)
+	}
+	if _, err := driver.FileInfo("ns/.meta.tmp"); !os.IsNotExist(err) {
+		t.Errorf("src should be renamed, %v", err)
+	}
+	if err := driver.Rename("ns/missing", "ns/.meta"); !os.IsNotExist(err) {
+		t.Errorf("renaming a missing file should fail, %v", err)
+	}
+}
+
+func TestCommitAndAbort(t *testing.T) {
+	driver, clean := setup(t)
+	defer clean()
+
+	driver.Upload(strings.NewReader("data"), "ns/.staging/a.tar.gz.1")
+	if err := driver.Commit("ns/.staging/a.tar.gz.1", "ns/a.tar.gz"); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := driver.Download(&buf, "ns/a.tar.gz"); err != nil || buf.String() != "data" {
+		t.Errorf("staged file should be committed, %q %v", buf.String(), err)
+	}
+	driver.Upload(strings.NewReader("part"), "ns/.staging/b.tar.gz.2")
+	if err := driver.Abort("ns/.staging/b.tar.gz.2"); err != nil {
+		t.Fatal(err)
+	}
+	if files, _ := driver.List("ns/.staging"); len(files) != 0 {
+		t.Errorf("staged files should be removed, %d left", len(files))
+	}
+}
+
+func TestCreate(t *testing.T) {
+	driver, clean := setup(t)
+	defer clean()
+
+	if err := driver.Create(strings.NewReader("first"), "ns/.meta.journal/1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := driver.Create(strings.NewReader("second"), "ns/.meta.journal/1"); !os.IsExist(err) {
+		t.Errorf("creating an existing file should fail, %v", err)
+	}
+	var buf bytes.Buffer
+	if err := driver.Download(&buf, "ns/.meta.journal/1"); err != nil || buf.String() != "first" {
+		t.Errorf("the file should not be replaced, %q %v", buf.String(), err)
+	}
+}
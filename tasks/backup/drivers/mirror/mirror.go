@@ -0,0 +1,333 @@
+package mirror
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/laincloud/backupd/tasks/backup"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+)
+
+const (
+	Prefix   = "mirror:"
+	statusOK = "ok"
+)
+
+var errEarlyReturn = errors.New("upload returned before all data written")
+
+// Init registers a mirror driver over the given drivers, they must be registered already.
+// The first driver is the primary one, reading is always tried on it first.
+func Init(names []string) error {
+	if len(names) < 2 {
+		return errors.New("mirror driver needs at least two backup drivers")
+	}
+	driver := &MirrorDriver{
+		staged:  make(map[string]map[string]string),
+		watches: make(map[string]map[string]string),
+	}
+	for _, name := range names {
+		replica, ok := backup.GetDriver(name)
+		if !ok {
+			return fmt.Errorf("Backup driver \"%s\" not exist", name)
+		}
+		driver.replicas = append(driver.replicas, replica)
+	}
+	backup.Register(driver)
+	return nil
+}
+
+// ParseName returns the replicas' names in a driver name like mirror:moosefs,s3, ok is false if it's not a mirror driver
+func ParseName(name string) ([]string, bool) {
+	if !strings.HasPrefix(name, Prefix) {
+		return nil, false
+	}
+	return strings.Split(strings.TrimPrefix(name, Prefix), ","), true
+}
+
+// MirrorDriver writes every backup to all its replicas, and reads from the first healthy one
+type MirrorDriver struct {
+	replicas []backup.Storage
+	staged   map[string]map[string]string // the result of uploading the staged file on each replica, till it's committed or aborted
+	watches  map[string]map[string]string // the results of the writes to the files with the watched prefix, see WatchReplicas
+	lock     sync.Mutex
+}
+
+func (driver *MirrorDriver) Name() string {
+	names := make([]string, len(driver.replicas))
+	for i, replica := range driver.replicas {
+		names[i] = replica.Name()
+	}
+	return Prefix + strings.Join(names, ",")
+}
+
+// record the result of each replica for the watches of dest, the write fails only if all replicas failed
+func (driver *MirrorDriver) record(op, dest string, errs []error) error {
+	status := make(map[string]string)
+	var failed []string
+	for i, replica := range driver.replicas {
+		if errs[i] != nil {
+			log.Warnf("Fail to %s %s on replica %s, %s", op, dest, replica.Name(), errs[i].Error())
+			status[replica.Name()] = errs[i].Error()
+			failed = append(failed, fmt.Sprintf("%s: %s", replica.Name(), errs[i].Error()))
+		} else {
+			status[replica.Name()] = statusOK
+		}
+	}
+	driver.lock.Lock()
+	if op == "upload" && backup.IsStaged(dest) { // asked by the commit
+		driver.staged[dest] = status
+	}
+	for prefix, watched := range driver.watches {
+		if !strings.HasPrefix(dest, prefix) {
+			continue
+		}
+		for name, result := range status {
+			if watched[name] == "" || watched[name] == statusOK { // the first failure is kept
+				watched[name] = result
+			}
+		}
+	}
+	driver.lock.Unlock()
+
+	if len(failed) == len(driver.replicas) {
+		return fmt.Errorf("Fail to %s %s on all replicas, %s", op, dest, strings.Join(failed, "; "))
+	}
+	return nil
+}
+
+// run f on all the replicas concurrently
+func (driver *MirrorDriver) fanout(f func(backup.Storage) error) []error {
+	errs := make([]error, len(driver.replicas))
+	var wg sync.WaitGroup
+	for i, replica := range driver.replicas {
+		wg.Add(1)
+		go func(i int, replica backup.Storage) {
+			defer wg.Done()
+			errs[i] = f(replica)
+		}(i, replica)
+	}
+	wg.Wait()
+	return errs
+}
+
+// WatchReplicas starts recording the results of the writes to the files with the prefix on each replica
+func (driver *MirrorDriver) WatchReplicas(prefix string) {
+	driver.lock.Lock()
+	defer driver.lock.Unlock()
+	driver.watches[prefix] = make(map[string]string)
+}
+
+// ReplicaStatus stops watching the prefix and returns "ok" for the replicas all the writes succeeded on,
+// or the first error on the others. A replica without any write is not in it.
+func (driver *MirrorDriver) ReplicaStatus(prefix string) map[string]string {
+	driver.lock.Lock()
+	defer driver.lock.Unlock()
+	status := driver.watches[prefix]
+	delete(driver.watches, prefix)
+	return status
+}
+
+// the result of uploading the staged file, it's forgot after read
+func (driver *MirrorDriver) stagedStatus(staged string) map[string]string {
+	driver.lock.Lock()
+	defer driver.lock.Unlock()
+	status := driver.staged[staged]
+	delete(driver.staged, staged)
+	return status
+}
+
+// Upload copies the reader to all the replicas at the same time, the reader is read only once.
+// A replica failed is dropped and the others go on.
+func (driver *MirrorDriver) Upload(reader io.Reader, dest string) error {
+	var (
+		n         = len(driver.replicas)
+		writers   = make([]*io.PipeWriter, n)
+		errs      = make([]error, n)
+		writeErrs = make([]error, n)
+		wg        sync.WaitGroup
+	)
+	for i, replica := range driver.replicas {
+		pr, pw := io.Pipe()
+		writers[i] = pw
+		wg.Add(1)
+		go func(i int, replica backup.Storage) {
+			defer wg.Done()
+			if errs[i] = replica.Upload(pr, dest); errs[i] != nil {
+				pr.CloseWithError(errs[i])
+			} else {
+				pr.CloseWithError(errEarlyReturn)
+			}
+		}(i, replica)
+	}
+
+	alive := n
+	buf := make([]byte, 32*1024)
+	var readErr error
+	for alive > 0 {
+		nr, err := reader.Read(buf)
+		if nr > 0 {
+			for i, w := range writers {
+				if w == nil {
+					continue
+				}
+				if _, writeErrs[i] = w.Write(buf[:nr]); writeErrs[i] != nil { // the replica failed, drop it
+					writers[i] = nil
+					alive--
+				}
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			readErr = err
+			break
+		}
+	}
+	for _, w := range writers {
+		if w != nil {
+			w.CloseWithError(readErr) // nil is io.EOF for the replica
+		}
+	}
+	wg.Wait()
+
+	if readErr != nil {
+		return readErr
+	}
+	for i := range errs {
+		if errs[i] == nil && writeErrs[i] != nil { // the replica did not get the whole file
+			errs[i] = writeErrs[i]
+		}
+	}
+	return driver.record("upload", dest, errs)
+}
+
+// Create writes the file only if it does not exist, the primary replica decides whether it exists,
+// then the file is copied to the others
+func (driver *MirrorDriver) Create(reader io.Reader, dest string) error {
+	content, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return err
+	}
+	creator, ok := driver.replicas[0].(backup.Creator)
+	if !ok {
+		return driver.Upload(bytes.NewReader(content), dest)
+	}
+	if err := creator.Create(bytes.NewReader(content), dest); err != nil {
+		return err
+	}
+	errs := make([]error, len(driver.replicas))
+	for i, replica := range driver.replicas[1:] {
+		errs[i+1] = replica.Upload(bytes.NewReader(content), dest)
+	}
+	return driver.record("create", dest, errs)
+}
+
+// resumeWriter skips the bytes already written by the failed replica, the rest is written from the next one
+type resumeWriter struct {
+	w       io.Writer
+	skip    int64
+	written int64
+	err     error // the writer failed, not the replica
+}
+
+func (rw *resumeWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	if rw.skip >= int64(n) {
+		rw.skip -= int64(n)
+		return n, nil
+	}
+	p, rw.skip = p[rw.skip:], 0
+	nw, err := rw.w.Write(p)
+	rw.written += int64(nw)
+	if err != nil {
+		rw.err = err
+		return n - len(p) + nw, err
+	}
+	return n, nil
+}
+
+// Download reads the file from the first replica has it, if the replica fails in the middle,
+// the rest is read from the next replica
+func (driver *MirrorDriver) Download(writer io.Writer, src string) error {
+	rw := &resumeWriter{w: writer}
+	var err error
+	for _, replica := range driver.replicas {
+		if _, err = replica.FileInfo(src); err != nil {
+			log.Warnf("%s not available on replica %s, %s", src, replica.Name(), err.Error())
+			continue
+		}
+		rw.skip = rw.written
+		if err = replica.Download(rw, src); err == nil || rw.err != nil {
+			return err
+		}
+		log.Warnf("Fail to download %s from replica %s after %d bytes, %s", src, replica.Name(), rw.written, err.Error())
+	}
+	return err
+}
+
+func (driver *MirrorDriver) List(dir string) ([]os.FileInfo, error) {
+	var err error
+	for _, replica := range driver.replicas {
+		var ret []os.FileInfo
+		if ret, err = replica.List(dir); err == nil {
+			return ret, nil
+		}
+		log.Warnf("Fail to list %s on replica %s, %s", dir, replica.Name(), err.Error())
+	}
+	return nil, err
+}
+
+func (driver *MirrorDriver) Delete(file string) error {
+	return driver.record("delete", file, driver.fanout(func(replica backup.Storage) error {
+		return replica.Delete(file)
+	}))
+}
+
+func (driver *MirrorDriver) FileInfo(name string) (os.FileInfo, error) {
+	var err error
+	for _, replica := range driver.replicas {
+		var info os.FileInfo
+		if info, err = replica.FileInfo(name); err == nil {
+			return info, nil
+		}
+	}
+	return nil, err
+}
+
+// Commit commits the staged file on the replicas it was uploaded to, the others are recorded failed with the upload error
+func (driver *MirrorDriver) Commit(staged, dest string) error {
+	uploaded := driver.stagedStatus(staged)
+	return driver.record("commit", dest, driver.fanout(func(replica backup.Storage) error {
+		if status, ok := uploaded[replica.Name()]; ok && status != statusOK {
+			return errors.New(status)
+		}
+		return backup.CommitStaged(replica, staged, dest)
+	}))
+}
+
+// Abort removes the staged file on all the replicas
+func (driver *MirrorDriver) Abort(staged string) error {
+	driver.stagedStatus(staged)
+	return driver.record("abort", staged, driver.fanout(func(replica backup.Storage) error {
+		return backup.AbortStaged(replica, staged)
+	}))
+}
+
+func (driver *MirrorDriver) Rsync(src, dest string, filter *backup.Filter) error {
+	return driver.record("rsync", dest, driver.fanout(func(replica backup.Storage) error {
+		return replica.Rsync(src, dest, filter)
+	}))
+}
+
+// SnapshotRsync syncs every replica by backup.SnapshotSync, each saves the files it replaces
+func (driver *MirrorDriver) SnapshotRsync(src, dest, saveDir string, filter *backup.Filter) error {
+	return driver.record("rsync", dest, driver.fanout(func(replica backup.Storage) error {
+		return backup.SnapshotSync(replica, src, dest, saveDir, filter)
+	}))
+}
@@ -0,0 +1,284 @@
+package mirror
+
+import (
+	"bytes"
+	"errors"
+	"github.com/laincloud/backupd/tasks/backup"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// memDriver keeps the files in memory, all the operations fail if broken is set
+type memDriver struct {
+	name   string
+	files  map[string][]byte
+	broken bool
+}
+
+var errBroken = errors.New("storage broken")
+
+func newMemDriver(name string) *memDriver {
+	return &memDriver{name: name, files: make(map[string][]byte)}
+}
+
+func (d *memDriver) Name() string {
+	return d.name
+}
+
+func (d *memDriver) Upload(reader io.Reader, dest string) error {
+	if d.broken {
+		return errBroken
+	}
+	data, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return err
+	}
+	d.files[dest] = data
+	return nil
+}
+
+func (d *memDriver) Download(writer io.Writer, src string) error {
+	if d.broken {
+		return errBroken
+	}
+	data, ok := d.files[src]
+	if !ok {
+		return &os.PathError{Op: "download", Path: src, Err: os.ErrNotExist}
+	}
+	_, err := writer.Write(data)
+	return err
+}
+
+func (d *memDriver) List(dir string) ([]os.FileInfo, error) {
+	if d.broken {
+		return nil, errBroken
+	}
+	var ret []os.FileInfo
+	for name, data := range d.files {
+		if strings.HasPrefix(name, dir+"/") {
+			ret = append(ret, &memInfo{name: strings.TrimPrefix(name, dir+"/"), size: int64(len(data))})
+		}
+	}
+	return ret, nil
+}
+
+func (d *memDriver) Delete(file string) error {
+	if d.broken {
+		return errBroken
+	}
+	delete(d.files, file)
+	return nil
+}
+
+func (d *memDriver) FileInfo(name string) (os.FileInfo, error) {
+	if d.broken {
+		return nil, errBroken
+	}
+	data, ok := d.files[name]
+	if !ok {
+		return nil, &os.PathError{Op: "stat", Path: name, Err: os.ErrNotExist}
+	}
+	return &memInfo{name: name, size: int64(len(data))}, nil
+}
+
+func (d *memDriver) Rsync(src, dest string, filter *backup.Filter) error {
+	if d.broken {
+		return errBroken
+	}
+	d.files[dest] = []byte(src)
+	return nil
+}
+
+type memInfo struct {
+	name string
+	size int64
+}
+
+func (fi *memInfo) Name() string       { return fi.name }
+func (fi *memInfo) Size() int64        { return fi.size }
+func (fi *memInfo) Mode() os.FileMode  { return 0644 }
+func (fi *memInfo) ModTime() time.Time { return time.Time{} }
+func (fi *memInfo) IsDir() bool        { return false }
+func (fi *memInfo) Sys() interface{}   { return nil }
+
+func setup() (*MirrorDriver, *memDriver, *memDriver) {
+	primary, secondary := newMemDriver("primary"), newMemDriver("secondary")
+	return &MirrorDriver{
+		replicas: []backup.Storage{primary, secondary},
+		staged:   make(map[string]map[string]string),
+		watches:  make(map[string]map[string]string),
+	}, primary, secondary
+}
+
+func TestInit(t *testing.T) {
+	if names, ok := ParseName("mirror:moosefs,s3"); !ok || len(names) != 2 || names[0] != "moosefs" || names[1] != "s3" {
+		t.Errorf("unexpected replicas %v", names)
+	}
+	if _, ok := ParseName("moosefs"); ok {
+		t.Error("moosefs is not a mirror driver")
+	}
+
+	backup.Register(newMemDriver("a"))
+	backup.Register(newMemDriver("b"))
+	if err := Init([]string{"a"}); err == nil {
+		t.Error("mirror driver with one replica should fail")
+	}
+	if err := Init([]string{"a", "notexist"}); err == nil {
+		t.Error("mirror driver with unknown replica should fail")
+	}
+	if err := Init([]string{"a", "b"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := backup.GetDriver("mirror:a,b"); !ok {
+		t.Error("mirror driver should be registered as mirror:a,b")
+	}
+}
+
+func TestUpload(t *testing.T) {
+	driver, primary, secondary := setup()
+
+	data := strings.Repeat("backup data ", 10000)
+	driver.WatchReplicas("ns/a.tar.gz")
+	if err := driver.Upload(strings.NewReader(data), "ns/a.tar.gz"); err != nil {
+		t.Fatal(err)
+	}
+	if string(primary.files["ns/a.tar.gz"]) != data || string(secondary.files["ns/a.tar.gz"]) != data {
+		t.Error("file should be uploaded to all replicas")
+	}
+	if status := driver.ReplicaStatus("ns/a.tar.gz"); status["primary"] != "ok" || status["secondary"] != "ok" {
+		t.Errorf("unexpected replica status %v", status)
+	}
+
+	// one replica broken, the failure is kept till the watch stops
+	driver.WatchReplicas("ns/b.tar.gz")
+	primary.broken = true
+	if err := driver.Upload(strings.NewReader(data), "ns/b.tar.gz"); err != nil {
+		t.Fatal(err)
+	}
+	if string(secondary.files["ns/b.tar.gz"]) != data {
+		t.Error("file should be uploaded to the healthy replica")
+	}
+	primary.broken = false
+	driver.Upload(strings.NewReader("manifest"), "ns/b.tar.gz.index")
+	driver.Upload(strings.NewReader("not watched"), "ns/other")
+	if status := driver.ReplicaStatus("ns/b.tar.gz"); status["primary"] != errBroken.Error() || status["secondary"] != "ok" {
+		t.Errorf("unexpected replica status %v", status)
+	}
+	if len(driver.watches) != 0 || len(driver.staged) != 0 {
+		t.Errorf("nothing should be recorded without watches, %v %v", driver.watches, driver.staged)
+	}
+
+	// all replicas broken
+	primary.broken, secondary.broken = true, true
+	if err := driver.Upload(strings.NewReader(data), "ns/c.tar.gz"); err == nil {
+		t.Error("upload should fail if all replicas failed")
+	}
+}
+
+// failDriver fails the download after writing some bytes
+type failDriver struct {
+	*memDriver
+}
+
+func (d *failDriver) Download(writer io.Writer, src string) error {
+	data := d.files[src]
+	writer.Write(data[:len(data)/2])
+	return errBroken
+}
+
+func TestDownloadFallback(t *testing.T) {
+	primary, secondary := &failDriver{newMemDriver("primary")}, newMemDriver("secondary")
+	driver := &MirrorDriver{replicas: []backup.Storage{primary, secondary}}
+	primary.files["ns/a.tar.gz"] = []byte("0123456789")
+	secondary.files["ns/a.tar.gz"] = []byte("0123456789")
+	var buf bytes.Buffer
+	if err := driver.Download(&buf, "ns/a.tar.gz"); err != nil || buf.String() != "0123456789" {
+		t.Errorf("the rest should be read from the next replica, %q %v", buf.String(), err)
+	}
+	delete(secondary.files, "ns/a.tar.gz")
+	buf.Reset()
+	if err := driver.Download(&buf, "ns/a.tar.gz"); err == nil {
+		t.Error("download should fail if no replica has the whole file")
+	}
+}
+
+func TestReadFromHealthyReplica(t *testing.T) {
+	driver, primary, secondary := setup()
+
+	secondary.files["ns/a.tar.gz"] = []byte("only on secondary")
+	var buf bytes.Buffer
+	if err := driver.Download(&buf, "ns/a.tar.gz"); err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != "only on secondary" {
+		t.Errorf("unexpected content %q", buf.String())
+	}
+
+	primary.broken = true
+	list, err := driver.List("ns")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 {
+		t.Errorf("expect 1 file from secondary, got %d", len(list))
+	}
+}
+
+func TestDeleteAndRsync(t *testing.T) {
+	driver, primary, secondary := setup()
+
+	driver.WatchReplicas("ns/inc")
+	if err := driver.Rsync("/data", "ns/inc", nil); err != nil {
+		t.Fatal(err)
+	}
+	if string(primary.files["ns/inc"]) != "/data" || string(secondary.files["ns/inc"]) != "/data" {
+		t.Error("rsync should run on all replicas")
+	}
+	if status := driver.ReplicaStatus("ns/inc"); len(status) != 2 {
+		t.Errorf("unexpected replica status %v", status)
+	}
+
+	secondary.broken = true
+	if err := driver.Delete("ns/inc"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := primary.files["ns/inc"]; ok {
+		t.Error("file should be deleted on primary")
+	}
+}
+
+func TestCommitAndAbort(t *testing.T) {
+	driver, primary, secondary := setup()
+
+	driver.WatchReplicas("ns/a.tar.gz")
+	primary.broken = true
+	driver.Upload(strings.NewReader("data"), "ns/.staging/a.tar.gz.1")
+	primary.broken = false
+	if err := driver.Commit("ns/.staging/a.tar.gz.1", "ns/a.tar.gz"); err != nil {
+		t.Fatal(err)
+	}
+	if string(secondary.files["ns/a.tar.gz"]) != "data" {
+		t.Error("staged file should be committed on the replica it was uploaded to")
+	}
+	if _, ok := secondary.files["ns/.staging/a.tar.gz.1"]; ok {
+		t.Error("staged file should be removed after committed")
+	}
+	if status := driver.ReplicaStatus("ns/a.tar.gz"); status["primary"] != errBroken.Error() || status["secondary"] != "ok" {
+		t.Errorf("the failed upload should be recorded in the status of dest, %v", status)
+	}
+
+	driver.Upload(strings.NewReader("part"), "ns/.staging/b.tar.gz.2")
+	if err := driver.Abort("ns/.staging/b.tar.gz.2"); err != nil {
+		t.Fatal(err)
+	}
+	if len(primary.files) != 0 || len(secondary.files) != 1 {
+		t.Errorf("staged file should be removed on all replicas, %d %d", len(primary.files), len(secondary.files))
+	}
+	if len(driver.staged) != 0 {
+		t.Errorf("the status of staged files should not be kept, %v", driver.staged)
+	}
+}
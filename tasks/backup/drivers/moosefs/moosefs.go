@@ -9,7 +9,9 @@ import (
 	"os"
 	"os/exec"
 	"path"
+	"path/filepath"
 	"strings"
+	"time"
 )
 
 var (
@@ -92,6 +94,40 @@ func (driver *MoosefsDriver) Upload(reader io.Reader, dest string) error {
 	return nil
 }
 
+// Create writes the file only if it does not exist, a temporary file is written and hard linked to dest
+func (driver *MoosefsDriver) Create(reader io.Reader, dest string) error {
+	if err := checkMFS(); err != nil {
+		return err
+	}
+	dest = path.Join(moosefsDir, dest)
+	if err := os.MkdirAll(path.Dir(dest), 0666); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(path.Dir(dest), "."+path.Base(dest)+".tmp")
+	if err != nil {
+		return errorFilter(err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := io.Copy(tmp, reader); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Link(tmp.Name(), dest); err != nil {
+		if lerr, ok := err.(*os.LinkError); ok {
+			err = &os.PathError{Op: "create", Path: lerr.New, Err: lerr.Err}
+		}
+		return errorFilter(err)
+	}
+	return nil
+}
+
 func (driver *MoosefsDriver) Download(writer io.Writer, src string) error {
 	if err := checkMFS(); err != nil {
 		return err
@@ -135,21 +171,115 @@ func (driver *MoosefsDriver) Delete(file string) error {
 	return nil
 }
 
-func (driver *MoosefsDriver) Rsync(src, dest string) error {
+// Rename renames src to dest atomically, dest is replaced if exists
+func (driver *MoosefsDriver) Rename(src, dest string) error {
+	if err := checkMFS(); err != nil {
+		return err
+	}
+	if err := os.Rename(path.Join(moosefsDir, src), path.Join(moosefsDir, dest)); err != nil {
+		if lerr, ok := err.(*os.LinkError); ok {
+			err = &os.PathError{Op: lerr.Op, Path: lerr.Old, Err: lerr.Err}
+		}
+		return errorFilter(err)
+	}
+	return nil
+}
+
+// Commit renames the staged file to dest
+func (driver *MoosefsDriver) Commit(staged, dest string) error {
 	if err := checkMFS(); err != nil {
 		return err
 	}
+	if err := os.MkdirAll(path.Dir(path.Join(moosefsDir, dest)), 0666); err != nil {
+		return err
+	}
+	return driver.Rename(staged, dest)
+}
+
+// Abort removes the staged file
+func (driver *MoosefsDriver) Abort(staged string) error {
+	return driver.Delete(staged)
+}
+
+func (driver *MoosefsDriver) Rsync(src, dest string, filter *backup.Filter) error {
+	if err := checkMFS(); err != nil {
+		return err
+	}
+	return rsync(src, dest, filter)
+}
+
+// SnapshotRsync runs rsync with --backup-dir, the replaced files are moved into saveDir unless it already has them
+func (driver *MoosefsDriver) SnapshotRsync(src, dest, saveDir string, filter *backup.Filter) error {
+	if err := checkMFS(); err != nil {
+		return err
+	}
+	// rsync overwrites the files in backup dir, the older versions in saveDir must be kept
+	tmp := path.Join(moosefsDir, saveDir) + fmt.Sprintf(".rsync.%d", time.Now().UnixNano())
+	defer os.RemoveAll(tmp)
+	if err := rsync(src, dest, filter, "--backup", "--backup-dir="+tmp); err != nil {
+		return err
+	}
+	return filepath.Walk(tmp, func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && file == tmp { // nothing replaced
+				return nil
+			}
+			return err
+		}
+		rel, err := filepath.Rel(tmp, file)
+		if err != nil || info.IsDir() {
+			return err
+		}
+		saved := path.Join(moosefsDir, saveDir, rel)
+		if _, err := os.Lstat(saved); err == nil {
+			return nil
+		}
+		if err := os.MkdirAll(path.Dir(saved), 0755); err != nil {
+			return err
+		}
+		return os.Rename(file, saved)
+	})
+}
+
+func rsync(src, dest string, filter *backup.Filter, opts ...string) error {
 	src, dest = src+"/", path.Join(moosefsDir, dest)+"/"
 	if err := os.MkdirAll(path.Dir(dest), 0666); err != nil {
 		return err
 	}
-	cmd := exec.Command("/bin/bash", "-c", fmt.Sprintf("rsync -az --safe-links %s %s", src, dest))
+	args := append([]string{"-az", "--safe-links"}, opts...)
+	args = append(args, rsyncFilter(filter)...)
+	cmd := exec.Command("rsync", append(args, src, dest)...)
 	if output, err := cmd.CombinedOutput(); err != nil {
 		return errors.New(err.Error() + ", Output:" + string(output))
 	}
 	return nil
 }
 
+// rsyncFilter returns the rsync options of filter, the patterns with "/" are anchored to the transfer root
+func rsyncFilter(filter *backup.Filter) []string {
+	if filter == nil {
+		return nil
+	}
+	anchor := func(p string) string {
+		if strings.Contains(p, "/") && !strings.HasPrefix(p, "/") {
+			return "/" + p
+		}
+		return p
+	}
+	var args []string
+	for _, p := range filter.Exclude {
+		args = append(args, "--exclude="+anchor(p))
+	}
+	if len(filter.Include) > 0 {
+		args = append(args, "--include=*/")
+		for _, p := range filter.Include {
+			args = append(args, "--include="+anchor(p), "--include="+anchor(p)+"/**")
+		}
+		args = append(args, "--exclude=*")
+	}
+	return args
+}
+
 func (driver *MoosefsDriver) FileInfo(name string) (os.FileInfo, error) {
 	if err := checkMFS(); err != nil {
 		return nil, err
@@ -1,49 +1,58 @@
 package moosefs
 
 import (
-	"fmt"
+	"bytes"
+	"io/ioutil"
 	"os"
+	"path"
+	"strings"
 	"testing"
 )
 
-func init() {
-	moosefsDir = "/tmp/mfs"
-	os.Mkdir(moosefsDir, os.ModePerm)
-}
-
-func TestUpload(t *testing.T) {
-	driver := &MoosefsDriver{}
-	if err := driver.Upload("/etc/bashrc"); err != nil {
-		t.Error(err)
+// setup points the driver to a temporary directory, the tests are skipped without the moosefs client
+func setup(t *testing.T) (*MoosefsDriver, func()) {
+	dir, err := ioutil.TempDir("", "backupd-moosefs")
+	if err != nil {
+		t.Fatal(err)
 	}
-}
-
-func TestDownload(t *testing.T) {
-	driver := &MoosefsDriver{}
-	if err := driver.Download("bashrc", "/tmp/basrch_from_moosefs"); err != nil {
-		t.Error(err)
+	moosefsDir = dir
+	if err := checkMFS(); err != nil {
+		os.RemoveAll(dir)
+		t.Skipf("moosefs is not available, %s", err.Error())
 	}
+	return &MoosefsDriver{}, func() { os.RemoveAll(dir) }
 }
 
-func TestList(t *testing.T) {
-	driver := &MoosefsDriver{}
-	l, err := driver.List()
-	if err != nil {
-		t.Error(err)
-	}
-	fmt.Println(l)
-}
+func TestUploadDownload(t *testing.T) {
+	driver, clean := setup(t)
+	defer clean()
 
-func TestDelete(t *testing.T) {
-	driver := &MoosefsDriver{}
-	if err := driver.Delete("bashrc"); err != nil {
+	if err := driver.Upload(strings.NewReader("hello"), "ns/bashrc"); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := driver.Download(&buf, "ns/bashrc"); err != nil || buf.String() != "hello" {
+		t.Errorf("unexpected content %q, %v", buf.String(), err)
+	}
+	if l, err := driver.List("ns"); err != nil || len(l) != 1 {
+		t.Errorf("expect 1 file, got %v %v", l, err)
+	}
+	if err := driver.Delete("ns/bashrc"); err != nil {
 		t.Error(err)
 	}
 }
 
 func TestRsync(t *testing.T) {
-	driver := &MoosefsDriver{}
-	if err := driver.Rsync("/etc", "/etc"); err != nil {
+	driver, clean := setup(t)
+	defer clean()
+
+	src, _ := ioutil.TempDir("", "backupd-moosefs-src")
+	defer os.RemoveAll(src)
+	ioutil.WriteFile(path.Join(src, "a"), []byte("file a"), 0644)
+	if err := driver.Rsync(src, "ns/inc", nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := driver.FileInfo("ns/inc/a"); err != nil {
 		t.Error(err)
 	}
 }
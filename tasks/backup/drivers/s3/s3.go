@@ -0,0 +1,719 @@
+package s3
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"github.com/laincloud/backupd/tasks/backup"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	metaMtime = "x-amz-meta-mtime"
+	metaMode  = "x-amz-meta-mode"
+)
+
+var (
+	conf   Config
+	client = &http.Client{}
+
+	// uploads larger than partSize are sent with multipart upload, s3 requires at least 5MB for a part
+	partSize = 16 << 20
+	// the part size is doubled every partGrowth parts up to maxPartSize,
+	// so the 10000 parts allowed by s3 hold objects up to 5TB while small uploads use small buffers
+	partGrowth        = 1000
+	maxPartSize int64 = 5 << 30
+	// the parts larger than memPartSize are spooled into a temp file instead of memory
+	memPartSize = 64 << 20
+	// objects larger than copyLimit are copied in parts of copyLimit, s3 copies at most 5GB in a request
+	copyLimit int64 = 5 << 30
+)
+
+// Config is the s3 connection settings
+type Config struct {
+	Endpoint  string // like https://s3.amazonaws.com or http://127.0.0.1:9000
+	Region    string
+	Bucket    string
+	Prefix    string // all the backups will be stored under the prefix in bucket
+	AccessKey string
+	SecretKey string
+}
+
+func Init(c Config) error {
+	if c.Endpoint == "" || c.Bucket == "" { // s3 not be configed
+		return errors.New("s3 endpoint or bucket is empty")
+	}
+	if !strings.HasPrefix(c.Endpoint, "http://") && !strings.HasPrefix(c.Endpoint, "https://") {
+		c.Endpoint = "https://" + c.Endpoint
+	}
+	c.Endpoint = strings.TrimRight(c.Endpoint, "/")
+	c.Prefix = strings.Trim(c.Prefix, "/")
+	if c.Region == "" {
+		c.Region = "us-east-1"
+	}
+	conf = c
+
+	// check the bucket is accessable
+	resp, err := request("HEAD", "", nil, nil, nil)
+	if err != nil {
+		return fmt.Errorf("Fail to access bucket %s on %s:%s", conf.Bucket, conf.Endpoint, err.Error())
+	}
+	resp.Body.Close()
+	backup.Register(&S3Driver{})
+	return nil
+}
+
+// object key in bucket for the given name
+func objectKey(name string) string {
+	return strings.TrimLeft(path.Join(conf.Prefix, name), "/")
+}
+
+// S3Error is the error returned by s3 server
+type S3Error struct {
+	Code       string `xml:"Code"`
+	Message    string `xml:"Message"`
+	StatusCode int    `xml:"-"`
+}
+
+func (e *S3Error) Error() string {
+	if e.Code == "" {
+		return fmt.Sprintf("s3 request failed with status %d", e.StatusCode)
+	}
+	return fmt.Sprintf("s3 request failed with status %d, %s: %s", e.StatusCode, e.Code, e.Message)
+}
+
+func notFound(op, name string, err error) error {
+	if e, ok := err.(*S3Error); ok && e.StatusCode == http.StatusNotFound {
+		return &os.PathError{Op: op, Path: name, Err: os.ErrNotExist}
+	}
+	return err
+}
+
+// send a signed request to s3 with the body in memory
+func request(method, key string, query url.Values, header http.Header, body []byte) (*http.Response, error) {
+	payloadHash := emptySHA256
+	if len(body) > 0 {
+		payloadHash = hashHex(body)
+	}
+	return send(method, key, query, header, bytes.NewReader(body), int64(len(body)), payloadHash)
+}
+
+// send a request signed with the sha256 of body, the body is read after it's hashed
+func send(method, key string, query url.Values, header http.Header, body io.Reader, size int64, payloadHash string) (*http.Response, error) {
+	u := &url.URL{
+		Path:     "/" + conf.Bucket,
+		RawQuery: query.Encode(),
+	}
+	if key != "" {
+		u.Path += "/" + key
+	}
+	u.RawPath = uriEncode(u.Path, false)
+	req, err := http.NewRequest(method, conf.Endpoint+u.RequestURI(), body)
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = size
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	sign(req, payloadHash, time.Now())
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		s3err := &S3Error{StatusCode: resp.StatusCode}
+		if content, err := ioutil.ReadAll(resp.Body); err == nil && len(content) > 0 {
+			xml.Unmarshal(content, s3err)
+		}
+		return nil, s3err
+	}
+	return resp, nil
+}
+
+func requestXML(method, key string, query url.Values, body []byte, v interface{}) error {
+	resp, err := request(method, key, query, nil, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if v == nil {
+		return nil
+	}
+	return xml.NewDecoder(resp.Body).Decode(v)
+}
+
+// upload the reader to the key, multipart upload is used if content is larger than partSize
+func upload(reader io.Reader, key string, header http.Header) error {
+	buf := make([]byte, partSize)
+	n, err := io.ReadFull(reader, buf)
+	if err == io.EOF || err == io.ErrUnexpectedEOF { // small object, put it directly
+		resp, err := request("PUT", key, nil, header, buf[:n])
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	var initiate struct {
+		UploadID string `xml:"UploadId"`
+	}
+	// the metadata must be given when initiating, not in the parts
+	resp, err := request("POST", key, url.Values{"uploads": []string{""}}, header, nil)
+	if err != nil {
+		return err
+	}
+	err = xml.NewDecoder(resp.Body).Decode(&initiate)
+	resp.Body.Close()
+	if err != nil {
+		return err
+	}
+	// wrapped into multipartUpload, so we can abort it easily
+	if err := multipartUpload(reader, key, initiate.UploadID, buf[:n]); err != nil {
+		if resp, err := request("DELETE", key, url.Values{"uploadId": []string{initiate.UploadID}}, nil, nil); err == nil {
+			resp.Body.Close()
+		}
+		return err
+	}
+	return nil
+}
+
+// partSizeOf returns the size of the part number, it grows with the number of parts uploaded
+func partSizeOf(number int) int {
+	size := int64(partSize)
+	for i := (number - 1) / partGrowth; i > 0 && size < maxPartSize; i-- {
+		size *= 2
+	}
+	if size > maxPartSize {
+		size = maxPartSize
+	}
+	return int(size)
+}
+
+type completePart struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+// partReader reads the parts of a multipart upload, the parts larger than memPartSize are spooled into a temp file
+type partReader struct {
+	reader io.Reader
+	buf    []byte
+	spool  *os.File
+}
+
+// next reads the part of size at most, it returns the part, its size and sha256
+func (p *partReader) next(size int) (io.Reader, int64, string, error) {
+	if size <= memPartSize {
+		if len(p.buf) != size {
+			p.buf = make([]byte, size)
+		}
+		n, err := io.ReadFull(p.reader, p.buf)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return nil, 0, "", err
+		}
+		return bytes.NewReader(p.buf[:n]), int64(n), hashHex(p.buf[:n]), nil
+	}
+
+	p.buf = nil
+	if p.spool == nil {
+		spool, err := ioutil.TempFile("", "backupd-s3-part")
+		if err != nil {
+			return nil, 0, "", err
+		}
+		p.spool = spool
+	}
+	if _, err := p.spool.Seek(0, io.SeekStart); err != nil {
+		return nil, 0, "", err
+	}
+	if err := p.spool.Truncate(0); err != nil {
+		return nil, 0, "", err
+	}
+	h := sha256.New()
+	n, err := io.CopyN(io.MultiWriter(p.spool, h), p.reader, int64(size))
+	if err != nil && err != io.EOF {
+		return nil, 0, "", err
+	}
+	return io.NewSectionReader(p.spool, 0, n), n, hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func (p *partReader) Close() {
+	if p.spool != nil {
+		p.spool.Close()
+		os.Remove(p.spool.Name())
+	}
+}
+
+func multipartUpload(reader io.Reader, key, uploadID string, first []byte) error {
+	var (
+		parts   []completePart
+		part    io.Reader = bytes.NewReader(first)
+		size              = int64(len(first))
+		hash              = hashHex(first)
+		partsIn           = &partReader{reader: reader}
+	)
+	defer partsIn.Close()
+	for number := 1; ; number++ {
+		query := url.Values{
+			"partNumber": []string{strconv.Itoa(number)},
+			"uploadId":   []string{uploadID},
+		}
+		resp, err := send("PUT", key, query, nil, part, size, hash)
+		if err != nil {
+			return fmt.Errorf("Fail to upload part %d of %s, %s", number, key, err.Error())
+		}
+		resp.Body.Close()
+		parts = append(parts, completePart{PartNumber: number, ETag: resp.Header.Get("ETag")})
+
+		if part, size, hash, err = partsIn.next(partSizeOf(number + 1)); err != nil {
+			return err
+		} else if size == 0 {
+			break
+		}
+	}
+
+	content, err := xml.Marshal(struct {
+		XMLName xml.Name       `xml:"CompleteMultipartUpload"`
+		Parts   []completePart `xml:"Part"`
+	}{Parts: parts})
+	if err != nil {
+		return err
+	}
+	return requestXML("POST", key, url.Values{"uploadId": []string{uploadID}}, content, nil)
+}
+
+// copyResult is the result of copying an object or a part, s3 may fail a copy with status 200 and an Error
+type copyResult struct {
+	XMLName xml.Name
+	ETag    string `xml:"ETag"`
+	S3Error
+}
+
+func copyRequest(key string, query url.Values, header http.Header) (string, error) {
+	resp, err := request("PUT", key, query, header, nil)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	var result copyResult
+	if err := xml.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return "", err
+	}
+	if result.XMLName.Local == "Error" {
+		result.S3Error.StatusCode = resp.StatusCode
+		return "", &result.S3Error
+	}
+	return result.ETag, nil
+}
+
+// copy the object src to dest, objects larger than copyLimit are copied with multipart upload
+func copyObject(src, dest string, size int64) error {
+	source := http.Header{"X-Amz-Copy-Source": []string{uriEncode("/"+conf.Bucket+"/"+src, false)}}
+	if size <= copyLimit {
+		_, err := copyRequest(dest, nil, source)
+		return err
+	}
+
+	var initiate struct {
+		UploadID string `xml:"UploadId"`
+	}
+	if err := requestXML("POST", dest, url.Values{"uploads": []string{""}}, nil, &initiate); err != nil {
+		return err
+	}
+	var parts []completePart
+	for start, number := int64(0), 1; start < size; start, number = start+copyLimit, number+1 {
+		end := start + copyLimit - 1
+		if end >= size {
+			end = size - 1
+		}
+		header := http.Header{
+			"X-Amz-Copy-Source":       source["X-Amz-Copy-Source"],
+			"X-Amz-Copy-Source-Range": []string{fmt.Sprintf("bytes=%d-%d", start, end)},
+		}
+		query := url.Values{
+			"partNumber": []string{strconv.Itoa(number)},
+			"uploadId":   []string{initiate.UploadID},
+		}
+		etag, err := copyRequest(dest, query, header)
+		if err != nil {
+			if resp, err := request("DELETE", dest, url.Values{"uploadId": []string{initiate.UploadID}}, nil, nil); err == nil {
+				resp.Body.Close()
+			}
+			return fmt.Errorf("Fail to copy part %d of %s, %s", number, src, err.Error())
+		}
+		parts = append(parts, completePart{PartNumber: number, ETag: etag})
+	}
+	content, err := xml.Marshal(struct {
+		XMLName xml.Name       `xml:"CompleteMultipartUpload"`
+		Parts   []completePart `xml:"Part"`
+	}{Parts: parts})
+	if err != nil {
+		return err
+	}
+	return requestXML("POST", dest, url.Values{"uploadId": []string{initiate.UploadID}}, content, nil)
+}
+
+type listResult struct {
+	Contents []struct {
+		Key          string    `xml:"Key"`
+		Size         int64     `xml:"Size"`
+		LastModified time.Time `xml:"LastModified"`
+	} `xml:"Contents"`
+	CommonPrefixes []struct {
+		Prefix string `xml:"Prefix"`
+	} `xml:"CommonPrefixes"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+// list all objects under the prefix, if delimiter is not empty, only the first level is listed
+func listObjects(prefix, delimiter string, limit int) ([]os.FileInfo, error) {
+	var (
+		ret   []os.FileInfo
+		token string
+	)
+	for {
+		query := url.Values{"list-type": []string{"2"}, "prefix": []string{prefix}}
+		if delimiter != "" {
+			query.Set("delimiter", delimiter)
+		}
+		if limit > 0 {
+			query.Set("max-keys", strconv.Itoa(limit))
+		}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		var result listResult
+		if err := requestXML("GET", "", query, nil, &result); err != nil {
+			return nil, err
+		}
+		for _, item := range result.Contents {
+			if item.Key == prefix { // the directory marker itself
+				continue
+			}
+			ret = append(ret, &fileInfo{
+				name:    item.Key[len(prefix):],
+				size:    item.Size,
+				mode:    0644,
+				modTime: item.LastModified,
+			})
+		}
+		for _, item := range result.CommonPrefixes {
+			ret = append(ret, &fileInfo{
+				name: strings.TrimSuffix(item.Prefix[len(prefix):], "/"),
+				mode: os.ModeDir | 0755,
+			})
+		}
+		if !result.IsTruncated || (limit > 0 && len(ret) >= limit) {
+			break
+		}
+		token = result.NextContinuationToken
+	}
+	return ret, nil
+}
+
+type fileInfo struct {
+	name    string
+	size    int64
+	mode    os.FileMode
+	modTime time.Time
+}
+
+func (fi *fileInfo) Name() string       { return fi.name }
+func (fi *fileInfo) Size() int64        { return fi.size }
+func (fi *fileInfo) Mode() os.FileMode  { return fi.mode }
+func (fi *fileInfo) ModTime() time.Time { return fi.modTime }
+func (fi *fileInfo) IsDir() bool        { return fi.mode.IsDir() }
+func (fi *fileInfo) Sys() interface{}   { return nil }
+
+type S3Driver struct{}
+
+func (driver *S3Driver) Name() string {
+	return "s3"
+}
+
+func (driver *S3Driver) Upload(reader io.Reader, dest string) error {
+	return upload(reader, objectKey(dest), nil)
+}
+
+// Create writes the object only if it does not exist by a conditional put, it's for small files like the meta journal
+func (driver *S3Driver) Create(reader io.Reader, dest string) error {
+	content, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return err
+	}
+	resp, err := request("PUT", objectKey(dest), nil, http.Header{"If-None-Match": {"*"}}, content)
+	if err != nil {
+		// 409 is returned if a conditional put to the same key is in progress
+		if e, ok := err.(*S3Error); ok && (e.StatusCode == http.StatusPreconditionFailed || e.StatusCode == http.StatusConflict) {
+			return &os.PathError{Op: "create", Path: dest, Err: os.ErrExist}
+		}
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (driver *S3Driver) Download(writer io.Writer, src string) error {
+	resp, err := request("GET", objectKey(src), nil, nil, nil)
+	if err != nil {
+		return notFound("download", src, err)
+	}
+	defer resp.Body.Close()
+	if _, err := io.Copy(writer, resp.Body); err != nil {
+		return err
+	}
+	return nil
+}
+
+// s3 has no directory, the objects having prefix "<dir>/" are seen as the files in dir
+func (driver *S3Driver) List(dir string) ([]os.FileInfo, error) {
+	prefix := objectKey(dir)
+	if prefix != "" {
+		prefix += "/"
+	}
+	ret, err := listObjects(prefix, "/", 0)
+	if err != nil {
+		return nil, err
+	}
+	if len(ret) == 0 {
+		return nil, &os.PathError{Op: "list", Path: dir, Err: os.ErrNotExist}
+	}
+	return ret, nil
+}
+
+// delete the object, and all the objects under it if it's a directory
+func (driver *S3Driver) Delete(file string) error {
+	key := objectKey(file)
+	children, err := listObjects(key+"/", "", 0)
+	if err != nil {
+		return err
+	}
+	for _, child := range children {
+		resp, err := request("DELETE", key+"/"+child.Name(), nil, nil, nil)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+	}
+	if len(children) > 0 { // the index of the synced directory
+		if resp, err := request("DELETE", rsyncIndex(key), nil, nil, nil); err == nil {
+			resp.Body.Close()
+		} else if !os.IsNotExist(notFound("delete", file, err)) {
+			return err
+		}
+	}
+	resp, err := request("DELETE", key, nil, nil, nil)
+	if err != nil {
+		return notFound("delete", file, err)
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (driver *S3Driver) FileInfo(name string) (os.FileInfo, error) {
+	key := objectKey(name)
+	resp, err := request("HEAD", key, nil, nil, nil)
+	if err != nil {
+		if e, ok := err.(*S3Error); !ok || e.StatusCode != http.StatusNotFound {
+			return nil, err
+		}
+		// not a object, maybe it's a directory
+		children, err := listObjects(key+"/", "/", 1)
+		if err != nil {
+			return nil, err
+		}
+		if len(children) == 0 {
+			return nil, &os.PathError{Op: "stat", Path: name, Err: os.ErrNotExist}
+		}
+		return &fileInfo{name: path.Base(name), mode: os.ModeDir | 0755}, nil
+	}
+	resp.Body.Close()
+
+	info := &fileInfo{
+		name: path.Base(name),
+		size: resp.ContentLength,
+		mode: 0644,
+	}
+	info.modTime, _ = http.ParseTime(resp.Header.Get("Last-Modified"))
+	if sec, err := strconv.ParseInt(resp.Header.Get(metaMtime), 10, 64); err == nil {
+		info.modTime = time.Unix(sec, 0)
+	}
+	if mode, err := strconv.ParseUint(resp.Header.Get(metaMode), 8, 32); err == nil {
+		info.mode = os.FileMode(mode)
+	}
+	return info, nil
+}
+
+// Commit copies the staged object to dest and deletes it, s3 has no rename.
+// The copy is atomic, dest is never seen partly.
+func (driver *S3Driver) Commit(staged, dest string) error {
+	info, err := driver.FileInfo(staged)
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		return fmt.Errorf("Staged file %s is a directory", staged)
+	}
+	if err := copyObject(objectKey(staged), objectKey(dest), info.Size()); err != nil {
+		return notFound("commit", staged, err)
+	}
+	resp, err := request("DELETE", objectKey(staged), nil, nil, nil)
+	if err != nil {
+		return notFound("commit", staged, err)
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// Abort removes the staged object
+func (driver *S3Driver) Abort(staged string) error {
+	return driver.Delete(staged)
+}
+
+// upload the files in src selected by filter which are new or changed since last time.
+// file's mode and mtime are stored in object's metadata
+func (driver *S3Driver) Rsync(src, dest string, filter *backup.Filter) error {
+	return rsync(src, dest, "", filter)
+}
+
+// SnapshotRsync is Rsync which copies the objects of dest into saveDir in the bucket before they are replaced
+func (driver *S3Driver) SnapshotRsync(src, dest, saveDir string, filter *backup.Filter) error {
+	return rsync(src, dest, saveDir, filter)
+}
+
+// rsyncIndex returns the key of the index beside the synced directory key,
+// it records the size and mtime of the synced files so the unchanged ones are found without a HEAD for each
+func rsyncIndex(key string) string {
+	return path.Join(path.Dir(key), "."+path.Base(key)+".rsync")
+}
+
+type syncedFile struct {
+	Size  int64 `json:"size"`
+	Mtime int64 `json:"mtime"`
+}
+
+// loadSynced returns the files recorded in the index of key and the time it's written,
+// the objects uploaded after that are not recorded. An empty index is returned if it's not found or broken.
+func loadSynced(key string) (map[string]syncedFile, time.Time, error) {
+	synced := make(map[string]syncedFile)
+	resp, err := request("GET", rsyncIndex(key), nil, nil, nil)
+	if err != nil {
+		if e, ok := err.(*S3Error); ok && e.StatusCode == http.StatusNotFound {
+			return synced, time.Time{}, nil
+		}
+		return nil, time.Time{}, err
+	}
+	defer resp.Body.Close()
+	written, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+	if err := json.NewDecoder(resp.Body).Decode(&synced); err != nil {
+		return make(map[string]syncedFile), time.Time{}, nil
+	}
+	return synced, written, nil
+}
+
+func rsync(src, dest, saveDir string, filter *backup.Filter) error {
+	prefix := objectKey(dest) + "/"
+	synced, written, err := loadSynced(objectKey(dest))
+	if err != nil {
+		return err
+	}
+	files := make(map[string]syncedFile) // the index written after the sync
+	remotes := make(map[string]os.FileInfo)
+	objects, err := listObjects(prefix, "", 0)
+	if err != nil {
+		return err
+	}
+	for _, obj := range objects {
+		remotes[obj.Name()] = obj
+	}
+	saved := make(map[string]bool)
+	if saveDir != "" {
+		objects, err := listObjects(objectKey(saveDir)+"/", "", 0)
+		if err != nil {
+			return err
+		}
+		for _, obj := range objects {
+			saved[obj.Name()] = true
+		}
+	}
+
+	err = filepath.Walk(src, func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, file)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if !filter.Match(rel, info.IsDir()) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !info.Mode().IsRegular() { // directories are implicit in s3, symlinks are skipped like --safe-links
+			return nil
+		}
+		files[rel] = syncedFile{Size: info.Size(), Mtime: info.ModTime().Unix()}
+		if remote, ok := remotes[rel]; ok && remote.Size() == info.Size() {
+			mtime := synced[rel].Mtime
+			if f, ok := synced[rel]; !ok || f.Size != remote.Size() || !remote.ModTime().Before(written) {
+				// the listing only has the upload time, the mtime of the file is stored in the metadata
+				stored, err := (&S3Driver{}).FileInfo(path.Join(dest, rel))
+				if err != nil {
+					return err
+				}
+				mtime = stored.ModTime().Unix()
+			}
+			if mtime == info.ModTime().Unix() {
+				return nil // not changed since last upload
+			}
+		}
+		if remote, ok := remotes[rel]; ok && saveDir != "" && !saved[rel] { // the older version already saved is kept
+			if err := copyObject(prefix+rel, objectKey(saveDir)+"/"+rel, remote.Size()); err != nil {
+				return fmt.Errorf("Fail to save %s, %s", prefix+rel, err.Error())
+			}
+		}
+
+		f, err := os.Open(file)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		header := http.Header{}
+		header.Set(metaMtime, strconv.FormatInt(info.ModTime().Unix(), 10))
+		header.Set(metaMode, strconv.FormatUint(uint64(info.Mode().Perm()), 8))
+		if err := upload(f, prefix+rel, header); err != nil {
+			return fmt.Errorf("Fail to upload %s, %s", file, err.Error())
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	content, err := json.Marshal(files)
+	if err != nil {
+		return err
+	}
+	return upload(bytes.NewReader(content), rsyncIndex(objectKey(dest)), nil)
+}
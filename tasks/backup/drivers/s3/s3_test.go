@@ -0,0 +1,424 @@
+package s3
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeS3 is a in-memory s3 server supporting the api used by the driver
+type fakeS3 struct {
+	lock     sync.Mutex
+	objects  map[string][]byte
+	meta     map[string]http.Header
+	modified map[string]time.Time
+	uploads  map[string]map[int][]byte
+	parts    []int // sizes of the parts uploaded
+	heads    int   // number of the HEAD requests of objects
+}
+
+func newFakeS3() *fakeS3 {
+	return &fakeS3{
+		objects:  make(map[string][]byte),
+		meta:     make(map[string]http.Header),
+		modified: make(map[string]time.Time),
+		uploads:  make(map[string]map[int][]byte),
+	}
+}
+
+func (s *fakeS3) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if !strings.HasPrefix(req.Header.Get("Authorization"), signAlgorithm) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	fields := strings.SplitN(strings.TrimPrefix(req.URL.Path, "/"), "/", 2)
+	if fields[0] != "bucket" {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	key, query := "", req.URL.Query()
+	if len(fields) > 1 {
+		key = fields[1]
+	}
+	body, _ := ioutil.ReadAll(req.Body)
+	if req.Method == "PUT" || req.Method == "POST" {
+		s.modified[key] = time.Now()
+	}
+
+	switch {
+	case key == "" && req.Method == "HEAD":
+	case key == "" && req.Method == "GET":
+		s.list(w, query.Get("prefix"), query.Get("delimiter"))
+	case req.Method == "POST" && query.Get("uploadId") == "":
+		s.uploads[key] = make(map[int][]byte)
+		s.meta[key] = req.Header
+		fmt.Fprintf(w, "<InitiateMultipartUploadResult><UploadId>%s</UploadId></InitiateMultipartUploadResult>", key)
+	case req.Method == "POST":
+		var data []byte
+		for i := 1; i <= len(s.uploads[key]); i++ {
+			data = append(data, s.uploads[key][i]...)
+		}
+		s.objects[key] = data
+		delete(s.uploads, key)
+		w.Write([]byte("<CompleteMultipartUploadResult/>"))
+	case req.Method == "PUT" && req.Header.Get("X-Amz-Copy-Source") != "":
+		src := strings.TrimPrefix(req.Header.Get("X-Amz-Copy-Source"), "/bucket/")
+		data, ok := s.objects[src]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if query.Get("uploadId") == "" {
+			s.objects[key], s.meta[key] = data, s.meta[src]
+			w.Write([]byte("<CopyObjectResult><ETag>\"0\"</ETag></CopyObjectResult>"))
+			return
+		}
+		var number, start, end int
+		fmt.Sscanf(query.Get("partNumber"), "%d", &number)
+		fmt.Sscanf(req.Header.Get("X-Amz-Copy-Source-Range"), "bytes=%d-%d", &start, &end)
+		s.uploads[key][number] = data[start : end+1]
+		fmt.Fprintf(w, "<CopyPartResult><ETag>\"%d\"</ETag></CopyPartResult>", number)
+	case req.Method == "PUT" && query.Get("uploadId") != "":
+		var number int
+		fmt.Sscanf(query.Get("partNumber"), "%d", &number)
+		s.uploads[key][number] = body
+		s.parts = append(s.parts, len(body))
+		w.Header().Set("ETag", fmt.Sprintf("\"%d\"", number))
+	case req.Method == "PUT":
+		if _, ok := s.objects[key]; ok && req.Header.Get("If-None-Match") == "*" {
+			w.WriteHeader(http.StatusPreconditionFailed)
+			return
+		}
+		s.objects[key], s.meta[key] = body, req.Header
+	case req.Method == "GET", req.Method == "HEAD":
+		data, ok := s.objects[key]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if req.Method == "HEAD" {
+			s.heads++
+		}
+		for k, v := range s.meta[key] {
+			if strings.HasPrefix(strings.ToLower(k), "x-amz-meta-") {
+				w.Header()[k] = v
+			}
+		}
+		w.Header().Set("Last-Modified", s.modified[key].UTC().Format(http.TimeFormat))
+		w.Header().Set("Content-Length", fmt.Sprintf("%d", len(data)))
+		if req.Method == "GET" {
+			w.Write(data)
+		}
+	case req.Method == "DELETE":
+		delete(s.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func (s *fakeS3) list(w http.ResponseWriter, prefix, delimiter string) {
+	var (
+		result   listResult
+		keys     []string
+		prefixes = make(map[string]bool)
+	)
+	for k := range s.objects {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if !strings.HasPrefix(k, prefix) {
+			continue
+		}
+		rest := k[len(prefix):]
+		if i := strings.Index(rest, delimiter); delimiter != "" && i >= 0 {
+			prefixes[prefix+rest[:i+1]] = true
+			continue
+		}
+		result.Contents = append(result.Contents, struct {
+			Key          string    `xml:"Key"`
+			Size         int64     `xml:"Size"`
+			LastModified time.Time `xml:"LastModified"`
+		}{k, int64(len(s.objects[k])), s.modified[k].UTC()})
+	}
+	for p := range prefixes {
+		result.CommonPrefixes = append(result.CommonPrefixes, struct {
+			Prefix string `xml:"Prefix"`
+		}{p})
+	}
+	content, _ := xml.Marshal(struct {
+		XMLName xml.Name `xml:"ListBucketResult"`
+		listResult
+	}{listResult: result})
+	w.Write(content)
+}
+
+func setup(t *testing.T) (*S3Driver, *fakeS3, func()) {
+	fake := newFakeS3()
+	server := httptest.NewServer(fake)
+	partSize, partGrowth = 8, 1000
+	conf = Config{
+		Endpoint:  server.URL,
+		Region:    "us-east-1",
+		Bucket:    "bucket",
+		Prefix:    "backup",
+		AccessKey: "access",
+		SecretKey: "secret",
+	}
+	return &S3Driver{}, fake, server.Close
+}
+
+func TestInit(t *testing.T) {
+	server := httptest.NewServer(newFakeS3())
+	defer server.Close()
+	if err := Init(Config{Endpoint: server.URL, Bucket: "notexist", AccessKey: "a"}); err == nil {
+		t.Error("init should fail if bucket not exist")
+	}
+	if err := Init(Config{Endpoint: server.URL + "/", Bucket: "bucket", Prefix: "/backup/", AccessKey: "a"}); err != nil {
+		t.Fatal(err)
+	}
+	if conf.Prefix != "backup" || conf.Region != "us-east-1" {
+		t.Errorf("config not normalized, %+v", conf)
+	}
+}
+
+func TestUploadAndDownload(t *testing.T) {
+	driver, fake, stop := setup(t)
+	defer stop()
+
+	for _, content := range []string{"small", "a content larger than one part"} {
+		if err := driver.Upload(strings.NewReader(content), "10.0.0.1/file"); err != nil {
+			t.Fatal(err)
+		}
+		if string(fake.objects["backup/10.0.0.1/file"]) != content {
+			t.Errorf("uploaded content is %q, expect %q", fake.objects["backup/10.0.0.1/file"], content)
+		}
+		var buf bytes.Buffer
+		if err := driver.Download(&buf, "10.0.0.1/file"); err != nil {
+			t.Fatal(err)
+		}
+		if buf.String() != content {
+			t.Errorf("downloaded content is %q, expect %q", buf.String(), content)
+		}
+	}
+
+	err := driver.Download(&bytes.Buffer{}, "10.0.0.1/notexist")
+	if perr, ok := err.(*os.PathError); !ok || !os.IsNotExist(perr.Err) {
+		t.Errorf("expect not exist error, got %v", err)
+	}
+}
+
+func TestListDeleteAndFileInfo(t *testing.T) {
+	driver, _, stop := setup(t)
+	defer stop()
+
+	for _, name := range []string{"ns/a.tar.gz", "ns/dir/b", "ns/dir/c"} {
+		if err := driver.Upload(strings.NewReader(name), name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	list, err := driver.List("ns")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 2 {
+		t.Fatalf("expect 2 items in ns, got %d", len(list))
+	}
+
+	info, err := driver.FileInfo("ns/dir")
+	if err != nil || !info.IsDir() {
+		t.Errorf("ns/dir should be a directory, %v", err)
+	}
+	info, err = driver.FileInfo("ns/a.tar.gz")
+	if err != nil || info.IsDir() || info.Size() != int64(len("ns/a.tar.gz")) {
+		t.Errorf("unexpected file info of ns/a.tar.gz, %+v, %v", info, err)
+	}
+
+	if err := driver.Delete("ns/dir"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := driver.FileInfo("ns/dir/b"); !os.IsNotExist(err.(*os.PathError).Err) {
+		t.Errorf("ns/dir/b should be deleted, %v", err)
+	}
+}
+
+func TestRsync(t *testing.T) {
+	driver, fake, stop := setup(t)
+	defer stop()
+
+	src, err := ioutil.TempDir("", "s3-rsync")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(src)
+	os.MkdirAll(path.Join(src, "sub"), 0755)
+	ioutil.WriteFile(path.Join(src, "a"), []byte("file a"), 0600)
+	ioutil.WriteFile(path.Join(src, "sub", "b"), []byte("file b"), 0644)
+
+	if err := driver.Rsync(src, "ns/inc", nil); err != nil {
+		t.Fatal(err)
+	}
+	if string(fake.objects["backup/ns/inc/sub/b"]) != "file b" {
+		t.Errorf("sub/b not synced")
+	}
+	info, err := driver.FileInfo("ns/inc/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("mode of a should be kept, got %v", info.Mode())
+	}
+
+	// the files recorded in the index are compared without HEAD
+	if _, ok := fake.objects["backup/ns/.inc.rsync"]; !ok {
+		t.Fatal("the index of synced files should be written")
+	}
+	for key := range fake.objects {
+		if strings.HasPrefix(key, "backup/ns/inc/") {
+			fake.modified[key] = fake.modified[key].Add(-time.Hour)
+		}
+	}
+	fake.heads = 0
+	if err := driver.Rsync(src, "ns/inc", nil); err != nil {
+		t.Fatal(err)
+	}
+	if fake.heads != 0 {
+		t.Errorf("the unchanged files should be found by the index, %d HEAD sent", fake.heads)
+	}
+
+	// unchanged files should not be uploaded again, the ones changed after the index is written are checked by HEAD
+	fake.objects["backup/ns/inc/a"], fake.modified["backup/ns/inc/a"] = []byte("file x"), time.Now().Add(time.Minute)
+	if err := driver.Rsync(src, "ns/inc", nil); err != nil {
+		t.Fatal(err)
+	}
+	if string(fake.objects["backup/ns/inc/a"]) != "file x" {
+		t.Errorf("a is uploaded again although it's not changed")
+	}
+
+	// an older version of the same size is uploaded, the mtime stored is compared instead of the upload time
+	ioutil.WriteFile(path.Join(src, "a"), []byte("file c"), 0600)
+	mtime := time.Now().Add(-time.Hour)
+	os.Chtimes(path.Join(src, "a"), mtime, mtime)
+	if err := driver.Rsync(src, "ns/inc", nil); err != nil {
+		t.Fatal(err)
+	}
+	if string(fake.objects["backup/ns/inc/a"]) != "file c" {
+		t.Errorf("a should be uploaded as its mtime changed, got %q", fake.objects["backup/ns/inc/a"])
+	}
+
+	if err := driver.Delete("ns/inc"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := fake.objects["backup/ns/.inc.rsync"]; ok {
+		t.Error("the index should be deleted with the directory")
+	}
+}
+
+func TestPartSizeGrowth(t *testing.T) {
+	driver, fake, stop := setup(t)
+	defer stop()
+
+	partGrowth, memPartSize = 2, 8 // the parts of 16 bytes are spooled
+	defer func() { partGrowth, memPartSize = 1000, 64<<20 }()
+	content := strings.Repeat("x", 8*2+16*2+10)
+	if err := driver.Upload(strings.NewReader(content), "ns/big"); err != nil {
+		t.Fatal(err)
+	}
+	if string(fake.objects["backup/ns/big"]) != content {
+		t.Errorf("uploaded content is broken")
+	}
+	if fmt.Sprint(fake.parts) != "[8 8 16 16 10]" {
+		t.Errorf("part sizes should grow, got %v", fake.parts)
+	}
+	if size := partSizeOf(100); int64(size) != maxPartSize {
+		t.Errorf("part size should be capped at %d, got %d", maxPartSize, size)
+	}
+}
+
+func TestSnapshotRsync(t *testing.T) {
+	driver, fake, stop := setup(t)
+	defer stop()
+
+	src, err := ioutil.TempDir("", "s3-rsync")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(src)
+	ioutil.WriteFile(path.Join(src, "a"), []byte("a1"), 0600)
+	ioutil.WriteFile(path.Join(src, "b"), []byte("b1"), 0600)
+	if err := driver.Rsync(src, "ns/inc", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	driver.Upload(strings.NewReader("b0"), "ns/inc@1/b")
+	mtime := time.Now().Add(time.Hour)
+	for _, file := range []string{"a", "b"} {
+		ioutil.WriteFile(path.Join(src, file), []byte(file+"2"), 0600)
+		os.Chtimes(path.Join(src, file), mtime, mtime)
+	}
+	if err := driver.SnapshotRsync(src, "ns/inc", "ns/inc@1", nil); err != nil {
+		t.Fatal(err)
+	}
+	for key, content := range map[string]string{"ns/inc/a": "a2", "ns/inc/b": "b2", "ns/inc@1/a": "a1", "ns/inc@1/b": "b0"} {
+		if string(fake.objects["backup/"+key]) != content {
+			t.Errorf("%s should be %q, got %q", key, content, fake.objects["backup/"+key])
+		}
+	}
+}
+
+func TestCommitAndAbort(t *testing.T) {
+	driver, fake, clean := setup(t)
+	defer clean()
+
+	for _, limit := range []int64{5 << 30, 4} {
+		copyLimit = limit
+		driver.Upload(strings.NewReader("hello world"), "ns/.staging/a.tar.gz.1")
+		if err := driver.Commit("ns/.staging/a.tar.gz.1", "ns/a.tar.gz"); err != nil {
+			t.Fatal(err)
+		}
+		if content := fake.objects["backup/ns/a.tar.gz"]; string(content) != "hello world" {
+			t.Errorf("staged file should be copied to dest in parts of %d, got %q", limit, content)
+		}
+		if _, ok := fake.objects["backup/ns/.staging/a.tar.gz.1"]; ok {
+			t.Error("staged file should be deleted after committed")
+		}
+	}
+	copyLimit = 5 << 30
+	if err := driver.Commit("ns/.staging/missing", "ns/a.tar.gz"); !os.IsNotExist(err) {
+		t.Errorf("committing a missing file should fail, %v", err)
+	}
+	driver.Upload(strings.NewReader("part"), "ns/.staging/b.tar.gz.2")
+	if err := driver.Abort("ns/.staging/b.tar.gz.2"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := fake.objects["backup/ns/.staging/b.tar.gz.2"]; ok {
+		t.Error("staged file should be removed")
+	}
+}
+
+func TestCreate(t *testing.T) {
+	driver, _, clean := setup(t)
+	defer clean()
+
+	if err := driver.Create(strings.NewReader("first"), "ns/.meta.journal/1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := driver.Create(strings.NewReader("second"), "ns/.meta.journal/1"); !os.IsExist(err) {
+		t.Errorf("creating an existing file should fail, %v", err)
+	}
+	var buf bytes.Buffer
+	if err := driver.Download(&buf, "ns/.meta.journal/1"); err != nil || buf.String() != "first" {
+		t.Errorf("the file should not be replaced, %q %v", buf.String(), err)
+	}
+}
@@ -0,0 +1,395 @@
+package sftp
+
+import (
+	"errors"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/laincloud/backupd/tasks/backup"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	conf   Config
+	client *sftp.Client
+	lock   sync.Mutex
+)
+
+// Config is the ssh connection settings of the backup host
+type Config struct {
+	Addr       string // host:port of the ssh server
+	User       string
+	KeyFile    string // private key used to login
+	KnownHosts string // known_hosts file used to check the server's host key
+	Dir        string // the directory backups stored in on the backup host
+}
+
+func Init(c Config) error {
+	if c.Addr == "" || c.Dir == "" { // sftp not be configed
+		return errors.New("sftp address or directory is empty")
+	}
+	if c.KeyFile == "" || c.KnownHosts == "" {
+		return errors.New("sftp private key file and known hosts file must be given")
+	}
+	if !strings.Contains(c.Addr, ":") {
+		c.Addr += ":22"
+	}
+	conf = c
+
+	return withClient(func(cli *sftp.Client) error {
+		info, err := cli.Stat(conf.Dir)
+		if err != nil { // directory not exist, create it
+			if err := cli.MkdirAll(conf.Dir); err != nil {
+				return fmt.Errorf("Fail to create dir %s on %s:%s", conf.Dir, conf.Addr, err.Error())
+			}
+		} else if !info.IsDir() {
+			return fmt.Errorf("%s on %s already exist, but it's not a directory", conf.Dir, conf.Addr)
+		}
+		backup.Register(&SftpDriver{})
+		return nil
+	})
+}
+
+func dial() (*sftp.Client, error) {
+	key, err := ioutil.ReadFile(conf.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	signer, err := ssh.ParsePrivateKey(key)
+	if err != nil {
+		return nil, fmt.Errorf("Unvalid private key %s, %s", conf.KeyFile, err.Error())
+	}
+	hostKeyCallback, err := knownhosts.New(conf.KnownHosts)
+	if err != nil {
+		return nil, fmt.Errorf("Unvalid known hosts file %s, %s", conf.KnownHosts, err.Error())
+	}
+	conn, err := ssh.Dial("tcp", conf.Addr, &ssh.ClientConfig{
+		User:            conf.User,
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+		HostKeyCallback: hostKeyCallback,
+		Timeout:         30 * time.Second,
+	})
+	if err != nil {
+		return nil, err
+	}
+	cli, err := sftp.NewClient(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return cli, nil
+}
+
+// run f with the shared sftp client, the connection will be rebuilt next time if it's broken
+func withClient(f func(*sftp.Client) error) error {
+	lock.Lock()
+	if client == nil {
+		cli, err := dial()
+		if err != nil {
+			lock.Unlock()
+			return fmt.Errorf("Fail to connect to %s, %s", conf.Addr, err.Error())
+		}
+		client = cli
+	}
+	cli := client
+	lock.Unlock()
+
+	err := f(cli)
+	if err != nil && brokenConn(err) {
+		log.Warnf("Connection to %s broken, %s, reconnect next time", conf.Addr, err.Error())
+		lock.Lock()
+		if client == cli {
+			client.Close()
+			client = nil
+		}
+		lock.Unlock()
+	}
+	return err
+}
+
+func brokenConn(err error) bool {
+	if _, ok := err.(*os.PathError); ok {
+		return false
+	}
+	if _, ok := err.(*sftp.StatusError); ok {
+		return false
+	}
+	return err == io.EOF || err == io.ErrUnexpectedEOF || err == sftp.ErrSSHFxConnectionLost ||
+		strings.Contains(err.Error(), "connection")
+}
+
+// do not expose the backup directory in errors
+func errorFilter(err error) error {
+	if perr, ok := err.(*os.PathError); ok {
+		perr.Path = strings.TrimPrefix(strings.TrimPrefix(perr.Path, conf.Dir), "/")
+		return perr
+	}
+	return err
+}
+
+// write the reader into a temporary file and rename it to file, so file is always complete
+func atomicWrite(cli *sftp.Client, reader io.Reader, file string) error {
+	return writeTemp(cli, reader, file, cli.PosixRename)
+}
+
+// write the reader into file if it does not exist, the temporary file is hard linked to file by the extension
+// hardlink@openssh.com, which fails if file exists
+func atomicCreate(cli *sftp.Client, reader io.Reader, file string) error {
+	return writeTemp(cli, reader, file, func(tmp, file string) error {
+		defer cli.Remove(tmp)
+		if err := cli.Link(tmp, file); err != nil {
+			if _, serr := cli.Lstat(file); serr == nil { // sftp v3 has no status of existing file
+				return &os.PathError{Op: "create", Path: file, Err: os.ErrExist}
+			}
+			return err
+		}
+		return nil
+	})
+}
+
+// writeTemp writes the reader into a temporary file besides file, and publishes it as file
+func writeTemp(cli *sftp.Client, reader io.Reader, file string, publish func(tmp, file string) error) error {
+	if err := cli.MkdirAll(path.Dir(file)); err != nil {
+		return err
+	}
+	tmp := path.Join(path.Dir(file), fmt.Sprintf(".%s.tmp%d", path.Base(file), time.Now().UnixNano()))
+	out, err := cli.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if _, err := out.ReadFrom(reader); err != nil {
+		out.Close()
+		cli.Remove(tmp)
+		return err
+	}
+	if err := out.Close(); err != nil {
+		cli.Remove(tmp)
+		return err
+	}
+	if err := publish(tmp, file); err != nil {
+		cli.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+type SftpDriver struct{}
+
+func (driver *SftpDriver) Name() string {
+	return "sftp"
+}
+
+func (driver *SftpDriver) Upload(reader io.Reader, dest string) error {
+	return withClient(func(cli *sftp.Client) error {
+		return errorFilter(atomicWrite(cli, reader, path.Join(conf.Dir, dest)))
+	})
+}
+
+// Create writes the file only if it does not exist
+func (driver *SftpDriver) Create(reader io.Reader, dest string) error {
+	return withClient(func(cli *sftp.Client) error {
+		return errorFilter(atomicCreate(cli, reader, path.Join(conf.Dir, dest)))
+	})
+}
+
+func (driver *SftpDriver) Download(writer io.Writer, src string) error {
+	return withClient(func(cli *sftp.Client) error {
+		in, err := cli.Open(path.Join(conf.Dir, src))
+		if err != nil {
+			return errorFilter(err)
+		}
+		defer in.Close()
+		if _, err := in.WriteTo(writer); err != nil {
+			return err
+		}
+		return nil
+	})
+}
+
+func (driver *SftpDriver) List(dir string) ([]os.FileInfo, error) {
+	var ret []os.FileInfo
+	err := withClient(func(cli *sftp.Client) error {
+		var err error
+		ret, err = cli.ReadDir(path.Join(conf.Dir, dir))
+		return errorFilter(err)
+	})
+	return ret, err
+}
+
+func (driver *SftpDriver) Delete(file string) error {
+	return withClient(func(cli *sftp.Client) error {
+		return errorFilter(cli.RemoveAll(path.Join(conf.Dir, file)))
+	})
+}
+
+func (driver *SftpDriver) FileInfo(name string) (os.FileInfo, error) {
+	var ret os.FileInfo
+	err := withClient(func(cli *sftp.Client) error {
+		var err error
+		ret, err = cli.Stat(path.Join(conf.Dir, name))
+		return errorFilter(err)
+	})
+	return ret, err
+}
+
+// Rename renames src to dest by posix-rename@openssh.com, dest is replaced if exists
+func (driver *SftpDriver) Rename(src, dest string) error {
+	return withClient(func(cli *sftp.Client) error {
+		return errorFilter(cli.PosixRename(path.Join(conf.Dir, src), path.Join(conf.Dir, dest)))
+	})
+}
+
+// Commit renames the staged file to dest
+func (driver *SftpDriver) Commit(staged, dest string) error {
+	return withClient(func(cli *sftp.Client) error {
+		if err := cli.MkdirAll(path.Dir(path.Join(conf.Dir, dest))); err != nil {
+			return err
+		}
+		return errorFilter(cli.PosixRename(path.Join(conf.Dir, staged), path.Join(conf.Dir, dest)))
+	})
+}
+
+// Abort removes the staged file
+func (driver *SftpDriver) Abort(staged string) error {
+	return driver.Delete(staged)
+}
+
+// Rsync uploads the new or changed files in src selected by filter to dest, a file is seen as changed if its size or mtime is different.
+// Mode and mtime are kept on the backup host, safe symlinks are copied like `rsync -a --safe-links`
+func (driver *SftpDriver) Rsync(src, dest string, filter *backup.Filter) error {
+	return rsync(src, dest, "", filter)
+}
+
+// SnapshotRsync is Rsync which hard links the regular files of dest into saveDir before they are replaced,
+// or copies them if the server has no hardlink extension
+func (driver *SftpDriver) SnapshotRsync(src, dest, saveDir string, filter *backup.Filter) error {
+	return rsync(src, dest, saveDir, filter)
+}
+
+// save the file replaced by the sync into saved, the older version already saved is kept
+func saveFile(cli *sftp.Client, file, saved string) error {
+	if _, err := cli.Lstat(saved); err == nil {
+		return nil
+	}
+	if err := cli.MkdirAll(path.Dir(saved)); err != nil {
+		return err
+	}
+	if err := cli.Link(file, saved); err == nil {
+		return nil
+	}
+	in, err := cli.Open(file)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	return atomicWrite(cli, in, saved)
+}
+
+func rsync(src, dest, saveDir string, filter *backup.Filter) error {
+	src = path.Clean(src)
+	return withClient(func(cli *sftp.Client) error {
+		dest := path.Join(conf.Dir, dest)
+		save := func(rel, target string, remote os.FileInfo) error {
+			if saveDir == "" || !remote.Mode().IsRegular() {
+				return nil
+			}
+			return errorFilter(saveFile(cli, target, path.Join(conf.Dir, saveDir, rel)))
+		}
+		if err := cli.MkdirAll(dest); err != nil {
+			return errorFilter(err)
+		}
+
+		// collect the files already on the backup host
+		remotes := make(map[string]os.FileInfo)
+		walker := cli.Walk(dest)
+		for walker.Step() {
+			if walker.Err() != nil {
+				return errorFilter(walker.Err())
+			}
+			remotes[walker.Path()] = walker.Stat()
+		}
+
+		return filepath.Walk(src, func(file string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			rel, err := filepath.Rel(src, file)
+			if err != nil {
+				return err
+			}
+			if !filter.Match(filepath.ToSlash(rel), info.IsDir()) {
+				if info.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			target := path.Join(dest, filepath.ToSlash(rel))
+			remote, exist := remotes[target]
+
+			switch {
+			case info.IsDir():
+				if !exist {
+					if err := cli.MkdirAll(target); err != nil {
+						return errorFilter(err)
+					}
+				}
+			case info.Mode()&os.ModeSymlink != 0:
+				link, err := os.Readlink(file)
+				if err != nil {
+					return err
+				}
+				if path.IsAbs(link) || strings.HasPrefix(path.Join(path.Dir(rel), link), "..") {
+					return nil // unsafe symlink, ignore it like --safe-links
+				}
+				if exist {
+					if old, err := cli.ReadLink(target); err == nil && old == link {
+						return nil
+					}
+					if err := save(filepath.ToSlash(rel), target, remote); err != nil {
+						return err
+					}
+					cli.Remove(target)
+				}
+				return errorFilter(cli.Symlink(link, target))
+			case info.Mode().IsRegular():
+				if exist && remote.Mode().IsRegular() && remote.Size() == info.Size() &&
+					remote.ModTime().Unix() == info.ModTime().Unix() {
+					return nil // not changed
+				}
+				if exist {
+					if err := save(filepath.ToSlash(rel), target, remote); err != nil {
+						return err
+					}
+				}
+				in, err := os.Open(file)
+				if err != nil {
+					return err
+				}
+				err = atomicWrite(cli, in, target)
+				in.Close()
+				if err != nil {
+					return errorFilter(err)
+				}
+				if err := cli.Chtimes(target, info.ModTime(), info.ModTime()); err != nil {
+					return errorFilter(err)
+				}
+				exist = false // it's a new file now, mode must be set
+			default: // devices, sockets and pipes are not backuped
+				return nil
+			}
+			if !exist || remote.Mode().Perm() != info.Mode().Perm() {
+				return errorFilter(cli.Chmod(target, info.Mode().Perm()))
+			}
+			return nil
+		})
+	})
+}
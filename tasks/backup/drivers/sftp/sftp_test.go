@@ -0,0 +1,246 @@
+package sftp
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+// serve a in-process sftp server on a random port, only the given client key can login
+func serveSftp(t *testing.T, clientKey ssh.PublicKey) (string, ssh.PublicKey, func()) {
+	_, hostPriv, _ := ed25519.GenerateKey(rand.Reader)
+	hostSigner, err := ssh.NewSignerFromKey(hostPriv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if bytes.Equal(key.Marshal(), clientKey.Marshal()) {
+				return nil, nil
+			}
+			return nil, os.ErrPermission
+		},
+	}
+	config.AddHostKey(hostSigner)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				_, chans, reqs, err := ssh.NewServerConn(conn, config)
+				if err != nil {
+					return
+				}
+				go ssh.DiscardRequests(reqs)
+				for newChannel := range chans {
+					channel, requests, err := newChannel.Accept()
+					if err != nil {
+						return
+					}
+					go func() {
+						for req := range requests {
+							req.Reply(req.Type == "subsystem" && string(req.Payload[4:]) == "sftp", nil)
+						}
+					}()
+					server, err := sftp.NewServer(channel)
+					if err != nil {
+						return
+					}
+					go server.Serve()
+				}
+			}()
+		}
+	}()
+	return listener.Addr().String(), hostSigner.PublicKey(), func() { listener.Close() }
+}
+
+func setup(t *testing.T) (*SftpDriver, string, func()) {
+	dir, err := ioutil.TempDir("", "backupd-sftp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, priv, _ := ed25519.GenerateKey(rand.Reader)
+	clientKey, _ := ssh.NewPublicKey(pub)
+	block, err := ssh.MarshalPrivateKey(priv, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ioutil.WriteFile(path.Join(dir, "id_ed25519"), pem.EncodeToMemory(block), 0600)
+
+	addr, hostKey, stop := serveSftp(t, clientKey)
+	line := knownhosts.Line([]string{knownhosts.Normalize(addr)}, hostKey)
+	ioutil.WriteFile(path.Join(dir, "known_hosts"), []byte(line+"\n"), 0600)
+
+	client = nil // connect to the new server
+	conf = Config{
+		Addr:       addr,
+		User:       "backup",
+		KeyFile:    path.Join(dir, "id_ed25519"),
+		KnownHosts: path.Join(dir, "known_hosts"),
+		Dir:        path.Join(dir, "store"),
+	}
+	os.Mkdir(conf.Dir, 0755)
+	return &SftpDriver{}, dir, func() {
+		stop()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestUnknownHost(t *testing.T) {
+	_, dir, clean := setup(t)
+	defer clean()
+
+	ioutil.WriteFile(path.Join(dir, "known_hosts"), nil, 0600)
+	if _, err := dial(); err == nil || !strings.Contains(err.Error(), "knownhosts") {
+		t.Errorf("connect should fail because of unknown host key, %v", err)
+	}
+}
+
+func TestUploadAndDownload(t *testing.T) {
+	driver, _, clean := setup(t)
+	defer clean()
+
+	if err := driver.Upload(strings.NewReader("hello"), "10.0.0.1/a.tar.gz"); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := driver.Download(&buf, "10.0.0.1/a.tar.gz"); err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != "hello" {
+		t.Errorf("downloaded content is %q, expect %q", buf.String(), "hello")
+	}
+	list, err := driver.List("10.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 || list[0].Name() != "a.tar.gz" {
+		t.Errorf("unexpected file list %v", list)
+	}
+	if err := driver.Delete("10.0.0.1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := driver.FileInfo("10.0.0.1/a.tar.gz"); !os.IsNotExist(err) {
+		t.Errorf("file should be deleted, %v", err)
+	}
+}
+
+func TestCommitAndAbort(t *testing.T) {
+	driver, _, clean := setup(t)
+	defer clean()
+
+	driver.Upload(strings.NewReader("data"), "10.0.0.1/.staging/a.tar.gz.1")
+	if err := driver.Commit("10.0.0.1/.staging/a.tar.gz.1", "10.0.0.1/a.tar.gz"); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := driver.Download(&buf, "10.0.0.1/a.tar.gz"); err != nil || buf.String() != "data" {
+		t.Errorf("staged file should be committed, %q %v", buf.String(), err)
+	}
+	driver.Upload(strings.NewReader("part"), "10.0.0.1/.staging/b.tar.gz.2")
+	if err := driver.Abort("10.0.0.1/.staging/b.tar.gz.2"); err != nil {
+		t.Fatal(err)
+	}
+	if list, _ := driver.List("10.0.0.1/.staging"); len(list) != 0 {
+		t.Errorf("staged files should be removed, %v", list)
+	}
+}
+
+func TestRsync(t *testing.T) {
+	driver, dir, clean := setup(t)
+	defer clean()
+
+	src := path.Join(dir, "src")
+	mtime := time.Now().Add(-time.Hour).Truncate(time.Second)
+	os.MkdirAll(path.Join(src, "sub"), 0755)
+	ioutil.WriteFile(path.Join(src, "sub", "a"), []byte("file a"), 0600)
+	os.Chtimes(path.Join(src, "sub", "a"), mtime, mtime)
+	os.Symlink("sub/a", path.Join(src, "link"))
+
+	if err := driver.Rsync(src, "ns/inc", nil); err != nil {
+		t.Fatal(err)
+	}
+	info, err := driver.FileInfo("ns/inc/sub/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 || !info.ModTime().Equal(mtime) {
+		t.Errorf("mode and mtime should be kept, got %v %v", info.Mode(), info.ModTime())
+	}
+	if link, err := os.Readlink(path.Join(conf.Dir, "ns/inc/link")); err != nil || link != "sub/a" {
+		t.Errorf("symlink should be copied, %s %v", link, err)
+	}
+
+	// unchanged file should not be uploaded again
+	target := path.Join(conf.Dir, "ns/inc/sub/a")
+	ioutil.WriteFile(target, []byte("FILE A"), 0600)
+	os.Chtimes(target, mtime, mtime)
+	if err := driver.Rsync(src, "ns/inc", nil); err != nil {
+		t.Fatal(err)
+	}
+	if content, _ := ioutil.ReadFile(target); string(content) != "FILE A" {
+		t.Errorf("unchanged file is uploaded again")
+	}
+}
+
+func TestSnapshotRsync(t *testing.T) {
+	driver, dir, clean := setup(t)
+	defer clean()
+
+	src := path.Join(dir, "src")
+	os.MkdirAll(src, 0755)
+	ioutil.WriteFile(path.Join(src, "a"), []byte("a1"), 0600)
+	ioutil.WriteFile(path.Join(src, "b"), []byte("b1"), 0600)
+	if err := driver.Rsync(src, "ns/inc", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	driver.Upload(strings.NewReader("b0"), "ns/inc@1/b")
+	mtime := time.Now().Add(time.Hour)
+	for _, file := range []string{"a", "b"} {
+		ioutil.WriteFile(path.Join(src, file), []byte(file+"2"), 0600)
+		os.Chtimes(path.Join(src, file), mtime, mtime)
+	}
+	if err := driver.SnapshotRsync(src, "ns/inc", "ns/inc@1", nil); err != nil {
+		t.Fatal(err)
+	}
+	for file, content := range map[string]string{"ns/inc/a": "a2", "ns/inc/b": "b2", "ns/inc@1/a": "a1", "ns/inc@1/b": "b0"} {
+		if data, err := ioutil.ReadFile(path.Join(conf.Dir, file)); err != nil || string(data) != content {
+			t.Errorf("%s should be %q, got %q %v", file, content, data, err)
+		}
+	}
+}
+
+func TestCreate(t *testing.T) {
+	driver, _, clean := setup(t)
+	defer clean()
+
+	if err := driver.Create(strings.NewReader("first"), "ns/.meta.journal/1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := driver.Create(strings.NewReader("second"), "ns/.meta.journal/1"); !os.IsExist(err) {
+		t.Errorf("creating an existing file should fail, %v", err)
+	}
+	var buf bytes.Buffer
+	if err := driver.Download(&buf, "ns/.meta.journal/1"); err != nil || buf.String() != "first" {
+		t.Errorf("the file should not be replaced, %q %v", buf.String(), err)
+	}
+}
@@ -0,0 +1,341 @@
+package webdav
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"github.com/laincloud/backupd/tasks/backup"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const propfindBody = `<?xml version="1.0" encoding="utf-8"?>
+<d:propfind xmlns:d="DAV:">
+  <d:prop>
+    <d:resourcetype/>
+    <d:getcontentlength/>
+    <d:getlastmodified/>
+  </d:prop>
+</d:propfind>`
+
+var (
+	conf   Config
+	base   *url.URL
+	client = &http.Client{}
+)
+
+// Config is the webdav server settings
+type Config struct {
+	URL      string // the collection backups stored in, like https://cloud.example.com/remote.php/dav/files/lain/backup
+	User     string
+	Password string
+}
+
+func Init(c Config) error {
+	if c.URL == "" { // webdav not be configed
+		return errors.New("webdav url is empty")
+	}
+	u, err := url.Parse(c.URL)
+	if err != nil {
+		return fmt.Errorf("Unvalid webdav url %s, %s", c.URL, err.Error())
+	}
+	u.Path = strings.TrimRight(u.Path, "/")
+	conf, base = c, u
+
+	info, err := stat("")
+	if err != nil {
+		if !os.IsNotExist(err) {
+			return fmt.Errorf("Fail to access %s, %s", u.String(), err.Error())
+		}
+		if err := mkcolAll(""); err != nil { // collection not exist, create it
+			return fmt.Errorf("Fail to create collection %s, %s", u.String(), err.Error())
+		}
+	} else if !info.IsDir() {
+		return fmt.Errorf("%s already exist, but it's not a collection", u.String())
+	}
+	backup.Register(&WebdavDriver{})
+	return nil
+}
+
+// StatusError is returned when webdav server responses a unexpected status
+type StatusError struct {
+	Method     string
+	StatusCode int
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("webdav %s failed with status %d %s", e.Method, e.StatusCode, http.StatusText(e.StatusCode))
+}
+
+func notFound(op, name string, err error) error {
+	if e, ok := err.(*StatusError); ok && e.StatusCode == http.StatusNotFound {
+		return &os.PathError{Op: op, Path: name, Err: os.ErrNotExist}
+	}
+	return err
+}
+
+func resourceURL(name string) string {
+	u := *base
+	u.Path = path.Join(base.Path, name)
+	return u.String()
+}
+
+func request(method, name string, body io.Reader, header http.Header) (*http.Response, error) {
+	req, err := http.NewRequest(method, resourceURL(name), body)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	if conf.User != "" {
+		req.SetBasicAuth(conf.User, conf.Password)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 {
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+		return nil, &StatusError{Method: method, StatusCode: resp.StatusCode}
+	}
+	return resp, nil
+}
+
+// create the collection and all its parents under the base collection
+func mkcolAll(dir string) error {
+	var current string
+	for _, field := range strings.Split(strings.Trim(path.Clean(dir), "/."), "/") {
+		current = path.Join(current, field)
+		resp, err := request("MKCOL", current, nil, nil)
+		if err != nil {
+			// 405 means the collection already exist
+			if e, ok := err.(*StatusError); ok && e.StatusCode == http.StatusMethodNotAllowed {
+				continue
+			}
+			return err
+		}
+		resp.Body.Close()
+	}
+	return nil
+}
+
+type multistatus struct {
+	Responses []struct {
+		Href  string `xml:"href"`
+		Props []struct {
+			Status       string `xml:"status"`
+			ResourceType struct {
+				Collection *struct{} `xml:"collection"`
+			} `xml:"prop>resourcetype"`
+			ContentLength string `xml:"prop>getcontentlength"`
+			LastModified  string `xml:"prop>getlastmodified"`
+		} `xml:"propstat"`
+	} `xml:"response"`
+}
+
+// propfind returns the infos of name, and its members if depth is 1
+func propfind(name string, depth int) (map[string]os.FileInfo, error) {
+	header := http.Header{
+		"Depth":        []string{strconv.Itoa(depth)},
+		"Content-Type": []string{"application/xml; charset=utf-8"},
+	}
+	resp, err := request("PROPFIND", name, strings.NewReader(propfindBody), header)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var ms multistatus
+	if err := xml.NewDecoder(resp.Body).Decode(&ms); err != nil {
+		return nil, fmt.Errorf("Unvalid PROPFIND response, %s", err.Error())
+	}
+	ret := make(map[string]os.FileInfo)
+	for _, r := range ms.Responses {
+		href, err := url.Parse(r.Href)
+		if err != nil {
+			return nil, err
+		}
+		p := strings.Trim(strings.TrimPrefix(strings.TrimRight(href.Path, "/"), base.Path), "/")
+		info := &fileInfo{name: path.Base(p), mode: 0644}
+		for _, prop := range r.Props {
+			if !strings.Contains(prop.Status, " 200 ") {
+				continue
+			}
+			if prop.ResourceType.Collection != nil {
+				info.mode = os.ModeDir | 0755
+			}
+			if size, err := strconv.ParseInt(prop.ContentLength, 10, 64); err == nil {
+				info.size = size
+			}
+			if t, err := http.ParseTime(prop.LastModified); err == nil {
+				info.modTime = t
+			}
+		}
+		ret[p] = info
+	}
+	return ret, nil
+}
+
+func stat(name string) (os.FileInfo, error) {
+	infos, err := propfind(name, 0)
+	if err != nil {
+		return nil, notFound("stat", name, err)
+	}
+	for _, info := range infos {
+		return info, nil
+	}
+	return nil, &os.PathError{Op: "stat", Path: name, Err: os.ErrNotExist}
+}
+
+// list the members of the collection, key is the path relative to the base collection
+func list(dir string) (map[string]os.FileInfo, error) {
+	infos, err := propfind(dir, 1)
+	if err != nil {
+		return nil, notFound("list", dir, err)
+	}
+	delete(infos, strings.Trim(path.Clean(dir), "/."))
+	return infos, nil
+}
+
+type fileInfo struct {
+	name    string
+	size    int64
+	mode    os.FileMode
+	modTime time.Time
+}
+
+func (fi *fileInfo) Name() string       { return fi.name }
+func (fi *fileInfo) Size() int64        { return fi.size }
+func (fi *fileInfo) Mode() os.FileMode  { return fi.mode }
+func (fi *fileInfo) ModTime() time.Time { return fi.modTime }
+func (fi *fileInfo) IsDir() bool        { return fi.mode.IsDir() }
+func (fi *fileInfo) Sys() interface{}   { return nil }
+
+func put(reader io.Reader, dest string) error {
+	if err := mkcolAll(path.Dir(dest)); err != nil {
+		return err
+	}
+	resp, err := request("PUT", dest, reader, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+type WebdavDriver struct{}
+
+func (driver *WebdavDriver) Name() string {
+	return "webdav"
+}
+
+// Upload streams the reader to webdav server with chunked transfer encoding.
+// The file is written into the staging directory of its namespace and moved to dest, unless dest is staged already,
+// so a failed upload never leaves dest half written.
+func (driver *WebdavDriver) Upload(reader io.Reader, dest string) error {
+	if backup.IsStaged(dest) {
+		return put(ioutil.NopCloser(reader), dest)
+	}
+	staged := backup.NamespaceStagedName(dest)
+	if err := put(ioutil.NopCloser(reader), staged); err != nil {
+		driver.Delete(staged)
+		return err
+	}
+	if err := driver.Commit(staged, dest); err != nil {
+		driver.Delete(staged)
+		return err
+	}
+	return nil
+}
+
+func (driver *WebdavDriver) Download(writer io.Writer, src string) error {
+	resp, err := request("GET", src, nil, nil)
+	if err != nil {
+		return notFound("download", src, err)
+	}
+	defer resp.Body.Close()
+	if _, err := io.Copy(writer, resp.Body); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (driver *WebdavDriver) List(dir string) ([]os.FileInfo, error) {
+	infos, err := list(dir)
+	if err != nil {
+		return nil, err
+	}
+	ret := make([]os.FileInfo, 0, len(infos))
+	for _, info := range infos {
+		ret = append(ret, info)
+	}
+	return ret, nil
+}
+
+// Delete removes the resource, a collection is removed with all its members
+func (driver *WebdavDriver) Delete(file string) error {
+	resp, err := request("DELETE", file, nil, nil)
+	if err != nil {
+		return notFound("delete", file, err)
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (driver *WebdavDriver) FileInfo(name string) (os.FileInfo, error) {
+	return stat(name)
+}
+
+// Commit moves the staged file to dest by MOVE, dest is replaced if exists
+func (driver *WebdavDriver) Commit(staged, dest string) error {
+	if err := mkcolAll(path.Dir(dest)); err != nil {
+		return err
+	}
+	resp, err := request("MOVE", staged, nil, http.Header{"Destination": {resourceURL(dest)}, "Overwrite": {"T"}})
+	if err != nil {
+		return notFound("commit", staged, err)
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// Create writes the file only if it does not exist, it's uploaded staged and moved to dest without overwriting
+func (driver *WebdavDriver) Create(reader io.Reader, dest string) error {
+	staged := backup.StagedName(dest)
+	if err := mkcolAll(path.Dir(dest)); err != nil {
+		return err
+	}
+	if err := put(ioutil.NopCloser(reader), staged); err != nil {
+		driver.Delete(staged)
+		return err
+	}
+	resp, err := request("MOVE", staged, nil, http.Header{"Destination": {resourceURL(dest)}, "Overwrite": {"F"}})
+	if err != nil {
+		driver.Delete(staged)
+		if e, ok := err.(*StatusError); ok && e.StatusCode == http.StatusPreconditionFailed {
+			return &os.PathError{Op: "create", Path: dest, Err: os.ErrExist}
+		}
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// Abort removes the staged file
+func (driver *WebdavDriver) Abort(staged string) error {
+	return driver.Delete(staged)
+}
+
+// Rsync syncs src to dest with backup.IncrementSync, webdav has no way to keep mode, mtime and symlinks
+func (driver *WebdavDriver) Rsync(src, dest string, filter *backup.Filter) error {
+	return backup.IncrementSync(driver, src, dest, filter)
+}
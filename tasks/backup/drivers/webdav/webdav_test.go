@@ -0,0 +1,223 @@
+package webdav
+
+import (
+	"bytes"
+	"errors"
+	"github.com/laincloud/backupd/tasks/backup"
+	xwebdav "golang.org/x/net/webdav"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+// serve the directory with the webdav handler of golang.org/x/net, backups are stored in /dav/backup
+func setup(t *testing.T) (*WebdavDriver, string, func()) {
+	dir, err := ioutil.TempDir("", "backupd-webdav")
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := &xwebdav.Handler{
+		Prefix:     "/dav",
+		FileSystem: xwebdav.Dir(dir),
+		LockSystem: xwebdav.NewMemLS(),
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if user, password, ok := req.BasicAuth(); !ok || user != "lain" || password != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		handler.ServeHTTP(w, req)
+	}))
+	conf = Config{URL: server.URL + "/dav/backup", User: "lain", Password: "secret"}
+	base, _ = url.Parse(conf.URL)
+	if err := mkcolAll(""); err != nil {
+		t.Fatal(err)
+	}
+	return &WebdavDriver{}, dir, func() {
+		server.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestInit(t *testing.T) {
+	_, dir, clean := setup(t)
+	defer clean()
+
+	os.RemoveAll(path.Join(dir, "backup"))
+	if err := Init(Config{URL: conf.URL + "/", User: "lain", Password: "wrong"}); err == nil {
+		t.Error("init should fail with wrong password")
+	}
+	if err := Init(Config{URL: conf.URL + "/", User: "lain", Password: "secret"}); err != nil {
+		t.Fatal(err)
+	}
+	if info, err := os.Stat(path.Join(dir, "backup")); err != nil || !info.IsDir() {
+		t.Errorf("backup collection should be created, %v", err)
+	}
+}
+
+func TestUploadAndDownload(t *testing.T) {
+	driver, dir, clean := setup(t)
+	defer clean()
+
+	if err := driver.Upload(strings.NewReader("hello"), "10.0.0.1/a.tar.gz"); err != nil {
+		t.Fatal(err)
+	}
+	if content, _ := ioutil.ReadFile(path.Join(dir, "backup/10.0.0.1/a.tar.gz")); string(content) != "hello" {
+		t.Errorf("uploaded content is %q, expect %q", content, "hello")
+	}
+	var buf bytes.Buffer
+	if err := driver.Download(&buf, "10.0.0.1/a.tar.gz"); err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != "hello" {
+		t.Errorf("downloaded content is %q, expect %q", buf.String(), "hello")
+	}
+	if _, err := driver.FileInfo("10.0.0.1/notexist"); !os.IsNotExist(err.(*os.PathError).Err) {
+		t.Errorf("expect not exist error, got %v", err)
+	}
+}
+
+type failReader struct{}
+
+func (r failReader) Read(p []byte) (int, error) {
+	return 0, errors.New("broken")
+}
+
+func TestUploadStaged(t *testing.T) {
+	driver, dir, clean := setup(t)
+	defer clean()
+
+	if err := driver.Upload(strings.NewReader("old"), "10.0.0.1/inc/sub/a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := driver.Upload(io.MultiReader(strings.NewReader("new"), failReader{}), "10.0.0.1/inc/sub/a"); err == nil {
+		t.Error("upload should fail")
+	}
+	if content, _ := ioutil.ReadFile(path.Join(dir, "backup/10.0.0.1/inc/sub/a")); string(content) != "old" {
+		t.Errorf("a failed upload should not touch dest, got %q", content)
+	}
+	// the file is staged in the namespace, no staging directory is left beside dest,
+	// the staged file may be still written by the server when it's deleted, it's swept later then
+	if _, err := os.Stat(path.Join(dir, "backup/10.0.0.1/inc/sub/.staging")); !os.IsNotExist(err) {
+		t.Errorf("staging directory should not be created in the increment backup, %v", err)
+	}
+}
+
+func TestListDeleteAndFileInfo(t *testing.T) {
+	driver, _, clean := setup(t)
+	defer clean()
+
+	for _, name := range []string{"ns/a.tar.gz", "ns/dir/b", "ns/dir/c"} {
+		if err := driver.Upload(strings.NewReader(name), name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	list, err := driver.List("ns")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 3 { // a.tar.gz, dir and the staging directory
+		t.Fatalf("expect 3 items in ns, got %d", len(list))
+	}
+	info, err := driver.FileInfo("ns/dir")
+	if err != nil || !info.IsDir() || info.Name() != "dir" {
+		t.Errorf("ns/dir should be a directory, %v %v", info, err)
+	}
+	info, err = driver.FileInfo("ns/a.tar.gz")
+	if err != nil || info.IsDir() || info.Size() != int64(len("ns/a.tar.gz")) {
+		t.Errorf("unexpected file info of ns/a.tar.gz, %+v, %v", info, err)
+	}
+	if err := driver.Delete("ns/dir"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := driver.FileInfo("ns/dir/b"); !os.IsNotExist(err.(*os.PathError).Err) {
+		t.Errorf("ns/dir/b should be deleted, %v", err)
+	}
+}
+
+func TestRsync(t *testing.T) {
+	driver, dir, clean := setup(t)
+	defer clean()
+
+	src := path.Join(dir, "src")
+	os.MkdirAll(path.Join(src, "sub", "empty"), 0755)
+	ioutil.WriteFile(path.Join(src, "a"), []byte("file a"), 0644)
+	ioutil.WriteFile(path.Join(src, "sub", "b"), []byte("file b"), 0644)
+	old := time.Now().Add(-time.Hour)
+	os.Chtimes(path.Join(src, "a"), old, old)
+
+	if err := driver.Rsync(src, "ns/inc", nil); err != nil {
+		t.Fatal(err)
+	}
+	if content, _ := ioutil.ReadFile(path.Join(dir, "backup/ns/inc/sub/b")); string(content) != "file b" {
+		t.Errorf("sub/b not synced, %q", content)
+	}
+	index, err := backup.LoadIndex(driver, "ns/inc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !index["sub/empty"].Mode.IsDir() || !index["a"].ModTime.Equal(old) {
+		t.Errorf("directories and mtime should be kept in index, %v", index)
+	}
+
+	// a is not changed, b is changed
+	target := path.Join(dir, "backup/ns/inc/a")
+	ioutil.WriteFile(target, []byte("FILE A"), 0644)
+	ioutil.WriteFile(path.Join(src, "sub", "b"), []byte("file b changed"), 0644)
+	if err := driver.Rsync(src, "ns/inc", nil); err != nil {
+		t.Fatal(err)
+	}
+	if content, _ := ioutil.ReadFile(target); string(content) != "FILE A" {
+		t.Errorf("unchanged file is uploaded again")
+	}
+	if content, _ := ioutil.ReadFile(path.Join(dir, "backup/ns/inc/sub/b")); string(content) != "file b changed" {
+		t.Errorf("changed file not synced, %q", content)
+	}
+}
+
+func TestCommitAndAbort(t *testing.T) {
+	driver, dir, clean := setup(t)
+	defer clean()
+
+	driver.Upload(strings.NewReader("new"), "ns/.staging/a.tar.gz.1")
+	driver.Upload(strings.NewReader("old"), "ns/a.tar.gz")
+	if err := driver.Commit("ns/.staging/a.tar.gz.1", "ns/a.tar.gz"); err != nil {
+		t.Fatal(err)
+	}
+	if content, _ := ioutil.ReadFile(path.Join(dir, "backup/ns/a.tar.gz")); string(content) != "new" {
+		t.Errorf("dest should be replaced by the staged file, got %q", content)
+	}
+	if err := driver.Commit("ns/.staging/missing", "ns/a.tar.gz"); err == nil {
+		t.Error("committing a missing file should fail")
+	}
+	driver.Upload(strings.NewReader("part"), "ns/.staging/b.tar.gz.2")
+	if err := driver.Abort("ns/.staging/b.tar.gz.2"); err != nil {
+		t.Fatal(err)
+	}
+	if list, _ := driver.List("ns/.staging"); len(list) != 0 {
+		t.Errorf("staged files should be removed, %v", list)
+	}
+}
+
+func TestCreate(t *testing.T) {
+	driver, _, clean := setup(t)
+	defer clean()
+
+	if err := driver.Create(strings.NewReader("first"), "ns/.meta.journal/1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := driver.Create(strings.NewReader("second"), "ns/.meta.journal/1"); !os.IsExist(err) {
+		t.Errorf("creating an existing file should fail, %v", err)
+	}
+	var buf bytes.Buffer
+	if err := driver.Download(&buf, "ns/.meta.journal/1"); err != nil || buf.String() != "first" {
+		t.Errorf("the file should not be replaced, %q %v", buf.String(), err)
+	}
+}
@@ -0,0 +1,110 @@
+package backup
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// Filter selects the files of a volume to back up by glob patterns of path.Match, the paths are relative to the volume.
+// A pattern without "/" matches the base name of a file at any depth, like *.log, a pattern with "/" matches the path
+// from the volume root, like cache/* or /tmp. An excluded directory is skipped with all its files.
+// If there are include patterns, only the files matching one, or in a directory matching one, are backed up,
+// the directories are always kept. A nil Filter selects all the files.
+type Filter struct {
+	Include []string
+	Exclude []string
+}
+
+// NewFilter returns the filter of the patterns, nil if there is no pattern
+func NewFilter(include, exclude []string) (*Filter, error) {
+	f := &Filter{}
+	for _, p := range include {
+		if p = cleanPattern(p); p != "" {
+			f.Include = append(f.Include, p)
+		}
+	}
+	for _, p := range exclude {
+		if p = cleanPattern(p); p != "" {
+			f.Exclude = append(f.Exclude, p)
+		}
+	}
+	for _, p := range append(f.Include, f.Exclude...) {
+		if _, err := path.Match(p, ""); err != nil {
+			return nil, fmt.Errorf("Unvalid pattern %s, %s", p, err.Error())
+		}
+	}
+	if len(f.Include)+len(f.Exclude) == 0 {
+		return nil, nil
+	}
+	return f, nil
+}
+
+// cleanPattern cleans the pattern p, the leading "/" is kept to anchor it to the volume root
+func cleanPattern(p string) string {
+	if p = strings.TrimSpace(p); p == "" || strings.Trim(p, "/") == "" {
+		return ""
+	}
+	anchor := ""
+	if strings.HasPrefix(p, "/") {
+		anchor = "/"
+	}
+	return anchor + strings.Trim(path.Clean("/"+p), "/")
+}
+
+func matchPattern(p, rel string) bool {
+	if !strings.Contains(p, "/") {
+		rel = path.Base(rel)
+	}
+	ok, _ := path.Match(strings.TrimPrefix(p, "/"), rel)
+	return ok
+}
+
+// Match tells whether the file or directory rel is selected, a directory not selected is skipped
+func (f *Filter) Match(rel string, isDir bool) bool {
+	return f.Why(rel, isDir) == ""
+}
+
+// Why returns why the file or directory rel is not selected, empty if it's selected
+func (f *Filter) Why(rel string, isDir bool) string {
+	if f == nil {
+		return ""
+	}
+	if rel = strings.Trim(path.Clean("/"+rel), "/"); rel == "" { // the volume itself
+		return ""
+	}
+	for dir := rel; dir != "."; dir = path.Dir(dir) {
+		for _, p := range f.Exclude {
+			if matchPattern(p, dir) {
+				return fmt.Sprintf("excluded by %s", p)
+			}
+		}
+	}
+	if isDir || len(f.Include) == 0 {
+		return ""
+	}
+	for dir := rel; dir != "."; dir = path.Dir(dir) {
+		for _, p := range f.Include {
+			if matchPattern(p, dir) {
+				return ""
+			}
+		}
+	}
+	return fmt.Sprintf("not included by %s", strings.Join(f.Include, ", "))
+}
+
+// filter returns the filter of the backup, nil if it selects all the files
+func (ent *Entity) filter() *Filter {
+	if len(ent.Include)+len(ent.Exclude) == 0 {
+		return nil
+	}
+	return &Filter{Include: ent.Include, Exclude: ent.Exclude}
+}
+
+// noFile returns the error of the file f not in the backup, with the reason if it's filtered out
+func (ent *Entity) noFile(f string) error {
+	if why := ent.filter().Why(f, false); why != "" {
+		return fmt.Errorf("No file %s in backup %s, it's %s", f, ent.Name, why)
+	}
+	return fmt.Errorf("No file %s in backup %s", f, ent.Name)
+}
@@ -0,0 +1,96 @@
+package backup
+
+import (
+	"github.com/laincloud/backupd/crond"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestFilter(t *testing.T) {
+	if f, err := NewFilter([]string{" ", ""}, nil); err != nil || f != nil {
+		t.Errorf("no filter should be made without patterns, %+v %v", f, err)
+	}
+	if _, err := NewFilter(nil, []string{"[a-"}); err == nil {
+		t.Error("unvalid pattern should fail")
+	}
+	f, err := NewFilter([]string{"db", "conf/*.yml"}, []string{"*.log", "/tmp/", "db/cache"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(f.Exclude, ",") != "*.log,/tmp,db/cache" {
+		t.Errorf("patterns should be cleaned, %v", f.Exclude)
+	}
+	for _, c := range []struct {
+		rel   string
+		isDir bool
+		why   string
+	}{
+		{"", true, ""},
+		{"db", true, ""},
+		{"db/data", false, ""},
+		{"db/cache/x", false, "excluded by db/cache"},
+		{"db/error.log", false, "excluded by *.log"},
+		{"conf", true, ""},
+		{"conf/app.yml", false, ""},
+		{"conf/app.json", false, "not included by db, conf/*.yml"},
+		{"tmp", true, "excluded by /tmp"},
+		{"a/tmp", true, ""},
+		{"README", false, "not included by db, conf/*.yml"},
+	} {
+		if why := f.Why(c.rel, c.isDir); why != c.why {
+			t.Errorf("%s: expect %q, got %q", c.rel, c.why, why)
+		}
+	}
+	var none *Filter
+	if !none.Match("any", false) {
+		t.Error("nil filter should select all the files")
+	}
+}
+
+func TestFilterBackup(t *testing.T) {
+	root, _ := ioutil.TempDir("", "backupd-filter")
+	defer os.RemoveAll(root)
+	driver := &dirDriver{root: path.Join(root, "store")}
+	driverRunning = driver
+	meta = NewMeta(driver, namespace)
+	src := path.Join(root, "data")
+	os.MkdirAll(path.Join(src, "cache"), 0755)
+	files := map[string]string{"db": "database", "cache/page": "cached", "error.log": "log"}
+	for file, content := range files {
+		ioutil.WriteFile(path.Join(src, file), []byte(content), 0644)
+	}
+
+	if _, err := backup(crond.FuncArg{"path": src, "exclude": []string{"[a-"}}); err == nil {
+		t.Error("backup with unvalid pattern should fail")
+	}
+	for _, mode := range []string{MODE_FULL, MODE_INCREMENT, MODE_DEDUP} {
+		result, err := backup(crond.FuncArg{"path": src, "archive": "app-data", "mode": mode,
+			"exclude": []interface{}{"cache", "*.log"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		name := result["file"].(string)
+		ent := meta.Get(name)
+		if ent == nil || strings.Join(ent.Exclude, ",") != "cache,*.log" {
+			t.Fatalf("the filter of %s backup should be in meta, %+v", mode, ent)
+		}
+
+		os.RemoveAll(src)
+		os.MkdirAll(src, 0755)
+		if _, err := backup_recover(crond.FuncArg{"backup": name}); err != nil {
+			t.Fatal(err)
+		}
+		checkFiles(t, src, map[string]string{"db": "database", "cache/page": "", "error.log": ""})
+		_, err = backup_recover(crond.FuncArg{"backup": name, "files": []string{"cache/page"}})
+		if err == nil || !strings.Contains(err.Error(), "excluded by cache") {
+			t.Errorf("recovering a filtered file of %s backup should tell why, %v", mode, err)
+		}
+		for file, content := range files {
+			os.MkdirAll(path.Dir(path.Join(src, file)), 0755)
+			ioutil.WriteFile(path.Join(src, file), []byte(content), 0644)
+		}
+	}
+}
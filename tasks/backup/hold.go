@@ -0,0 +1,59 @@
+package backup
+
+import (
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"time"
+)
+
+// Hold pins a backup, it can not be deleted by the delete API or backup_expire until unheld or expired
+type Hold struct {
+	Reason  string     `json:"reason"`
+	Owner   string     `json:"owner"`
+	Created time.Time  `json:"created"`
+	Expires *time.Time `json:"expires,omitempty"` // nil means held until unheld
+}
+
+// active checks whether the hold is still in effect at now
+func (h *Hold) active(now time.Time) bool {
+	return h != nil && (h.Expires == nil || now.Before(*h.Expires))
+}
+
+func (h *Hold) String() string {
+	ret := fmt.Sprintf("held by %s", h.Owner)
+	if h.Reason != "" {
+		ret += ": " + h.Reason
+	}
+	if h.Expires != nil {
+		ret += " until " + h.Expires.Format(time.RFC3339)
+	}
+	return ret
+}
+
+// HoldBackup pins the backup named name, a held backup is held again with the new reason, owner and expiry
+func HoldBackup(name, reason, owner string, expires *time.Time) (Entity, error) {
+	if owner == "" {
+		return Entity{}, fmt.Errorf("Owner of the hold must be given")
+	}
+	if expires != nil && !expires.After(time.Now()) {
+		return Entity{}, fmt.Errorf("Expiry of the hold %s is passed", expires.Format(time.RFC3339))
+	}
+	return setHold(name, &Hold{Reason: reason, Owner: owner, Created: time.Now(), Expires: expires})
+}
+
+// UnholdBackup removes the hold of the backup named name
+func UnholdBackup(name string) (Entity, error) {
+	return setHold(name, nil)
+}
+
+func setHold(name string, hold *Hold) (Entity, error) {
+	return updateEntity(name, func(ent *Entity) error {
+		ent.Hold = hold
+		if hold != nil {
+			log.Infof("Backup %s is %s", name, hold.String())
+		} else {
+			log.Infof("Backup %s is unheld", name)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,84 @@
+package backup
+
+import (
+	"github.com/laincloud/backupd/crond"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHoldBackup(t *testing.T) {
+	root, _ := ioutil.TempDir("", "backupd-hold")
+	defer os.RemoveAll(root)
+	driver := &dirDriver{root: path.Join(root, "store")}
+	driverRunning = driver
+	meta = NewMeta(driver, namespace)
+	src := path.Join(root, "data")
+	os.MkdirAll(src, 0755)
+	ioutil.WriteFile(path.Join(src, "db"), []byte("database"), 0644)
+
+	var names []string
+	for i, age := range []time.Duration{3 * time.Hour, 2 * time.Hour, time.Hour} {
+		ent := NewEntity(src, "app-data-"+string('a'+rune(i)), 0, nil, "/data", MODE_FULL)
+		ent.Created = time.Now().Add(-age)
+		if err := ent.Backup(driver); err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, ent.Name)
+	}
+
+	if _, err := HoldBackup(names[0], "before migration", "", nil); err == nil {
+		t.Error("hold without owner should fail")
+	}
+	passed := time.Now().Add(-time.Minute)
+	if _, err := HoldBackup(names[0], "before migration", "ops", &passed); err == nil {
+		t.Error("hold with a passed expiry should fail")
+	}
+	ent, err := HoldBackup(names[0], "before migration", "ops", nil)
+	if err != nil || ent.Hold == nil || ent.Hold.Owner != "ops" {
+		t.Fatalf("unexpected hold %+v %v", ent.Hold, err)
+	}
+	// the hold is synced to the backend
+	mt := NewMeta(driver, namespace)
+	if err := mt.LoadFromBackend(); err != nil || mt.Get(names[0]).Hold == nil {
+		t.Errorf("hold should be stored in meta, %v", err)
+	}
+
+	if err := Delete(names[0]); err == nil || !strings.Contains(err.Error(), "held by ops: before migration") {
+		t.Errorf("held backup should not be deleted, %v", err)
+	}
+	result, err := expire(crond.FuncArg{"info": []string{src, "30m"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	kept := result["kept"].([]RetentionDecision)
+	if len(kept) != 2 || kept[1].Name != names[0] || kept[1].Reason != "held by ops: before migration" {
+		t.Errorf("held backup should be kept by expire, %+v", result)
+	}
+	if meta.Get(names[0]) == nil || meta.Get(names[1]) != nil {
+		t.Error("only the held backup should be kept besides the newest")
+	}
+
+	if _, err := UnholdBackup(names[0]); err != nil {
+		t.Fatal(err)
+	}
+	if err := Delete(names[0]); err != nil || meta.Get(names[0]) != nil {
+		t.Errorf("unheld backup should be deleted, %v", err)
+	}
+
+	// the expired hold does not pin the backup any more
+	expires := time.Now().Add(time.Second)
+	if _, err := HoldBackup(names[2], "", "ops", &expires); err != nil {
+		t.Fatal(err)
+	}
+	if err := Delete(names[2]); err == nil {
+		t.Error("held backup should not be deleted before the hold expires")
+	}
+	time.Sleep(time.Until(expires))
+	if err := Delete(names[2]); err != nil {
+		t.Errorf("backup should be deleted after the hold expires, %v", err)
+	}
+}
@@ -0,0 +1,318 @@
+package backup
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	log "github.com/Sirupsen/logrus"
+	"hash"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const indexSuffix = ".index"
+
+// IndexEntry is a file, directory or symlink in the increment backup
+type IndexEntry struct {
+	Path    string      `json:"path"` // relative to the backuped directory
+	Size    int64       `json:"size"`
+	ModTime time.Time   `json:"mtime"`
+	Mode    os.FileMode `json:"mode"`
+	Hash    string      `json:"hash,omitempty"` // sha256 of the regular file
+	Link    string      `json:"link,omitempty"` // target of the symlink
+}
+
+// the index of increment backup dest is stored beside it, named dest.index
+func indexFile(dest string) string {
+	return path.Clean(dest) + indexSuffix
+}
+
+// LoadIndex returns the file index of the increment backup dest, key is the relative path.
+// An empty index is returned if dest is never synced by IncrementSync.
+func LoadIndex(driver Storage, dest string) (map[string]IndexEntry, error) {
+	ret := make(map[string]IndexEntry)
+	if _, err := driver.FileInfo(indexFile(dest)); err != nil {
+		if os.IsNotExist(err) {
+			return ret, nil
+		}
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := driver.Download(&buf, indexFile(dest)); err != nil {
+		return nil, err
+	}
+	var entries []IndexEntry
+	if err := json.Unmarshal(buf.Bytes(), &entries); err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		ret[entry.Path] = entry
+	}
+	return ret, nil
+}
+
+func saveIndex(driver Storage, dest string, index map[string]IndexEntry) error {
+	entries := make([]IndexEntry, 0, len(index))
+	for _, entry := range index {
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Path < entries[j].Path })
+	data, err := json.Marshal(entries)
+	if err != nil {
+		return err
+	}
+	return driver.Upload(bytes.NewReader(data), indexFile(dest))
+}
+
+func hashFile(file string) (string, error) {
+	in, err := os.Open(file)
+	if err != nil {
+		return "", err
+	}
+	defer in.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, in); err != nil {
+		return "", err
+	}
+	return hashString(h), nil
+}
+
+// IncrementSync syncs the directory src to dest with only the Upload and Delete of driver,
+// so the drivers without a native rsync can support increment backup by calling it in their Rsync.
+// It compares src with the index of the last sync, a file is uploaded only if its content is changed,
+// the files removed from src or not selected by filter are kept in dest like the native rsync of other drivers.
+// Mode, mtime and safe symlinks are kept in the index.
+func IncrementSync(driver Storage, src, dest string, filter *Filter) error {
+	return incrementSync(driver, src, dest, "", filter)
+}
+
+// incrementSync is IncrementSync which copies the files of dest into saveDir before they are replaced or deleted,
+// the files already in saveDir are kept. Nothing is saved if saveDir is empty.
+func incrementSync(driver Storage, src, dest, saveDir string, filter *Filter) error {
+	src = path.Clean(src)
+	old, err := LoadIndex(driver, dest)
+	if err != nil {
+		return err
+	}
+	saved := make(map[string]string)
+	if saveDir != "" {
+		if saved, err = storedFiles(driver, saveDir); err != nil {
+			return err
+		}
+	}
+	// save the regular file rel in dest, or the ones under it if it's a directory
+	save := func(rel string) error {
+		if saveDir == "" {
+			return nil
+		}
+		names := []string{rel}
+		if prev, ok := old[rel]; ok && prev.Mode.IsDir() {
+			for name := range old {
+				if strings.HasPrefix(name, rel+"/") {
+					names = append(names, name)
+				}
+			}
+		}
+		for _, name := range names {
+			if _, ok := saved[name]; ok || old[name].Hash == "" {
+				continue
+			}
+			if err := copyStored(driver, path.Join(dest, name), path.Join(saveDir, name)); err != nil {
+				return err
+			}
+			saved[name] = path.Join(saveDir, name)
+		}
+		return nil
+	}
+	index := make(map[string]IndexEntry)
+	uploaded := 0
+
+	err = filepath.Walk(src, func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, file)
+		if err != nil || rel == "." {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if !filter.Match(rel, info.IsDir()) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		entry := IndexEntry{Path: rel, ModTime: info.ModTime(), Mode: info.Mode()}
+		prev, exist := old[rel]
+
+		switch {
+		case info.IsDir():
+		case info.Mode()&os.ModeSymlink != 0:
+			link, err := os.Readlink(file)
+			if err != nil {
+				return err
+			}
+			if path.IsAbs(link) || strings.HasPrefix(path.Join(path.Dir(rel), link), "..") {
+				return nil // unsafe symlink, ignore it like rsync --safe-links
+			}
+			entry.Link = link
+		case info.Mode().IsRegular():
+			entry.Size = info.Size()
+			if exist && prev.Hash != "" && prev.Size == entry.Size && prev.ModTime.Equal(entry.ModTime) {
+				entry.Hash = prev.Hash // not changed
+				break
+			}
+			if exist && prev.Hash != "" && prev.Size == entry.Size { // only mtime changed?
+				if entry.Hash, err = hashFile(file); err != nil {
+					return err
+				}
+				if entry.Hash == prev.Hash {
+					break
+				}
+			}
+			if err := save(rel); err != nil {
+				return err
+			}
+			if exist && prev.Mode.IsDir() { // it was a directory
+				if err := driver.Delete(path.Join(dest, rel)); err != nil {
+					return err
+				}
+			}
+			in, err := os.Open(file)
+			if err != nil {
+				return err
+			}
+			defer in.Close()
+			h := sha256.New()
+			if err := driver.Upload(io.TeeReader(in, h), path.Join(dest, rel)); err != nil {
+				return err
+			}
+			entry.Hash = hashString(h)
+			uploaded++
+		default: // devices, sockets and pipes are not backuped
+			return nil
+		}
+		if exist && prev.Hash != "" && entry.Hash == "" { // it was a regular file
+			if err := save(rel); err != nil {
+				return err
+			}
+			if err := driver.Delete(path.Join(dest, rel)); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+		index[rel] = entry
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	keepRemoved(old, index)
+	log.Debugf("%d files uploaded for increment backup %s", uploaded, dest)
+	return saveIndex(driver, dest, index)
+}
+
+// updateIndex records the checksums of the files in src into the index of dest, after dest is synced by the driver's Rsync.
+// The checksum is reused if the size and mtime (in seconds, like the quick check of rsync) are not changed,
+// so the index written by IncrementSync is kept. A changed file is hashed from its stored copy with the size and mtime
+// of the copy, the file in src may be written again after synced. Only the files selected by filter are recorded.
+// It returns the new index.
+func updateIndex(driver Storage, src, dest string, filter *Filter) (map[string]IndexEntry, error) {
+	src = path.Clean(src)
+	old, err := LoadIndex(driver, dest)
+	if err != nil {
+		return nil, err
+	}
+	index := make(map[string]IndexEntry)
+	changed := false
+	err = filepath.Walk(src, func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, file)
+		if err != nil || rel == "." {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if !filter.Match(rel, info.IsDir()) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		entry := IndexEntry{Path: rel, ModTime: info.ModTime(), Mode: info.Mode()}
+		prev, exist := old[rel]
+
+		switch {
+		case info.IsDir():
+		case info.Mode()&os.ModeSymlink != 0:
+			link, err := os.Readlink(file)
+			if err != nil {
+				return err
+			}
+			if path.IsAbs(link) || strings.HasPrefix(path.Join(path.Dir(rel), link), "..") {
+				return nil // not synced by rsync --safe-links
+			}
+			entry.Link = link
+		case info.Mode().IsRegular():
+			entry.Size = info.Size()
+			if exist && prev.Hash != "" && prev.Size == entry.Size && prev.ModTime.Unix() == entry.ModTime.Unix() {
+				entry.Hash, entry.ModTime = prev.Hash, prev.ModTime
+				break
+			}
+			stored, err := driver.FileInfo(path.Join(dest, rel))
+			if os.IsNotExist(err) {
+				return nil // created after synced
+			} else if err != nil {
+				return err
+			}
+			h, counter := sha256.New(), &countWriter{}
+			if err := driver.Download(io.MultiWriter(h, counter), path.Join(dest, rel)); err != nil {
+				return err
+			}
+			entry.Size, entry.ModTime, entry.Hash = counter.n, stored.ModTime(), hashString(h)
+		default:
+			return nil
+		}
+		if !exist || prev.Hash != entry.Hash || prev.Link != entry.Link || prev.Mode != entry.Mode || !prev.ModTime.Equal(entry.ModTime) {
+			changed = true
+		}
+		index[rel] = entry
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	keepRemoved(old, index)
+	if !changed && len(index) == len(old) {
+		return index, nil
+	}
+	return index, saveIndex(driver, dest, index)
+}
+
+// keepRemoved adds the entries of the files removed from src into the new index, they are still in dest.
+// The ones under a path which is not a directory any more are dropped, they are deleted with it.
+func keepRemoved(old, index map[string]IndexEntry) {
+	for rel, prev := range old {
+		if _, ok := index[rel]; ok {
+			continue
+		}
+		replaced := false
+		for dir := path.Dir(rel); dir != "." && !replaced; dir = path.Dir(dir) {
+			entry, ok := index[dir]
+			replaced = ok && !entry.Mode.IsDir()
+		}
+		if !replaced {
+			index[rel] = prev
+		}
+	}
+}
+
+func hashString(h hash.Hash) string {
+	return hex.EncodeToString(h.Sum(nil))
+}
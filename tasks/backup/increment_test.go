@@ -0,0 +1,133 @@
+package backup
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+// dirDriver stores files in a directory, and counts the uploads
+type dirDriver struct {
+	root    string
+	uploads int
+}
+
+func (d *dirDriver) Name() string { return "dir" }
+
+func (d *dirDriver) Upload(reader io.Reader, dest string) error {
+	d.uploads++
+	os.MkdirAll(path.Dir(path.Join(d.root, dest)), 0755)
+	out, err := os.Create(path.Join(d.root, dest))
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	_, err = io.Copy(out, reader)
+	return err
+}
+
+func (d *dirDriver) Create(reader io.Reader, dest string) error {
+	os.MkdirAll(path.Dir(path.Join(d.root, dest)), 0755)
+	out, err := os.OpenFile(path.Join(d.root, dest), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	_, err = io.Copy(out, reader)
+	return err
+}
+
+func (d *dirDriver) Download(writer io.Writer, src string) error {
+	in, err := os.Open(path.Join(d.root, src))
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	_, err = io.Copy(writer, in)
+	return err
+}
+
+func (d *dirDriver) List(dir string) ([]os.FileInfo, error) {
+	return ioutil.ReadDir(path.Join(d.root, dir))
+}
+
+func (d *dirDriver) Delete(file string) error {
+	return os.RemoveAll(path.Join(d.root, file))
+}
+
+func (d *dirDriver) FileInfo(name string) (os.FileInfo, error) {
+	return os.Stat(path.Join(d.root, name))
+}
+
+func (d *dirDriver) Rsync(src, dest string, filter *Filter) error {
+	return IncrementSync(d, src, dest, filter)
+}
+
+func TestIncrementSync(t *testing.T) {
+	root, _ := ioutil.TempDir("", "backupd-increment")
+	defer os.RemoveAll(root)
+	src, driver := path.Join(root, "src"), &dirDriver{root: path.Join(root, "store")}
+
+	mtime := time.Now().Add(-time.Hour).Truncate(time.Second)
+	os.MkdirAll(path.Join(src, "sub"), 0755)
+	ioutil.WriteFile(path.Join(src, "a"), []byte("file a"), 0600)
+	ioutil.WriteFile(path.Join(src, "sub", "b"), []byte("file b"), 0644)
+	os.Chtimes(path.Join(src, "a"), mtime, mtime)
+	os.Symlink("sub/b", path.Join(src, "link"))
+	os.Symlink("/etc/passwd", path.Join(src, "unsafe"))
+
+	if err := IncrementSync(driver, src, "ns/inc", nil); err != nil {
+		t.Fatal(err)
+	}
+	if driver.uploads != 3 { // a, sub/b and the index
+		t.Errorf("expect 3 uploads, got %d", driver.uploads)
+	}
+	index, err := LoadIndex(driver, "ns/inc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a := index["a"]; a.Mode.Perm() != 0600 || !a.ModTime.Equal(mtime) || a.Hash == "" {
+		t.Errorf("unexpected index entry of a, %+v", a)
+	}
+	if index["link"].Link != "sub/b" || !index["sub"].Mode.IsDir() {
+		t.Errorf("symlink and directory should be in index, %v", index)
+	}
+	if _, ok := index["unsafe"]; ok {
+		t.Error("unsafe symlink should be ignored")
+	}
+
+	// touch a, change sub/b and remove link
+	driver.uploads = 0
+	now := time.Now()
+	os.Chtimes(path.Join(src, "a"), now, now)
+	ioutil.WriteFile(path.Join(src, "sub", "b"), []byte("file B"), 0644)
+	os.Remove(path.Join(src, "link"))
+	if err := IncrementSync(driver, src, "ns/inc", nil); err != nil {
+		t.Fatal(err)
+	}
+	if driver.uploads != 2 { // sub/b and the index
+		t.Errorf("expect 2 uploads, got %d", driver.uploads)
+	}
+	if content, _ := ioutil.ReadFile(path.Join(driver.root, "ns/inc/sub/b")); string(content) != "file B" {
+		t.Errorf("changed file not synced, %q", content)
+	}
+	index, _ = LoadIndex(driver, "ns/inc")
+	if index["link"].Link != "sub/b" || !index["a"].ModTime.Equal(now) { // the removed link is kept
+		t.Errorf("index not updated, %v", index)
+	}
+
+	// removed file is kept like rsync without --delete
+	os.Remove(path.Join(src, "a"))
+	if err := IncrementSync(driver, src, "ns/inc", nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path.Join(driver.root, "ns/inc/a")); err != nil {
+		t.Errorf("removed file should be kept, %v", err)
+	}
+	if index, _ = LoadIndex(driver, "ns/inc"); index["a"].Hash == "" {
+		t.Errorf("removed file should be kept in index, %v", index)
+	}
+}
@@ -0,0 +1,55 @@
+package backup
+
+import (
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"strings"
+)
+
+// ParseLabels parses the labels like key=value, the key can not be empty or have spaces
+func ParseLabels(kvs []string) (map[string]string, error) {
+	ret := make(map[string]string)
+	for _, kv := range kvs {
+		parts := strings.SplitN(kv, "=", 2)
+		if len(parts) != 2 || parts[0] == "" || strings.ContainsAny(parts[0], " \t\n") {
+			return nil, fmt.Errorf("Unvalid label %q, it should be key=value", kv)
+		}
+		ret[parts[0]] = parts[1]
+	}
+	return ret, nil
+}
+
+// MatchLabels checks whether the labels match all the selectors, a selector is key=value, or key which means the key exists
+func MatchLabels(labels map[string]string, selectors []string) bool {
+	for _, sel := range selectors {
+		parts := strings.SplitN(sel, "=", 2)
+		v, ok := labels[parts[0]]
+		if !ok || len(parts) == 2 && v != parts[1] {
+			return false
+		}
+	}
+	return true
+}
+
+// LabelBackup sets the labels in set and removes the ones in remove of the backup named name, note is not changed if nil
+func LabelBackup(name string, set map[string]string, remove []string, note *string) (Entity, error) {
+	return updateEntity(name, func(ent *Entity) error {
+		if ent.Labels == nil {
+			ent.Labels = make(map[string]string)
+		}
+		for _, k := range remove {
+			delete(ent.Labels, k)
+		}
+		for k, v := range set {
+			ent.Labels[k] = v
+		}
+		if len(ent.Labels) == 0 {
+			ent.Labels = nil
+		}
+		if note != nil {
+			ent.Note = *note
+		}
+		log.Infof("Labels of backup %s are %v, note %q", name, ent.Labels, ent.Note)
+		return nil
+	})
+}
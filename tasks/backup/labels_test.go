@@ -0,0 +1,75 @@
+package backup
+
+import (
+	"github.com/laincloud/backupd/crond"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestParseLabels(t *testing.T) {
+	labels, err := ParseLabels([]string{"stage=before-migration", "ticket=OPS-1=2", "empty="})
+	if err != nil || len(labels) != 3 || labels["ticket"] != "OPS-1=2" || labels["empty"] != "" {
+		t.Errorf("unexpected labels %v %v", labels, err)
+	}
+	for _, kv := range []string{"stage", "=value", "a key=value"} {
+		if _, err := ParseLabels([]string{kv}); err == nil {
+			t.Errorf("%q should be unvalid", kv)
+		}
+	}
+
+	labels = map[string]string{"stage": "before-migration", "schema": "v2"}
+	for sel, match := range map[string]bool{"stage=before-migration": true, "schema": true, "stage=after": false, "owner": false} {
+		if MatchLabels(labels, []string{sel}) != match {
+			t.Errorf("%q should match %v", sel, match)
+		}
+	}
+	if MatchLabels(labels, []string{"schema=v2", "stage=after"}) || !MatchLabels(nil, nil) {
+		t.Error("all the selectors should be matched")
+	}
+}
+
+func TestLabelBackup(t *testing.T) {
+	root, _ := ioutil.TempDir("", "backupd-labels")
+	defer os.RemoveAll(root)
+	driver := &dirDriver{root: path.Join(root, "store")}
+	driverRunning = driver
+	meta = NewMeta(driver, namespace)
+	src := path.Join(root, "data")
+	os.MkdirAll(src, 0755)
+	ioutil.WriteFile(path.Join(src, "db"), []byte("database"), 0644)
+
+	if _, err := backup(crond.FuncArg{"path": src, "labels": []string{"bad"}}); err == nil {
+		t.Error("backup with unvalid labels should fail")
+	}
+	result, err := backup(crond.FuncArg{"path": src, "archive": "app-data",
+		"labels": []interface{}{"stage=before-migration"}, "note": "before v2 schema migration"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	name := result["file"].(string)
+	ent := meta.Get(name)
+	if ent == nil || ent.Labels["stage"] != "before-migration" || ent.Note != "before v2 schema migration" {
+		t.Fatalf("labels should be set at creation, %+v", ent)
+	}
+
+	if _, err := LabelBackup("missing", nil, nil, nil); err == nil {
+		t.Error("labeling an unknown backup should fail")
+	}
+	ent2, err := LabelBackup(name, map[string]string{"schema": "v2"}, []string{"stage"}, nil)
+	if err != nil || len(ent2.Labels) != 1 || ent2.Labels["schema"] != "v2" || ent2.Note != "before v2 schema migration" {
+		t.Errorf("unexpected labels %v %q %v", ent2.Labels, ent2.Note, err)
+	}
+	note := ""
+	if _, err := LabelBackup(name, nil, []string{"schema"}, &note); err != nil {
+		t.Fatal(err)
+	}
+	mt := NewMeta(driver, namespace)
+	if err := mt.LoadFromBackend(); err != nil {
+		t.Fatal(err)
+	}
+	if ent := mt.Get(name); ent.Labels != nil || ent.Note != "" {
+		t.Errorf("labels and note should be removed in meta, %+v", ent)
+	}
+}
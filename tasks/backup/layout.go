@@ -0,0 +1,114 @@
+package backup
+
+import (
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// The storage layouts, where the new backups are stored:
+//
+//	ip   <ip>/<backup>, the backups are in the namespace of the server making them, each namespace has its own meta
+//	app  apps/<app>/<proc>/<instance>/<volume>/<backup>, indexed by the meta in apps shared by all the servers
+//
+// In app layout the history of an instance is found wherever it runs now. The backups whose archive name is not made
+// by the controller, see ParseArchiveName, are always stored in ip layout.
+const (
+	LayoutIP  = "ip"
+	LayoutApp = "app"
+	appsDir   = "apps"
+)
+
+var (
+	layout   = LayoutIP
+	appIndex *Meta // the index of the backups in app layout
+)
+
+// SetLayout sets the storage layout of the new backups, it's called before Init
+func SetLayout(name string) error {
+	if name != LayoutIP && name != LayoutApp {
+		return fmt.Errorf("Unvalid storage layout %s, ip or app", name)
+	}
+	layout = name
+	return nil
+}
+
+// AppNamespace returns the namespace of the volume of the instance in app layout
+func AppNamespace(app, proc string, instanceNo int, volume string) string {
+	return path.Join(appsDir, app, proc, strconv.Itoa(instanceNo), strings.Replace(strings.Trim(volume, "/"), "/", "-", -1))
+}
+
+// archiveNamespace returns the namespace in app layout of the archive, empty if the archive name can not be parsed
+func archiveNamespace(archive string) string {
+	app, proc, instanceNo, volume, ok := ParseArchiveName(archive)
+	if !ok {
+		return ""
+	}
+	return AppNamespace(app, proc, instanceNo, volume)
+}
+
+// ns returns the namespace the backup is stored in, empty Namespace means the namespace of this server
+func (ent *Entity) ns() string {
+	if ent.Namespace != "" {
+		return ent.Namespace
+	}
+	return namespace
+}
+
+// inAppLayout tells whether the backup is stored in app layout
+func (ent *Entity) inAppLayout() bool {
+	return strings.HasPrefix(ent.Namespace, appsDir+"/")
+}
+
+// metaOf returns the meta the backup is recorded in
+func metaOf(ent *Entity) *Meta {
+	if ent.inAppLayout() && appIndex != nil {
+		return appIndex
+	}
+	return meta
+}
+
+// OpenIndex loads the index of app layout, an index never written is empty
+func OpenIndex(store Storage) (*Meta, error) {
+	index := NewSharedMeta(store, appsDir)
+	if err := index.LoadFromBackend(); err != nil {
+		if _, ferr := store.FileInfo(path.Join(appsDir, metaFile)); os.IsNotExist(ferr) {
+			return index, nil
+		}
+		return index, err
+	}
+	return index, nil
+}
+
+// metas returns the meta of this server and the index of app layout, the index is refreshed to read the changes of the others
+func metas() []*Meta {
+	if appIndex == nil {
+		return []*Meta{meta}
+	}
+	if err := appIndex.Refresh(); err != nil {
+		log.Warnf("Fail to refresh the index of app layout, %s", err.Error())
+	}
+	return []*Meta{meta, appIndex}
+}
+
+// findBackup returns the backup named name and the meta it's recorded in, nil if not found
+func findBackup(name string) (*Entity, *Meta) {
+	for _, mt := range metas() {
+		if ent := mt.Get(name); ent != nil {
+			return ent, mt
+		}
+	}
+	return nil, nil
+}
+
+// listBackups returns the backups of the directories in both layouts, all the backups if no directory given
+func listBackups(dir ...string) []Entity {
+	var ret []Entity
+	for _, mt := range metas() {
+		ret = append(ret, mt.Array(dir...)...)
+	}
+	return ret
+}
@@ -0,0 +1,169 @@
+package backup
+
+import (
+	"github.com/laincloud/backupd/crond"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestAppNamespace(t *testing.T) {
+	if ns := AppNamespace("hello", "hello.web.web", 1, "/var/lib/mysql"); ns != "apps/hello/hello.web.web/1/var-lib-mysql" {
+		t.Errorf("unexpected namespace %s", ns)
+	}
+	if ns := archiveNamespace("hello-hello.web.web-1-var-lib-mysql"); ns != "apps/hello/hello.web.web/1/var-lib-mysql" {
+		t.Errorf("unexpected namespace of archive %s", ns)
+	}
+	if ns := archiveNamespace("app-data"); ns != "" {
+		t.Errorf("unparsed archive should be in ip layout, got %s", ns)
+	}
+	if err := SetLayout("node"); err == nil || layout != LayoutIP {
+		t.Error("unvalid layout should not be set")
+	}
+}
+
+func TestAppLayout(t *testing.T) {
+	root, _ := ioutil.TempDir("", "backupd-layout")
+	defer os.RemoveAll(root)
+	driver := &dirDriver{root: path.Join(root, "store")}
+	driverRunning = driver
+	meta = NewMeta(driver, namespace)
+	appIndex = NewSharedMeta(driver, appsDir)
+	SetLayout(LayoutApp)
+	defer func() { layout, appIndex = LayoutIP, nil }()
+	src := path.Join(root, "data")
+	os.MkdirAll(src, 0755)
+	ioutil.WriteFile(path.Join(src, "db"), []byte("v1"), 0644)
+
+	archive := "hello-hello.web.web-1-data"
+	ns := "apps/hello/hello.web.web/1/data"
+	result, err := backup(crond.FuncArg{"path": src, "archive": archive})
+	if err != nil {
+		t.Fatal(err)
+	}
+	name := result["file"].(string)
+	if _, err := driver.FileInfo(path.Join(ns, name)); err != nil {
+		t.Errorf("backup should be stored by app, proc, instance and volume, %v", err)
+	}
+	if _, err := backup(crond.FuncArg{"path": src, "archive": archive, "mode": MODE_INCREMENT}); err != nil {
+		t.Fatal(err)
+	}
+	if len(meta.Array()) != 0 || len(appIndex.Array(src)) != 2 || len(appIndex.Snapshots(archive)) != 1 {
+		t.Fatalf("backups should be in the index, %d %d", len(meta.Array()), len(appIndex.Array()))
+	}
+	if ents, _ := List(src); len(ents) != 2 {
+		t.Errorf("backups in app layout should be listed, %d", len(ents))
+	}
+
+	// the instance is rescheduled to another server
+	meta = NewMeta(driver, "10.0.0.2")
+	appIndex = NewSharedMeta(driver, appsDir)
+	if ent, err := Info(name); err != nil || ent.Namespace != ns {
+		t.Fatalf("backup should be found on the new server, %+v %v", ent, err)
+	}
+	ioutil.WriteFile(path.Join(src, "db"), []byte("v2"), 0644)
+	if _, err := backup_recover(crond.FuncArg{"namespace": "10.0.0.1", "backup": name}); err != nil {
+		t.Fatal(err)
+	}
+	checkFiles(t, src, map[string]string{"db": "v1"})
+	ioutil.WriteFile(path.Join(src, "db"), []byte("v2"), 0644)
+	if _, err := backup_recover(crond.FuncArg{"backup": archive}); err != nil {
+		t.Fatal(err)
+	}
+	checkFiles(t, src, map[string]string{"db": "v1"})
+
+	// the index is shared, the changes of the others are read
+	other := NewSharedMeta(driver, appsDir)
+	other.LoadFromBackend()
+	if err := Delete(name); err != nil {
+		t.Fatal(err)
+	}
+	if err := other.Refresh(); err != nil || other.Get(name) != nil || len(other.Array()) != 1 {
+		t.Errorf("deleting should be read by the other servers, %v", err)
+	}
+	if _, err := driver.FileInfo(path.Join(ns, name)); !os.IsNotExist(err) {
+		t.Errorf("backup in app layout should be deleted, %v", err)
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	root, _ := ioutil.TempDir("", "backupd-migrate")
+	defer os.RemoveAll(root)
+	driver := &dirDriver{root: path.Join(root, "store")}
+	driverRunning = driver
+	meta = NewMeta(driver, "10.0.0.1")
+	namespace = "10.0.0.1"
+	defer func() { namespace, appIndex = "", nil }()
+	src := path.Join(root, "data")
+	os.MkdirAll(src, 0755)
+	ioutil.WriteFile(path.Join(src, "db"), []byte("v1"), 0644)
+
+	full := NewEntity(src, "hello-hello.web.web-1-var-lib-mysql", 1, nil, "/var/lib/mysql", MODE_FULL)
+	dedup := NewEntity(src, "hello-hello.web.web-1-data", 1, nil, "/data", MODE_DEDUP)
+	kept := NewEntity(src, "app-data", 1, nil, "/data", MODE_FULL)
+	for _, err := range []error{full.Backup(driver), dedup.DedupBackup(driver), kept.Backup(driver)} {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	increment := NewEntity(src, "hello-hello.web.web-2-data", 2, nil, "/data", MODE_INCREMENT)
+	increment.Created = time.Now().Add(-time.Hour)
+	if err := increment.IncrementBackup(); err != nil {
+		t.Fatal(err)
+	}
+	ioutil.WriteFile(path.Join(src, "db"), []byte("v2"), 0644)
+	increment = NewEntity(src, "hello-hello.web.web-2-data", 2, nil, "/data", MODE_INCREMENT)
+	if err := increment.IncrementBackup(); err != nil {
+		t.Fatal(err)
+	}
+
+	index, _ := OpenIndex(driver)
+	appIndex = index
+	result, err := Migrate(driver, meta, index, false)
+	if err != nil || len(result.Migrated) != 4 || len(result.Warnings) != 1 || len(meta.Array()) != 5 || len(index.Array()) != 0 {
+		t.Fatalf("only the plan should be made, %+v %v", result, err)
+	}
+	if result, err = Migrate(driver, meta, index, true); err != nil || len(result.Migrated) != 4 || !result.Applied {
+		t.Fatalf("unexpected migration %+v %v", result, err)
+	}
+	if len(meta.Array()) != 1 || meta.Get(kept.Name) == nil || len(index.Array()) != 4 {
+		t.Fatalf("backups should be moved into the index, %d %d", len(meta.Array()), len(index.Array()))
+	}
+	for _, file := range []string{full.Name, dedup.Name, "hello-hello.web.web-2-data"} {
+		if _, err := driver.FileInfo(path.Join("10.0.0.1", file)); !os.IsNotExist(err) {
+			t.Errorf("%s should be deleted from the namespace of server, %v", file, err)
+		}
+	}
+	if ent := index.Get(full.Name); ent == nil || ent.Namespace != "apps/hello/hello.web.web/1/var-lib-mysql" {
+		t.Errorf("unexpected migrated backup %+v", ent)
+	}
+
+	// the migrated backups are restored on another server
+	meta, namespace = NewMeta(driver, "10.0.0.2"), "10.0.0.2"
+	scratch := path.Join(root, "scratch")
+	for _, name := range []string{full.Name, dedup.Name} {
+		ent, err := Info(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		os.RemoveAll(scratch)
+		if _, err := ent.restoreTo(driver, scratch); err != nil {
+			t.Fatalf("%s should be restored, %v", name, err)
+		}
+		checkFiles(t, path.Join(scratch, "data"), map[string]string{"db": "v1"})
+	}
+	ioutil.WriteFile(path.Join(src, "db"), []byte("v3"), 0644)
+	if _, err := backup_recover(crond.FuncArg{"namespace": "10.0.0.1", "backup": "hello-hello.web.web-2-data", "at": time.Now().Add(-time.Minute).Format(time.RFC3339)}); err != nil {
+		t.Fatal(err)
+	}
+	checkFiles(t, src, map[string]string{"db": "v1"})
+
+	// nothing is left to migrate
+	mt := NewMeta(driver, "10.0.0.1")
+	mt.LoadFromBackend()
+	if result, err = Migrate(driver, mt, index, true); err != nil || len(result.Migrated) != 0 || len(index.Array()) != 4 {
+		t.Errorf("migration should be idempotent, %+v %v", result, err)
+	}
+}
@@ -0,0 +1,193 @@
+package backup
+
+import (
+	"archive/tar"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+)
+
+// The manifest of a full backup is the file list of the archive, it's stored beside the archive named <archive>.index
+// in the same format with the index of increment backup, so the files can be browsed without downloading the archive.
+
+// archiveRel returns the path of a file in the archive relative to the backuped directory,
+// the files are named <base of the directory>/... in the archive, false is returned for the directory itself
+func archiveRel(name string) (string, bool) {
+	parts := strings.SplitN(path.Clean(name), "/", 2)
+	if len(parts) < 2 {
+		return "", false
+	}
+	return parts[1], true
+}
+
+func addManifest(index map[string]IndexEntry, hdr *tar.Header) {
+	rel, ok := archiveRel(hdr.Name)
+	if !ok {
+		return
+	}
+	entry := IndexEntry{Path: rel, Size: hdr.Size, ModTime: hdr.ModTime, Mode: hdr.FileInfo().Mode()}
+	switch hdr.Typeflag {
+	case tar.TypeSymlink:
+		entry.Link = hdr.Linkname
+	case tar.TypeLink: // the size is in the first path of the file
+		if first, ok := archiveRel(hdr.Linkname); ok {
+			entry.Size = index[first].Size
+		}
+	}
+	index[rel] = entry
+}
+
+// manifest returns the files in the full or dedup backup, key is the relative path.
+// The archive is read through if it's backuped without manifest.
+func (ent *Entity) manifest(driver Storage) (map[string]IndexEntry, error) {
+	store, err := ent.storage(driver)
+	if err != nil {
+		return nil, err
+	}
+	file := path.Join(ent.ns(), ent.Name)
+	index := make(map[string]IndexEntry)
+	if ent.Mode == MODE_DEDUP {
+		snap, err := loadSnapshot(store, file, ent.Checksum)
+		if err != nil {
+			return nil, err
+		}
+		for i := range snap.Files {
+			addManifest(index, &snap.Files[i].Header)
+		}
+		return index, nil
+	}
+	if _, err := store.FileInfo(indexFile(file)); err == nil {
+		return LoadIndex(store, file)
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	log.Infof("No manifest of %s, reading the archive", ent.Name)
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(ent.tarStream(store, ent.ns(), pw))
+	}()
+	tr := tar.NewReader(pr)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			pr.CloseWithError(err)
+			return nil, err
+		}
+		addManifest(index, hdr)
+	}
+	_, err = io.Copy(ioutil.Discard, pr)
+	pr.CloseWithError(err)
+	return index, err
+}
+
+// ArchiveFileList returns the files directly in dir of the full or dedup backup, dir is relative to the backuped directory
+func ArchiveFileList(name, dir string) ([]IndexEntry, error) {
+	log.Infof("Getting file list of %s in %s", dir, name)
+	ent, err := Info(name)
+	if err != nil {
+		return nil, err
+	}
+	if ent.Mode == MODE_INCREMENT {
+		return nil, fmt.Errorf("%s is an increment backup", name)
+	}
+	index, err := ent.manifest(driverRunning)
+	if err != nil {
+		return nil, err
+	}
+	return listIndexDir(index, name, dir)
+}
+
+// listIndexDir returns the entries in the directory dir of the index, sorted by path
+func listIndexDir(index map[string]IndexEntry, name, dir string) ([]IndexEntry, error) {
+	dir = strings.Trim(path.Clean("/"+dir), "/")
+	if dir != "" {
+		if entry, ok := index[dir]; !ok || !entry.Mode.IsDir() {
+			return nil, fmt.Errorf("No directory %s in %s", dir, name)
+		}
+	}
+	ret := []IndexEntry{}
+	for rel, entry := range index {
+		parent := path.Dir(rel)
+		if parent == dir || parent == "." && dir == "" {
+			ret = append(ret, entry)
+		}
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Path < ret[j].Path })
+	return ret, nil
+}
+
+// RecoverFiles extracts the files of the full or dedup backup into the source, the other files in the source are kept.
+// files are relative to the backuped directory, a directory is recovered with all the files in it.
+// The files are extracted into a staging directory first, the source is not touched if the backup is corrupted.
+func (ent *Entity) RecoverFiles(driver Storage, ns string, files []string) error {
+	selected := make(map[string]bool)
+	for _, file := range files {
+		f := strings.Trim(path.Clean("/"+file), "/")
+		if f == "" {
+			return fmt.Errorf("Unvalid file %q to recover", file)
+		}
+		selected[f] = false
+	}
+	var root string // the name of backuped directory in the archive
+	match := func(name string) bool {
+		rel, ok := archiveRel(name)
+		if !ok {
+			root = name
+			return true
+		}
+		ret := false
+		for f := range selected {
+			if rel == f || strings.HasPrefix(rel, f+"/") {
+				selected[f], ret = true, true
+			} else if strings.HasPrefix(f, rel+"/") { // the parent directories keep their mode and mtime
+				ret = true
+			}
+		}
+		return ret
+	}
+
+	stageDir := ent.Source + ".recovering"
+	if err := os.RemoveAll(stageDir); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(stageDir, 0755); err != nil {
+		return err
+	}
+	defer os.RemoveAll(stageDir)
+
+	store, err := ent.storage(driver)
+	if err != nil {
+		return err
+	}
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(ent.tarStream(store, ns, pw))
+	}()
+	ent.fileErrors, err = extractFiltered(pr, stageDir, match)
+	if err == nil { // till the checksum is verified
+		_, err = io.Copy(ioutil.Discard, pr)
+	}
+	pr.CloseWithError(err)
+	if err != nil {
+		log.Errorf("Fail to extract files from backup %s, %s", ent.Name, err.Error())
+		return err
+	}
+	for f, found := range selected {
+		if !found {
+			return ent.noFile(f)
+		}
+	}
+
+	errs, err := copyTree(path.Join(stageDir, root), ent.Source)
+	ent.fileErrors = append(ent.fileErrors, errs...)
+	return err
+}
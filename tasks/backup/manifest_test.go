@@ -0,0 +1,116 @@
+package backup
+
+import (
+	"github.com/laincloud/backupd/crond"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestArchiveFileList(t *testing.T) {
+	root, _ := ioutil.TempDir("", "backupd-manifest")
+	defer os.RemoveAll(root)
+	driver := &dirDriver{root: path.Join(root, "store")}
+	driverRunning = driver
+	meta = NewMeta(driver, namespace)
+	src := path.Join(root, "data")
+	os.MkdirAll(path.Join(src, "conf", "sub"), 0755)
+	ioutil.WriteFile(path.Join(src, "db"), []byte("database"), 0644)
+	ioutil.WriteFile(path.Join(src, "conf", "app.yml"), []byte("app"), 0644)
+	os.Symlink("app.yml", path.Join(src, "conf", "link"))
+
+	var full string
+	for _, mode := range []string{MODE_FULL, MODE_DEDUP} {
+		ent := NewEntity(src, "app-data-"+mode, 0, nil, "/data", mode)
+		if mode == MODE_FULL {
+			full = ent.Name
+		}
+		var err error
+		if mode == MODE_DEDUP {
+			err = ent.DedupBackup(driver)
+		} else {
+			err = ent.Backup(driver)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		list, err := ArchiveFileList(ent.Name, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(list) != 2 || list[0].Path != "conf" || !list[0].Mode.IsDir() || list[1].Path != "db" || list[1].Size != 8 {
+			t.Errorf("%s: unexpected files in root, %+v", mode, list)
+		}
+		list, err = ArchiveFileList(ent.Name, "/conf/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(list) != 3 || list[0].Path != "conf/app.yml" || list[1].Link != "app.yml" || list[2].Path != "conf/sub" {
+			t.Errorf("%s: unexpected files in conf, %+v", mode, list)
+		}
+		if _, err := ArchiveFileList(ent.Name, "db"); err == nil {
+			t.Errorf("%s: listing a file should fail", mode)
+		}
+	}
+
+	// the backups without manifest are listed by reading the archive
+	manifest := path.Join(driver.root, namespace, full+indexSuffix)
+	if _, err := os.Stat(manifest); err != nil {
+		t.Fatal("manifest should be stored beside the archive")
+	}
+	os.Remove(manifest)
+	if list, err := ArchiveFileList(full, "conf"); err != nil || len(list) != 3 {
+		t.Errorf("files should be listed without manifest, %+v %v", list, err)
+	}
+}
+
+func TestRecoverFiles(t *testing.T) {
+	root, _ := ioutil.TempDir("", "backupd-recover-files")
+	defer os.RemoveAll(root)
+	driver := &dirDriver{root: path.Join(root, "store")}
+	driverRunning = driver
+	meta = NewMeta(driver, namespace)
+	src := path.Join(root, "data")
+	os.MkdirAll(path.Join(src, "conf"), 0755)
+	ioutil.WriteFile(path.Join(src, "db"), []byte("old db"), 0644)
+	ioutil.WriteFile(path.Join(src, "conf", "app.yml"), []byte("old conf"), 0644)
+
+	ent := NewEntity(src, "app-data", 0, nil, "/data", MODE_FULL)
+	if err := ent.Backup(driver); err != nil {
+		t.Fatal(err)
+	}
+	ioutil.WriteFile(path.Join(src, "db"), []byte("new db"), 0644)
+	os.RemoveAll(path.Join(src, "conf"))
+	ioutil.WriteFile(path.Join(src, "conf"), []byte("now a file"), 0644)
+	ioutil.WriteFile(path.Join(src, "live"), []byte("live"), 0644)
+
+	if _, err := backup_recover(crond.FuncArg{"backup": ent.Name, "files": []string{"conf/app.yml", "missing"}}); err == nil {
+		t.Error("recovering a file not in the backup should fail")
+	}
+	if content, _ := ioutil.ReadFile(path.Join(src, "conf")); string(content) != "now a file" {
+		t.Error("the source should not be touched if any file is not found")
+	}
+
+	if _, err := backup_recover(crond.FuncArg{"backup": ent.Name, "files": []string{"/conf/app.yml"}}); err != nil {
+		t.Fatal(err)
+	}
+	for file, content := range map[string]string{"conf/app.yml": "old conf", "db": "new db", "live": "live"} {
+		if data, _ := ioutil.ReadFile(path.Join(src, file)); string(data) != content {
+			t.Errorf("%s should be %q, got %q", file, content, data)
+		}
+	}
+
+	// into an alternate directory
+	dest := path.Join(root, "restored")
+	if _, err := backup_recover(crond.FuncArg{"backup": ent.Name, "files": []string{"db"}, "destDir": dest}); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := ioutil.ReadFile(path.Join(dest, "db")); string(data) != "old db" {
+		t.Errorf("db should be recovered into %s, got %q", dest, data)
+	}
+	if _, err := os.Stat(path.Join(dest, "conf")); !os.IsNotExist(err) {
+		t.Error("only the selected files should be recovered")
+	}
+}
@@ -3,98 +3,547 @@ package backup
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"os"
 	"path"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
 )
 
+// The meta of a namespace is stored as generations and a journal:
+//
+//	.meta             the latest generation, all the backups at its version
+//	.meta.prev        the previous generation, used if .meta is lost or corrupted
+//	.meta.journal/<v> the changes of the transaction committed at version v
+//
+// A transaction only uploads its changes into the journal, the memory is changed after the journal is written,
+// so a failed commit changes nothing. Every metaCompactEvery commits a new generation is written,
+// by uploading .meta.tmp and renaming it to .meta if the storage is a Renamer, and the journal covered by
+// the previous generation is deleted. Loading reads the latest generation which can be read and replays the journal after it.
+// A meta shared by the servers, like the index of app layout, replays the journal written by the others before each commit.
+// The records are written by Creator, the commit finding its version written by another server refreshes and runs again,
+// and only the server committing a version of a multiple of metaCompactEvery compacts a shared meta. The meta of a server
+// is written by others only when fixed by ReconcileNamespace, which commits it as a shared meta.
+const (
+	metaPrevSuffix    = ".prev"
+	metaTmpSuffix     = ".tmp"
+	metaJournalSuffix = ".journal"
+	metaCompactEvery  = 100
+	// the times a commit of shared meta is tried when the others commit the same version
+	metaCommitRetries = 10
+)
+
+// metaGeneration is the content of a meta file, the meta before versioning is a plain map of the entities
+type metaGeneration struct {
+	Version  uint64              `json:"version"`
+	Entities map[string][]Entity `json:"entities"`
+}
+
+// metaOp is a change in the journal, an entity put into Key, or deleted by Name
+type metaOp struct {
+	Key    string  `json:"key,omitempty"`
+	Entity *Entity `json:"entity,omitempty"`
+	Name   string  `json:"name,omitempty"`
+}
+
+// errMetaConflict is returned by committing a version of the shared meta written by another server
+var errMetaConflict = errors.New("meta version conflicted")
+
+type metaRecord struct {
+	Version uint64   `json:"version"`
+	Ops     []metaOp `json:"ops"`
+}
+
 type Meta struct {
-	Entities  map[string][]Entity
+	lock      sync.RWMutex
+	entities  map[string][]Entity // key is the source, or source@increment for the increment snapshots
+	names     map[string]string   // the key of the entities by name
+	version   uint64              // version of the last commit
+	base      uint64              // version of the latest generation
 	file      string
 	backend   Storage
 	namespace string
+	shared    bool // written by several servers
 }
 
 func NewMeta(backend Storage, namespace string) *Meta {
 	return &Meta{
-		Entities:  make(map[string][]Entity),
-		file:      ".meta",
+		entities:  make(map[string][]Entity),
+		names:     make(map[string]string),
+		file:      metaFile,
 		backend:   backend,
 		namespace: namespace,
 	}
 }
 
-func (meta *Meta) Add(ent Entity) {
-	meta.Entities[ent.Source] = append(meta.Entities[ent.Source], ent)
-}
-func (meta *Meta) Set(src string, ents []Entity) {
-	meta.Entities[src] = ents
+// NewSharedMeta returns the meta written by several servers, the changes of the others are read by Refresh
+func NewSharedMeta(backend Storage, namespace string) *Meta {
+	meta := NewMeta(backend, namespace)
+	meta.shared = true
+	return meta
 }
 
 func (meta *Meta) Get(name string) *Entity {
-	for _, arr := range meta.Entities {
+	meta.lock.RLock()
+	defer meta.lock.RUnlock()
+	return meta.get(name)
+}
+
+// Snapshots returns the snapshots of the increment backup archive, the oldest first
+func (meta *Meta) Snapshots(archive string) []Entity {
+	meta.lock.RLock()
+	defer meta.lock.RUnlock()
+	var ret []Entity
+	for _, arr := range meta.entities {
 		for _, item := range arr {
-			if item.Name == name {
-				return &item
+			if item.isSnapshot() && item.mirrorName() == archive {
+				ret = append(ret, item)
 			}
 		}
 	}
-	return nil
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Created.Before(ret[j].Created) })
+	return ret
 }
 
-func (meta *Meta) Delete(name string) {
-	for k, arr := range meta.Entities {
-		for i, item := range arr {
-			if item.Name == name {
-				meta.Entities[k] = append(meta.Entities[k][:i], meta.Entities[k][i+1:]...)
-				return
-			}
+// Snapshot returns the last snapshot of the increment backup archive taken at or before at, nil if not found
+func (meta *Meta) Snapshot(archive string, at time.Time) *Entity {
+	var ret *Entity
+	for _, item := range meta.Snapshots(archive) {
+		if item.Created.After(at) {
+			break
 		}
+		tmp := item
+		ret = &tmp
 	}
+	return ret
 }
 
 func (meta *Meta) Array(src ...string) []Entity {
+	meta.lock.RLock()
+	defer meta.lock.RUnlock()
 	var ret []Entity
 	if len(src) > 0 {
 		for _, item := range src {
-			tmp, ok := meta.Entities[item]
-			if ok {
-				ret = append(ret, tmp...)
-			}
-			tmp, ok = meta.Entities[item+"@increment"]
-			if ok {
-				ret = append(ret, tmp...)
-			}
+			ret = append(ret, meta.entities[item]...)
+			ret = append(ret, meta.entities[item+"@increment"]...)
 		}
 		return ret
 	}
-	ret = make([]Entity, 0, 100)
-	for _, arr := range meta.Entities {
+	ret = make([]Entity, 0, len(meta.names))
+	for _, arr := range meta.entities {
 		ret = append(ret, arr...)
 	}
 	return ret
 }
 
-func (meta *Meta) Sync() error {
+// Version returns the version of the last commit
+func (meta *Meta) Version() uint64 {
+	meta.lock.RLock()
+	defer meta.lock.RUnlock()
+	return meta.version
+}
+
+func (meta *Meta) get(name string) *Entity {
+	key, ok := meta.names[name]
+	if !ok {
+		return nil
+	}
+	for _, item := range meta.entities[key] {
+		if item.Name == name {
+			return &item
+		}
+	}
+	return nil
+}
+
+// put replaces the entity having the same name, or appends it into key
+func (meta *Meta) put(key string, ent Entity) {
+	if old, ok := meta.names[ent.Name]; ok {
+		for i, item := range meta.entities[old] {
+			if item.Name == ent.Name {
+				meta.entities[old][i] = ent
+				return
+			}
+		}
+	}
+	meta.entities[key] = append(meta.entities[key], ent)
+	meta.names[ent.Name] = key
+}
+
+func (meta *Meta) delete(name string) {
+	key, ok := meta.names[name]
+	if !ok {
+		return
+	}
+	delete(meta.names, name)
+	arr := meta.entities[key]
+	for i, item := range arr {
+		if item.Name == name {
+			meta.entities[key] = append(arr[:i:i], arr[i+1:]...)
+			break
+		}
+	}
+	if len(meta.entities[key]) == 0 {
+		delete(meta.entities, key)
+	}
+}
+
+func (meta *Meta) apply(ops []metaOp) {
+	for _, op := range ops {
+		if op.Entity != nil {
+			meta.put(op.Key, *op.Entity)
+		} else {
+			meta.delete(op.Name)
+		}
+	}
+}
+
+func (meta *Meta) reset(entities map[string][]Entity) {
+	meta.entities = make(map[string][]Entity)
+	meta.names = make(map[string]string)
+	for key, arr := range entities {
+		for _, item := range arr {
+			meta.put(key, item)
+		}
+	}
+}
+
+// MetaTx collects the changes of a transaction, it reads the meta with the changes made so far
+type MetaTx struct {
+	meta *Meta
+	ops  []metaOp
+}
+
+// Get returns a copy of the entity named name, nil if not found
+func (tx *MetaTx) Get(name string) *Entity {
+	for i := len(tx.ops) - 1; i >= 0; i-- {
+		op := tx.ops[i]
+		if op.Entity != nil && op.Entity.Name == name {
+			ent := *op.Entity
+			return &ent
+		} else if op.Entity == nil && op.Name == name {
+			return nil
+		}
+	}
+	return tx.meta.get(name)
+}
+
+// Put adds the entity into key, or replaces the one having the same name
+func (tx *MetaTx) Put(key string, ent Entity) {
+	tx.ops = append(tx.ops, metaOp{Key: key, Entity: &ent})
+}
+
+// Update replaces the entity having the same name, false if not found
+func (tx *MetaTx) Update(ent Entity) bool {
+	if tx.Get(ent.Name) == nil {
+		return false
+	}
+	tx.Put(ent.Source, ent)
+	return true
+}
+
+func (tx *MetaTx) Delete(name string) {
+	tx.ops = append(tx.ops, metaOp{Name: name})
+}
+
+// Commit runs fn in a transaction, the changes made by fn are written into the journal and then applied in memory.
+// Nothing is changed if fn or the writing fails. fn may run again with the changes of the others for a shared meta.
+func (meta *Meta) Commit(fn func(tx *MetaTx) error) error {
+	meta.lock.Lock()
+	defer meta.lock.Unlock()
+	for i := 0; ; i++ {
+		err := meta.commit(fn)
+		if err != errMetaConflict {
+			return err
+		}
+		if i+1 >= metaCommitRetries {
+			return fmt.Errorf("Fail to commit meta of %s, conflicted %d times", meta.namespace, metaCommitRetries)
+		}
+		log.Infof("Meta of %s is committed by another server at version %d, retrying", meta.namespace, meta.version+1)
+	}
+}
+
+func (meta *Meta) commit(fn func(tx *MetaTx) error) error {
+	if meta.shared {
+		if err := meta.refresh(); err != nil {
+			return fmt.Errorf("Fail to refresh meta of %s, %s", meta.namespace, err.Error())
+		}
+	}
+	tx := &MetaTx{meta: meta}
+	if err := fn(tx); err != nil {
+		return err
+	}
+	if len(tx.ops) == 0 {
+		return nil
+	}
+
 	stopLock.Lock()
 	defer stopLock.Unlock()
-	content, err := json.Marshal(meta.Entities)
+	record := metaRecord{Version: meta.version + 1, Ops: tx.ops}
+	content, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	err = meta.writeRecord(content, record.Version)
+	if err != nil && meta.written(content, record.Version) { // the record is stored though the writing failed
+		err = nil
+	}
+	if os.IsExist(err) && !meta.shared {
+		// the version is committed by another server fixing this namespace, see ReconcileNamespace
+		v := meta.version
+		records, jerr := meta.journal()
+		if jerr != nil {
+			return fmt.Errorf("Fail to read meta journal of %s, %s", meta.namespace, jerr.Error())
+		}
+		meta.replay(records) // stops at the record can not be read
+		if meta.version != v {
+			return errMetaConflict
+		}
+		// the record can not be replayed, it's overwritten
+		err = meta.backend.Upload(bytes.NewReader(content), meta.journalFile(record.Version))
+	}
+	if err != nil {
+		if meta.shared && os.IsExist(err) {
+			return errMetaConflict
+		}
+		return fmt.Errorf("Fail to upload meta journal:%s", err.Error())
+	}
+	meta.apply(tx.ops)
+	meta.version = record.Version
+	compact := meta.version-meta.base >= metaCompactEvery
+	if meta.shared { // only one server writes each generation
+		compact = meta.version%metaCompactEvery == 0
+	}
+	if compact {
+		if err := meta.compact(); err != nil { // the journal is still there, try it next time
+			log.Warnf("Fail to compact meta of %s, %s", meta.namespace, err.Error())
+		}
+	}
+	return nil
+}
+
+// writeRecord writes the record of version v into the journal, the record is only created if no other server wrote it,
+// or an error satisfying os.IsExist is returned. It's uploaded directly if the storage is not a Creator.
+func (meta *Meta) writeRecord(content []byte, v uint64) error {
+	if creator, ok := meta.backend.(Creator); ok {
+		return creator.Create(bytes.NewReader(content), meta.journalFile(v))
+	}
+	return meta.backend.Upload(bytes.NewReader(content), meta.journalFile(v))
+}
+
+func (meta *Meta) journalFile(version uint64) string {
+	return path.Join(meta.namespace, meta.file+metaJournalSuffix, fmt.Sprintf("%020d", version))
+}
+
+// compact writes the generation at the current version, the latest one becomes the previous one
+func (meta *Meta) compact() error {
+	file := path.Join(meta.namespace, meta.file)
+	content, err := json.Marshal(metaGeneration{Version: meta.version, Entities: meta.entities})
 	if err != nil {
 		return err
 	}
-	buf := bytes.NewBuffer(content)
-	if err := meta.backend.Upload(buf, path.Join(meta.namespace, meta.file)); err != nil {
-		return fmt.Errorf("Fail to upload meta file:%s", err.Error())
+	if renamer, ok := meta.backend.(Renamer); ok {
+		if err := meta.backend.Upload(bytes.NewReader(content), file+metaTmpSuffix); err != nil {
+			return fmt.Errorf("Fail to upload meta file:%s", err.Error())
+		}
+		if _, err := meta.backend.FileInfo(file); err == nil {
+			if err := renamer.Rename(file, file+metaPrevSuffix); err != nil {
+				return fmt.Errorf("Fail to keep the previous meta file:%s", err.Error())
+			}
+		}
+		if err := renamer.Rename(file+metaTmpSuffix, file); err != nil {
+			return fmt.Errorf("Fail to rename meta file:%s", err.Error())
+		}
+	} else {
+		if _, err := meta.backend.FileInfo(file); err == nil {
+			if err := copyStored(meta.backend, file, file+metaPrevSuffix); err != nil {
+				return fmt.Errorf("Fail to keep the previous meta file:%s", err.Error())
+			}
+		}
+		if err := meta.backend.Upload(bytes.NewReader(content), file); err != nil {
+			return fmt.Errorf("Fail to upload meta file:%s", err.Error())
+		}
+	}
+
+	// the journal after the previous generation is kept, the latest generation may be unreadable
+	records, _ := meta.journal()
+	for _, v := range records {
+		if v <= meta.base {
+			meta.backend.Delete(meta.journalFile(v))
+		}
 	}
+	meta.base = meta.version
+	log.Debugf("Meta of %s compacted at version %d", meta.namespace, meta.version)
 	return nil
 }
 
-func (meta *Meta) LoadFromBackend() error {
+// journal returns the versions of the records in the journal, in order
+func (meta *Meta) journal() ([]uint64, error) {
+	files, err := meta.backend.List(path.Join(meta.namespace, meta.file+metaJournalSuffix))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var ret []uint64
+	for _, f := range files {
+		if v, err := strconv.ParseUint(f.Name(), 10, 64); err == nil {
+			ret = append(ret, v)
+		}
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i] < ret[j] })
+	return ret, nil
+}
+
+// loadGeneration reads the meta file, the meta before versioning is read as version 0
+func (meta *Meta) loadGeneration(file string) (*metaGeneration, error) {
 	var buf bytes.Buffer
-	if err := driverRunning.Download(&buf, path.Join(meta.namespace, meta.file)); err != nil {
+	if err := meta.backend.Download(&buf, file); err != nil {
+		return nil, err
+	}
+	content := bytes.Trim(buf.Bytes(), "\x00")
+	gen := &metaGeneration{}
+	if err := json.Unmarshal(content, gen); err == nil && gen.Entities != nil {
+		return gen, nil
+	}
+	gen = &metaGeneration{}
+	if err := json.Unmarshal(content, &gen.Entities); err != nil {
+		return nil, fmt.Errorf("Unvalid meta file %s, %s", file, err.Error())
+	}
+	if gen.Entities == nil {
+		gen.Entities = make(map[string][]Entity)
+	}
+	return gen, nil
+}
+
+// LoadFromBackend reads the latest readable generation and replays the journal after it.
+// A corrupted meta file is kept as .meta.corrupted-<unix> for repairing by hand, and the previous generation is used instead.
+func (meta *Meta) LoadFromBackend() error {
+	file := path.Join(meta.namespace, meta.file)
+	recovered := false
+	gen, err := meta.loadGeneration(file)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Errorf("Fail to load meta of %s, recovering from the previous one, %s", meta.namespace, err.Error())
+			if cerr := copyStored(meta.backend, file, fmt.Sprintf("%s.corrupted-%d", file, time.Now().Unix())); cerr != nil {
+				log.Errorf("Fail to keep the corrupted meta file, %s", cerr.Error())
+			} else {
+				meta.backend.Delete(file) // not be kept as the previous generation by the next compaction
+			}
+			recovered = true
+		}
+		var perr error
+		if gen, perr = meta.loadGeneration(file + metaPrevSuffix); perr != nil {
+			if !os.IsNotExist(perr) {
+				log.Errorf("Fail to load the previous meta of %s, %s", meta.namespace, perr.Error())
+			}
+			gen = nil
+		}
+	}
+	records, jerr := meta.journal()
+	if gen == nil && len(records) == 0 {
+		if jerr != nil {
+			err = jerr
+		}
 		return fmt.Errorf("Fail to download the meta data from backend, %s", err.Error())
 	}
-	if err := json.Unmarshal(bytes.Trim(buf.Bytes(), "\x00"), &meta.Entities); err != nil {
-		panic(fmt.Sprintf("Unvalid meta file, please repaire the meta by hand, %s", err.Error()))
+	if gen == nil { // replay the whole journal
+		gen = &metaGeneration{Entities: make(map[string][]Entity)}
+	}
+
+	meta.lock.Lock()
+	defer meta.lock.Unlock()
+	meta.reset(gen.Entities)
+	meta.version, meta.base = gen.Version, gen.Version
+	if err = meta.replay(records); err != nil {
+		// the changes after are lost, they are skipped by a new generation
+		log.Errorf("Meta journal of %s is broken after version %d, %s", meta.namespace, meta.version, err.Error())
+		meta.version = records[len(records)-1]
+		recovered = true
+	}
+	if meta.version != meta.base {
+		log.Infof("Meta of %s loaded at version %d, %d changes replayed", meta.namespace, meta.version, meta.version-meta.base)
+	}
+	if recovered {
+		stopLock.Lock()
+		defer stopLock.Unlock()
+		if err := meta.compact(); err != nil {
+			log.Errorf("Fail to write the recovered meta of %s, %s", meta.namespace, err.Error())
+		}
+	}
+	return nil
+}
+
+// written tells whether the record of version v in the journal is content
+func (meta *Meta) written(content []byte, v uint64) bool {
+	var buf bytes.Buffer
+	if err := meta.backend.Download(&buf, meta.journalFile(v)); err != nil {
+		return false
+	}
+	return bytes.Equal(bytes.Trim(buf.Bytes(), "\x00"), content)
+}
+
+// readRecord downloads the record of version v in the journal
+func (meta *Meta) readRecord(v uint64) (*metaRecord, error) {
+	var buf bytes.Buffer
+	if err := meta.backend.Download(&buf, meta.journalFile(v)); err != nil {
+		return nil, err
+	}
+	record := &metaRecord{}
+	if err := json.Unmarshal(bytes.Trim(buf.Bytes(), "\x00"), record); err != nil {
+		return nil, err
+	}
+	return record, nil
+}
+
+// replay applies the records after the current version in order, it stops at the first missing or unreadable one
+func (meta *Meta) replay(records []uint64) error {
+	for _, v := range records {
+		if v <= meta.version {
+			continue
+		}
+		if v != meta.version+1 {
+			return fmt.Errorf("version %d is missing", meta.version+1)
+		}
+		record, err := meta.readRecord(v)
+		if err != nil {
+			return err
+		}
+		meta.apply(record.Ops)
+		meta.version = v
 	}
 	return nil
 }
+
+// Refresh reads the changes committed by the other servers since the last loading or commit
+func (meta *Meta) Refresh() error {
+	meta.lock.Lock()
+	defer meta.lock.Unlock()
+	return meta.refresh()
+}
+
+func (meta *Meta) refresh() error {
+	records, err := meta.journal()
+	if err != nil {
+		return err
+	}
+	if err := meta.replay(records); err == nil {
+		return nil
+	}
+	// the journal read last time is compacted by the others, read the latest generation
+	gen, err := meta.loadGeneration(path.Join(meta.namespace, meta.file))
+	if err != nil {
+		return err
+	}
+	if records, err = meta.journal(); err != nil {
+		return err
+	}
+	meta.reset(gen.Entities)
+	meta.version, meta.base = gen.Version, gen.Version
+	return meta.replay(records)
+}
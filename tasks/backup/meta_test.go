@@ -0,0 +1,270 @@
+package backup
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// failDriver fails the uploads and creates when fail is set,
+// the creates fail after the file is written when lost is set, like a response lost in the network
+type failDriver struct {
+	dirDriver
+	fail bool
+	lost bool
+}
+
+func (d *failDriver) Upload(reader io.Reader, dest string) error {
+	if d.fail {
+		return errors.New("storage is down")
+	}
+	return d.dirDriver.Upload(reader, dest)
+}
+
+func (d *failDriver) Create(reader io.Reader, dest string) error {
+	if d.fail {
+		return errors.New("storage is down")
+	}
+	if err := d.dirDriver.Create(reader, dest); err != nil || !d.lost {
+		return err
+	}
+	return errors.New("connection reset")
+}
+
+// renameDriver renames the files
+type renameDriver struct {
+	dirDriver
+}
+
+func (d *renameDriver) Rename(src, dest string) error {
+	return os.Rename(path.Join(d.root, src), path.Join(d.root, dest))
+}
+
+// raceDriver runs before when a record is created, like another server committing at the same time
+type raceDriver struct {
+	renameDriver
+	before func()
+}
+
+func (d *raceDriver) Create(reader io.Reader, dest string) error {
+	if before := d.before; before != nil {
+		d.before = nil
+		before()
+	}
+	return d.renameDriver.Create(reader, dest)
+}
+
+func metaEntity(i int) Entity {
+	return Entity{Mode: MODE_FULL, Source: fmt.Sprintf("/data/%d", i%3), Name: fmt.Sprintf("backup-%d", i)}
+}
+
+func TestMetaCommit(t *testing.T) {
+	root, _ := ioutil.TempDir("", "backupd-meta")
+	defer os.RemoveAll(root)
+	driver := &failDriver{dirDriver: dirDriver{root: root}}
+	mt := NewMeta(driver, "ns")
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if err := mt.Commit(func(tx *MetaTx) error { tx.Put(metaEntity(i).Source, metaEntity(i)); return nil }); err != nil {
+				t.Error(err)
+			}
+			mt.Array()
+			mt.Get(metaEntity(i).Name)
+		}(i)
+	}
+	wg.Wait()
+	if mt.Version() != 50 || len(mt.Array()) != 50 || len(mt.Array("/data/1")) != 17 {
+		t.Fatalf("all the commits should be applied, version %d, %d backups", mt.Version(), len(mt.Array()))
+	}
+
+	// a failed commit changes nothing
+	driver.fail = true
+	err := mt.Commit(func(tx *MetaTx) error { tx.Delete("backup-1"); return nil })
+	if err == nil || mt.Get("backup-1") == nil || mt.Version() != 50 {
+		t.Errorf("failed commit should not change the meta, %v", err)
+	}
+	driver.fail = false
+	err = mt.Commit(func(tx *MetaTx) error { tx.Delete("backup-1"); return errors.New("abort") })
+	if err == nil || mt.Get("backup-1") == nil {
+		t.Error("aborted commit should not change the meta")
+	}
+
+	ent := mt.Get("backup-2")
+	ent.Note = "changed"
+	err = mt.Commit(func(tx *MetaTx) error {
+		tx.Delete("backup-1")
+		if tx.Get("backup-1") != nil || !tx.Update(*ent) || tx.Get("backup-2").Note != "changed" {
+			return errors.New("changes should be read in the transaction")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	loaded := NewMeta(driver, "ns")
+	if err := loaded.LoadFromBackend(); err != nil {
+		t.Fatal(err)
+	}
+	if loaded.Version() != 51 || len(loaded.Array()) != 49 || loaded.Get("backup-1") != nil || loaded.Get("backup-2").Note != "changed" {
+		t.Errorf("the journal should be replayed, version %d, %d backups", loaded.Version(), len(loaded.Array()))
+	}
+
+	// a broken record at the next version is overwritten
+	driver.Upload(strings.NewReader("broken"), mt.journalFile(52))
+	if err := mt.Commit(func(tx *MetaTx) error { tx.Delete("backup-3"); return nil }); err != nil || mt.Version() != 52 {
+		t.Fatalf("broken record should be overwritten, version %d, %v", mt.Version(), err)
+	}
+	if err := loaded.LoadFromBackend(); err != nil || loaded.Version() != 52 || loaded.Get("backup-3") != nil {
+		t.Errorf("the overwritten record should be replayed, version %d, %v", loaded.Version(), err)
+	}
+
+	// the record is written though the creating failed
+	driver.lost = true
+	if err := mt.Commit(func(tx *MetaTx) error { tx.Delete("backup-4"); return nil }); err != nil || mt.Get("backup-4") != nil {
+		t.Errorf("the written record should be committed, %v", err)
+	}
+	driver.lost = false
+}
+
+func TestMetaCompactAndRecover(t *testing.T) {
+	root, _ := ioutil.TempDir("", "backupd-meta")
+	defer os.RemoveAll(root)
+	driver := &renameDriver{dirDriver{root: root}}
+	mt := NewMeta(driver, "ns")
+	for i := 0; i < metaCompactEvery*2+10; i++ {
+		ent := metaEntity(i)
+		if err := mt.Commit(func(tx *MetaTx) error { tx.Put(ent.Source, ent); return nil }); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the journal after the previous generation is kept
+	journal, _ := mt.journal()
+	if len(journal) != metaCompactEvery+10 || journal[0] != metaCompactEvery+1 {
+		t.Errorf("unexpected journal %d records, from %d", len(journal), journal[0])
+	}
+	if _, err := driver.FileInfo("ns/.meta.prev"); err != nil {
+		t.Errorf("previous generation should be kept, %v", err)
+	}
+
+	// the corrupted meta is recovered from the previous generation and the journal
+	ioutil.WriteFile(path.Join(root, "ns", ".meta"), []byte(`{"version":200,"entit`), 0644)
+	loaded := NewMeta(driver, "ns")
+	if err := loaded.LoadFromBackend(); err != nil {
+		t.Fatal(err)
+	}
+	if loaded.Version() != metaCompactEvery*2+10 || len(loaded.Array()) != metaCompactEvery*2+10 {
+		t.Errorf("meta should be recovered, version %d, %d backups", loaded.Version(), len(loaded.Array()))
+	}
+	files, _ := driver.List("ns")
+	corrupted := false
+	for _, f := range files {
+		corrupted = corrupted || strings.HasPrefix(f.Name(), ".meta.corrupted-")
+	}
+	if !corrupted {
+		t.Error("corrupted meta should be kept")
+	}
+	reloaded := NewMeta(driver, "ns")
+	if err := reloaded.LoadFromBackend(); err != nil || len(reloaded.Array()) != metaCompactEvery*2+10 {
+		t.Errorf("recovered meta should be written, %v", err)
+	}
+
+	// nothing can be read
+	ioutil.WriteFile(path.Join(root, "ns", ".meta"), []byte("broken"), 0644)
+	ioutil.WriteFile(path.Join(root, "ns", ".meta.prev"), []byte("broken"), 0644)
+	os.RemoveAll(path.Join(root, "ns", ".meta.journal"))
+	if err := NewMeta(driver, "ns").LoadFromBackend(); err == nil {
+		t.Error("loading the broken meta should fail")
+	}
+}
+
+func TestMetaLegacy(t *testing.T) {
+	root, _ := ioutil.TempDir("", "backupd-meta")
+	defer os.RemoveAll(root)
+	driver := &dirDriver{root: root}
+	driver.Upload(bytes.NewBufferString(`{"/data":[{"mode":"full","source":"/data","name":"data-1"}]}`+"\x00\x00"), "ns/.meta")
+
+	mt := NewMeta(driver, "ns")
+	if err := mt.LoadFromBackend(); err != nil {
+		t.Fatal(err)
+	}
+	if mt.Version() != 0 || mt.Get("data-1") == nil {
+		t.Fatalf("legacy meta should be loaded, %v", mt.Array())
+	}
+	if err := mt.compact(); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	driver.Download(&buf, "ns/.meta")
+	if !strings.HasPrefix(buf.String(), `{"version":0,"entities":{"/data":[`) {
+		t.Errorf("meta should be written in the versioned format, %s", buf.String())
+	}
+}
+
+func TestMetaShared(t *testing.T) {
+	root, _ := ioutil.TempDir("", "backupd-meta")
+	defer os.RemoveAll(root)
+	driver := &renameDriver{dirDriver{root: root}}
+	a, b := NewSharedMeta(driver, "apps"), NewSharedMeta(driver, "apps")
+	for i := 0; i < 10; i++ {
+		mt, ent := a, metaEntity(i)
+		if i%2 == 1 {
+			mt = b
+		}
+		if err := mt.Commit(func(tx *MetaTx) error { tx.Put(ent.Source, ent); return nil }); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if a.Version() != 9 || len(a.Array()) != 9 || b.Refresh() != nil || len(b.Array()) != 10 {
+		t.Fatalf("the commits of both should be read, version %d %d", a.Version(), b.Version())
+	}
+
+	// the journal read last time is compacted twice by the other
+	for i := 10; i < metaCompactEvery*2+10; i++ {
+		ent := metaEntity(i)
+		if err := a.Commit(func(tx *MetaTx) error { tx.Put(ent.Source, ent); return nil }); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := b.Refresh(); err != nil || b.Version() != a.Version() || len(b.Array()) != metaCompactEvery*2+10 {
+		t.Errorf("the latest generation should be read, version %d, %v", b.Version(), err)
+	}
+}
+
+func TestMetaSharedConflict(t *testing.T) {
+	root, _ := ioutil.TempDir("", "backupd-meta")
+	defer os.RemoveAll(root)
+	driver := &raceDriver{renameDriver: renameDriver{dirDriver{root: root}}}
+	a, b := NewSharedMeta(driver, "apps"), NewSharedMeta(&driver.renameDriver, "apps")
+	runs := 0
+	driver.before = func() { // another server commits version 1, its commit is written as b does
+		ent := metaEntity(1)
+		content, _ := json.Marshal(metaRecord{Version: 1, Ops: []metaOp{{Key: ent.Source, Entity: &ent}}})
+		if err := b.writeRecord(content, 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ent := metaEntity(0)
+	if err := a.Commit(func(tx *MetaTx) error { runs++; tx.Put(ent.Source, ent); return nil }); err != nil {
+		t.Fatal(err)
+	}
+	if runs != 2 || a.Version() != 2 || len(a.Array()) != 2 {
+		t.Errorf("the conflicted commit should be run again, %d runs, version %d", runs, a.Version())
+	}
+	c := NewSharedMeta(driver, "apps")
+	if err := c.LoadFromBackend(); err != nil || len(c.Array()) != 2 {
+		t.Errorf("both commits should be in the journal, %v", err)
+	}
+}
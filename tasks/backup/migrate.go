@@ -0,0 +1,229 @@
+package backup
+
+import (
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"os"
+	"path"
+	"sort"
+)
+
+// MigrateResult is the backups moved from the namespace of a server into app layout
+type MigrateResult struct {
+	Namespace string   `json:"namespace"`
+	Migrated  []Entity `json:"migrated"` // with the namespaces in app layout
+	Warnings  []string `json:"warnings"` // the backups can not be migrated, they are kept
+	Applied   bool     `json:"applied"`
+}
+
+// Migrate moves the backups in the namespace of mt into app layout indexed by index, only the plan is returned if apply is false.
+// The backups of an archive are moved together, they are copied and indexed before removed from mt and deleted,
+// so a broken migration can be run again.
+func Migrate(store Storage, mt, index *Meta, apply bool) (*MigrateResult, error) {
+	ns := mt.namespace
+	if ns == "" || ns == appsDir || path.Dir(ns) != "." {
+		return nil, fmt.Errorf("Unvalid namespace %s, it must be the namespace of a server", ns)
+	}
+	if err := index.Refresh(); err != nil {
+		return nil, fmt.Errorf("Fail to read the index of app layout, %s", err.Error())
+	}
+	result := &MigrateResult{Namespace: ns, Migrated: []Entity{}, Warnings: []string{}, Applied: apply}
+
+	archives := make(map[string][]Entity)
+	for _, ent := range mt.Array() {
+		archive := archiveOf(ent)
+		archives[archive] = append(archives[archive], ent)
+	}
+	names := make([]string, 0, len(archives))
+	for archive := range archives {
+		names = append(names, archive)
+	}
+	sort.Strings(names)
+
+	for _, archive := range names {
+		dest := archiveNamespace(archive)
+		if dest == "" {
+			warning := fmt.Sprintf("Archive name %s can not be parsed, its backups are kept in %s", archive, ns)
+			log.Warn(warning)
+			result.Warnings = append(result.Warnings, warning)
+			continue
+		}
+		ents := archives[archive]
+		if apply {
+			if err := migrateArchive(store, ns, dest, ents, mt, index); err != nil {
+				warning := fmt.Sprintf("Fail to migrate archive %s, %s", archive, err.Error())
+				log.Warn(warning)
+				result.Warnings = append(result.Warnings, warning)
+				continue
+			}
+		}
+		for _, ent := range ents {
+			ent.Namespace = dest
+			result.Migrated = append(result.Migrated, ent)
+		}
+	}
+	if apply {
+		log.Infof("%d backups in %s migrated into app layout", len(result.Migrated), ns)
+	}
+	return result, nil
+}
+
+// migrateArchive copies the backups of an archive from namespace ns into dest, indexes them and deletes the old ones
+func migrateArchive(store Storage, ns, dest string, ents []Entity, mt, index *Meta) error {
+	var copied []Entity
+	var pinned []string // the chunks copied into dest are not collected till indexed
+	defer func() { pins.unpin(pinned) }()
+	mirrored := false
+	for _, ent := range ents {
+		ent.Namespace = dest
+		if index.Get(ent.Name) != nil { // indexed by a broken migration
+			continue
+		}
+		switch {
+		case ent.Mode == MODE_DEDUP:
+			files, err := copyChunks(store, ns, dest, ent)
+			pinned = append(pinned, files...)
+			if err != nil {
+				return err
+			}
+			if err := copyStored(store, path.Join(ns, ent.Name), path.Join(dest, ent.Name)); err != nil {
+				return err
+			}
+		case ent.Mode == MODE_INCREMENT:
+			if !mirrored { // the mirror is shared by the snapshots
+				if err := copyBackup(store, path.Join(ns, ent.mirrorName()), path.Join(dest, ent.mirrorName())); err != nil {
+					return err
+				}
+				mirrored = true
+			}
+			if ent.isSnapshot() {
+				if err := copyBackup(store, path.Join(ns, ent.Name), path.Join(dest, ent.Name)); err != nil {
+					return err
+				}
+			}
+		default:
+			if err := copyBackup(store, path.Join(ns, ent.Name), path.Join(dest, ent.Name)); err != nil {
+				return err
+			}
+		}
+		copied = append(copied, ent)
+	}
+
+	err := index.Commit(func(tx *MetaTx) error {
+		for _, ent := range copied {
+			key := ent.Source
+			if ent.Mode == MODE_INCREMENT {
+				key += "@increment"
+			}
+			tx.Put(key, ent)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	err = mt.Commit(func(tx *MetaTx) error {
+		for _, ent := range ents {
+			tx.Delete(ent.Name)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, ent := range ents { // the chunks of dedup backups in ns are collected by backup_gc
+		store.Delete(path.Join(ns, ent.Name))
+		store.Delete(indexFile(path.Join(ns, ent.Name)))
+		if ent.Mode == MODE_INCREMENT {
+			store.Delete(path.Join(ns, ent.mirrorName()))
+			store.Delete(indexFile(path.Join(ns, ent.mirrorName())))
+		}
+	}
+	log.Debugf("%d backups of %s migrated into %s", len(ents), ns, dest)
+	return nil
+}
+
+// copyBackup copies the file or directory src with its index or manifest, a missing src is skipped
+func copyBackup(store Storage, src, dest string) error {
+	info, err := store.FileInfo(src)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err == nil && info.IsDir() {
+		files, err := storedFiles(store, src)
+		if err != nil {
+			return err
+		}
+		for rel, file := range files {
+			if err := copyStored(store, file, path.Join(dest, rel)); err != nil {
+				return err
+			}
+		}
+	} else if err == nil {
+		if err := copyStored(store, src, dest); err != nil {
+			return err
+		}
+	}
+	if _, err := store.FileInfo(indexFile(src)); err == nil {
+		return copyStored(store, indexFile(src), indexFile(dest))
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// copyChunks copies the chunks of the dedup backup from namespace ns into dest, the ones already in dest are not copied.
+// It returns the chunk files in dest, they are pinned.
+func copyChunks(store Storage, ns, dest string, ent Entity) ([]string, error) {
+	decrypted, err := ent.storage(store)
+	if err != nil {
+		return nil, err
+	}
+	snap, err := loadSnapshot(decrypted, path.Join(ns, ent.Name), ent.Checksum)
+	if err != nil {
+		return nil, err
+	}
+	generation := pins.current()
+	stored, err := listChunks(store, dest)
+	if err != nil {
+		return nil, err
+	}
+	var pinned []string
+	seen := make(map[string]bool)
+	for _, file := range snap.Files {
+		for _, hash := range file.Chunks {
+			ref := ent.chunkRef(hash)
+			if seen[ref] {
+				continue
+			}
+			seen[ref] = true
+			pins.pin(chunkFile(dest, ref))
+			pinned = append(pinned, chunkFile(dest, ref))
+			_, listed := stored[ref]
+			if ok, err := chunkStored(store, chunkFile(dest, ref), listed, generation); err != nil {
+				return pinned, err
+			} else if !ok {
+				if err := copyStored(store, chunkFile(ns, ref), chunkFile(dest, ref)); err != nil {
+					return pinned, err
+				}
+			}
+		}
+	}
+	return pinned, nil
+}
+
+// MigrateNamespace migrates the backups in namespace ns on the running driver into app layout, empty means the namespace of this server
+func MigrateNamespace(ns string, apply bool) (*MigrateResult, error) {
+	if appIndex == nil {
+		return nil, fmt.Errorf("The index of app layout is not loaded")
+	}
+	mt := meta
+	if ns != "" && ns != namespace {
+		mt = NewMeta(driverRunning, ns)
+		if err := mt.LoadFromBackend(); err != nil {
+			return nil, err
+		}
+	}
+	return Migrate(driverRunning, mt, appIndex, apply)
+}
@@ -0,0 +1,304 @@
+package backup
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// The archive of a large volume can be uploaded in parts, the backup interrupted by a network failure or a restart
+// of daemon is continued from the last committed part by the next run of its job. The parts are stored as
+// <ns>/<name>/<part no>, and the progress is recorded in the checkpoint <ns>/.checkpoints/<name> until the backup
+// is added into meta. The archive is reassembled from the parts by the storage of the entity when downloaded.
+const (
+	checkpointDir = ".checkpoints"
+	// the checkpoints not resumed in it are swept with their parts
+	checkpointExpire = 7 * 24 * time.Hour
+)
+
+var partSizeMB = 0 // the default part size of full backups in MB, 0 means not uploaded in parts
+
+// SetPartSize sets the default part size of full backups in MB, it's called before Init
+func SetPartSize(mb int) error {
+	if mb < 0 {
+		return fmt.Errorf("Unvalid part size %d", mb)
+	}
+	partSizeMB = mb
+	return nil
+}
+
+// checkpoint is the progress of a full backup uploaded in parts
+type checkpoint struct {
+	Name             string     `json:"name"`
+	Source           string     `json:"source"`
+	Compression      string     `json:"compression"`
+	CompressionLevel int        `json:"compressionLevel"`
+	KeyID            string     `json:"keyId"`
+	PartSize         int64      `json:"partSize"`
+	Created          time.Time  `json:"created"`
+	Parts            []partInfo `json:"parts"` // the committed parts
+}
+
+type partInfo struct {
+	Size   int64  `json:"size"`
+	Hash   string `json:"hash"`   // sha256 of the part before encrypted
+	Stored int64  `json:"stored"` // size of the part stored, it's encrypted
+}
+
+func partName(i int) string {
+	return fmt.Sprintf("%08d", i+1)
+}
+
+func checkpointFile(ns, name string) string {
+	return path.Join(ns, checkpointDir, name)
+}
+
+func loadCheckpoint(driver Storage, file string) (*checkpoint, error) {
+	var buf bytes.Buffer
+	if err := driver.Download(&buf, file); err != nil {
+		return nil, err
+	}
+	var cp checkpoint
+	if err := json.Unmarshal(buf.Bytes(), &cp); err != nil {
+		return nil, fmt.Errorf("Unvalid checkpoint %s, %s", file, err.Error())
+	}
+	return &cp, nil
+}
+
+func saveCheckpoint(driver Storage, ns string, cp *checkpoint) error {
+	data, err := json.Marshal(cp)
+	if err != nil {
+		return err
+	}
+	return driver.Upload(bytes.NewReader(data), checkpointFile(ns, cp.Name))
+}
+
+// resume returns the checkpoint of the last interrupted backup of the same source and options to continue it,
+// its parts are moved under the name of the entity, so the backup is stored under the current time.
+// A new checkpoint is returned if there is none.
+func (ent *Entity) resume(driver Storage) *checkpoint {
+	ret := &checkpoint{
+		Name:             ent.Name,
+		Source:           ent.Source,
+		Compression:      ent.Compression,
+		CompressionLevel: ent.CompressionLevel,
+		KeyID:            ent.KeyID,
+		PartSize:         ent.partSize,
+		Created:          ent.Created,
+	}
+	files, err := driver.List(path.Join(ent.ns(), checkpointDir))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Warnf("Fail to list the checkpoints in %s, %s", ent.ns(), err.Error())
+		}
+		return ret
+	}
+	var last *checkpoint
+	for _, f := range files {
+		cp, err := loadCheckpoint(driver, checkpointFile(ent.ns(), f.Name()))
+		if err != nil {
+			log.Warnf("Fail to load checkpoint %s, %s", f.Name(), err.Error())
+			continue
+		}
+		if cp.Source != ret.Source || cp.Compression != ret.Compression || cp.CompressionLevel != ret.CompressionLevel ||
+			cp.KeyID != ret.KeyID || cp.PartSize != ret.PartSize || metaOf(ent).Get(cp.Name) != nil {
+			continue
+		}
+		if last == nil || cp.Created.After(last.Created) {
+			last = cp
+		}
+	}
+	if last == nil {
+		return ret
+	}
+	log.Infof("Resuming backup %s of %s after part %d as %s", last.Name, ent.Source, len(last.Parts), ent.Name)
+	ent.moveParts(driver, last, ret)
+	return ret
+}
+
+// moveParts moves the committed parts of checkpoint from into the checkpoint to, which is saved first with no parts,
+// so the parts moved are swept with it if the daemon dies. The parts not moved are uploaded again.
+func (ent *Entity) moveParts(driver Storage, from, to *checkpoint) {
+	if err := saveCheckpoint(driver, ent.ns(), to); err != nil {
+		log.Warnf("Fail to save the checkpoint of %s, %s", to.Name, err.Error())
+		return
+	}
+	for i, part := range from.Parts {
+		src, dest := path.Join(ent.ns(), from.Name, partName(i)), path.Join(ent.ns(), to.Name, partName(i))
+		if err := CommitStaged(driver, src, dest); err != nil {
+			log.Warnf("Fail to move part %d of %s, %s", i+1, from.Name, err.Error())
+			break
+		}
+		to.Parts = append(to.Parts, part)
+	}
+	if err := saveCheckpoint(driver, ent.ns(), to); err != nil {
+		log.Warnf("Fail to save the checkpoint of %s, %s", to.Name, err.Error())
+		to.Parts = nil // the parts moved are swept with the empty checkpoint
+		return
+	}
+	if err := driver.Delete(path.Join(ent.ns(), from.Name)); err != nil && !os.IsNotExist(err) {
+		log.Warnf("Fail to delete the parts left of %s, %s", from.Name, err.Error())
+	}
+	if err := driver.Delete(checkpointFile(ent.ns(), from.Name)); err != nil && !os.IsNotExist(err) {
+		log.Warnf("Fail to delete the checkpoint of %s, %s", from.Name, err.Error())
+	}
+}
+
+// uploadParts uploads the compressed archive r in parts, the parts committed by the last run are skipped if they are
+// the same. The checkpoint is saved after every part committed, and the number of parts is set into the entity.
+// The parts are compared before encrypted, so it's only resumed if the codec compresses the same files into the same
+// bytes, like the gzip, zstd, xz and none codecs here. A file changed since the last run changes the parts from it on.
+func (ent *Entity) uploadParts(driver, store Storage, r io.Reader, cp *checkpoint) error {
+	var (
+		dir     = path.Join(ent.ns(), ent.Name)
+		br      = bufio.NewReader(r)
+		spool   *os.File // keeps the part read for comparing, it's uploaded if changed
+		i       int
+		resumed int
+	)
+	defer func() {
+		if spool != nil {
+			spool.Close()
+			os.Remove(spool.Name())
+		}
+	}()
+	for ; ; i++ {
+		if _, err := br.Peek(1); err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		part := io.LimitReader(br, cp.PartSize)
+		if i < len(cp.Parts) {
+			var err error
+			if spool == nil {
+				if spool, err = ioutil.TempFile("", "backupd-part"); err != nil {
+					return err
+				}
+			}
+			spool.Truncate(0)
+			spool.Seek(0, io.SeekStart)
+			h := sha256.New()
+			n, err := io.CopyN(io.MultiWriter(h, spool), br, cp.Parts[i].Size)
+			if err != nil && err != io.EOF {
+				return err
+			}
+			if n == cp.Parts[i].Size && hashString(h) == cp.Parts[i].Hash {
+				resumed++
+				continue
+			}
+			log.Infof("Part %d of %s is changed since the last run, it's uploaded again with the parts after it", i+1, ent.Name)
+			cp.Parts = cp.Parts[:i]
+			spool.Seek(0, io.SeekStart)
+			part = io.LimitReader(io.MultiReader(io.LimitReader(spool, n), br), cp.PartSize)
+		}
+		if err := ent.uploadPart(driver, store, part, i, cp); err != nil {
+			return err
+		}
+	}
+	for j := i; j < len(cp.Parts); j++ { // the archive is shorter than the last run
+		driver.Delete(path.Join(dir, partName(j)))
+	}
+	if i < len(cp.Parts) {
+		cp.Parts = cp.Parts[:i]
+	}
+	if resumed > 0 {
+		log.Infof("%d of %d parts of %s resumed", resumed, i, ent.Name)
+	}
+	ent.Parts = len(cp.Parts)
+	ent.Size = 0 // the size stored like the archive not in parts
+	for _, part := range cp.Parts {
+		ent.Size += uint64(part.Stored)
+	}
+	return nil
+}
+
+// uploadPart uploads the i-th part staged, and records it in the checkpoint after committed
+func (ent *Entity) uploadPart(driver, store Storage, r io.Reader, i int, cp *checkpoint) error {
+	dest := path.Join(ent.ns(), ent.Name, partName(i))
+	staged := StagedName(path.Join(ent.ns(), ent.Name+"."+partName(i)))
+	h := sha256.New()
+	counter := &countWriter{}
+	if err := store.Upload(io.TeeReader(r, io.MultiWriter(h, counter)), staged); err != nil {
+		abortStaged(driver, staged)
+		return fmt.Errorf("Fail to upload part %d of %s, %s", i+1, ent.Name, err.Error())
+	}
+	if err := CommitStaged(driver, staged, dest); err != nil {
+		abortStaged(driver, staged)
+		return fmt.Errorf("Fail to commit part %d of %s, %s", i+1, ent.Name, err.Error())
+	}
+	stored := int64(0)
+	if info, err := driver.FileInfo(dest); err == nil {
+		stored = info.Size()
+	}
+	cp.Parts = append(cp.Parts, partInfo{Size: counter.n, Hash: hashString(h), Stored: stored})
+	if err := saveCheckpoint(driver, ent.ns(), cp); err != nil {
+		return fmt.Errorf("Fail to save the checkpoint of %s, %s", ent.Name, err.Error())
+	}
+	return nil
+}
+
+type countWriter struct {
+	n int64
+}
+
+func (w *countWriter) Write(p []byte) (int, error) {
+	w.n += int64(len(p))
+	return len(p), nil
+}
+
+// partStorage reassembles the archive uploaded in parts when it's downloaded, in whichever namespace it is
+type partStorage struct {
+	Storage
+	name  string
+	parts int
+}
+
+func (s *partStorage) Download(writer io.Writer, src string) error {
+	if path.Base(src) != s.name {
+		return s.Storage.Download(writer, src)
+	}
+	for i := 0; i < s.parts; i++ {
+		if err := s.Storage.Download(writer, path.Join(src, partName(i))); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sweepCheckpoints deletes the checkpoints in namespace ns not resumed since before with their parts,
+// the parts of the backups already in meta are kept
+func sweepCheckpoints(store Storage, ns string, before time.Time, mt *Meta) (int, error) {
+	files, err := store.List(path.Join(ns, checkpointDir))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	n := 0
+	for _, f := range files {
+		if !f.ModTime().Before(before) || strings.HasPrefix(f.Name(), ".") {
+			continue
+		}
+		if mt == nil || mt.Get(f.Name()) == nil {
+			if err := store.Delete(path.Join(ns, f.Name())); err != nil && !os.IsNotExist(err) {
+				return n, err
+			}
+		}
+		if err := store.Delete(checkpointFile(ns, f.Name())); err != nil && !os.IsNotExist(err) {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
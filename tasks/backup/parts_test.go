@@ -0,0 +1,173 @@
+package backup
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+// partFailDriver fails the staged uploads after limit of them succeeded, -1 means never
+type partFailDriver struct {
+	dirDriver
+	limit    int
+	uploaded int
+}
+
+func (d *partFailDriver) Upload(reader io.Reader, dest string) error {
+	if strings.Contains(dest, "/"+stagingDir+"/") {
+		if d.limit >= 0 && d.uploaded >= d.limit {
+			return errors.New("network is down")
+		}
+		d.uploaded++
+	}
+	return d.dirDriver.Upload(reader, dest)
+}
+
+func TestPartsResume(t *testing.T) {
+	root, _ := ioutil.TempDir("", "backupd-parts")
+	defer os.RemoveAll(root)
+	driver := &partFailDriver{dirDriver: dirDriver{root: path.Join(root, "store")}, limit: 4}
+	driverRunning = driver
+	meta = NewMeta(driver, "10.0.0.1")
+	namespace = "10.0.0.1"
+	keys = map[string][]byte{"2024": []byte("abcdefghijklmnopqrstuvwxyzabcdef")}
+	defer func() { namespace, keys = "", map[string][]byte{} }()
+	src := path.Join(root, "data")
+	os.MkdirAll(src, 0755)
+	a, b := make([]byte, 10000), make([]byte, 10000)
+	rand.New(rand.NewSource(1)).Read(a)
+	rand.New(rand.NewSource(2)).Read(b)
+	ioutil.WriteFile(path.Join(src, "a"), a, 0644)
+	ioutil.WriteFile(path.Join(src, "b"), b, 0644)
+
+	newEntity := func() *Entity {
+		ent := NewEntity(src, "hello-hello.web.web-1-data", 1, nil, "/data", MODE_FULL)
+		ent.SetCompression(CodecNone, LevelDefault)
+		ent.KeyID, ent.partSize = "2024", 4096
+		return ent
+	}
+	first := newEntity()
+	if err := first.Backup(driver); err == nil {
+		t.Fatal("backup should fail when the network is down")
+	}
+	cp, err := loadCheckpoint(driver, checkpointFile(namespace, first.Name))
+	if err != nil || len(cp.Parts) != 4 || meta.Get(first.Name) != nil {
+		t.Fatalf("the committed parts should be recorded in checkpoint, %+v %v", cp, err)
+	}
+
+	// the file b starts in the fourth part, it's uploaded again with the parts after it
+	b[0] ^= 0xff
+	ioutil.WriteFile(path.Join(src, "b"), b, 0644)
+	driver.limit, driver.uploaded = -1, 0
+	second := newEntity()
+	second.Name = "hello-hello.web.web-1-data-0.tar"
+	if err := second.Backup(driver); err != nil {
+		t.Fatal(err)
+	}
+	if second.Name != "hello-hello.web.web-1-data-0.tar" || second.Parts < 6 || driver.uploaded != second.Parts-3 {
+		t.Errorf("backup should be resumed from the first part under its own name, %s %d parts %d uploaded", second.Name, second.Parts, driver.uploaded)
+	}
+	for _, file := range []string{path.Join(namespace, first.Name), checkpointFile(namespace, first.Name)} {
+		if _, err := driver.FileInfo(file); !os.IsNotExist(err) {
+			t.Errorf("%s of the resumed backup should be moved, %v", file, err)
+		}
+	}
+	if _, err := driver.FileInfo(checkpointFile(namespace, second.Name)); !os.IsNotExist(err) {
+		t.Errorf("checkpoint should be deleted after committed, %v", err)
+	}
+	if ent := meta.Get(second.Name); ent == nil || ent.Parts != second.Parts || ent.Size < 20000 {
+		t.Fatalf("backup in parts should be in meta, %+v", ent)
+	}
+	stored := uint64(0)
+	parts, _ := driver.List(path.Join(namespace, second.Name))
+	for _, part := range parts {
+		stored += uint64(part.Size())
+	}
+	if second.Size != stored {
+		t.Errorf("size of the backup should be the encrypted parts stored %d, got %d", stored, second.Size)
+	}
+
+	// the parts are reassembled when restored and verified
+	scratch := path.Join(root, "scratch")
+	if _, err := second.restoreTo(driver, scratch); err != nil {
+		t.Fatal(err)
+	}
+	checkFiles(t, path.Join(scratch, "data"), map[string]string{"a": string(a), "b": string(b)})
+	if fes, err := second.Verify(driver, ""); err != nil || len(fes) != 0 {
+		t.Errorf("backup in parts should be verified, %v %v", fes, err)
+	}
+	if diff, err := Reconcile(driver, NewMeta(driver, namespace), false); err != nil || len(diff.Missing) != 1 || diff.Missing[0].Parts != second.Parts {
+		t.Errorf("backup in parts should be rebuilt, %+v %v", diff, err)
+	}
+	if err := Delete(second.Name); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := driver.FileInfo(path.Join(namespace, second.Name)); !os.IsNotExist(err) {
+		t.Errorf("the parts should be deleted, %v", err)
+	}
+}
+
+// the parts are only resumed if the same files are compressed into the same bytes
+func TestPartsCodecDeterministic(t *testing.T) {
+	data := make([]byte, 1<<20)
+	rnd := rand.New(rand.NewSource(1))
+	for i := range data {
+		data[i] = byte(rnd.Intn(16)) // compressible
+	}
+	compress := func(codec Codec, chunk int) []byte {
+		var buf bytes.Buffer
+		w, err := codec.NewWriter(&buf, LevelDefault)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < len(data); i += chunk {
+			end := i + chunk
+			if end > len(data) {
+				end = len(data)
+			}
+			w.Write(data[i:end])
+		}
+		w.Close()
+		return buf.Bytes()
+	}
+	for name, codec := range codecs {
+		if !bytes.Equal(compress(codec, 32<<10), compress(codec, 1000)) {
+			t.Errorf("%s should compress the same data into the same bytes", name)
+		}
+	}
+}
+
+func TestSweepCheckpoints(t *testing.T) {
+	root, _ := ioutil.TempDir("", "backupd-checkpoints")
+	defer os.RemoveAll(root)
+	driver := &dirDriver{root: root}
+	mt := NewMeta(driver, "ns")
+	mt.Commit(func(tx *MetaTx) error {
+		tx.Put("/data/a", Entity{Mode: MODE_FULL, Source: "/data/a", Name: "a.tar.gz"})
+		return nil
+	})
+
+	for _, name := range []string{"a.tar.gz", "b.tar.gz", "c.tar.gz"} {
+		saveCheckpoint(driver, "ns", &checkpoint{Name: name})
+		driver.Upload(strings.NewReader("part"), path.Join("ns", name, partName(0)))
+	}
+	old := time.Now().Add(-2 * checkpointExpire)
+	for _, name := range []string{"a.tar.gz", "b.tar.gz"} {
+		os.Chtimes(path.Join(root, checkpointFile("ns", name)), old, old)
+	}
+	if n, err := sweepCheckpoints(driver, "ns", time.Now().Add(-checkpointExpire), mt); err != nil || n != 2 {
+		t.Fatalf("the expired checkpoints should be swept, %d %v", n, err)
+	}
+	for name, exist := range map[string]bool{"a.tar.gz": true, "b.tar.gz": false, "c.tar.gz": true} {
+		if _, err := driver.FileInfo(path.Join("ns", name)); (err == nil) != exist {
+			t.Errorf("parts of %s should exist: %v, %v", name, exist, err)
+		}
+	}
+}
@@ -0,0 +1,306 @@
+package backup
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"io"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// VolumeRoot is where the volumes of lain apps are, the archive name of a volume is made from the path under it
+const VolumeRoot = "/data/lain/volumes"
+
+var errHeadRead = errors.New("head read")
+
+// MetaDiff is the difference between the meta and the backups on the storage
+type MetaDiff struct {
+	Namespace string   `json:"namespace"`
+	Missing   []Entity `json:"missing"`  // on the storage but not in meta, rebuilt from the names
+	Orphaned  []Entity `json:"orphaned"` // in meta but not on the storage
+	Warnings  []string `json:"warnings"` // the files can not be rebuilt or guessed
+	Fixed     bool     `json:"fixed"`
+}
+
+// ParseArchiveName parses the archive name made by the controller, <app>-<proc>-<instance>-<volume with / replaced by ->,
+// the proc's name begins with "<app>.". The volume is guessed, a - in it can not be told from a /.
+func ParseArchiveName(archive string) (app, proc string, instanceNo int, volume string, ok bool) {
+	for i := 1; i < len(archive); i++ {
+		if archive[i] != '-' || !strings.HasPrefix(archive[i+1:], archive[:i]+".") {
+			continue
+		}
+		app = archive[:i]
+		fields := strings.SplitN(archive[2*i+2:], "-", 3) // <type>.<name>, instance and volume
+		if len(fields) != 3 || fields[0] == "" || fields[2] == "" {
+			continue
+		}
+		n, err := strconv.Atoi(fields[1])
+		if err != nil || n < 0 {
+			continue
+		}
+		return app, app + "." + fields[0], n, "/" + strings.Replace(fields[2], "-", "/", -1), true
+	}
+	return "", "", 0, "", false
+}
+
+// splitBackupName splits the name of full or dedup backup <archive>-<unix><ext>
+func splitBackupName(name, ext string) (string, time.Time, bool) {
+	base := strings.TrimSuffix(name, ext)
+	i := strings.LastIndex(base, "-")
+	if i <= 0 {
+		return "", time.Time{}, false
+	}
+	sec, err := strconv.ParseInt(base[i+1:], 10, 64)
+	if err != nil {
+		return "", time.Time{}, false
+	}
+	return base[:i], time.Unix(sec, 0), true
+}
+
+// backupFile returns the mode, archive name and the creation time of the backup stored as the file, ok is false if it's not a backup
+func backupFile(info os.FileInfo) (mode, archive string, created time.Time, ok bool) {
+	name := info.Name()
+	if strings.HasPrefix(name, ".") {
+		return
+	}
+	if strings.HasSuffix(name, indexSuffix) { // the index of snapshot, or the manifest of full backup
+		base := strings.TrimSuffix(name, indexSuffix)
+		if i := strings.LastIndex(base, "@"); i > 0 {
+			if sec, err := strconv.ParseInt(base[i+1:], 10, 64); err == nil {
+				return MODE_INCREMENT, base[:i], time.Unix(sec, 0), true
+			}
+		}
+		return
+	}
+	if info.IsDir() {
+		if codec, err := GetCodec(CodecByFile(name)); err == nil && strings.HasSuffix(name, codec.Ext()) {
+			if archive, created, ok = splitBackupName(name, codec.Ext()); ok { // the archive uploaded in parts
+				return MODE_FULL, archive, created, ok
+			}
+		}
+		if !strings.Contains(name, "@") { // the mirror, it's a legacy increment backup without snapshots
+			return MODE_INCREMENT, name, info.ModTime(), true
+		}
+		return
+	}
+	if strings.HasSuffix(name, snapshotExt) {
+		archive, created, ok = splitBackupName(name, snapshotExt)
+		return MODE_DEDUP, archive, created, ok
+	}
+	if codec, err := GetCodec(CodecByFile(name)); err == nil && strings.HasSuffix(name, codec.Ext()) {
+		archive, created, ok = splitBackupName(name, codec.Ext())
+		return MODE_FULL, archive, created, ok
+	}
+	return
+}
+
+// headWriter keeps the first n bytes and stops the downloading
+type headWriter struct {
+	buf bytes.Buffer
+	n   int
+}
+
+func (w *headWriter) Write(p []byte) (int, error) {
+	if left := w.n - w.buf.Len(); len(p) > left {
+		w.buf.Write(p[:left])
+		return left, errHeadRead
+	}
+	return w.buf.Write(p)
+}
+
+// guessKey finds the key the file is encrypted with by decrypting its first chunk, empty if not encrypted
+func guessKey(store Storage, file string) (string, error) {
+	head := &headWriter{n: len(cryptMagic) + cryptSaltSize + cryptChunkSize + 16 + 1}
+	if err := store.Download(head, file); err != nil && err != errHeadRead && !strings.Contains(err.Error(), errHeadRead.Error()) {
+		return "", err
+	}
+	if !bytes.HasPrefix(head.buf.Bytes(), []byte(cryptMagic)) {
+		return "", nil
+	}
+	for id, key := range keys {
+		dec, err := newDecrypter(bytes.NewReader(head.buf.Bytes()), key)
+		if err != nil {
+			continue
+		}
+		if _, err := dec.Read(make([]byte, 1)); err == nil || err == io.EOF {
+			return id, nil
+		}
+	}
+	return "", fmt.Errorf("%s is encrypted by an unknown key", path.Base(file))
+}
+
+// rebuildEntity makes the entity of the backup file from its name, the source and volume are taken from the known backups
+// of the archive if any, or else guessed from the archive name
+func rebuildEntity(store Storage, ns string, info os.FileInfo, mode, archive string, created time.Time, known map[string]Entity) (Entity, error) {
+	ent := Entity{Mode: mode, Server: ns, Created: created}
+	file := path.Join(ns, info.Name())
+	switch mode {
+	case MODE_FULL:
+		ent.Name, ent.Size = info.Name(), uint64(info.Size())
+		ent.Compression = CodecByFile(ent.Name)
+		if info.IsDir() {
+			parts, err := store.List(file)
+			if err != nil {
+				return ent, err
+			}
+			ent.Size = 0
+			for _, part := range parts {
+				if !strings.HasPrefix(part.Name(), ".") {
+					ent.Parts++
+					ent.Size += uint64(part.Size())
+				}
+			}
+			file = path.Join(file, partName(0))
+		}
+	case MODE_DEDUP:
+		ent.Name, ent.Size = info.Name(), uint64(info.Size())
+	case MODE_INCREMENT:
+		ent.Name = strings.TrimSuffix(info.Name(), indexSuffix) // the index of snapshot is encrypted with the same key
+		if info.IsDir() {
+			file = indexFile(file)
+		}
+	}
+	if _, err := store.FileInfo(file); err == nil {
+		keyID, err := guessKey(store, file)
+		if err != nil {
+			return ent, err
+		}
+		ent.KeyID = keyID
+	}
+
+	if item, ok := known[archive]; ok {
+		ent.Source, ent.Volume, ent.InstanceNo, ent.Containers = item.Source, item.Volume, item.InstanceNo, item.Containers
+	} else if app, proc, instanceNo, volume, ok := ParseArchiveName(archive); ok {
+		ent.Source = path.Join(VolumeRoot, app, proc, strconv.Itoa(instanceNo), volume)
+		ent.Volume, ent.InstanceNo = volume, instanceNo
+	} else if strings.HasPrefix(archive, "_") { // the default archive name of the source
+		ent.Source = strings.Replace(archive, "_", "/", -1)
+	} else {
+		return ent, fmt.Errorf("Unknown source of %s, the archive name %s can not be parsed", ent.Name, archive)
+	}
+	return ent, nil
+}
+
+// archiveOf returns the archive name of the backup
+func archiveOf(ent Entity) string {
+	if ent.Mode == MODE_INCREMENT {
+		return ent.mirrorName()
+	}
+	if ent.Mode == MODE_DEDUP {
+		archive, _, _ := splitBackupName(ent.Name, snapshotExt)
+		return archive
+	}
+	codec, _ := GetCodec(ent.Compression)
+	archive, _, _ := splitBackupName(ent.Name, codec.Ext())
+	return archive
+}
+
+// storedFile returns the file on the storage which must exist for the backup
+func storedFile(ns string, ent Entity) string {
+	if ent.isSnapshot() {
+		return indexFile(path.Join(ns, ent.Name))
+	}
+	return path.Join(ns, ent.Name)
+}
+
+// Reconcile compares the meta mt with the backups in its namespace on the storage, the backups not in the meta are rebuilt
+// from their names and the ones not on the storage are orphaned. The meta is fixed if fix is true, or else only the diff is returned.
+func Reconcile(store Storage, mt *Meta, fix bool) (*MetaDiff, error) {
+	ns := mt.namespace
+	if ns == appsDir {
+		return nil, fmt.Errorf("The index of app layout can not be reconciled")
+	}
+	diff := &MetaDiff{Namespace: ns, Missing: []Entity{}, Orphaned: []Entity{}, Warnings: []string{}}
+	files, err := store.List(ns)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("Fail to list %s, %s", ns, err.Error())
+	}
+
+	known := make(map[string]Entity) // the backups in meta by archive name
+	ents := mt.Array()
+	for _, ent := range ents {
+		known[archiveOf(ent)] = ent
+		_, err := store.FileInfo(storedFile(ns, ent))
+		if err == nil {
+			continue
+		} else if !os.IsNotExist(err) {
+			return nil, fmt.Errorf("Fail to check %s, %s", ent.Name, err.Error())
+		}
+		diff.Orphaned = append(diff.Orphaned, ent)
+	}
+
+	snapshots := make(map[string]bool) // the archives having snapshots, their mirrors are not backups
+	for _, info := range files {
+		if mode, archive, _, ok := backupFile(info); ok && mode == MODE_INCREMENT && !info.IsDir() {
+			snapshots[archive] = true
+		}
+	}
+	for _, info := range files {
+		mode, archive, created, ok := backupFile(info)
+		if !ok || mode == MODE_INCREMENT && info.IsDir() && snapshots[archive] {
+			continue
+		}
+		name := info.Name()
+		if mode == MODE_INCREMENT && !info.IsDir() {
+			name = strings.TrimSuffix(name, indexSuffix)
+		}
+		if mt.Get(name) != nil {
+			continue
+		}
+		if _, err := store.FileInfo(checkpointFile(ns, name)); err == nil { // being uploaded in parts
+			continue
+		}
+		ent, err := rebuildEntity(store, ns, info, mode, archive, created, known)
+		if err != nil {
+			log.Warnf("Fail to rebuild the backup %s, %s", name, err.Error())
+			diff.Warnings = append(diff.Warnings, err.Error())
+			continue
+		}
+		diff.Missing = append(diff.Missing, ent)
+	}
+
+	if !fix || len(diff.Missing)+len(diff.Orphaned) == 0 {
+		return diff, nil
+	}
+	err = mt.Commit(func(tx *MetaTx) error {
+		for _, ent := range diff.Missing {
+			key := ent.Source
+			if ent.Mode == MODE_INCREMENT {
+				key += "@increment"
+			}
+			tx.Put(key, ent)
+		}
+		for _, ent := range diff.Orphaned {
+			tx.Delete(ent.Name)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	log.Infof("Meta of %s reconciled, %d backups rebuilt, %d orphans removed", ns, len(diff.Missing), len(diff.Orphaned))
+	diff.Fixed = true
+	return diff, nil
+}
+
+// ReconcileNamespace reconciles the meta of namespace ns on the running driver, empty means the namespace of this server.
+// The meta of another server is fixed as a shared meta, its server may be committing it, the journal records created
+// exclusively make either commit run again with the other's changes. It's refused if the storage can not create exclusively.
+func ReconcileNamespace(ns string, fix bool) (*MetaDiff, error) {
+	mt := meta
+	if ns != "" && ns != namespace {
+		if _, ok := driverRunning.(Creator); fix && !ok {
+			return nil, fmt.Errorf("Fail to fix meta of %s, the storage %s can not lock it against its server", ns, driverRunning.Name())
+		}
+		mt = NewSharedMeta(driverRunning, ns)
+		if err := mt.LoadFromBackend(); err != nil { // the meta may be lost, it's rebuilt
+			log.Warnf("Fail to load meta of %s, %s", ns, err.Error())
+		}
+	}
+	return Reconcile(driverRunning, mt, fix)
+}
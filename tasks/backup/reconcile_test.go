@@ -0,0 +1,158 @@
+package backup
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestParseArchiveName(t *testing.T) {
+	for archive, expect := range map[string][]interface{}{
+		"hello-hello.web.web-1-var-lib-mysql":    {"hello", "hello.web.web", 1, "/var/lib/mysql"},
+		"my-app-my-app.worker.sync-12-data":      {"my-app", "my-app.worker.sync", 12, "/data"},
+		"hello-hello.web.web-1-var-lib-my-data":  {"hello", "hello.web.web", 1, "/var/lib/my/data"},
+		"hello-world.web.web-1-data":             nil,
+		"hello-hello.web.web-x-data":             nil,
+		"_data_lain_volumes_hello_web_1_var_lib": nil,
+	} {
+		app, proc, instanceNo, volume, ok := ParseArchiveName(archive)
+		if expect == nil {
+			if ok {
+				t.Errorf("%s should not be parsed, got %s %s %d %s", archive, app, proc, instanceNo, volume)
+			}
+		} else if !ok || app != expect[0] || proc != expect[1] || instanceNo != expect[2] || volume != expect[3] {
+			t.Errorf("unexpected %s %s %d %s of %s", app, proc, instanceNo, volume, archive)
+		}
+	}
+}
+
+func TestReconcileForeignNamespace(t *testing.T) {
+	root, _ := ioutil.TempDir("", "backupd-reconcile")
+	defer os.RemoveAll(root)
+	driver := &dirDriver{root: root}
+	driverRunning = driver
+	owner := NewMeta(driver, "10.0.0.2") // the meta in memory of the server of 10.0.0.2
+	ent := metaEntity(0)
+	owner.Commit(func(tx *MetaTx) error { tx.Put(ent.Source, ent); return nil })
+
+	diff, err := ReconcileNamespace("10.0.0.2", true)
+	if err != nil || !diff.Fixed || len(diff.Orphaned) != 1 {
+		t.Fatalf("the orphan should be removed, %+v %v", diff, err)
+	}
+	// the server commits at the version written by the fix, it runs again with the fix
+	ent = metaEntity(1)
+	if err := owner.Commit(func(tx *MetaTx) error { tx.Put(ent.Source, ent); return nil }); err != nil {
+		t.Fatal(err)
+	}
+	if owner.Version() != 3 || owner.Get(metaEntity(0).Name) != nil || owner.Get(ent.Name) == nil {
+		t.Errorf("the fix should be read by the server, version %d, %+v", owner.Version(), owner.Array())
+	}
+	loaded := NewMeta(driver, "10.0.0.2")
+	if err := loaded.LoadFromBackend(); err != nil || loaded.Version() != 3 || len(loaded.Array()) != 1 {
+		t.Errorf("both commits should be in the journal, version %d, %v", loaded.Version(), err)
+	}
+
+	// the meta of another server can not be fixed without exclusive creating, it can still be compared
+	driverRunning = struct{ Storage }{driver}
+	if _, err := ReconcileNamespace("10.0.0.2", true); err == nil {
+		t.Error("fix should be refused if the storage is not a Creator")
+	}
+	if _, err := ReconcileNamespace("10.0.0.2", false); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestReconcile(t *testing.T) {
+	root, _ := ioutil.TempDir("", "backupd-reconcile")
+	defer os.RemoveAll(root)
+	driver := &dirDriver{root: path.Join(root, "store")}
+	driverRunning = driver
+	meta = NewMeta(driver, namespace)
+	keys = map[string][]byte{"2024": []byte("abcdefghijklmnopqrstuvwxyzabcdef")}
+	defer func() { keys = map[string][]byte{} }()
+	src := path.Join(root, "data")
+	os.MkdirAll(src, 0755)
+	ioutil.WriteFile(path.Join(src, "db"), []byte("database"), 0644)
+
+	full := NewEntity(src, "hello-hello.web.web-1-var-lib-mysql", 1, nil, "/var/lib/mysql", MODE_FULL)
+	full.SetCompression(CodecZstd, LevelDefault)
+	full.KeyID = "2024"
+	dedup := NewEntity(src, "hello-hello.web.web-1-data", 1, nil, "/data", MODE_DEDUP)
+	if err := full.Backup(driver); err != nil {
+		t.Fatal(err)
+	}
+	if err := dedup.DedupBackup(driver); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	s1 := testSnapshot(t, src, now.Add(-2*time.Hour), map[string]string{"a": "v1"})
+	s2 := testSnapshot(t, src, now.Add(-time.Hour), map[string]string{"a": "v2"})
+
+	// the meta is lost
+	driver.Delete(path.Join(namespace, metaFile))
+	driver.Delete(path.Join(namespace, metaFile+metaJournalSuffix))
+	mt := NewMeta(driver, namespace)
+	diff, err := Reconcile(driver, mt, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(diff.Missing) != 2 || len(diff.Orphaned) != 0 || diff.Fixed || len(mt.Array()) != 0 {
+		t.Fatalf("the backups should be missing without fixing, %+v", diff)
+	}
+	// the source of the snapshots can not be parsed from app-data
+	if len(diff.Warnings) != 2 {
+		t.Errorf("unexpected warnings %v", diff.Warnings)
+	}
+	mt.Commit(func(tx *MetaTx) error { tx.Put(src+"@increment", *s1); return nil }) // the source of app-data is known from the meta
+	if diff, err = Reconcile(driver, mt, true); err != nil || !diff.Fixed || len(diff.Missing) != 3 {
+		t.Fatalf("missing backups should be added, %+v %v", diff, err)
+	}
+	rebuilt := mt.Get(full.Name)
+	if rebuilt == nil || rebuilt.Mode != MODE_FULL || rebuilt.Compression != CodecZstd || rebuilt.KeyID != "2024" ||
+		rebuilt.Source != "/data/lain/volumes/hello/hello.web.web/1/var/lib/mysql" || rebuilt.Volume != "/var/lib/mysql" ||
+		rebuilt.InstanceNo != 1 || rebuilt.Created.Unix() != full.Created.Unix() {
+		t.Errorf("unexpected rebuilt full backup %+v", rebuilt)
+	}
+	if ent := mt.Get(dedup.Name); ent == nil || ent.Mode != MODE_DEDUP {
+		t.Errorf("unexpected rebuilt dedup backup %+v", ent)
+	}
+	if ent := mt.Get(s2.Name); ent == nil || ent.Mode != MODE_INCREMENT || ent.Source != src || !ent.Created.Equal(time.Unix(s2.Created.Unix(), 0)) {
+		t.Errorf("unexpected rebuilt snapshot %+v", ent)
+	}
+	if len(mt.Snapshots("app-data")) != 2 {
+		t.Error("rebuilt snapshots should be found by the archive")
+	}
+	loaded := NewMeta(driver, namespace)
+	if err := loaded.LoadFromBackend(); err != nil || len(loaded.Array()) != 4 {
+		t.Errorf("fixed meta should be synced, %v", err)
+	}
+
+	// the backup deleted by hand is orphaned
+	driver.Delete(path.Join(namespace, full.Name))
+	if diff, err = Reconcile(driver, mt, false); err != nil || len(diff.Orphaned) != 1 || diff.Orphaned[0].Name != full.Name {
+		t.Fatalf("deleted backup should be orphaned, %+v %v", diff, err)
+	}
+	if mt.Get(full.Name) == nil {
+		t.Error("orphan should be kept without fixing")
+	}
+	if diff, err = Reconcile(driver, mt, true); err != nil || mt.Get(full.Name) != nil {
+		t.Errorf("orphan should be removed, %+v %v", diff, err)
+	}
+
+	// the backup encrypted by an unknown key is not rebuilt
+	keys["2025"] = []byte("bcdefghijklmnopqrstuvwxyzabcdefg")
+	full.KeyID = "2025"
+	if err := full.Backup(driver); err != nil {
+		t.Fatal(err)
+	}
+	delete(keys, "2025")
+	mt.Commit(func(tx *MetaTx) error {
+		tx.Delete(full.Name)
+		return nil
+	})
+	if diff, err = Reconcile(driver, mt, false); err != nil || len(diff.Missing) != 0 || len(diff.Warnings) != 1 {
+		t.Errorf("backup of unknown key should be warned, %+v %v", diff, err)
+	}
+}
@@ -0,0 +1,150 @@
+package backup
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Retention decides which backups of a directory are kept by backup_expire.
+// A backup is kept if it is younger than Expire, or selected by any of the keep-last and grandfather-father-son counts,
+// the newest MinKeep successful backups and the held ones are always kept. The corrupted backups are not counted by the policies.
+type Retention struct {
+	Expire  time.Duration // 0 means not expired by age
+	Last    int           // the newest n backups
+	Daily   int           // the newest backup of each of the last n days
+	Weekly  int
+	Monthly int
+	Yearly  int
+	MinKeep int // at least 1
+}
+
+// RetentionDecision is a backup kept or pruned by the retention policy
+type RetentionDecision struct {
+	Name   string `json:"name"`
+	Reason string `json:"reason"`
+	Error  string `json:"error,omitempty"` // the backup is not deleted
+}
+
+// ParseRetention parses the retention policy like "30d", or "expire=30d,last=7,daily=7,weekly=4,monthly=12,yearly=3,min=2",
+// the duration is parsed by DurationParser
+func ParseRetention(s string) (Retention, error) {
+	ret := Retention{MinKeep: 1}
+	if !strings.Contains(s, "=") {
+		dur, err := DurationParser(s)
+		ret.Expire = dur
+		return ret, err
+	}
+	for _, field := range strings.Split(s, ",") {
+		kv := strings.SplitN(strings.TrimSpace(field), "=", 2)
+		if len(kv) != 2 {
+			return ret, fmt.Errorf("Unvalid retention %q", field)
+		}
+		if kv[0] == "expire" {
+			dur, err := DurationParser(kv[1])
+			if err != nil {
+				return ret, err
+			}
+			ret.Expire = dur
+			continue
+		}
+		n, err := strconv.Atoi(kv[1])
+		if err != nil || n < 0 {
+			return ret, fmt.Errorf("Unvalid retention %q", field)
+		}
+		switch kv[0] {
+		case "last":
+			ret.Last = n
+		case "daily":
+			ret.Daily = n
+		case "weekly":
+			ret.Weekly = n
+		case "monthly":
+			ret.Monthly = n
+		case "yearly":
+			ret.Yearly = n
+		case "min":
+			ret.MinKeep = n
+		default:
+			return ret, fmt.Errorf("Unknown retention %q", kv[0])
+		}
+	}
+	if ret.MinKeep < 1 {
+		ret.MinKeep = 1
+	}
+	if ret.Expire == 0 && ret.Last+ret.Daily+ret.Weekly+ret.Monthly+ret.Yearly == 0 {
+		return ret, fmt.Errorf("Retention %q keeps nothing", s)
+	}
+	return ret, nil
+}
+
+// Apply returns the backups kept and pruned, the backups are of the same directory
+func (r Retention) Apply(ents []Entity, now time.Time) (kept, pruned []RetentionDecision) {
+	sorted := make([]Entity, len(ents))
+	copy(sorted, ents)
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].Created.After(sorted[j].Created) })
+
+	reasons := make(map[string][]string)
+	periods := []struct {
+		name  string
+		count int
+		key   func(time.Time) string
+	}{
+		{"daily", r.Daily, func(t time.Time) string { return t.Format("2006-01-02") }},
+		{"weekly", r.Weekly, func(t time.Time) string {
+			year, week := t.ISOWeek()
+			return fmt.Sprintf("%d-W%02d", year, week)
+		}},
+		{"monthly", r.Monthly, func(t time.Time) string { return t.Format("2006-01") }},
+		{"yearly", r.Yearly, func(t time.Time) string { return t.Format("2006") }},
+	}
+	seen := make([]map[string]bool, len(periods))
+	for i := range seen {
+		seen[i] = make(map[string]bool)
+	}
+	successful := 0
+	for _, ent := range sorted {
+		if ent.Corrupted != "" {
+			continue
+		}
+		successful++
+		if successful <= r.MinKeep {
+			reasons[ent.Name] = append(reasons[ent.Name], fmt.Sprintf("minimum %d", r.MinKeep))
+		}
+		if successful <= r.Last {
+			reasons[ent.Name] = append(reasons[ent.Name], fmt.Sprintf("last %d", r.Last))
+		}
+		for i, p := range periods {
+			key := p.key(ent.Created.Local())
+			if len(seen[i]) < p.count && !seen[i][key] {
+				seen[i][key] = true
+				reasons[ent.Name] = append(reasons[ent.Name], p.name+" "+key)
+			}
+		}
+	}
+
+	for _, ent := range sorted {
+		if ent.Hold.active(now) {
+			reasons[ent.Name] = append(reasons[ent.Name], ent.Hold.String())
+		}
+		age := now.Sub(ent.Created)
+		if r.Expire > 0 && age <= r.Expire {
+			reasons[ent.Name] = append(reasons[ent.Name], "within "+r.Expire.String())
+		}
+		if len(reasons[ent.Name]) > 0 {
+			kept = append(kept, RetentionDecision{Name: ent.Name, Reason: strings.Join(reasons[ent.Name], ", ")})
+			continue
+		}
+		reason := "not selected by policy"
+		switch {
+		case ent.Corrupted != "":
+			reason = "corrupted, " + ent.Corrupted
+		case r.Expire > 0:
+			reason = "older than " + r.Expire.String()
+		}
+		pruned = append(pruned, RetentionDecision{Name: ent.Name, Reason: reason})
+	}
+	return kept, pruned
+}
@@ -0,0 +1,117 @@
+package backup
+
+import (
+	"fmt"
+	"github.com/laincloud/backupd/crond"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestParseRetention(t *testing.T) {
+	r, err := ParseRetention("30d")
+	if err != nil || r.Expire != 30*24*time.Hour || r.MinKeep != 1 {
+		t.Errorf("unexpected retention %+v %v", r, err)
+	}
+	r, err = ParseRetention("expire=2h,last=3,daily=7,weekly=4,monthly=12,yearly=2,min=2")
+	if err != nil || r != (Retention{Expire: 2 * time.Hour, Last: 3, Daily: 7, Weekly: 4, Monthly: 12, Yearly: 2, MinKeep: 2}) {
+		t.Errorf("unexpected retention %+v %v", r, err)
+	}
+	for _, s := range []string{"", "3x", "last=a", "hourly=3", "min=2", "last=-1"} {
+		if _, err := ParseRetention(s); err == nil {
+			t.Errorf("%q should be unvalid", s)
+		}
+	}
+}
+
+func testEntities(now time.Time, ages ...time.Duration) []Entity {
+	ret := make([]Entity, len(ages))
+	for i, age := range ages {
+		ret[i] = Entity{Name: fmt.Sprintf("b%d", i), Created: now.Add(-age)}
+	}
+	return ret
+}
+
+func decisionNames(decisions []RetentionDecision) map[string]bool {
+	ret := make(map[string]bool)
+	for _, d := range decisions {
+		ret[d.Name] = true
+	}
+	return ret
+}
+
+func TestRetentionApply(t *testing.T) {
+	now := time.Date(2026, 3, 15, 12, 0, 0, 0, time.Local)
+	day := 24 * time.Hour
+
+	// two backups a day for 60 days
+	var ages []time.Duration
+	for i := 0; i < 120; i++ {
+		ages = append(ages, time.Duration(i)*12*time.Hour)
+	}
+	ents := testEntities(now, ages...)
+	kept, pruned := Retention{Daily: 3, Monthly: 2, MinKeep: 1}.Apply(ents, now)
+	names := decisionNames(kept)
+	// b0: today and this month, b2, b4: the last two days, b30: the newest of February
+	if len(kept) != 4 || !names["b0"] || !names["b2"] || !names["b4"] || !names["b30"] || len(pruned) != 116 {
+		t.Errorf("unexpected kept backups %+v", kept)
+	}
+	if kept[0].Reason != "minimum 1, daily 2026-03-15, monthly 2026-03" {
+		t.Errorf("unexpected reason %q", kept[0].Reason)
+	}
+
+	kept, _ = Retention{Last: 2, Weekly: 2, MinKeep: 1}.Apply(testEntities(now, 0, day, 8*day, 9*day), now)
+	if names := decisionNames(kept); len(kept) != 3 || !names["b0"] || !names["b1"] || !names["b2"] {
+		t.Errorf("unexpected kept backups %+v", kept)
+	}
+
+	// the newest successful backups are kept even if all expired
+	ents = testEntities(now, 10*day, 11*day, 12*day, 13*day)
+	ents[0].Corrupted = "checksum mismatch"
+	kept, pruned = Retention{Expire: day, MinKeep: 2}.Apply(ents, now)
+	if names := decisionNames(kept); len(kept) != 2 || !names["b1"] || !names["b2"] {
+		t.Errorf("unexpected kept backups %+v", kept)
+	}
+	if len(pruned) != 2 || pruned[0].Name != "b0" || pruned[0].Reason != "corrupted, checksum mismatch" || pruned[1].Reason != "older than 24h0m0s" {
+		t.Errorf("unexpected pruned backups %+v", pruned)
+	}
+}
+
+func TestExpireRetention(t *testing.T) {
+	root, _ := ioutil.TempDir("", "backupd-retention")
+	defer os.RemoveAll(root)
+	driver := &dirDriver{root: path.Join(root, "store")}
+	driverRunning = driver
+	meta = NewMeta(driver, namespace)
+	src := path.Join(root, "data")
+	os.MkdirAll(src, 0755)
+	ioutil.WriteFile(path.Join(src, "db"), []byte("database"), 0644)
+
+	now := time.Now()
+	var names []string
+	for i := 0; i < 4; i++ {
+		ent := NewEntity(src, fmt.Sprintf("app-data-%d", i), 0, nil, "/data", MODE_FULL)
+		ent.Created = now.Add(-time.Duration(4-i) * time.Hour)
+		if err := ent.Backup(driver); err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, ent.Name)
+	}
+	// all the backups are older than the expire time, but not the whole history is deleted
+	result, err := expire(crond.FuncArg{"info": []string{src, "expire=1h,last=2"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	kept, pruned := result["kept"].([]RetentionDecision), result["pruned"].([]RetentionDecision)
+	if len(kept) != 2 || kept[0].Name != names[3] || kept[0].Reason != "minimum 1, last 2" || len(pruned) != 2 {
+		t.Errorf("unexpected expire result %+v", result)
+	}
+	if ents := meta.Array(src); len(ents) != 2 {
+		t.Errorf("pruned backups should be deleted, %+v", ents)
+	}
+	if _, err := os.Stat(path.Join(driver.root, namespace, names[0])); !os.IsNotExist(err) {
+		t.Error("pruned archive should be deleted")
+	}
+}
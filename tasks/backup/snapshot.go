@@ -0,0 +1,218 @@
+package backup
+
+import (
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"io"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The increment backup keeps a series of snapshots named <archive>@<unix>, they share the mirror directory <archive>,
+// which is synced by the driver's Rsync and always has the files of the latest snapshot.
+// When the mirror is synced, the files replaced or deleted by the sync are copied into <archive>@<unix> of the last snapshot,
+// the changed-files directory, see SnapshotSync. The full file list of each snapshot is in its index <archive>@<unix>.index,
+// a file of the snapshot is found in the changed-files directories of it and the later snapshots, the earliest first,
+// or else in the mirror.
+
+// mirrorName returns the mirror directory of the increment backup
+func (ent *Entity) mirrorName() string {
+	return strings.SplitN(ent.Name, "@", 2)[0]
+}
+
+// the increment backups before snapshots have only the mirror, named <archive>
+func (ent *Entity) isSnapshot() bool {
+	return ent.Mode == MODE_INCREMENT && strings.Contains(ent.Name, "@")
+}
+
+// ParseTimestamp parses the time in unix seconds or RFC3339
+func ParseTimestamp(s string) (time.Time, error) {
+	if sec, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Unix(sec, 0), nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
+
+// selectedPath checks whether rel is one of the files or in the directories, "*" selects all
+func selectedPath(rel string, files []string) bool {
+	for _, f := range files {
+		if f == "*" {
+			return true
+		}
+		f = strings.Trim(path.Clean("/"+f), "/")
+		if rel == f || strings.HasPrefix(rel, f+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// storedFiles returns the files stored in dir, key is the relative path, an empty map if dir not exist
+func storedFiles(store Storage, dir string) (map[string]string, error) {
+	ret := make(map[string]string)
+	if _, err := store.FileInfo(dir); err != nil {
+		if os.IsNotExist(err) {
+			return ret, nil
+		}
+		return nil, err
+	}
+	files, err := findAllFiles(dir, "*", store)
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range files {
+		ret[strings.TrimPrefix(file[len(dir):], "/")] = file
+	}
+	return ret, nil
+}
+
+// copyStored copies a file in the storage by downloading and uploading it
+func copyStored(store Storage, src, dest string) error {
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(store.Download(pw, src))
+	}()
+	err := store.Upload(pr, dest)
+	pr.CloseWithError(err)
+	return err
+}
+
+// SnapshotSync syncs src into the mirror dest and copies the files it replaces or deletes into saveDir,
+// by the storage's SnapshotRsync, or else by IncrementSync, which knows them from the index of dest.
+// The files already in saveDir are the older versions, they are kept.
+func SnapshotSync(store Storage, src, dest, saveDir string, filter *Filter) error {
+	if syncer, ok := store.(SnapshotSyncer); ok {
+		return syncer.SnapshotRsync(src, dest, saveDir, filter)
+	}
+	return incrementSync(store, src, dest, saveDir, filter)
+}
+
+// incrementFiles returns the index of the increment backup and where its selected regular files are stored, key is the relative path
+func (ent *Entity) incrementFiles(store Storage, files []string) (map[string]IndexEntry, map[string]string, error) {
+	locations := make(map[string]string)
+	if !ent.isSnapshot() { // all files are in the mirror
+		pathBase := path.Join(ent.ns(), ent.Name)
+		var fileList []string
+		for _, f := range files {
+			tmp, err := findAllFiles(pathBase, f, store)
+			if err != nil {
+				return nil, nil, err
+			}
+			fileList = append(fileList, tmp...)
+		}
+		for _, file := range fileList {
+			locations[strings.TrimPrefix(file[len(pathBase):], "/")] = file
+		}
+		// mode and mtime in the index are used if the backup is synced by IncrementSync
+		index, err := LoadIndex(store, pathBase)
+		if err != nil {
+			log.Warnf("Fail to load the index of %s, %s", pathBase, err.Error())
+			index = make(map[string]IndexEntry)
+		}
+		return index, locations, nil
+	}
+
+	index, err := LoadIndex(store, path.Join(ent.ns(), ent.Name))
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(index) == 0 {
+		return nil, nil, fmt.Errorf("No index of snapshot %s", ent.Name)
+	}
+	for _, f := range files {
+		found := false
+		for rel := range index {
+			if selectedPath(rel, []string{f}) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, nil, ent.noFile(f)
+		}
+	}
+
+	saved := make(map[string]string) // the earliest version after the snapshot
+	for _, item := range metaOf(ent).Snapshots(ent.mirrorName()) {
+		if item.Created.Before(ent.Created) {
+			continue
+		}
+		stored, err := storedFiles(store, path.Join(ent.ns(), item.Name))
+		if err != nil {
+			return nil, nil, err
+		}
+		for rel, file := range stored {
+			if _, ok := saved[rel]; !ok {
+				saved[rel] = file
+			}
+		}
+	}
+	for rel, entry := range index {
+		if entry.Hash == "" || !selectedPath(rel, files) {
+			continue
+		}
+		if file, ok := saved[rel]; ok {
+			locations[rel] = file
+		} else {
+			locations[rel] = path.Join(ent.ns(), ent.mirrorName(), rel)
+		}
+	}
+	return index, locations, nil
+}
+
+// mergeSnapshot moves the files in the changed-files directory of the snapshot to be deleted into the previous snapshot's,
+// the previous snapshot needs the ones it does not have. It returns whether ent is the only snapshot of the backup.
+func mergeSnapshot(ent *Entity) (bool, error) {
+	var prev *Entity
+	only := true
+	for _, item := range metaOf(ent).Snapshots(ent.mirrorName()) {
+		if item.Name == ent.Name {
+			continue
+		}
+		only = false
+		if item.Created.Before(ent.Created) {
+			tmp := item
+			prev = &tmp
+		}
+	}
+	if prev == nil {
+		return only, nil
+	}
+	store, err := ent.storage(driverRunning)
+	if err != nil {
+		return false, err
+	}
+	stored, err := storedFiles(store, path.Join(ent.ns(), ent.Name))
+	if err != nil || len(stored) == 0 {
+		return false, err
+	}
+	existing, err := storedFiles(store, path.Join(ent.ns(), prev.Name))
+	if err != nil {
+		return false, err
+	}
+	for rel, file := range stored {
+		if _, ok := existing[rel]; ok {
+			continue
+		}
+		if err := copyStored(store, file, path.Join(ent.ns(), prev.Name, rel)); err != nil {
+			return false, err
+		}
+	}
+	log.Debugf("Snapshot %s merged into %s", ent.Name, prev.Name)
+	return false, nil
+}
+
+// indexInfo is a file in the index of increment snapshot
+type indexInfo struct {
+	entry IndexEntry
+}
+
+func (fi *indexInfo) Name() string       { return path.Base(fi.entry.Path) }
+func (fi *indexInfo) Size() int64        { return fi.entry.Size }
+func (fi *indexInfo) Mode() os.FileMode  { return fi.entry.Mode }
+func (fi *indexInfo) ModTime() time.Time { return fi.entry.ModTime }
+func (fi *indexInfo) IsDir() bool        { return fi.entry.Mode.IsDir() }
+func (fi *indexInfo) Sys() interface{}   { return nil }
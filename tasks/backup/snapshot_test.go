@@ -0,0 +1,206 @@
+package backup
+
+import (
+	"github.com/laincloud/backupd/crond"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testSnapshot(t *testing.T, src string, created time.Time, files map[string]string) *Entity {
+	for file, content := range files {
+		if content == "" {
+			os.Remove(path.Join(src, file))
+		} else {
+			ioutil.WriteFile(path.Join(src, file), []byte(content), 0644)
+		}
+	}
+	ent := NewEntity(src, "app-data", 0, nil, "/data", MODE_INCREMENT)
+	ent.Created = created
+	if err := ent.IncrementBackup(); err != nil {
+		t.Fatal(err)
+	}
+	return ent
+}
+
+func checkFiles(t *testing.T, dir string, files map[string]string) {
+	for file, content := range files {
+		data, err := ioutil.ReadFile(path.Join(dir, file))
+		if content == "" && !os.IsNotExist(err) || content != "" && string(data) != content {
+			t.Errorf("%s should be %q, got %q %v", file, content, data, err)
+		}
+	}
+}
+
+func TestIncrementSnapshots(t *testing.T) {
+	root, _ := ioutil.TempDir("", "backupd-snapshot")
+	defer os.RemoveAll(root)
+	driver := &dirDriver{root: path.Join(root, "store")}
+	driverRunning = driver
+	meta = NewMeta(driver, namespace)
+	src := path.Join(root, "data")
+	os.MkdirAll(src, 0755)
+
+	// the increment backup before snapshots is replaced by the first snapshot
+	legacy := NewEntity(src, "app-data", 0, nil, "/data", MODE_INCREMENT)
+	meta.Commit(func(tx *MetaTx) error {
+		tx.Put(src+"@increment", *legacy)
+		return nil
+	})
+	now := time.Now()
+	s1 := testSnapshot(t, src, now.Add(-3*time.Hour), map[string]string{"a": "v1", "b": "b1"})
+	s2 := testSnapshot(t, src, now.Add(-2*time.Hour), map[string]string{"a": "v2", "b": "", "c": "c2"})
+	s3 := testSnapshot(t, src, now.Add(-time.Hour), map[string]string{"a": "v3"})
+	if ents := meta.Array(src); len(ents) != 3 || meta.Get(legacy.Name) != nil {
+		t.Fatalf("each run should be a snapshot, %+v", ents)
+	}
+	if s1.Name == s2.Name || s1.mirrorName() != "app-data" || !s3.isSnapshot() {
+		t.Errorf("unexpected snapshot names %s %s", s1.Name, s2.Name)
+	}
+
+	if flist, err := FileList(s1.Name); err != nil || len(flist) != 2 || flist[1].Name() != "b" || flist[1].Size() != 2 {
+		t.Errorf("snapshot should be listed by its index, %v", err)
+	}
+	if _, err := backup_recover(crond.FuncArg{"backup": s1.Name}); err != nil {
+		t.Fatal(err)
+	}
+	checkFiles(t, src, map[string]string{"a": "v1", "b": "b1"})
+	at := strconv.FormatInt(s2.Created.Add(time.Minute).Unix(), 10)
+	if _, err := backup_recover(crond.FuncArg{"backup": "app-data", "at": at}); err != nil {
+		t.Fatal(err)
+	}
+	checkFiles(t, src, map[string]string{"a": "v2", "c": "c2"})
+	if _, err := backup_recover(crond.FuncArg{"backup": "app-data"}); err != nil {
+		t.Fatal(err)
+	}
+	checkFiles(t, src, map[string]string{"a": "v3"})
+	if _, err := backup_recover(crond.FuncArg{"backup": "app-data", "at": now.Add(-4 * time.Hour).Format(time.RFC3339)}); err == nil {
+		t.Error("recover before the first snapshot should fail")
+	}
+
+	// the files of the middle snapshot needed by the older one are kept
+	if err := Delete(s2.Name); err != nil {
+		t.Fatal(err)
+	}
+	dest := path.Join(root, "restored")
+	if _, err := backup_recover(crond.FuncArg{"backup": s1.Name, "destDir": dest}); err != nil {
+		t.Fatal(err)
+	}
+	checkFiles(t, dest, map[string]string{"a": "v1", "b": "b1", "c": ""})
+	if _, err := s1.Verify(driver, ""); err != nil {
+		t.Errorf("snapshot should be verified after deleting the next one, %v", err)
+	}
+	d, err := OpenDownload(s1.Name + "/a")
+	if err != nil || d.Checksum == "" {
+		t.Fatalf("file of snapshot should be downloaded, %v", err)
+	}
+
+	for _, ent := range []*Entity{s1, s3} {
+		if err := Delete(ent.Name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := os.Stat(path.Join(driver.root, namespace, "app-data")); !os.IsNotExist(err) {
+		t.Error("mirror should be deleted with the last snapshot")
+	}
+}
+
+func TestExpireSnapshots(t *testing.T) {
+	root, _ := ioutil.TempDir("", "backupd-snapshot-expire")
+	defer os.RemoveAll(root)
+	driver := &dirDriver{root: path.Join(root, "store")}
+	driverRunning = driver
+	meta = NewMeta(driver, namespace)
+	src := path.Join(root, "data")
+	os.MkdirAll(src, 0755)
+
+	now := time.Now()
+	testSnapshot(t, src, now.Add(-3*time.Hour), map[string]string{"a": "v1"})
+	s2 := testSnapshot(t, src, now.Add(-2*time.Hour), map[string]string{"a": "v2"})
+	s3 := testSnapshot(t, src, now, map[string]string{"a": "v3"})
+
+	if _, err := expire(crond.FuncArg{"info": []string{src + "@increment", "150m"}}); err != nil {
+		t.Fatal(err)
+	}
+	if ents := meta.Array(src); len(ents) != 2 || meta.Get(s2.Name) == nil || meta.Get(s3.Name) == nil {
+		t.Fatalf("only the old snapshot should be expired, %+v", ents)
+	}
+	if _, err := backup_recover(crond.FuncArg{"backup": s2.Name}); err != nil {
+		t.Fatal(err)
+	}
+	checkFiles(t, src, map[string]string{"a": "v2"})
+}
+
+func TestSnapshotSync(t *testing.T) {
+	root, _ := ioutil.TempDir("", "backupd-snapshot-sync")
+	defer os.RemoveAll(root)
+	driver := &dirDriver{root: path.Join(root, "store")}
+	src := path.Join(root, "data")
+	os.MkdirAll(path.Join(src, "sub"), 0755)
+	for file, content := range map[string]string{"a": "a1", "b": "b1", "c": "c1", "sub/d": "d1"} {
+		ioutil.WriteFile(path.Join(src, file), []byte(content), 0644)
+	}
+	if err := IncrementSync(driver, src, "ns/mirror", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// the replaced files are saved, the older version already saved is kept, removed files are kept in mirror
+	driver.Upload(strings.NewReader("c0"), "ns/mirror@1/c")
+	ioutil.WriteFile(path.Join(src, "a"), []byte("a2"), 0644)
+	ioutil.WriteFile(path.Join(src, "c"), []byte("c2"), 0644)
+	os.RemoveAll(path.Join(src, "sub"))
+	os.Remove(path.Join(src, "b"))
+	ioutil.WriteFile(path.Join(src, "sub"), []byte("sub is a file"), 0644)
+	if err := SnapshotSync(driver, src, "ns/mirror", "ns/mirror@1", nil); err != nil {
+		t.Fatal(err)
+	}
+	checkFiles(t, path.Join(driver.root, "ns/mirror"), map[string]string{"a": "a2", "b": "b1", "c": "c2", "sub": "sub is a file"})
+	checkFiles(t, path.Join(driver.root, "ns/mirror@1"), map[string]string{"a": "a1", "b": "", "c": "c0", "sub/d": "d1"})
+
+	// unchanged files are not saved
+	if err := SnapshotSync(driver, src, "ns/mirror", "ns/mirror@2", nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path.Join(driver.root, "ns/mirror@2")); !os.IsNotExist(err) {
+		t.Errorf("nothing should be saved, %v", err)
+	}
+}
+
+func TestDeleteSnapshotWhileSyncing(t *testing.T) {
+	root, _ := ioutil.TempDir("", "backupd-snapshot-busy")
+	defer os.RemoveAll(root)
+	driver := &dirDriver{root: path.Join(root, "store")}
+	driverRunning = driver
+	meta = NewMeta(driver, namespace)
+	src := path.Join(root, "data")
+	os.MkdirAll(src, 0755)
+
+	now := time.Now()
+	s1 := testSnapshot(t, src, now.Add(-time.Hour), map[string]string{"a": "v1"})
+	bstats.Set(src, StateBackuping)
+	if err := Delete(s1.Name); err == nil || meta.Get(s1.Name) == nil {
+		t.Errorf("snapshot should not be deleted while its source is backed up, %v", err)
+	}
+	bstats.Free(src)
+
+	mirror := path.Join(s1.ns(), s1.mirrorName())
+	mstats.Set(mirror, StateBackuping)
+	if err := Delete(s1.Name); err == nil || meta.Get(s1.Name) == nil {
+		t.Errorf("snapshot should not be deleted while its mirror is synced, %v", err)
+	}
+	mstats.Free(mirror)
+
+	mstats.Set(mirror, StateDeleting)
+	ent := NewEntity(src, "app-data", 0, nil, "/data", MODE_INCREMENT)
+	if err := ent.IncrementBackup(); err == nil {
+		t.Error("increment backup should give up while a snapshot is deleted")
+	}
+	mstats.Free(mirror)
+	if err := Delete(s1.Name); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,145 @@
+package backup
+
+import (
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The archives and snapshots are uploaded into <dir>/.staging/<name>.<unix nano> first, and committed as <dir>/<name>
+// after the whole file is written, so a file half written by a failed backup or a died daemon is never seen as a backup.
+// The staged files left are deleted by the sweeper when the daemon starts.
+const (
+	stagingDir = ".staging"
+	// the staged files in app layout older than it are swept, they may be being written by other servers
+	stagedExpire = 24 * time.Hour
+)
+
+// StagedName returns a new staged name for dest
+func StagedName(dest string) string {
+	return path.Join(path.Dir(dest), stagingDir, fmt.Sprintf("%s.%d", path.Base(dest), time.Now().UnixNano()))
+}
+
+// NamespaceStagedName returns a new staged name for dest in the staging directory of its namespace,
+// it's for the storages staging every write, so no staging directory is left inside the increment backups.
+func NamespaceStagedName(dest string) string {
+	parts := strings.Split(path.Clean(dest), "/")
+	n := 1
+	if parts[0] == appsDir {
+		n = 2
+	}
+	if len(parts) <= n {
+		return StagedName(dest)
+	}
+	return path.Join(path.Join(parts[:n]...), stagingDir, fmt.Sprintf("%s.%d", path.Base(dest), time.Now().UnixNano()))
+}
+
+// IsStaged tells whether the file is a staged name made by StagedName
+func IsStaged(name string) bool {
+	return path.Base(path.Dir(name)) == stagingDir
+}
+
+// CommitStaged makes the staged file seen as dest, the file is copied and removed if the storage is neither a Stager nor a Renamer
+func CommitStaged(store Storage, staged, dest string) error {
+	if stager, ok := store.(Stager); ok {
+		return stager.Commit(staged, dest)
+	}
+	if renamer, ok := store.(Renamer); ok {
+		return renamer.Rename(staged, dest)
+	}
+	if err := copyStored(store, staged, dest); err != nil {
+		return err
+	}
+	store.Delete(staged)
+	return nil
+}
+
+// AbortStaged removes the staged file
+func AbortStaged(store Storage, staged string) error {
+	if stager, ok := store.(Stager); ok {
+		return stager.Abort(staged)
+	}
+	return store.Delete(staged)
+}
+
+// abortStaged removes the staged file of the failed upload
+func abortStaged(store Storage, staged string) {
+	if err := AbortStaged(store, staged); err != nil && !os.IsNotExist(err) {
+		log.Warnf("Fail to remove the staged file %s, %s", staged, err.Error())
+	}
+}
+
+// stagedTime returns when the file is staged, it's the time in its name made by StagedName,
+// the modification time is less precise on some file systems. The modification time is used if not named so.
+func stagedTime(f os.FileInfo) time.Time {
+	if i := strings.LastIndex(f.Name(), "."); i >= 0 {
+		if nano, err := strconv.ParseInt(f.Name()[i+1:], 10, 64); err == nil {
+			return time.Unix(0, nano)
+		}
+	}
+	return f.ModTime()
+}
+
+// SweepStaged deletes the files staged in the namespace ns before t
+func SweepStaged(store Storage, ns string, before time.Time) (int, error) {
+	files, err := store.List(path.Join(ns, stagingDir))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	n := 0
+	for _, f := range files {
+		if !stagedTime(f).Before(before) {
+			continue
+		}
+		if err := AbortStaged(store, path.Join(ns, stagingDir, f.Name())); err != nil && !os.IsNotExist(err) {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
+
+// sweep deletes the staged files left by the failed backups, all the ones in the namespace of this server,
+// and the expired ones in the namespaces of app layout. The checkpoints not resumed for long are deleted with their parts.
+// It runs in background when the daemon starts, the files staged after started are being uploaded by this daemon,
+// the storage and the metas are given by Init.
+func sweep(store Storage, mt, index *Meta, started time.Time) {
+	ns := mt.namespace
+	n, err := SweepStaged(store, ns, started)
+	if err != nil {
+		log.Warnf("Fail to sweep the staged files in %s, %s", ns, err.Error())
+	}
+	m, err := sweepCheckpoints(store, ns, started.Add(-checkpointExpire), mt)
+	if err != nil {
+		log.Warnf("Fail to sweep the checkpoints in %s, %s", ns, err.Error())
+	}
+	n += m
+	if index != nil {
+		swept := make(map[string]bool)
+		for _, ent := range index.Array() {
+			if swept[ent.Namespace] || !strings.HasPrefix(ent.Namespace, appsDir+"/") {
+				continue
+			}
+			swept[ent.Namespace] = true
+			m, err := SweepStaged(store, ent.Namespace, started.Add(-stagedExpire))
+			if err != nil {
+				log.Warnf("Fail to sweep the staged files in %s, %s", ent.Namespace, err.Error())
+			}
+			n += m
+			if m, err = sweepCheckpoints(store, ent.Namespace, started.Add(-checkpointExpire), index); err != nil {
+				log.Warnf("Fail to sweep the checkpoints in %s, %s", ent.Namespace, err.Error())
+			}
+			n += m
+		}
+	}
+	if n > 0 {
+		log.Infof("%d staged files and checkpoints left by the failed backups deleted", n)
+	}
+}
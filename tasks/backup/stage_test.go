@@ -0,0 +1,134 @@
+package backup
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+// metaFailDriver fails the uploads and creates of meta when fail is set
+type metaFailDriver struct {
+	dirDriver
+	fail bool
+}
+
+func (d *metaFailDriver) Upload(reader io.Reader, dest string) error {
+	if d.fail && strings.Contains(dest, metaFile) {
+		return errors.New("storage is down")
+	}
+	return d.dirDriver.Upload(reader, dest)
+}
+
+func (d *metaFailDriver) Create(reader io.Reader, dest string) error {
+	if d.fail && strings.Contains(dest, metaFile) {
+		return errors.New("storage is down")
+	}
+	return d.dirDriver.Create(reader, dest)
+}
+
+func stagedFiles(driver Storage, ns string) int {
+	files, _ := driver.List(path.Join(ns, stagingDir))
+	return len(files)
+}
+
+func TestStagedArchive(t *testing.T) {
+	root, _ := ioutil.TempDir("", "backupd-stage")
+	defer os.RemoveAll(root)
+	driver := &metaFailDriver{dirDriver: dirDriver{root: path.Join(root, "store")}}
+	driverRunning = driver
+	meta = NewMeta(driver, "10.0.0.1")
+	namespace = "10.0.0.1"
+	defer func() { namespace = "" }()
+	src := path.Join(root, "data")
+	os.MkdirAll(src, 0755)
+	ioutil.WriteFile(path.Join(src, "db"), []byte("v1"), 0644)
+
+	// the archiving fails halfway
+	ent := NewEntity(src, "app-data", 1, nil, "/data", MODE_FULL)
+	err := ent.storeArchive(driver, nil, func(w io.Writer) error {
+		w.Write([]byte("part of the archive"))
+		return errors.New("disk error")
+	})
+	if err == nil {
+		t.Fatal("storing should fail")
+	}
+	if _, err := driver.FileInfo(path.Join(namespace, ent.Name)); !os.IsNotExist(err) {
+		t.Errorf("the partial archive should not be seen, %v", err)
+	}
+	if n := stagedFiles(driver, namespace); n != 0 {
+		t.Errorf("the staged archive should be aborted, %d left", n)
+	}
+
+	// the meta fails after the archive is committed
+	driver.fail = true
+	ent = NewEntity(src, "app-data", 1, nil, "/data", MODE_FULL)
+	if err := ent.Backup(driver); err == nil {
+		t.Fatal("backup should fail without meta")
+	}
+	if _, err := driver.FileInfo(path.Join(namespace, ent.Name)); !os.IsNotExist(err) {
+		t.Errorf("the archive not in meta should be deleted, %v", err)
+	}
+	dedup := NewEntity(src, "app-data", 1, nil, "/data", MODE_DEDUP)
+	if err := dedup.DedupBackup(driver); err == nil {
+		t.Fatal("dedup backup should fail without meta")
+	}
+	if _, err := driver.FileInfo(path.Join(namespace, dedup.Name)); !os.IsNotExist(err) {
+		t.Errorf("the snapshot not in meta should be deleted, %v", err)
+	}
+	if len(pins.refs) != 0 {
+		t.Errorf("the chunks of the failed snapshot should be unpinned, %v", pins.refs)
+	}
+
+	driver.fail = false
+	full, dedup := NewEntity(src, "app-data", 1, nil, "/data", MODE_FULL), NewEntity(src, "app-data", 1, nil, "/data", MODE_DEDUP)
+	for _, err := range []error{full.Backup(driver), dedup.DedupBackup(driver)} {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, name := range []string{full.Name, dedup.Name} {
+		if _, err := driver.FileInfo(path.Join(namespace, name)); err != nil || meta.Get(name) == nil {
+			t.Errorf("%s should be committed, %v", name, err)
+		}
+	}
+	if n := stagedFiles(driver, namespace); n != 0 {
+		t.Errorf("no staged file should be left, %d", n)
+	}
+}
+
+func TestSweepStaged(t *testing.T) {
+	root, _ := ioutil.TempDir("", "backupd-sweep")
+	defer os.RemoveAll(root)
+	driver := &dirDriver{root: root}
+
+	if n, err := SweepStaged(driver, "ns", time.Now()); err != nil || n != 0 {
+		t.Errorf("nothing should be swept, %d %v", n, err)
+	}
+	// the time in the name is used, or else the modification time
+	old, recent := StagedName("ns/a.tar.gz"), StagedName("ns/b.tar.gz")
+	if path.Dir(old) != "ns/"+stagingDir {
+		t.Errorf("unexpected staged name %s", old)
+	}
+	old = fmt.Sprintf("%s.%d", strings.TrimSuffix(old, path.Ext(old)), time.Now().Add(-2*stagedExpire).UnixNano())
+	unnamed := path.Join("ns", stagingDir, "c.tar.gz")
+	for _, name := range []string{old, recent, unnamed} {
+		driver.Upload(strings.NewReader(name), name)
+	}
+	os.Chtimes(path.Join(root, unnamed), time.Now().Add(-2*stagedExpire), time.Now().Add(-2*stagedExpire))
+
+	if n, err := SweepStaged(driver, "ns", time.Now().Add(-stagedExpire)); err != nil || n != 2 {
+		t.Errorf("the expired staged file should be swept, %d %v", n, err)
+	}
+	if _, err := driver.FileInfo(recent); err != nil {
+		t.Errorf("the staged file being written should be kept, %v", err)
+	}
+	if n, err := SweepStaged(driver, "ns", time.Now().Add(time.Second)); err != nil || n != 1 {
+		t.Errorf("all the staged files should be swept, %d %v", n, err)
+	}
+}
@@ -4,6 +4,9 @@ import (
 	"fmt"
 	log "github.com/Sirupsen/logrus"
 	"github.com/laincloud/backupd/crond"
+	"io/ioutil"
+	"os"
+	"path"
 	"time"
 )
 
@@ -15,7 +18,15 @@ import (
 //     "preRun": string	    script run in docker before backup
 //     "postRun": string	    script run in docker after backup
 //     "containers": []string  docker container ids
-//     "mode": increment or mode
+//     "mode": full, increment or dedup
+//     "compression": gzip, zstd, xz or none, only for full backup
+//     "compressionLevel": int  level of the compression, 0 means the default
+//     "key": string	    id of the key in keyfile to encrypt the backup, empty means not encrypted
+//     "partSize": int	    upload the archive in parts of MB and resume it if failed, only for full backup, 0 means the default of daemon
+//     "include": []string	    glob patterns of the files backed up, empty means all
+//     "exclude": []string	    glob patterns of the files not backed up
+//     "labels": []string	    labels of the backup like key=value, given when run once
+//     "note": string	    note of the backup, given when run once
 // }
 func backup(args crond.FuncArg) (crond.FuncResult, error) {
 	path := args.GetString("path", "")
@@ -26,6 +37,19 @@ func backup(args crond.FuncArg) (crond.FuncResult, error) {
 	containers := args.GetStringSlice("containers", []string{})
 	volume := args.GetString("volume", "")
 	mode := args.GetString("mode", MODE_FULL)
+	compression := args.GetString("compression", CodecGzip)
+	compressionLevel := args.GetInt("compressionLevel", LevelDefault)
+	keyID := args.GetString("key", "")
+	partSize := args.GetInt("partSize", 0)
+	note := args.GetString("note", "")
+	labels, err := ParseLabels(args.GetStringSlice("labels", []string{}))
+	if err != nil {
+		return nil, err
+	}
+	filter, err := NewFilter(args.GetStringSlice("include", []string{}), args.GetStringSlice("exclude", []string{}))
+	if err != nil {
+		return nil, err
+	}
 
 	// check path
 	if !fileExist(path) {
@@ -52,16 +76,41 @@ func backup(args crond.FuncArg) (crond.FuncResult, error) {
 
 	// run backup
 	entity := NewEntity(path, archive, instanceNo, containers, volume, mode)
-	var err error
+	if err := entity.SetCompression(compression, compressionLevel); err != nil {
+		return nil, err
+	}
+	entity.KeyID = keyID
+	if partSize <= 0 {
+		partSize = partSizeMB
+	}
+	entity.partSize = int64(partSize) << 20
+	if filter != nil {
+		entity.Include, entity.Exclude = filter.Include, filter.Exclude
+	}
+	if len(labels) > 0 {
+		entity.Labels = labels
+	}
+	entity.Note = note
+	stopWatching := watchReplicas(entity)
 	switch entity.Mode {
 	case MODE_INCREMENT:
 		err = entity.IncrementBackup()
+	case MODE_DEDUP:
+		err = entity.DedupBackup(driverRunning)
 	default:
 		err = entity.Backup(driverRunning)
 	}
+	replicas := stopWatching()
 	if err != nil {
 		return nil, err
 	}
+	if degraded := degradedReplicas(replicas); len(degraded) > 0 { // marked to be found and backed up again
+		log.Warnf("Backup %s is not stored on replicas %v", entity.Name, degraded)
+		entity.Degraded = degraded
+		if _, err := updateEntity(entity.Name, func(ent *Entity) error { ent.Degraded = degraded; return nil }); err != nil {
+			log.Warnf("Fail to mark backup %s degraded, %s", entity.Name, err.Error())
+		}
+	}
 
 	// run after
 	if postRun != "" {
@@ -71,68 +120,180 @@ func backup(args crond.FuncArg) (crond.FuncResult, error) {
 			}
 		}
 	}
-	return crond.FuncResult{
+	result := crond.FuncResult{
 		"file": entity.Name,
 		"size": entity.Size,
-	}, nil
+	}
+	if entity.Checksum != "" {
+		result["checksum"] = entity.Checksum
+	}
+	if len(entity.fileErrors) > 0 {
+		result["errors"] = entity.fileErrors
+	}
+	if replicas != nil {
+		result["replicas"] = replicas
+	}
+	if len(entity.Degraded) > 0 {
+		result["degraded"] = entity.Degraded
+	}
+	return result, nil
 }
 
+// the task function called by crond
+// {
+//     "info": []string	    pairs of directory path backuped and its retention policy, see ParseRetention,
+//			    the path of increment backup has a suffix @increment
+// }
 func expire(args crond.FuncArg) (crond.FuncResult, error) {
 	info := args.GetStringSlice("info", []string{})
 
 	log.Infof("Running a backup expire task")
-	expireMap := make(map[string]time.Duration)
-	for i := 0; i < len(info); i += 2 {
-		dur, err := durationParser(info[i+1])
+	policies := make(map[string]Retention)
+	for i := 0; i+1 < len(info); i += 2 {
+		policy, err := ParseRetention(info[i+1])
 		if err != nil {
-			log.Warnf("Fail to parse backup's exipre setting %s:%s, abandon",
+			log.Warnf("Fail to parse backup's retention policy %s:%s, abandon",
 				info[i+1], err.Error())
 			continue
 		}
-		expireMap[info[i]] = dur
+		policies[info[i]] = policy
+	}
+
+	groups := make(map[string][]Entity)
+	for _, item := range listBackups() {
+		key := item.Source
+		if item.Mode == MODE_INCREMENT {
+			if !item.isSnapshot() { // the increment backup before snapshots is never expired
+				continue
+			}
+			key = item.Source + "@increment"
+		}
+		groups[key] = append(groups[key], item)
 	}
 
 	now := time.Now()
 	counter := 0
-	for _, item := range meta.Array() {
-		if item.Mode != MODE_INCREMENT { // do not support expire for increment backup
-			expireTime, ok := expireMap[item.Source]
-			if ok && now.Sub(item.Created) > expireTime { // expired
+	var kept, pruned []RetentionDecision
+	for key, ents := range groups {
+		policy, ok := policies[key]
+		if !ok {
+			continue
+		}
+		k, p := policy.Apply(ents, now)
+		kept = append(kept, k...)
+		// the oldest first, the changed files of increment snapshot are merged less
+		for i := len(p) - 1; i >= 0; i-- {
+			log.Debugf("Backup %s pruned, %s", p[i].Name, p[i].Reason)
+			if err := Delete(p[i].Name); err != nil {
+				log.Warnf("Fail to delete backup file %s:%s", p[i].Name, err.Error())
+				p[i].Error = err.Error()
+			} else {
 				counter++
-				log.Debugf("Backup %s expired, delete it", item.Name)
-				if err := Delete(item.Name); err != nil {
-					log.Warnf("Fail to delete backup file %s:%s", item.Name, err.Error())
-				}
 			}
+			pruned = append(pruned, p[i])
 		}
 	}
 	log.Infof("Backup expire task finished, %d file deleted", counter)
-	return nil, nil
+	if len(kept)+len(pruned) == 0 {
+		return nil, nil
+	}
+	return crond.FuncResult{"kept": kept, "pruned": pruned}, nil
 }
 
+// the task function called by crond, it deletes the chunks not referred by any dedup backup,
+// in the namespace of this server and the namespaces of its dedup backups in app layout.
+// It's skipped if the last one is still running.
+func collect(args crond.FuncArg) (crond.FuncResult, error) {
+	namespaces := map[string]bool{namespace: true}
+	for _, ent := range listBackups() {
+		if ent.Mode == MODE_DEDUP && ent.Server == ip {
+			namespaces[ent.ns()] = true
+		}
+	}
+	log.Infof("Running a chunk collecting task")
+	deleted := make(map[string]int)
+	for ns := range namespaces {
+		n, err := collectChunks(ns)
+		if err == errCollecting {
+			log.Infof("Chunks are being collected by the last task, skipped")
+			return nil, nil
+		}
+		if err != nil {
+			log.Warnf("Fail to collect the unused chunks in %s, %s", ns, err.Error())
+			continue
+		}
+		if n > 0 {
+			log.Infof("%d unused chunks deleted in %s", n, ns)
+			deleted[ns] = n
+		}
+	}
+	if len(deleted) == 0 {
+		return nil, nil
+	}
+	return crond.FuncResult{"deleted": deleted}, nil
+}
+
+// the task function called by crond
+// {
+//     "namespace": string    the namespace of the backup, empty means this server
+//     "backup": string	    the backup name
+//     "files": []string	    the files to recover relative to the backuped directory, empty or "*" means all
+//     "destDir": string	    the directory to recover into, empty means the backuped directory
+//     "at": string	    for increment backup, recover the last snapshot taken at or before it, unix seconds or RFC3339
+// }
 func backup_recover(args crond.FuncArg) (crond.FuncResult, error) {
 	ns := args.GetString("namespace", "")
 	file := args.GetString("backup", "")
 	destDir := args.GetString("destDir", "")
+	at := args.GetString("at", "")
 	if file == "" {
 		return nil, fmt.Errorf("Empty recover file")
 	}
 
+	t := time.Now()
+	if at != "" {
+		var err error
+		if t, err = ParseTimestamp(at); err != nil {
+			return nil, fmt.Errorf("Unvalid time %s, %s", at, err.Error())
+		}
+	}
+
 	log.Infof("Recovering from %s/%s", ns, file)
-	var mt *Meta
+	mts := metas()
 	// namespace != ns means it's a migrate, move backup from other server
 	if ns != namespace && ns != "" {
 		mt := NewMeta(driverRunning, ns)
-		if err := mt.LoadFromBackend(); err != nil {
-			return nil, fmt.Errorf("Fail to read meta data from backend, %s", err.Error())
+		if err := mt.LoadFromBackend(); err != nil { // the backup may be in app layout
+			log.Warnf("Fail to read meta data of %s from backend, %s", ns, err.Error())
 		}
+		mts[0] = mt
 	} else {
-		ns, mt = namespace, meta
+		ns = namespace
+	}
+	// the backups in app layout are found in the index, wherever the instance runs now
+	var ent *Entity
+	for _, mt := range mts {
+		ent = mt.Get(file)
+		if at != "" || ent == nil { // the snapshot of increment backup named by archive
+			archive := file
+			if ent != nil {
+				archive = ent.mirrorName()
+			}
+			ent = mt.Snapshot(archive, t)
+		}
+		if ent != nil {
+			break
+		}
+	}
+	if ent == nil && at != "" {
+		return nil, fmt.Errorf("No snapshot of %s at %s", file, at)
 	}
-	ent := mt.Get(file)
 	if ent == nil {
 		return nil, fmt.Errorf("Unkown backup file %s in %s", file, ns)
 	}
+	if ent.inAppLayout() {
+		ns = ent.Namespace
+	}
 
 	if destDir != "" {
 		ent.Source = destDir
@@ -144,10 +305,138 @@ func backup_recover(args crond.FuncArg) (crond.FuncResult, error) {
 	}
 	defer bstats.Free(ent.Source)
 
+	files := args.GetStringSlice("files", []string{})
 	if ent.Mode == MODE_INCREMENT {
-		files := args.GetStringSlice("files", []string{})
+		if len(files) == 0 {
+			files = []string{"*"}
+		}
 		log.Debugf("Increment backup, recover files %v", files)
 		return nil, ent.IncrementRecover(files)
 	}
-	return nil, ent.Recover(driverRunning, ns, file)
+	var err error
+	if len(files) > 0 && !(len(files) == 1 && files[0] == "*") {
+		log.Debugf("Recover files %v from %s", files, file)
+		err = ent.RecoverFiles(driverRunning, ns, files)
+	} else {
+		err = ent.Recover(driverRunning, ns, file)
+	}
+	if len(ent.fileErrors) > 0 {
+		return crond.FuncResult{"errors": ent.fileErrors}, err
+	}
+	return nil, err
+}
+
+// the task function called by crond
+// {
+//     "path": string	    directory path backuped, the backups of it are verified
+//     "sample": int	    how many backups are verified each time, 0 means all
+//     "scratchDir": string    the directory to extract backups in, empty means the system's temp directory
+// }
+func verify(args crond.FuncArg) (crond.FuncResult, error) {
+	src := args.GetString("path", "")
+	sample := args.GetInt("sample", 0)
+	scratchDir := args.GetString("scratchDir", "")
+
+	ents := listBackups(src)
+	verifyOrder(ents)
+	if sample > 0 && sample < len(ents) {
+		ents = ents[:sample]
+	}
+	log.Infof("Running a backup verify task for %s, %d backups to verify", src, len(ents))
+
+	var (
+		results   = make([]VerifyResult, 0, len(ents))
+		verified  = make([]Entity, 0, len(ents))
+		corrupted = 0
+	)
+	for _, ent := range ents {
+		result := VerifyResult{Name: ent.Name, OK: true}
+		warnings, err := ent.Verify(driverRunning, scratchDir)
+		result.Warnings = warnings
+		now := time.Now()
+		ent.Verified, ent.Corrupted = &now, ""
+		if err != nil {
+			log.Errorf("Backup %s is corrupted, %s", ent.Name, err.Error())
+			result.OK, result.Error = false, err.Error()
+			ent.Corrupted = err.Error()
+			corrupted++
+		}
+		results = append(results, result)
+		verified = append(verified, ent)
+	}
+	for _, mt := range metas() {
+		err := mt.Commit(func(tx *MetaTx) error {
+			for _, ent := range verified {
+				if cur := tx.Get(ent.Name); cur != nil { // it may be deleted or changed when verifying
+					cur.Verified, cur.Corrupted = ent.Verified, ent.Corrupted
+					tx.Update(*cur)
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			log.Errorf("Fail to sync meta file to backends, %s", err.Error())
+		}
+	}
+
+	result := crond.FuncResult{"verified": results}
+	if corrupted > 0 {
+		return result, fmt.Errorf("%d of %d backups of %s are corrupted", corrupted, len(ents), src)
+	}
+	return result, nil
+}
+
+// the task function called by crond, restore the latest backup into a scratch directory and check it
+// {
+//     "path": string	    directory path backuped, its latest backup is restored
+//     "volume": string	    volume path in container, the restored data is mounted on it
+//     "containers": []string  docker container ids, the check runs in a throwaway container of the first one's image
+//     "check": string	    command to check the restored data, run by /bin/sh
+//     "timeout": string	    timeout of the check like 10m, default 30m
+//     "scratchDir": string    the directory to restore in, empty means the system's temp directory
+// }
+func drill(args crond.FuncArg) (crond.FuncResult, error) {
+	src := args.GetString("path", "")
+	volume := args.GetString("volume", "")
+	containers := args.GetStringSlice("containers", []string{})
+	check := args.GetString("check", "")
+	scratchDir := args.GetString("scratchDir", "")
+	timeout, err := DurationParser(args.GetString("timeout", "30m"))
+	if err != nil {
+		return nil, err
+	}
+	if check == "" || len(containers) == 0 {
+		return nil, fmt.Errorf("Restore drill needs a check command and a container")
+	}
+
+	ent, err := latestBackup(src)
+	if err != nil {
+		return nil, err
+	}
+	log.Infof("Running a restore drill for %s with backup %s", src, ent.Name)
+	scratch, err := ioutil.TempDir(scratchDir, "backupd-drill-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(scratch)
+
+	start := time.Now()
+	result := crond.FuncResult{"backup": ent.Name, "passed": false}
+	errs, err := ent.restoreTo(driverRunning, scratch)
+	if len(errs) > 0 {
+		result["errors"] = errs
+	}
+	if err != nil {
+		result["output"] = err.Error()
+		return result, fmt.Errorf("Fail to restore %s, %s", ent.Name, err.Error())
+	}
+	output, err := drillRunner(containers[0], volume, path.Join(scratch, path.Base(ent.Source)), check, timeout)
+	result["output"] = tailOutput(output)
+	result["duration"] = time.Since(start).String()
+	if err != nil {
+		log.Warnf("Restore drill for %s failed, %s", src, err.Error())
+		return result, fmt.Errorf("Check of restore drill failed, %s", err.Error())
+	}
+	result["passed"] = true
+	return result, nil
 }
@@ -0,0 +1,207 @@
+package backup
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/laincloud/backupd/crond"
+	"io"
+	"path"
+	"strings"
+	"time"
+)
+
+// Download is a backup file to be downloaded
+type Download struct {
+	Name     string // the file name to save as
+	Checksum string // sha256 of the content, empty if unknown
+	write    func(io.Writer) error
+}
+
+// Copy writes the content into w, an error is returned at the end if it does not match the checksum
+func (d *Download) Copy(w io.Writer) error {
+	return d.write(w)
+}
+
+// OpenDownload opens the full or dedup backup named file, or a file in increment backup named <backup>/<path>.
+// The archive of full backup is decrypted, and the dedup backup is assembled into a tar stream.
+func OpenDownload(file string) (*Download, error) {
+	parts := strings.SplitN(strings.Trim(path.Clean("/"+file), "/"), "/", 2)
+	ent, err := Info(parts[0])
+	if err != nil {
+		return nil, err
+	}
+	store, err := ent.storage(driverRunning)
+	if err != nil {
+		return nil, err
+	}
+	if ent.Mode != MODE_INCREMENT {
+		if len(parts) > 1 {
+			return nil, fmt.Errorf("%s is not an increment backup, download the whole backup or restore the files", ent.Name)
+		}
+		if ent.Mode == MODE_DEDUP {
+			return &Download{
+				Name:  strings.TrimSuffix(ent.Name, snapshotExt) + ".tar",
+				write: func(w io.Writer) error { return ent.tarStream(store, ent.ns(), w) },
+			}, nil
+		}
+		return &Download{
+			Name:     ent.Name,
+			Checksum: ent.Checksum,
+			write: func(w io.Writer) error {
+				return downloadChecked(store, path.Join(ent.ns(), ent.Name), ent.Checksum, w)
+			},
+		}, nil
+	}
+
+	if len(parts) < 2 {
+		return nil, fmt.Errorf("%s is an increment backup, download the files in it", ent.Name)
+	}
+	index, locations, err := ent.incrementFiles(store, []string{parts[1]})
+	if err != nil {
+		return nil, err
+	}
+	rel := strings.Trim(path.Clean("/"+parts[1]), "/")
+	src, ok := locations[rel]
+	if !ok {
+		return nil, fmt.Errorf("%s is not a regular file", file)
+	}
+	checksum := index[rel].Hash
+	return &Download{
+		Name:     path.Base(rel),
+		Checksum: checksum,
+		write: func(w io.Writer) error {
+			return downloadChecked(store, src, checksum, w)
+		},
+	}, nil
+}
+
+func downloadChecked(store Storage, file, checksum string, w io.Writer) error {
+	h := sha256.New()
+	if err := store.Download(io.MultiWriter(w, h), file); err != nil {
+		return err
+	}
+	if checksum != "" && hashString(h) != checksum {
+		return fmt.Errorf("Checksum of %s mismatch, the backup is corrupted", file)
+	}
+	return nil
+}
+
+// Import stores the tar archive r made elsewhere as a full backup of the directory src, so it can be recovered like the others.
+// The codec of r is detected by filename, the archive name, compression and key are taken from the backup job of src.
+// The files in r are relative to src, they are repacked into <base of src>/... like the archives made by backup.
+func Import(r io.Reader, src, filename string) (*Entity, error) {
+	job, err := crond.Find("backup", crond.FuncArg{"path": src})
+	if err != nil {
+		return nil, fmt.Errorf("No backup job for %s", src)
+	}
+	codec, err := GetCodec(CodecByFile(filename))
+	if err != nil {
+		return nil, err
+	}
+	reader, err := codec.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	args := job.Args
+	ent := NewEntity(src, args.GetString("archive", ""), args.GetInt("instanceNo", 0),
+		args.GetStringSlice("containers", []string{}), args.GetString("volume", ""), MODE_FULL)
+	if err := ent.SetCompression(args.GetString("compression", CodecGzip), args.GetInt("compressionLevel", LevelDefault)); err != nil {
+		return nil, err
+	}
+	ent.KeyID = args.GetString("key", "")
+
+	log.Infof("Importing %s as backup %s", filename, ent.Name)
+	manifest := make(map[string]IndexEntry)
+	err = ent.storeArchive(driverRunning, manifest, func(w io.Writer) error {
+		return repackArchive(tar.NewReader(reader), w, path.Base(ent.Source), func(hdr *tar.Header) { addManifest(manifest, hdr) })
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ent, nil
+}
+
+// repackArchive writes the files in tr into w named base/..., the parent directories not in tr are added.
+// The archive is refused if any link points outside of it or any file is under a symlink.
+func repackArchive(tr *tar.Reader, w io.Writer, base string, onFile func(*tar.Header)) error {
+	tw := tar.NewWriter(w)
+	dirs := make(map[string]bool)     // the directories written
+	symlinks := make(map[string]bool) // the symlinks written
+	var addDir func(dir string) error
+	addDir = func(dir string) error {
+		if dirs[dir] {
+			return nil
+		}
+		if dir != "." {
+			if err := addDir(path.Dir(dir)); err != nil {
+				return err
+			}
+		}
+		dirs[dir] = true
+		hdr := &tar.Header{Name: path.Join(base, dir) + "/", Typeflag: tar.TypeDir, Mode: 0755, ModTime: time.Now(), Format: tar.FormatPAX}
+		return writeHeader(tw, hdr, onFile)
+	}
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		name := path.Clean(hdr.Name)
+		if path.IsAbs(name) || name == ".." || strings.HasPrefix(name, "../") {
+			return fmt.Errorf("Unvalid path %s in archive", hdr.Name)
+		}
+		if hdr.Typeflag == tar.TypeDir && dirs[name] || name == "." && hdr.Typeflag != tar.TypeDir {
+			continue
+		}
+		for dir := path.Dir(name); dir != "."; dir = path.Dir(dir) {
+			if symlinks[dir] {
+				return fmt.Errorf("Unvalid path %s in archive, %s is a symlink", hdr.Name, dir)
+			}
+		}
+		if name != "." {
+			if err := addDir(path.Dir(name)); err != nil {
+				return err
+			}
+		}
+
+		hdr.Name = path.Join(base, name)
+		if hdr.Typeflag == tar.TypeDir {
+			hdr.Name += "/"
+			dirs[name] = true
+		}
+		if hdr.Typeflag == tar.TypeLink {
+			link := path.Clean(hdr.Linkname)
+			if path.IsAbs(link) || link == ".." || strings.HasPrefix(link, "../") {
+				return fmt.Errorf("Unvalid hard link %s in archive", hdr.Linkname)
+			}
+			hdr.Linkname = path.Join(base, link)
+		}
+		if hdr.Typeflag == tar.TypeSymlink {
+			link := path.Join(path.Dir(name), hdr.Linkname)
+			if path.IsAbs(hdr.Linkname) || link == ".." || strings.HasPrefix(link, "../") {
+				return fmt.Errorf("Unvalid symlink %s -> %s in archive", name, hdr.Linkname)
+			}
+			symlinks[name] = true
+		} else {
+			delete(symlinks, name)
+		}
+		hdr.PAXRecords, hdr.Format = nil, tar.FormatPAX
+		if err := writeHeader(tw, hdr, onFile); err != nil {
+			return err
+		}
+		if _, err := io.Copy(tw, tr); err != nil {
+			return err
+		}
+	}
+	if len(dirs) == 0 {
+		return fmt.Errorf("No file in archive")
+	}
+	return tw.Close()
+}
@@ -0,0 +1,151 @@
+package backup
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"github.com/laincloud/backupd/crond"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func testTarball(t *testing.T, files map[string]string) *bytes.Buffer {
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gw)
+	tw.WriteHeader(&tar.Header{Name: "./", Typeflag: tar.TypeDir, Mode: 0700, ModTime: time.Now()})
+	for name, content := range files {
+		hdr := &tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(content)), ModTime: time.Now()}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		tw.Write([]byte(content))
+	}
+	tw.Close()
+	gw.Close()
+	return &buf
+}
+
+func TestImport(t *testing.T) {
+	root, _ := ioutil.TempDir("", "backupd-import")
+	defer os.RemoveAll(root)
+	driver := &dirDriver{root: path.Join(root, "store")}
+	driverRunning = driver
+	meta = NewMeta(driver, namespace)
+	src := path.Join(root, "data")
+	os.MkdirAll(src, 0755)
+
+	archive := testTarball(t, map[string]string{"./db": "imported", "conf/app.yml": "conf"})
+	if _, err := Import(archive, src, "dump.tar.gz"); err == nil {
+		t.Error("import should fail without backup job")
+	}
+
+	crond.Register("backup", backup)
+	crond.Update([]crond.Job{{Spec: "0 0 1 1 *", Action: "backup", Args: crond.FuncArg{
+		"path": src, "archive": "app-data", "volume": "/data", "compression": CodecZstd,
+	}}}, "")
+	defer crond.Update(nil, "")
+
+	bad := testTarball(t, map[string]string{"../escape": "bad"})
+	if _, err := Import(bad, src, "bad.tar.gz"); err == nil || len(meta.Array(src)) != 0 {
+		t.Errorf("unsafe path should fail the import, %v", err)
+	}
+
+	archive = testTarball(t, map[string]string{"./db": "imported", "conf/app.yml": "conf"})
+	ent, err := Import(archive, src, "dump.tar.gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if path.Ext(ent.Name) != ".zst" || ent.Volume != "/data" || meta.Get(ent.Name) == nil {
+		t.Errorf("imported backup should be added like the backup job's, %+v", ent)
+	}
+	if list, err := ArchiveFileList(ent.Name, ""); err != nil || len(list) != 2 {
+		t.Errorf("imported backup should have a manifest, %+v %v", list, err)
+	}
+	if err := ent.Recover(driver, namespace, ent.Name); err != nil {
+		t.Fatal(err)
+	}
+	for file, content := range map[string]string{"db": "imported", "conf/app.yml": "conf"} {
+		if data, _ := ioutil.ReadFile(path.Join(src, file)); string(data) != content {
+			t.Errorf("%s should be recovered from the import, got %q", file, data)
+		}
+	}
+
+	// the stored archive is downloaded as it is
+	d, err := OpenDownload(ent.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := d.Copy(&buf); err != nil {
+		t.Fatal(err)
+	}
+	h := sha256.New()
+	h.Write(buf.Bytes())
+	if hashString(h) != d.Checksum || d.Name != ent.Name {
+		t.Errorf("downloaded archive should match the checksum, %+v", d)
+	}
+	corrupt(t, path.Join(driver.root, namespace, ent.Name))
+	if err := d.Copy(ioutil.Discard); err == nil {
+		t.Error("corrupted archive should fail the download")
+	}
+}
+
+func TestDownloadIncrement(t *testing.T) {
+	root, _ := ioutil.TempDir("", "backupd-download")
+	defer os.RemoveAll(root)
+	driver := &dirDriver{root: path.Join(root, "store")}
+	driverRunning = driver
+	meta = NewMeta(driver, namespace)
+	src := path.Join(root, "data")
+	os.MkdirAll(path.Join(src, "conf"), 0755)
+	ioutil.WriteFile(path.Join(src, "conf", "app.yml"), []byte("conf"), 0644)
+
+	inc := NewEntity(src, "app-data", 0, nil, "/data", MODE_INCREMENT)
+	if err := inc.IncrementBackup(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := OpenDownload(inc.Name); err == nil {
+		t.Error("increment backup should be downloaded by files")
+	}
+	if _, err := OpenDownload(inc.Name + "/conf"); err == nil {
+		t.Error("directory can not be downloaded")
+	}
+	d, err := OpenDownload(inc.Name + "/conf/app.yml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := d.Copy(&buf); err != nil || buf.String() != "conf" || d.Name != "app.yml" || d.Checksum == "" {
+		t.Errorf("unexpected download %+v %q %v", d, buf.String(), err)
+	}
+}
+
+func TestRepackLinks(t *testing.T) {
+	for _, c := range []struct {
+		hdrs []tar.Header
+		ok   bool
+	}{
+		{[]tar.Header{{Name: "conf", Typeflag: tar.TypeSymlink, Linkname: "etc/conf"}}, true},
+		{[]tar.Header{{Name: "a/b", Typeflag: tar.TypeSymlink, Linkname: "../c"}}, true},
+		{[]tar.Header{{Name: "x", Typeflag: tar.TypeSymlink, Linkname: "/etc"}}, false},
+		{[]tar.Header{{Name: "a/x", Typeflag: tar.TypeSymlink, Linkname: "../../etc"}}, false},
+		{[]tar.Header{{Name: "x", Typeflag: tar.TypeSymlink, Linkname: "a"}, {Name: "x/passwd", Typeflag: tar.TypeReg}}, false},
+		{[]tar.Header{{Name: "x", Typeflag: tar.TypeLink, Linkname: "../passwd"}}, false},
+	} {
+		var buf bytes.Buffer
+		tw := tar.NewWriter(&buf)
+		for i := range c.hdrs {
+			tw.WriteHeader(&c.hdrs[i])
+		}
+		tw.Close()
+		err := repackArchive(tar.NewReader(&buf), ioutil.Discard, "data", nil)
+		if (err == nil) != c.ok {
+			t.Errorf("%+v: expect ok %v, got %v", c.hdrs, c.ok, err)
+		}
+	}
+}
@@ -1,13 +1,16 @@
 package backup
 
 import (
+	"archive/tar"
 	"fmt"
 	log "github.com/Sirupsen/logrus"
 	"os"
 	"os/exec"
 	"path"
+	"path/filepath"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
 )
 
@@ -15,7 +18,8 @@ const (
 	APP_ROOT = "/lain/app"
 )
 
-func durationParser(s string) (time.Duration, error) {
+// DurationParser parses the durations like 3m, 23h and 2d
+func DurationParser(s string) (time.Duration, error) {
 	if len(s) == 0 {
 		return time.Hour * 1000000, fmt.Errorf("empty string")
 	}
@@ -35,7 +39,6 @@ func durationParser(s string) (time.Duration, error) {
 		dur = time.Hour * 24
 	default:
 		return 0, fmt.Errorf("Unknown time unit %c", unit)
-		dur = time.Hour * 24
 	}
 	return time.Duration(num) * dur, nil
 }
@@ -89,15 +92,159 @@ func containerNotRunning(id string) bool {
 	return true
 }
 
-func cloneDir(src, dest string) error {
-	sh := fmt.Sprintf("rsync -rIptgo --delete-before %s %s", src+"/", dest+"/")
-	cmd := exec.Command("/bin/bash", "-c", sh)
-	output, err := cmd.CombinedOutput()
+// cloneDir makes dest the same with src like `rsync -a --delete-before`, the files not in src are deleted first.
+// Files are copied with their mode, ownership(only as root) and mtime, symlinks, hardlinks and devices are kept.
+func cloneDir(src, dest string) ([]FileError, error) {
+	src, dest = path.Clean(src), path.Clean(dest)
+	if err := os.MkdirAll(dest, 0755); err != nil {
+		return nil, err
+	}
+
+	// delete the files not in src, or in different type
+	err := filepath.Walk(dest, func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(dest, file)
+		if old, err := os.Lstat(path.Join(src, rel)); err != nil || old.Mode().Type() != info.Mode().Type() {
+			if err := os.RemoveAll(file); err != nil {
+				return err
+			}
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return copyTree(src, dest)
+}
+
+// copyTree copies the files in src into dest like `rsync -a`, the files only in dest are kept.
+// A file in dest is replaced if it's in different type with the one in src.
+func copyTree(src, dest string) ([]FileError, error) {
+	src, dest = path.Clean(src), path.Clean(dest)
+	if err := os.MkdirAll(dest, 0755); err != nil {
+		return nil, err
+	}
+	var (
+		errs  []FileError
+		dirs  []*tar.Header
+		links = make(map[inode]string) // the first copied path of the hardlinked files
+	)
+	err := filepath.Walk(src, func(file string, info os.FileInfo, err error) error {
+		rel, _ := filepath.Rel(src, file)
+		if err != nil {
+			errs = fileError(errs, rel, err)
+			if info != nil && info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if info.Mode()&os.ModeSocket != 0 {
+			return nil
+		}
+		var link string
+		if info.Mode()&os.ModeSymlink != 0 {
+			if link, err = os.Readlink(file); err != nil {
+				errs = fileError(errs, rel, err)
+				return nil
+			}
+		}
+		hdr, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			errs = fileError(errs, rel, err)
+			return nil
+		}
+		hdr.Name = rel
+		target := path.Join(dest, rel)
+		if old, err := os.Lstat(target); err == nil && rel != "." && old.Mode().Type() != info.Mode().Type() {
+			if err := os.RemoveAll(target); err != nil {
+				errs = fileError(errs, rel, err)
+				return nil
+			}
+		}
+
+		switch {
+		case info.IsDir():
+			if err := os.MkdirAll(target, 0700); err != nil {
+				return err
+			}
+			dirs = append(dirs, hdr)
+			return nil
+		case info.Mode().IsRegular():
+			if stat, ok := info.Sys().(*syscall.Stat_t); ok && stat.Nlink > 1 {
+				key := inode{uint64(stat.Dev), uint64(stat.Ino)}
+				if first, ok := links[key]; ok {
+					os.Remove(target)
+					if err := os.Link(first, target); err != nil {
+						errs = fileError(errs, rel, err)
+					}
+					return nil
+				}
+				links[key] = target
+			}
+			in, err := os.Open(file)
+			if err != nil {
+				errs = fileError(errs, rel, err)
+				return nil
+			}
+			err = extractFile(in, target, hdr)
+			in.Close()
+		case info.Mode()&os.ModeSymlink != 0:
+			os.Remove(target)
+			err = os.Symlink(link, target)
+		default: // devices and pipes
+			os.Remove(target)
+			err = syscall.Mknod(target, devMode(hdr), int(mkdev(hdr.Devmajor, hdr.Devminor)))
+		}
+		if err == nil {
+			err = restoreAttrs(target, hdr)
+		}
+		if err != nil {
+			errs = fileError(errs, rel, err)
+		}
+		return nil
+	})
 	if err != nil {
-		log.Errorf("Fail to rsync files back to source: %s. \nOutput:\n%s", cmd.Args, output)
+		return errs, err
+	}
+
+	for i := len(dirs) - 1; i >= 0; i-- { // children first
+		if err := restoreAttrs(path.Join(dest, dirs[i].Name), dirs[i]); err != nil {
+			errs = fileError(errs, dirs[i].Name, err)
+		}
+	}
+	return errs, nil
+}
+
+// moveFile renames src to dest, it's copied if they are on different filesystems
+func moveFile(src, dest string) error {
+	if err := os.Rename(src, dest); err == nil {
+		return nil
+	}
+	info, err := os.Lstat(src)
+	if err != nil {
+		return err
+	}
+	hdr, err := tar.FileInfoHeader(info, "")
+	if err != nil {
+		return err
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	if err := extractFile(in, dest, hdr); err != nil {
+		return err
+	}
+	if err := restoreAttrs(dest, hdr); err != nil {
 		return err
 	}
-	return nil
+	return os.Remove(src)
 }
 
 func findAllFiles(root, file string, store Storage) ([]string, error) {
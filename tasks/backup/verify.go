@@ -0,0 +1,75 @@
+package backup
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+)
+
+// VerifyResult is the result of verifying a backup
+type VerifyResult struct {
+	Name     string      `json:"name"`
+	OK       bool        `json:"ok"`
+	Error    string      `json:"error,omitempty"`
+	Warnings []FileError `json:"warnings,omitempty"` // the files can not be extracted into the scratch directory, like devices if not root
+}
+
+// Verify downloads the backup and checks its checksums, full and dedup backups are extracted into a scratch directory in dir.
+// The backup is corrupted if error returned.
+func (ent *Entity) Verify(driver Storage, dir string) ([]FileError, error) {
+	store, err := ent.storage(driver)
+	if err != nil {
+		return nil, err
+	}
+	if ent.Mode == MODE_INCREMENT {
+		return nil, ent.verifyIncrement(store)
+	}
+
+	scratch, err := ioutil.TempDir(dir, "backupd-verify-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(scratch)
+	return ent.restoreTo(driver, scratch)
+}
+
+// every file having a checksum in the index is downloaded and checked
+func (ent *Entity) verifyIncrement(store Storage) error {
+	index, locations, err := ent.incrementFiles(store, []string{"*"})
+	if err != nil {
+		return err
+	}
+	for rel, entry := range index {
+		if entry.Hash == "" {
+			continue
+		}
+		file, ok := locations[rel]
+		if !ok {
+			return fmt.Errorf("File %s is missing", rel)
+		}
+		h := sha256.New()
+		if err := store.Download(h, file); err != nil {
+			return err
+		}
+		if hashString(h) != entry.Hash {
+			return fmt.Errorf("Checksum of %s mismatch", rel)
+		}
+	}
+	return nil
+}
+
+// the backups never verified are verified first, the newer the earlier, then the ones verified longest ago
+func verifyOrder(ents []Entity) {
+	sort.SliceStable(ents, func(i, j int) bool {
+		a, b := ents[i].Verified, ents[j].Verified
+		switch {
+		case a == nil && b == nil:
+			return ents[i].Created.After(ents[j].Created)
+		case a == nil || b == nil:
+			return a == nil
+		}
+		return a.Before(*b)
+	})
+}
@@ -0,0 +1,85 @@
+package backup
+
+import (
+	"github.com/laincloud/backupd/crond"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestVerifyOrder(t *testing.T) {
+	now := time.Now()
+	old, older := now.Add(-time.Hour), now.Add(-2*time.Hour)
+	ents := []Entity{
+		{Name: "verified", Verified: &old},
+		{Name: "old", Created: older},
+		{Name: "longest", Verified: &older},
+		{Name: "new", Created: now},
+	}
+	verifyOrder(ents)
+	for i, name := range []string{"new", "old", "longest", "verified"} {
+		if ents[i].Name != name {
+			t.Errorf("%s should be the %dth, got %s", name, i, ents[i].Name)
+		}
+	}
+}
+
+func TestVerify(t *testing.T) {
+	root, _ := ioutil.TempDir("", "backupd-verify")
+	defer os.RemoveAll(root)
+	driver := &dirDriver{root: path.Join(root, "store")}
+	driverRunning = driver
+	meta = NewMeta(driver, namespace)
+	src := path.Join(root, "data")
+	os.MkdirAll(src, 0755)
+	ioutil.WriteFile(path.Join(src, "file"), []byte("content"), 0644)
+
+	full := NewEntity(src, "app-data-full", 0, nil, "/data", MODE_FULL)
+	dedup := NewEntity(src, "app-data-dedup", 0, nil, "/data", MODE_DEDUP)
+	inc := NewEntity(src, "app-data-inc", 0, nil, "/data", MODE_INCREMENT)
+	if err := full.Backup(driver); err != nil {
+		t.Fatal(err)
+	}
+	if err := dedup.DedupBackup(driver); err != nil {
+		t.Fatal(err)
+	}
+	if err := inc.IncrementBackup(); err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := verify(crond.FuncArg{"path": src})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if results := result["verified"].([]VerifyResult); len(results) != 3 {
+		t.Errorf("all the backups should be verified, %+v", results)
+	}
+	for _, ent := range meta.Array(src) {
+		if ent.Verified == nil || ent.Corrupted != "" {
+			t.Errorf("%s should be verified, %+v", ent.Name, ent)
+		}
+	}
+
+	// all the backups are verified in turn by sample
+	corrupt(t, path.Join(driver.root, namespace, inc.mirrorName(), "file"))
+	verified := make(map[string]bool)
+	for i := 0; i < 3; i++ {
+		result, _ := verify(crond.FuncArg{"path": src, "sample": 1})
+		results := result["verified"].([]VerifyResult)
+		if len(results) != 1 {
+			t.Fatalf("only 1 backup should be verified, %+v", results)
+		}
+		verified[results[0].Name] = true
+	}
+	if len(verified) != 3 {
+		t.Errorf("all the backups should be verified in turn, %v", verified)
+	}
+	if ent := meta.Get(inc.Name); ent.Corrupted == "" {
+		t.Error("corrupted backup should be marked in meta")
+	}
+	if _, err := verify(crond.FuncArg{"path": src}); err == nil {
+		t.Error("corrupted backup should fail the verify task")
+	}
+}